@@ -0,0 +1,202 @@
+package dendrite
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"sort"
+	"time"
+)
+
+const (
+	// broadcastTimeout limits how long Broadcast() waits for acknowledgements
+	broadcastTimeout = 4 * time.Second
+	// broadcastHopMargin is taken off the timeout at each hop, so that vnode answers before its sender gives up
+	broadcastHopMargin = 250 * time.Millisecond
+)
+
+/*
+	Broadcast delivers a message of given type to every vnode in the ring, exactly once.
+
+	Message is handled on receiving vnodes just like any other request: it is decoded by the transport
+	(through claimed message types or TransportHooks) and passed to its handler, once per vnode. Handler's
+	response is ignored, except that PbErr response is not counted as acknowledgement.
+
+	Identifier space is partitioned with finger tables: vnode delivering the broadcast for range (self, limit)
+	splits it between its fingers, each of them being responsible for the part up to the next finger.
+	Every vnode receives the message in O(log N) rounds. Return value is aggregated number of vnodes that
+	acknowledged the message. Parts of the ring behind failed vnodes are not reached, so acknowledgement
+	count may be lower than the number of vnodes in the ring.
+
+	Vnodes wait for acknowledgements from their part of the ring for limited time, which gets shorter with
+	each hop. Vnodes deep enough in the tree ack their own delivery straight away and forward the message
+	without waiting, so no vnode blocks for the whole subtree. Acknowledgements that arrive late are not
+	counted, although those vnodes do receive the message.
+*/
+func (r *Ring) Broadcast(msgType MsgType, payload []byte) (int, error) {
+	// make sure this is something we know how to deliver
+	if _, err := r.transport.Decode(r.transport.Encode(msgType, payload)); err != nil {
+		return 0, fmt.Errorf("Broadcast - can not deliver message - %s", err)
+	}
+	if len(r.vnodes) > 0 {
+		root := r.vnodes[0]
+		return root.Broadcast(root.Id, msgType, payload, broadcastTimeout), nil
+	}
+	// client mode, let known vnode broadcast to the whole ring
+	if r.client == nil {
+		return 0, fmt.Errorf("Broadcast - no vnodes to broadcast from")
+	}
+	var last_err error
+	for _, root := range r.client.sample(clientLookupAttempts) {
+		acks, err := r.forwardBroadcast(root, root.Id, msgType, payload, broadcastTimeout)
+		if err != nil {
+			last_err = err
+			continue
+		}
+		return acks, nil
+	}
+	if last_err == nil {
+		last_err = fmt.Errorf("routing view is empty")
+	}
+	return 0, fmt.Errorf("Broadcast - %s", last_err)
+}
+
+/*
+	Broadcast implements VnodeHandler's Broadcast(). Vnode delivers the message to itself and
+	forwards it to vnodes within (vn, limit). Limit equal to vnode's Id means the whole ring.
+	Acknowledgements from targets are counted until timeout expires, the rest are left to arrive
+	in background.
+*/
+func (vn *localVnode) Broadcast(limit []byte, msgType MsgType, payload []byte, timeout time.Duration) int {
+	targets := vn.broadcastTargets(limit)
+	target_timeout := timeout - broadcastHopMargin
+	if target_timeout < 0 {
+		target_timeout = 0
+	}
+	acks_c := make(chan int, len(targets))
+	for idx, target := range targets {
+		// each target is responsible for the range up to the next one
+		target_limit := limit
+		if idx+1 < len(targets) {
+			target_limit = targets[idx+1].Id
+		}
+		go func(target *Vnode, target_limit []byte) {
+			acks, err := vn.ring.forwardBroadcast(target, target_limit, msgType, payload, target_timeout)
+			if err != nil {
+				vn.ring.Logf(LogInfo, "Broadcast() - failed to forward to %X - %s\n", target.Id, err)
+			}
+			acks_c <- acks
+		}(target, target_limit)
+	}
+
+	acks := 0
+	if vn.ring.deliverBroadcast(msgType, payload) {
+		acks++
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for pending := len(targets); pending > 0; pending-- {
+		select {
+		case target_acks := <-acks_c:
+			acks += target_acks
+		case <-timer.C:
+			return acks
+		}
+	}
+	return acks
+}
+
+// broadcastTimeoutOf returns the time receiving vnode may wait for acknowledgements. Senders that
+// don't set it get the full broadcastTimeout.
+func broadcastTimeoutOf(pbMsg *PBProtoBroadcast) time.Duration {
+	if pbMsg.Timeout == nil {
+		return broadcastTimeout
+	}
+	return time.Duration(pbMsg.GetTimeout())
+}
+
+// broadcastTargets returns known fingers and successors in range (vn, limit), ordered by distance from vn.
+func (vn *localVnode) broadcastTargets(limit []byte) []*Vnode {
+	seen := make(map[string]bool)
+	targets := make([]*Vnode, 0)
+	candidates := make([]*Vnode, 0, len(vn.successors)+vn.last_finger+1)
+	candidates = append(candidates, vn.successors...)
+	candidates = append(candidates, vn.finger[:vn.last_finger+1]...)
+	for _, c := range candidates {
+		if c == nil || seen[c.String()] || !inBroadcastRange(vn.Id, limit, c.Id) {
+			continue
+		}
+		seen[c.String()] = true
+		targets = append(targets, c)
+	}
+	sort.Sort(&byDistance{from: vn.Id, vnodes: targets})
+	return targets
+}
+
+// inBroadcastRange checks if key is in (id, limit). When limit equals id, range is the whole ring (except id).
+func inBroadcastRange(id, limit, key []byte) bool {
+	if bytes.Compare(id, limit) == 0 {
+		return bytes.Compare(id, key) != 0
+	}
+	return between(id, limit, key, false)
+}
+
+// byDistance sorts vnodes by their distance from given id.
+type byDistance struct {
+	from   []byte
+	vnodes []*Vnode
+}
+
+func (d *byDistance) Len() int      { return len(d.vnodes) }
+func (d *byDistance) Swap(i, j int) { d.vnodes[i], d.vnodes[j] = d.vnodes[j], d.vnodes[i] }
+func (d *byDistance) Less(i, j int) bool {
+	return distance(d.from, d.vnodes[i].Id).Cmp(distance(d.from, d.vnodes[j].Id)) == -1
+}
+
+// forwardBroadcast hands the broadcast for range (target, limit) over to target vnode, which may wait
+// for acknowledgements up to timeout. Local vnodes are called directly.
+func (r *Ring) forwardBroadcast(target *Vnode, limit []byte, msgType MsgType, payload []byte, timeout time.Duration) (int, error) {
+	if handler, ok := r.transport.GetVnodeHandler(target); ok {
+		return handler.Broadcast(limit, msgType, payload, timeout), nil
+	}
+	req := &PBProtoBroadcast{
+		Dest:    target.ToProtobuf(),
+		Limit:   limit,
+		MsgType: proto.Int32(int32(msgType)),
+		Payload: payload,
+		Timeout: proto.Int64(int64(timeout)),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := r.transport.Request(target.Host, PbBroadcast, reqData)
+	if err != nil {
+		return 0, err
+	}
+	switch decoded.Type {
+	case PbErr:
+		pbMsg := decoded.TransportMsg.(PBProtoErr)
+		return 0, fmt.Errorf("got error response - %s", pbMsg.GetError())
+	case PbBroadcastResp:
+		pbMsg := decoded.TransportMsg.(PBProtoBroadcastResp)
+		return int(pbMsg.GetAcks()), nil
+	default:
+		return 0, fmt.Errorf("unexpected response")
+	}
+}
+
+// deliverBroadcast decodes the message and runs its handler. It returns true if handler did not respond with error.
+func (r *Ring) deliverBroadcast(msgType MsgType, payload []byte) bool {
+	cm, err := r.transport.Decode(r.transport.Encode(msgType, payload))
+	if err != nil || cm.TransportHandler == nil {
+		r.Logf(LogInfo, "Broadcast() - no handler for message type %#x\n", byte(msgType))
+		return false
+	}
+	w := make(chan *ChordMsg, 1)
+	cm.TransportHandler(cm, w)
+	select {
+	case resp := <-w:
+		return resp.Type != PbErr
+	default:
+		// handler did not respond, message is delivered
+		return true
+	}
+}
@@ -33,8 +33,12 @@ func (m *PBProtoVnode) GetHost() string {
 }
 
 // PBProtoPing is simple structure for pinging remote vnodes.
+// Ping carries sender's time (sent), and pong echoes it back together with responder's time (received),
+// both in nanoseconds since epoch. They are used to estimate clock offset and round-trip time.
 type PBProtoPing struct {
 	Version          *int64 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	Sent             *int64 `protobuf:"varint,2,opt,name=sent" json:"sent,omitempty"`
+	Received         *int64 `protobuf:"varint,3,opt,name=received" json:"received,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -49,6 +53,20 @@ func (m *PBProtoPing) GetVersion() int64 {
 	return 0
 }
 
+func (m *PBProtoPing) GetSent() int64 {
+	if m != nil && m.Sent != nil {
+		return *m.Sent
+	}
+	return 0
+}
+
+func (m *PBProtoPing) GetReceived() int64 {
+	if m != nil && m.Received != nil {
+		return *m.Received
+	}
+	return 0
+}
+
 // PBProtoAck is generic response message with boolean 'ok' state.
 type PBProtoAck struct {
 	Version          *int64 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
@@ -108,11 +126,13 @@ func (m *PBProtoForward) GetVnode() *PBProtoVnode {
 	return nil
 }
 
-// PBProtoLeave (not used)
+// PBProtoLeave notifies the neighbour that source vnode is leaving, and hands over its predecessor and successors.
 type PBProtoLeave struct {
-	Source           *PBProtoVnode `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
-	Dest             *PBProtoVnode `protobuf:"bytes,2,req,name=dest" json:"dest,omitempty"`
-	XXX_unrecognized []byte        `json:"-"`
+	Source           *PBProtoVnode   `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Dest             *PBProtoVnode   `protobuf:"bytes,2,req,name=dest" json:"dest,omitempty"`
+	Predecessor      *PBProtoVnode   `protobuf:"bytes,3,opt,name=predecessor" json:"predecessor,omitempty"`
+	Successors       []*PBProtoVnode `protobuf:"bytes,4,rep,name=successors" json:"successors,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
 }
 
 func (m *PBProtoLeave) Reset()         { *m = PBProtoLeave{} }
@@ -133,6 +153,20 @@ func (m *PBProtoLeave) GetDest() *PBProtoVnode {
 	return nil
 }
 
+func (m *PBProtoLeave) GetPredecessor() *PBProtoVnode {
+	if m != nil {
+		return m.Predecessor
+	}
+	return nil
+}
+
+func (m *PBProtoLeave) GetSuccessors() []*PBProtoVnode {
+	if m != nil {
+		return m.Successors
+	}
+	return nil
+}
+
 // PBProtoListVnodes - request the list of vnodes from remote vnode.
 type PBProtoListVnodes struct {
 	XXX_unrecognized []byte `json:"-"`
@@ -234,5 +268,71 @@ func (m *PBProtoNotify) GetVnode() *PBProtoVnode {
 	return nil
 }
 
+// PBProtoBroadcast carries broadcast message to vnode responsible for delivering it in range (dest, limit).
+type PBProtoBroadcast struct {
+	Dest             *PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
+	Limit            []byte        `protobuf:"bytes,2,req,name=limit" json:"limit,omitempty"`
+	MsgType          *int32        `protobuf:"varint,3,req,name=msgType" json:"msgType,omitempty"`
+	Payload          []byte        `protobuf:"bytes,4,opt,name=payload" json:"payload,omitempty"`
+	Timeout          *int64        `protobuf:"varint,5,opt,name=timeout" json:"timeout,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *PBProtoBroadcast) Reset()         { *m = PBProtoBroadcast{} }
+func (m *PBProtoBroadcast) String() string { return proto.CompactTextString(m) }
+func (*PBProtoBroadcast) ProtoMessage()    {}
+
+func (m *PBProtoBroadcast) GetDest() *PBProtoVnode {
+	if m != nil {
+		return m.Dest
+	}
+	return nil
+}
+
+func (m *PBProtoBroadcast) GetLimit() []byte {
+	if m != nil {
+		return m.Limit
+	}
+	return nil
+}
+
+func (m *PBProtoBroadcast) GetMsgType() int32 {
+	if m != nil && m.MsgType != nil {
+		return *m.MsgType
+	}
+	return 0
+}
+
+func (m *PBProtoBroadcast) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *PBProtoBroadcast) GetTimeout() int64 {
+	if m != nil && m.Timeout != nil {
+		return *m.Timeout
+	}
+	return 0
+}
+
+// PBProtoBroadcastResp returns the number of vnodes that acknowledged the broadcast.
+type PBProtoBroadcastResp struct {
+	Acks             *int32 `protobuf:"varint,1,req,name=acks" json:"acks,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *PBProtoBroadcastResp) Reset()         { *m = PBProtoBroadcastResp{} }
+func (m *PBProtoBroadcastResp) String() string { return proto.CompactTextString(m) }
+func (*PBProtoBroadcastResp) ProtoMessage()    {}
+
+func (m *PBProtoBroadcastResp) GetAcks() int32 {
+	if m != nil && m.Acks != nil {
+		return *m.Acks
+	}
+	return 0
+}
+
 func init() {
 }
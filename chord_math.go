@@ -27,8 +27,13 @@ func Min(a, b int) int {
 func randStabilize(conf *Config) time.Duration {
 	min := conf.StabilizeMin
 	max := conf.StabilizeMax
-	rand.Seed(time.Now().UnixNano())
-	r := rand.Float64()
+	var r float64
+	if conf.Rand != nil {
+		r = conf.Rand.Float64()
+	} else {
+		rand.Seed(time.Now().UnixNano())
+		r = rand.Float64()
+	}
 	return time.Duration((r * float64(max-min)) + float64(min))
 }
 
@@ -0,0 +1,215 @@
+package dendrite
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+const (
+	// number of known vnodes whose successor lists are fetched on each view refresh
+	clientSampleSize = 3
+	// number of known vnodes client tries before giving up on a lookup
+	clientLookupAttempts = 3
+)
+
+// clientView is the routing view of a Ring running in client mode. It holds vnodes sampled from
+// peers' vnode and successor lists and their fingers, sorted by Id.
+type clientView struct {
+	lock      sync.RWMutex
+	seed      string
+	vnodes    []*Vnode
+	timerLock sync.Mutex
+	timer     Timer
+	stopped   bool
+}
+
+// merge adds unknown vnodes to the view.
+func (cv *clientView) merge(vnodes []*Vnode) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	for _, vn := range vnodes {
+		if vn == nil {
+			continue
+		}
+		idx := sort.Search(len(cv.vnodes), func(i int) bool {
+			return bytes.Compare(cv.vnodes[i].Id, vn.Id) >= 0
+		})
+		if idx < len(cv.vnodes) && bytes.Compare(cv.vnodes[idx].Id, vn.Id) == 0 {
+			continue
+		}
+		cv.vnodes = append(cv.vnodes, nil)
+		copy(cv.vnodes[idx+1:], cv.vnodes[idx:])
+		cv.vnodes[idx] = vn
+	}
+}
+
+// remove drops failed vnode from the view.
+func (cv *clientView) remove(vn *Vnode) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	for idx, known := range cv.vnodes {
+		if bytes.Compare(known.Id, vn.Id) == 0 {
+			cv.vnodes = append(cv.vnodes[:idx], cv.vnodes[idx+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to limit known vnodes preceding the key, closest first.
+func (cv *clientView) closest(key []byte, limit int) []*Vnode {
+	cv.lock.RLock()
+	defer cv.lock.RUnlock()
+	num := len(cv.vnodes)
+	limit = min(limit, num)
+	rv := make([]*Vnode, 0, limit)
+	if num == 0 {
+		return rv
+	}
+	// first vnode with Id >= key, the one before it is key's predecessor
+	idx := sort.Search(num, func(i int) bool {
+		return bytes.Compare(cv.vnodes[i].Id, key) >= 0
+	})
+	for i := 1; i <= limit; i++ {
+		rv = append(rv, cv.vnodes[(idx-i+num)%num])
+	}
+	return rv
+}
+
+// sample returns up to limit random vnodes from the view.
+func (cv *clientView) sample(limit int) []*Vnode {
+	cv.lock.RLock()
+	defer cv.lock.RUnlock()
+	rv := make([]*Vnode, 0, limit)
+	for _, idx := range rand.Perm(len(cv.vnodes)) {
+		if len(rv) == limit {
+			break
+		}
+		rv = append(rv, cv.vnodes[idx])
+	}
+	return rv
+}
+
+// size returns number of vnodes in the view.
+func (cv *clientView) size() int {
+	cv.lock.RLock()
+	defer cv.lock.RUnlock()
+	return len(cv.vnodes)
+}
+
+/*
+	JoinRingAsClient connects to existing dendrite network in client mode. Client runs no vnodes, so it
+	owns no part of the keyspace, holds no data and takes no part in stabilization. Instead, it keeps
+	a routing view of the ring, sampled from peers, which is used to route Lookup() directly to the
+	vnodes responsible for the key. config.NumVnodes is ignored.
+*/
+func JoinRingAsClient(config *Config, transport Transport, existing string) (*Ring, error) {
+	hosts, err := transport.ListVnodes(existing)
+	if err != nil {
+		return nil, err
+	}
+	if hosts == nil || len(hosts) == 0 {
+		return nil, fmt.Errorf("Remote host has no vnodes registered yet")
+	}
+
+	client_config := *config
+	client_config.NumVnodes = 0
+	r := &Ring{}
+	r.init(&client_config, transport)
+	r.client = &clientView{
+		seed:   existing,
+		vnodes: make([]*Vnode, 0),
+	}
+	r.client.merge(hosts)
+	r.refreshView()
+	r.scheduleRefresh()
+	return r, nil
+}
+
+// IsClient returns true if ring member runs in client mode.
+func (r *Ring) IsClient() bool {
+	return r.client != nil
+}
+
+// scheduleRefresh schedules client's refreshView(), unless client has stopped.
+func (r *Ring) scheduleRefresh() {
+	cv := r.client
+	cv.timerLock.Lock()
+	defer cv.timerLock.Unlock()
+	if cv.stopped {
+		return
+	}
+	cv.timer = r.clock.AfterFunc(randStabilize(r.config), func() {
+		r.refreshView()
+		r.scheduleRefresh()
+	})
+}
+
+// stopRefresh stops client's view refreshes. Refresh that is already running does not schedule the next one.
+func (r *Ring) stopRefresh() {
+	cv := r.client
+	cv.timerLock.Lock()
+	defer cv.timerLock.Unlock()
+	cv.stopped = true
+	if cv.timer != nil {
+		cv.timer.Stop()
+	}
+}
+
+// refreshView updates client's routing view with successor lists of randomly picked known vnodes, and
+// a random finger of each. Vnodes that fail to respond are removed from the view.
+func (r *Ring) refreshView() {
+	if r.client.size() == 0 {
+		// we lost everyone, start over from the seed
+		hosts, err := r.transport.ListVnodes(r.client.seed)
+		if err != nil {
+			r.Logln(LogInfo, "refreshView() - routing view is empty, and seed failed:", err)
+			return
+		}
+		r.client.merge(hosts)
+	}
+	for _, vn := range r.client.sample(clientSampleSize) {
+		succs, err := r.transport.FindSuccessors(vn, r.config.NumSuccessors, vn.Id)
+		if err != nil {
+			r.Logln(LogDebug, "refreshView() - removing vnode from routing view due to error:", err)
+			r.client.remove(vn)
+			continue
+		}
+		r.client.merge(succs)
+		// successor lists only reach nearby vnodes, fingers spread the view across the ring
+		finger, err := r.transport.FindSuccessors(vn, 1, powerOffset(vn.Id, rand.Intn(160), 160))
+		if err != nil {
+			r.Logln(LogDebug, "refreshView() - failed to sample finger:", err)
+			continue
+		}
+		r.client.merge(finger)
+	}
+}
+
+// clientLookup implements Lookup() in client mode, by asking known vnodes preceding the key.
+func (r *Ring) clientLookup(n int, keyHash []byte) ([]*Vnode, error) {
+	var last_err error
+	for _, vn := range r.client.closest(keyHash, clientLookupAttempts) {
+		successors, err := r.transport.FindSuccessors(vn, n, keyHash)
+		if err != nil {
+			last_err = err
+			r.client.remove(vn)
+			continue
+		}
+		// Trim the nil successors
+		for len(successors) > 0 && successors[len(successors)-1] == nil {
+			successors = successors[:len(successors)-1]
+		}
+		if len(successors) == 0 {
+			last_err = fmt.Errorf("no successors found for key")
+			continue
+		}
+		return successors, nil
+	}
+	if last_err == nil {
+		last_err = fmt.Errorf("routing view is empty")
+	}
+	return nil, last_err
+}
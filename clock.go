@@ -0,0 +1,76 @@
+package dendrite
+
+import (
+	"sort"
+	"time"
+)
+
+// Timer is a scheduled function call, as returned by Clock's AfterFunc().
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer already fired or was stopped.
+	Stop() bool
+}
+
+// Clock provides time to the ring. Stabilization and client view refreshes are scheduled through it,
+// which allows simulations to run rings on virtual time. Ring uses the system clock if Config.Clock is nil.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(time.Duration, func()) Timer
+}
+
+// systemClock implements Clock with package time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// PeerClocks returns clock offsets and round-trip times of remote hosts, as estimated by the transport from
+// stabilization pings. It returns nil if the transport does not track them (see ClockReporter).
+func (r *Ring) PeerClocks() []*PeerClock {
+	if reporter, ok := r.transport.(ClockReporter); ok {
+		return reporter.PeerClocks()
+	}
+	return nil
+}
+
+/* ClockSkew returns how far the majority of recently pinged remote hosts is from local clock: more than half
+of them are ahead of us by at least skew if it's positive, or behind by at least -skew if it's negative.
+It's the median of peer offsets, and zero if the two middle offsets point in different directions.
+Ok is false if no peer clocks are known.
+*/
+func (r *Ring) ClockSkew() (skew time.Duration, ok bool) {
+	offsets := make([]time.Duration, 0)
+	now := time.Now()
+	for _, peer := range r.PeerClocks() {
+		if peer.Host == r.config.Hostname || now.Sub(peer.Updated) > clockSampleMaxAge {
+			continue
+		}
+		offsets = append(offsets, peer.Offset)
+	}
+	if len(offsets) == 0 {
+		return 0, false
+	}
+	sort.Sort(durations(offsets))
+	mid := len(offsets) / 2
+	if len(offsets)%2 == 1 {
+		return offsets[mid], true
+	}
+	switch {
+	case offsets[mid-1] > 0:
+		return offsets[mid-1], true
+	case offsets[mid] < 0:
+		return offsets[mid], true
+	}
+	return 0, true
+}
+
+type durations []time.Duration
+
+func (s durations) Len() int           { return len(s) }
+func (s durations) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s durations) Less(i, j int) bool { return s[i] < s[j] }
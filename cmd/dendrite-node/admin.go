@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fastfn/dendrite"
+	"github.com/fastfn/dendrite/dtable"
+)
+
+// adminServer exposes node's state over HTTP:
+//
+//	/health  - returns "ok" while node is running
+//	/status  - node's configuration, vnodes, owned key ranges and pending hints
+//	/ring    - routing state of local vnodes (Ring's Snapshot())
+//	/clocks  - estimated clock offset and round-trip time of peers (Ring's PeerClocks())
+//	/metrics - node's metrics in Prometheus text format
+type adminServer struct {
+	conf  *nodeConfig
+	ring  *dendrite.Ring
+	table *dtable.DTable
+}
+
+type rangeStatus struct {
+	Vnode string `json:"vnode"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type nodeStatus struct {
+	Host         string        `json:"host"`
+	Nodes        []string      `json:"nodes"`
+	Vnodes       []string      `json:"vnodes"`
+	Replicas     int           `json:"replicas"`
+	Ranges       []rangeStatus `json:"ranges"`
+	LocalKeys    int           `json:"local_keys"`
+	PendingHints int           `json:"pending_hints"`
+	ClockSkew    string        `json:"clock_skew,omitempty"`
+}
+
+type peerClockStatus struct {
+	Host     string  `json:"host"`
+	OffsetMs float64 `json:"offset_ms"`
+	RTTMs    float64 `json:"rtt_ms"`
+	Samples  int     `json:"samples"`
+	Updated  string  `json:"updated"`
+}
+
+type vnodeState struct {
+	Vnode       string   `json:"vnode"`
+	Predecessor string   `json:"predecessor"`
+	Successors  []string `json:"successors"`
+	Fingers     []string `json:"fingers"`
+}
+
+// start runs admin server in the background.
+func (as *adminServer) start(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", as.health)
+	mux.HandleFunc("/status", as.status)
+	mux.HandleFunc("/ring", as.ringState)
+	mux.HandleFunc("/clocks", as.clocks)
+	mux.HandleFunc("/metrics", as.metrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("dendrite-node: admin server stopped -", err)
+		}
+	}()
+}
+
+func (as *adminServer) health(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (as *adminServer) status(w http.ResponseWriter, r *http.Request) {
+	st := &nodeStatus{
+		Host:         as.conf.Host,
+		Nodes:        as.conf.Nodes,
+		Vnodes:       make([]string, 0),
+		Replicas:     as.ring.Replicas(),
+		Ranges:       make([]rangeStatus, 0),
+		LocalKeys:    len(as.table.NewQuery().GetLocalKeys()),
+		PendingHints: as.table.PendingHints(),
+	}
+	if skew, ok := as.ring.ClockSkew(); ok {
+		st.ClockSkew = skew.String()
+	}
+	for _, vn := range as.ring.MyVnodes() {
+		st.Vnodes = append(st.Vnodes, vn.String())
+	}
+	for _, kr := range as.ring.OwnedRanges() {
+		st.Ranges = append(st.Ranges, rangeStatus{
+			Vnode: kr.Vnode.String(),
+			Start: fmt.Sprintf("%x", kr.Start),
+			End:   fmt.Sprintf("%x", kr.End),
+		})
+	}
+	writeJSON(w, st)
+}
+
+func (as *adminServer) ringState(w http.ResponseWriter, r *http.Request) {
+	snapshot := as.ring.Snapshot()
+	rv := make([]*vnodeState, len(snapshot.Vnodes))
+	for idx, vs := range snapshot.Vnodes {
+		rv[idx] = &vnodeState{
+			Vnode:       vnodeAddr(vs.Vnode),
+			Predecessor: vnodeAddr(vs.Predecessor),
+			Successors:  vnodeAddrs(vs.Successors),
+			Fingers:     vnodeAddrs(vs.Fingers),
+		}
+	}
+	writeJSON(w, rv)
+}
+
+func (as *adminServer) clocks(w http.ResponseWriter, r *http.Request) {
+	rv := make([]*peerClockStatus, 0)
+	for _, peer := range as.ring.PeerClocks() {
+		rv = append(rv, &peerClockStatus{
+			Host:     peer.Host,
+			OffsetMs: durationMs(peer.Offset),
+			RTTMs:    durationMs(peer.RTT),
+			Samples:  peer.Samples,
+			Updated:  peer.Updated.Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, rv)
+}
+
+func (as *adminServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE dendrite_vnodes gauge\ndendrite_vnodes %d\n", len(as.ring.MyVnodes()))
+	fmt.Fprintf(w, "# TYPE dtable_local_keys gauge\ndtable_local_keys %d\n", len(as.table.NewQuery().GetLocalKeys()))
+	fmt.Fprintf(w, "# TYPE dtable_pending_hints gauge\ndtable_pending_hints %d\n", as.table.PendingHints())
+	peers := as.ring.PeerClocks()
+	fmt.Fprintf(w, "# TYPE dendrite_peer_clock_offset_seconds gauge\n")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "dendrite_peer_clock_offset_seconds{peer=%q} %g\n", peer.Host, peer.Offset.Seconds())
+	}
+	fmt.Fprintf(w, "# TYPE dendrite_peer_rtt_seconds gauge\n")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "dendrite_peer_rtt_seconds{peer=%q} %g\n", peer.Host, peer.RTT.Seconds())
+	}
+	if skew, ok := as.ring.ClockSkew(); ok {
+		fmt.Fprintf(w, "# TYPE dendrite_clock_skew_seconds gauge\ndendrite_clock_skew_seconds %g\n", skew.Seconds())
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// vnodeAddr formats vnode as id@host.
+func vnodeAddr(vn *dendrite.Vnode) string {
+	if vn == nil {
+		return ""
+	}
+	return vn.String() + "@" + vn.Host
+}
+
+func vnodeAddrs(vnodes []*dendrite.Vnode) []string {
+	rv := make([]string, len(vnodes))
+	for idx, vn := range vnodes {
+		rv[idx] = vnodeAddr(vn)
+	}
+	return rv
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fastfn/dendrite"
+	"github.com/fastfn/dendrite/dtable"
+)
+
+// duration is time.Duration that decodes from JSON strings like "1s" or "500ms".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string, e.g. \"1s\" - %s", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// nodeConfig holds dendrite-node settings, as read from config file and flags.
+type nodeConfig struct {
+	Host         string   `json:"host"`
+	Nodes        []string `json:"nodes"`
+	Vnodes       int      `json:"vnodes"`
+	Replicas     int      `json:"replicas"`
+	StabilizeMin duration `json:"stabilize_min"`
+	StabilizeMax duration `json:"stabilize_max"`
+	Timeout      duration `json:"timeout"`
+	LogLevel     string   `json:"log_level"`
+	Admin        string   `json:"admin"`
+	MaxClockSkew duration `json:"max_clock_skew"`
+	DataDir      string   `json:"data_dir"`
+}
+
+// defaultNodeConfig returns nodeConfig matching dendrite.DefaultConfig().
+func defaultNodeConfig() *nodeConfig {
+	defaults := dendrite.DefaultConfig("")
+	return &nodeConfig{
+		Host:         "127.0.0.1:5000",
+		Nodes:        make([]string, 0),
+		Vnodes:       defaults.NumVnodes,
+		Replicas:     defaults.Replicas,
+		StabilizeMin: duration{defaults.StabilizeMin},
+		StabilizeMax: duration{defaults.StabilizeMax},
+		Timeout:      duration{5 * time.Second},
+		LogLevel:     "info",
+	}
+}
+
+// parseConfig builds nodeConfig from defaults, then config file (if given), and then flags that were set explicitly.
+func parseConfig(args []string) (*nodeConfig, error) {
+	conf := defaultNodeConfig()
+	fs := flag.NewFlagSet("dendrite-node", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to JSON config file")
+	host := fs.String("host", conf.Host, "address to listen on, as ip:port")
+	nodes := fs.String("nodes", "", "comma separated list of seed nodes to join; new ring is created if empty")
+	vnodes := fs.Int("vnodes", conf.Vnodes, "number of vnodes")
+	replicas := fs.Int("replicas", conf.Replicas, "number of replicas")
+	stabilizeMin := fs.Duration("stabilize-min", conf.StabilizeMin.Duration, "minimum interval between stabilizations")
+	stabilizeMax := fs.Duration("stabilize-max", conf.StabilizeMax.Duration, "maximum interval between stabilizations")
+	timeout := fs.Duration("timeout", conf.Timeout.Duration, "transport client timeout")
+	logLevel := fs.String("log", conf.LogLevel, "log level: null, info or debug")
+	admin := fs.String("admin", "", "address of admin HTTP server, e.g. 127.0.0.1:8080; disabled if empty")
+	maxClockSkew := fs.Duration("max-clock-skew", 0, "refuse writes if peers' clocks are further than this; disabled if 0")
+	dataDir := fs.String("data-dir", "", "directory to store tables in, so that they survive restarts; kept in memory only if empty")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		f, err := os.Open(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(conf); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s - %s", *configFile, err)
+		}
+	}
+
+	// flags given on command line override the config file
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			conf.Host = *host
+		case "nodes":
+			conf.Nodes = make([]string, 0)
+			for _, node := range strings.Split(*nodes, ",") {
+				if node = strings.TrimSpace(node); node != "" {
+					conf.Nodes = append(conf.Nodes, node)
+				}
+			}
+		case "vnodes":
+			conf.Vnodes = *vnodes
+		case "replicas":
+			conf.Replicas = *replicas
+		case "stabilize-min":
+			conf.StabilizeMin.Duration = *stabilizeMin
+		case "stabilize-max":
+			conf.StabilizeMax.Duration = *stabilizeMax
+		case "timeout":
+			conf.Timeout.Duration = *timeout
+		case "log":
+			conf.LogLevel = *logLevel
+		case "admin":
+			conf.Admin = *admin
+		case "max-clock-skew":
+			conf.MaxClockSkew.Duration = *maxClockSkew
+		case "data-dir":
+			conf.DataDir = *dataDir
+		}
+	})
+	return conf, conf.validate()
+}
+
+func (conf *nodeConfig) validate() error {
+	if conf.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if conf.Vnodes < 1 {
+		return fmt.Errorf("vnodes must be at least 1")
+	}
+	if conf.Replicas < 0 {
+		return fmt.Errorf("replicas can not be negative")
+	}
+	if conf.StabilizeMin.Duration <= 0 || conf.StabilizeMax.Duration < conf.StabilizeMin.Duration {
+		return fmt.Errorf("invalid stabilize interval [%s, %s]", conf.StabilizeMin, conf.StabilizeMax)
+	}
+	if conf.MaxClockSkew.Duration < 0 {
+		return fmt.Errorf("max clock skew can not be negative")
+	}
+	if _, _, err := conf.logLevels(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// logLevels maps configured log level to dendrite and dtable log levels.
+func (conf *nodeConfig) logLevels() (dendrite.LogLevel, dtable.LogLevel, error) {
+	switch strings.ToLower(conf.LogLevel) {
+	case "null", "none":
+		return dendrite.LogNull, dtable.LogNull, nil
+	case "info":
+		return dendrite.LogInfo, dtable.LogInfo, nil
+	case "debug":
+		return dendrite.LogDebug, dtable.LogDebug, nil
+	}
+	return dendrite.LogNull, dtable.LogNull, fmt.Errorf("unknown log level %q", conf.LogLevel)
+}
+
+// ringConfig returns dendrite.Config for the node.
+func (conf *nodeConfig) ringConfig() *dendrite.Config {
+	rc := dendrite.DefaultConfig(conf.Host)
+	rc.NumVnodes = conf.Vnodes
+	rc.Replicas = conf.Replicas
+	rc.StabilizeMin = conf.StabilizeMin.Duration
+	rc.StabilizeMax = conf.StabilizeMax.Duration
+	rc.LogLevel, _, _ = conf.logLevels()
+	return rc
+}
+
+// tableConfig returns dtable.Config for the node.
+func (conf *nodeConfig) tableConfig() *dtable.Config {
+	tc := dtable.DefaultConfig()
+	_, tc.LogLevel, _ = conf.logLevels()
+	tc.MaxClockSkew = conf.MaxClockSkew.Duration
+	if conf.DataDir != "" {
+		tc.Storage = dtable.NewDiskStorage(conf.DataDir)
+	}
+	return tc
+}
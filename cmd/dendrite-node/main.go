@@ -0,0 +1,101 @@
+/*
+	Command dendrite-node runs a dendrite storage node: ZMQTransport, Ring and DTable.
+
+	Settings are taken from flags, or from JSON config file given with -config. Flags set on command line
+	override the config file.
+		dendrite-node -host 127.0.0.1:5001 -nodes 127.0.0.1:5000,127.0.0.1:5002 -vnodes 3 -replicas 2
+		dendrite-node -config node.json -log debug
+
+	Config file uses the same names as flags:
+		{
+			"host": "127.0.0.1:5001",
+			"nodes": ["127.0.0.1:5000"],
+			"vnodes": 3,
+			"replicas": 2,
+			"stabilize_min": "1s",
+			"stabilize_max": "3s",
+			"timeout": "5s",
+			"log_level": "info",
+			"admin": "127.0.0.1:8001",
+			"max_clock_skew": "500ms",
+			"data_dir": "/var/lib/dendrite"
+		}
+
+	Node joins the ring through the first seed node that responds, or creates a new ring if no seeds
+	are given. On SIGTERM or SIGINT it leaves the ring gracefully and closes the transport.
+	If admin address is set, node serves /health, /status, /ring, /clocks and /metrics over HTTP.
+	With max_clock_skew set, node refuses writes to keys it owns while majority of its peers' clocks
+	is further from its own clock than that. With data_dir set, tables are stored on disk and loaded
+	back when node restarts with the same host and number of vnodes.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fastfn/dendrite"
+	"github.com/fastfn/dendrite/dtable"
+)
+
+func main() {
+	conf, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln("dendrite-node:", err)
+	}
+	transport, err := dendrite.InitZMQTransport(conf.Host, conf.Timeout.Duration, nil)
+	if err != nil {
+		log.Fatalln("dendrite-node: failed to start transport -", err)
+	}
+	ring, err := startRing(conf, transport)
+	if err != nil {
+		transport.Close()
+		log.Fatalln("dendrite-node:", err)
+	}
+	table, err := dtable.NewWithConfig(ring, transport, conf.tableConfig())
+	if err != nil {
+		ring.Leave()
+		transport.Close()
+		log.Fatalln("dendrite-node:", err)
+	}
+	if conf.Admin != "" {
+		admin := &adminServer{conf: conf, ring: ring, table: table}
+		admin.start(conf.Admin)
+	}
+	log.Printf("dendrite-node: running on %s with %d vnodes\n", conf.Host, conf.Vnodes)
+
+	signal_c := make(chan os.Signal, 1)
+	signal.Notify(signal_c, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signal_c
+	log.Printf("dendrite-node: got %s, leaving the ring\n", sig)
+	if err := ring.Leave(); err != nil {
+		log.Println("dendrite-node: leave -", err)
+	}
+	// table may still need the transport to finish in-flight writes
+	if err := table.Close(); err != nil {
+		log.Println("dendrite-node: close tables -", err)
+	}
+	if err := transport.Close(); err != nil {
+		log.Println("dendrite-node: close -", err)
+	}
+}
+
+// startRing joins the ring through the first seed node that responds, or creates a new one if there are no seeds.
+func startRing(conf *nodeConfig, transport dendrite.Transport) (*dendrite.Ring, error) {
+	if len(conf.Nodes) == 0 {
+		return dendrite.CreateRing(conf.ringConfig(), transport)
+	}
+	var last_err error
+	for _, seed := range conf.Nodes {
+		ring, err := dendrite.JoinRing(conf.ringConfig(), transport, seed)
+		if err == nil {
+			return ring, nil
+		}
+		log.Printf("dendrite-node: failed to join through %s - %s\n", seed, err)
+		last_err = err
+	}
+	return nil, fmt.Errorf("failed to join the ring through any of seed nodes, last error: %s", last_err)
+}
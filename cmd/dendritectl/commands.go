@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fastfn/dendrite"
+)
+
+// scanPageSize is the number of keys read with each Scan() request.
+const scanPageSize = 100
+
+// maxRingWalk limits the number of vnodes visited by ring walk, in case successor pointers form a loop.
+const maxRingWalk = 65536
+
+// run executes a single command.
+func (c *ctl) run(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	need := func(n int) error {
+		if len(args)-1 != n {
+			return fmt.Errorf("%s expects %d argument(s), got %d", args[0], n, len(args)-1)
+		}
+		return nil
+	}
+	switch args[0] {
+	case "get":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.get(w, args[1])
+	case "set":
+		if len(args) == 4 {
+			ttl, err := time.ParseDuration(args[3])
+			if err != nil {
+				return fmt.Errorf("invalid ttl %q - %s", args[3], err)
+			}
+			return c.table.NewQuery().Consistency(c.consistency).SetWithTTL([]byte(args[1]), []byte(args[2]), ttl)
+		}
+		if err := need(2); err != nil {
+			return err
+		}
+		return c.table.NewQuery().Consistency(c.consistency).Set([]byte(args[1]), []byte(args[2]))
+	case "del":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.table.NewQuery().Consistency(c.consistency).Delete([]byte(args[1]))
+	case "lookup":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.lookup(w, args[1])
+	case "ring":
+		if err := need(0); err != nil {
+			return err
+		}
+		return c.walk(w)
+	case "status":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.status(w, args[1])
+	case "scan":
+		if len(args) == 2 && args[1] == "values" {
+			return c.scan(w, true)
+		}
+		if err := need(0); err != nil {
+			return err
+		}
+		return c.scan(w, false)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func (c *ctl) get(w io.Writer, key string) error {
+	item, err := c.table.NewQuery().Get([]byte(key))
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return fmt.Errorf("key %q not found", key)
+	}
+	fmt.Fprintf(w, "%s\n", item.Val)
+	return nil
+}
+
+func (c *ctl) lookup(w io.Writer, key string) error {
+	keyHash := dendrite.HashKey([]byte(key))
+	vnodes, err := c.ring.Lookup(c.ring.Replicas()+1, keyHash)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "key hash: %x\n", keyHash)
+	for idx, vn := range vnodes {
+		role := "replica"
+		if idx == 0 {
+			role = "owner"
+		}
+		fmt.Fprintf(w, "%-8s %s@%s\n", role, vn.String(), vn.Host)
+	}
+	return nil
+}
+
+// scan prints all keys in the cluster, in key hash order, optionally with their values.
+func (c *ctl) scan(w io.Writer, values bool) error {
+	var cursor []byte
+	count := 0
+	for {
+		page, err := c.table.NewQuery().Scan(cursor, scanPageSize, values)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if values {
+				fmt.Fprintf(w, "%s\t%s\n", item.Key, item.Val)
+			} else {
+				fmt.Fprintf(w, "%s\n", item.Key)
+			}
+		}
+		count += len(page.Items)
+		if page.Cursor == nil {
+			break
+		}
+		cursor = page.Cursor
+	}
+	fmt.Fprintf(w, "\n%d keys\n", count)
+	return nil
+}
+
+// walk follows successor pointers around the ring, starting from seed's first vnode.
+func (c *ctl) walk(w io.Writer) error {
+	var start *dendrite.Vnode
+	for _, seed := range c.seeds {
+		if vnodes, err := c.transport.ListVnodes(seed); err == nil && len(vnodes) > 0 {
+			start = vnodes[0]
+			break
+		}
+	}
+	if start == nil {
+		return fmt.Errorf("none of seed nodes returned its vnodes")
+	}
+
+	hosts := make(map[string]int)
+	seen := make(map[string]bool)
+	current := start
+	for i := 0; i < maxRingWalk; i++ {
+		fmt.Fprintf(w, "%s@%s\n", current.String(), current.Host)
+		hosts[current.Host]++
+		seen[current.String()] = true
+		succs, err := c.transport.FindSuccessors(current, 1, current.Id)
+		if err != nil {
+			return fmt.Errorf("failed to get successor of %s - %s", current.String(), err)
+		}
+		if len(succs) == 0 || succs[0] == nil {
+			return fmt.Errorf("vnode %s has no successor", current.String())
+		}
+		next := succs[0]
+		if next.String() == start.String() {
+			break
+		}
+		if seen[next.String()] {
+			return fmt.Errorf("successor walk looped back to %s without returning to %s", next.String(), start.String())
+		}
+		current = next
+	}
+
+	// compare with vnodes each host reports
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "\n%d vnodes on %d hosts\n", len(seen), len(hosts))
+	for _, host := range names {
+		listed := "?"
+		if vnodes, err := c.transport.ListVnodes(host); err == nil {
+			listed = fmt.Sprintf("%d", len(vnodes))
+		}
+		fmt.Fprintf(w, "%-24s %d in ring, %s listed\n", host, hosts[host], listed)
+	}
+	return nil
+}
+
+func (c *ctl) status(w io.Writer, host string) error {
+	vnodes, err := c.transport.ListVnodes(host)
+	if err != nil {
+		return err
+	}
+	for _, vn := range vnodes {
+		status := "ok"
+		if err := c.table.Status(vn); err != nil {
+			status = err.Error()
+		}
+		fmt.Fprintf(w, "%s@%s %s\n", vn.String(), vn.Host, status)
+	}
+	return nil
+}
+
+// shell reads commands line by line, until EOF or quit.
+func (c *ctl) shell(r io.Reader, w io.Writer) {
+	scanner := bufio.NewScanner(r)
+	fmt.Fprint(w, "dendrite> ")
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) > 0 {
+			switch args[0] {
+			case "quit", "exit":
+				return
+			case "help":
+				fmt.Fprintln(w, "commands: get <key>, set <key> <value> [ttl], del <key>, lookup <key>, ring, status <host>, scan [values], quit")
+			default:
+				if err := c.run(w, args); err != nil {
+					fmt.Fprintln(w, "error:", err)
+				}
+			}
+		}
+		fmt.Fprint(w, "dendrite> ")
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,145 @@
+/*
+	Command dendritectl is a command-line client for a running dendrite cluster. It joins the ring in client mode
+	through one of seed nodes and talks to the cluster over the regular wire protocol.
+
+	Usage:
+		dendritectl -seed 127.0.0.1:5000 [flags] <command> [args]
+
+	Commands:
+		get <key>            print the value of a key, reading -consistency copies
+		set <key> <value> [ttl]
+		                     write a key, with -consistency writes before returning. Optional ttl
+		                     (e.g. 30s, 5m) makes the key expire
+		del <key>            delete a key
+		lookup <key>         show vnodes responsible for a key (owner first, then replicas)
+		ring                 walk the ring through successors and list its vnodes by host
+		status <host>        check dtable status of each vnode on the host
+		scan [values]        list all keys in the cluster, in key hash order, optionally with their values
+		shell                interactive shell, accepting the commands above
+
+	Client listens on -host (127.0.0.1:5999 by default), which has to be free.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fastfn/dendrite"
+	"github.com/fastfn/dendrite/dtable"
+)
+
+// ctl holds dendritectl's connection to the cluster.
+type ctl struct {
+	ring        *dendrite.Ring
+	transport   dendrite.Transport
+	table       *dtable.DTable
+	seeds       []string
+	consistency int
+}
+
+func main() {
+	seed := flag.String("seed", "127.0.0.1:5000", "comma separated list of cluster nodes to connect through")
+	host := flag.String("host", "127.0.0.1:5999", "local address for client's transport")
+	consistency := flag.Int("consistency", 1, "minimum number of copies written by set and del, or read by get")
+	timeout := flag.Duration("timeout", 5*time.Second, "request timeout")
+	logLevel := flag.String("log", "null", "log level: null, info or debug")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dendritectl [flags] <get|set|del|lookup|ring|status|scan|shell> [args]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c, err := connect(*host, *seed, *timeout, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dendritectl:", err)
+		os.Exit(1)
+	}
+	c.consistency = *consistency
+	defer c.close()
+
+	if flag.Arg(0) == "shell" {
+		c.shell(os.Stdin, os.Stdout)
+		return
+	}
+	if err := c.run(os.Stdout, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "dendritectl:", err)
+		c.close()
+		os.Exit(1)
+	}
+}
+
+// connect starts the transport and joins the ring as a client, through the first seed that responds.
+func connect(host, seeds string, timeout time.Duration, logLevel string) (*ctl, error) {
+	ringLevel, tableLevel := dendrite.LogNull, dtable.LogNull
+	// keep stdout for command output
+	logger := log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+	switch strings.ToLower(logLevel) {
+	case "null", "none":
+		logger = log.New(ioutil.Discard, "", 0)
+	case "info":
+		ringLevel, tableLevel = dendrite.LogInfo, dtable.LogInfo
+	case "debug":
+		ringLevel, tableLevel = dendrite.LogDebug, dtable.LogDebug
+	default:
+		return nil, fmt.Errorf("unknown log level %q", logLevel)
+	}
+
+	c := &ctl{seeds: make([]string, 0)}
+	for _, s := range strings.Split(seeds, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			c.seeds = append(c.seeds, s)
+		}
+	}
+	if len(c.seeds) == 0 {
+		return nil, fmt.Errorf("at least one seed node is required")
+	}
+
+	transport, err := dendrite.InitZMQTransport(host, timeout, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transport - %s", err)
+	}
+	c.transport = transport
+	conf := dendrite.DefaultConfig(host)
+	conf.LogLevel = ringLevel
+	conf.Logger = logger
+	var last_err error
+	for _, s := range c.seeds {
+		if c.ring, last_err = dendrite.JoinRingAsClient(conf, transport, s); last_err == nil {
+			break
+		}
+	}
+	if c.ring == nil {
+		transport.Close()
+		return nil, fmt.Errorf("failed to connect to the cluster - %s", last_err)
+	}
+	if c.table, err = dtable.New(c.ring, transport, tableLevel); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ctl) close() {
+	if c.table != nil {
+		c.table.Close()
+		c.table = nil
+	}
+	if c.ring != nil {
+		c.ring.Leave()
+		c.ring = nil
+	}
+	if c.transport != nil {
+		c.transport.Close()
+		c.transport = nil
+	}
+}
@@ -1,5 +1,9 @@
 #!/bin/bash
 
+# first node bootstraps the ring
+dendrite-node -host "127.0.0.1:5000" -admin "127.0.0.1:8000" &
+sleep 1
+
 for port in 5001 5002 5003 5004
 do
   dendrite-node -host "127.0.0.1:$port" -nodes "127.0.0.1:5000" &
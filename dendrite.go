@@ -3,7 +3,9 @@ package dendrite
 import (
 	"bytes"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	"log"
+	"math/rand"
 	"sort"
 	"time"
 )
@@ -19,18 +21,61 @@ type ChordMsg struct {
 	TransportHandler func(*ChordMsg, chan *ChordMsg) // request pointer, response channel
 }
 
+// NewErrorMsg is a helper to create encoded *ChordMsg (PBProtoErr) with error in it.
+func NewErrorMsg(msg string) *ChordMsg {
+	pbmsg := &PBProtoErr{
+		Error: proto.String(msg),
+	}
+	pbdata, _ := proto.Marshal(pbmsg)
+	return &ChordMsg{
+		Type: PbErr,
+		Data: pbdata,
+	}
+}
+
 type ErrHookUnknownType string
 
 func (e ErrHookUnknownType) Error() string {
 	return fmt.Sprintf("%s", string(e))
 }
 
+// ErrMsgTypeConflict is returned when MsgTypeClaim overlaps with message types claimed earlier.
+type ErrMsgTypeConflict string
+
+func (e ErrMsgTypeConflict) Error() string {
+	return string(e)
+}
+
 // TransportHook provides interface to build additional message types, decoders and handlers through 3rd party
 // packages that can register their hooks and leverage existing transport architecture and capabilities.
+// New extensions should prefer MsgTypeClaim, which reserves message types explicitly.
 type TransportHook interface {
 	Decode([]byte) (*ChordMsg, error) // decodes bytes to ChordMsg
 }
 
+// MsgDecoder decodes protobuf data of a single message type. Returned value is set as ChordMsg.TransportMsg.
+type MsgDecoder func([]byte) (interface{}, error)
+
+// MsgHandler handles a request and writes the response to given channel.
+type MsgHandler func(*ChordMsg, chan *ChordMsg)
+
+// MsgTypeHandler couples decoder and request handler for a single message type.
+// Handler should be nil for message types that are only sent as responses.
+type MsgTypeHandler struct {
+	Decoder MsgDecoder
+	Handler MsgHandler
+}
+
+// MsgTypeClaim is used to claim a range of message types [Min, Max] for exclusive use by Owner.
+// Every message type in Handlers must fall within the range. Types in the range without an entry
+// in Handlers are reserved, but can not be decoded.
+type MsgTypeClaim struct {
+	Owner    string
+	Min      MsgType
+	Max      MsgType
+	Handlers map[MsgType]*MsgTypeHandler
+}
+
 // DelegateHook provides interface to capture dendrite events in 3rd party packages.
 type DelegateHook interface {
 	EmitEvent(*EventCtx)
@@ -50,6 +95,9 @@ type Transport interface {
 	// Notify our successor of ourselves.
 	Notify(dest, self *Vnode) ([]*Vnode, error)
 
+	// Leave notifies dest that self is leaving the ring, handing over self's predecessor and successors.
+	Leave(dest, self, pred *Vnode, succs []*Vnode) error
+
 	// FindSuccessors sends request to a vnode, requesting the list of successors for given key.
 	FindSuccessors(*Vnode, int, []byte) ([]*Vnode, error)
 
@@ -66,6 +114,17 @@ type Transport interface {
 	// RegisterHook registers a TransportHook within the transport.
 	RegisterHook(TransportHook)
 
+	// Request sends encoded request of given message type to remote host and returns decoded response.
+	// It is used by extensions to send their own message types.
+	Request(host string, msgType MsgType, data []byte) (*ChordMsg, error)
+
+	// ClaimMsgTypes registers a MsgTypeClaim within the transport. It fails with ErrMsgTypeConflict
+	// if claimed range overlaps with previous claims.
+	ClaimMsgTypes(*MsgTypeClaim) error
+
+	// Close shuts down the transport, releasing all of its resources.
+	Close() error
+
 	TransportHook
 }
 
@@ -79,6 +138,8 @@ type Config struct {
 	Replicas      int      // number of replicas to keep by default
 	LogLevel      LogLevel // logLevel, 0 = null, 1 = info, 2 = debug
 	Logger        *log.Logger
+	Clock         Clock      // time source for stabilization, system clock if nil
+	Rand          *rand.Rand // source of stabilization jitter, math/rand's default source if nil
 }
 
 // DefaultConfig returns *Config with default values.
@@ -161,7 +222,9 @@ type Ring struct {
 	vnodes         []*localVnode // list of local vnodes
 	shutdown       chan bool
 	Stabilizations int
-	delegateHooks  []DelegateHook
+	events         *eventBus
+	client         *clientView // routing view, set in client mode only
+	clock          Clock
 	Logger         *log.Logger
 }
 
@@ -185,6 +248,11 @@ func (r *Ring) Replicas() int {
 	return r.config.Replicas
 }
 
+// NumSuccessors returns ring.config.NumSuccessors, the largest n Lookup() accepts.
+func (r *Ring) NumSuccessors() int {
+	return r.config.NumSuccessors
+}
+
 // MaxStabilize returns ring.config.StabilizeMax duration.
 func (r *Ring) MaxStabilize() time.Duration {
 	return r.config.StabilizeMax
@@ -197,6 +265,10 @@ func (r *Ring) Lookup(n int, keyHash []byte) ([]*Vnode, error) {
 		return nil, fmt.Errorf("Cannot ask for more successors than NumSuccessors!")
 	}
 
+	if r.client != nil {
+		return r.clientLookup(n, keyHash)
+	}
+
 	// Find the nearest local vnode
 	nearest := nearestVnodeToKey(r.vnodes, keyHash)
 
@@ -237,10 +309,14 @@ func (r *Ring) setLocalSuccessors() {
 func (r *Ring) init(config *Config, transport Transport) {
 	r.config = config
 	r.Logger = config.Logger
+	r.clock = config.Clock
+	if r.clock == nil {
+		r.clock = systemClock{}
+	}
 	r.transport = InitLocalTransport(transport)
 	r.vnodes = make([]*localVnode, config.NumVnodes)
 	r.shutdown = make(chan bool)
-	r.delegateHooks = make([]DelegateHook, 0)
+	r.events = newEventBus()
 	// initialize vnodes
 	for i := 0; i < config.NumVnodes; i++ {
 		vn := &localVnode{}
@@ -367,9 +443,41 @@ func JoinRing(config *Config, transport Transport, existing string) (*Ring, erro
 	return r, nil
 }
 
-// RegisterDelegateHook registers DelegateHook for emitting ring events.
+/*
+	Leave gracefully removes local vnodes from the ring. Each vnode stops stabilizing and hands its predecessor
+	and successors over to its neighbours, so they take over its keyspace without waiting to detect a failure.
+	Ring should not be used after Leave(), and its transport should be closed.
+*/
+func (r *Ring) Leave() error {
+	select {
+	case <-r.shutdown:
+		return fmt.Errorf("Ring has already left")
+	default:
+		close(r.shutdown)
+	}
+	if r.client != nil {
+		r.stopRefresh()
+		return nil
+	}
+	var last_err error
+	for _, vn := range r.vnodes {
+		if err := vn.leave(); err != nil {
+			r.Logf(LogInfo, "Leave() - failed to notify neighbours of %X - %s\n", vn.Id, err)
+			last_err = err
+		}
+	}
+	return last_err
+}
+
+// RegisterDelegateHook registers DelegateHook for emitting ring events. Hook is a lossless subscriber to all
+// event types, and its EmitEvent() is called for one event at a time, in order.
 func (r *Ring) RegisterDelegateHook(dh DelegateHook) {
-	r.delegateHooks = append(r.delegateHooks, dh)
+	sub := r.SubscribeLossless(0)
+	go func() {
+		for ctx := range sub.C {
+			dh.EmitEvent(ctx)
+		}
+	}()
 }
 
 type RingEventType int
@@ -378,21 +486,29 @@ var (
 	EvPredecessorJoined RingEventType = 1
 	EvPredecessorLeft   RingEventType = 2
 	EvReplicasChanged   RingEventType = 3
+	// EvSuccessorChanged - Target's immediate successor changed from SecondaryItem to PrimaryItem
+	EvSuccessorChanged RingEventType = 4
+	// EvFingerChanged - Target's finger changed from SecondaryItem to PrimaryItem
+	EvFingerChanged RingEventType = 5
+	// EvVnodeStabilized - Target completed stabilization round, ItemList holds its successors
+	EvVnodeStabilized RingEventType = 6
+	// EvVnodeIsolated - Target has no live successors on other hosts anymore (SecondaryItem was its successor before)
+	EvVnodeIsolated RingEventType = 7
+	// EvRangeGained - Target became responsible for Range, as its predecessor changed from SecondaryItem to PrimaryItem
+	EvRangeGained RingEventType = 8
+	// EvRangeLost - Target is no longer responsible for Range, as its predecessor changed from SecondaryItem to PrimaryItem
+	EvRangeLost RingEventType = 9
 )
 
-// EventCtx is a generic struct representing an event. Instance of EventCtx is emitted to DelegateHooks.
+// EventCtx is a generic struct representing an event. Instance of EventCtx is emitted to subscribers
+// and DelegateHooks. Seq is assigned when event is emitted, and is increasing within a Ring.
 type EventCtx struct {
 	EvType        RingEventType
+	Seq           uint64
 	Target        *Vnode
 	PrimaryItem   *Vnode
 	SecondaryItem *Vnode
 	ItemList      []*Vnode
+	Range         *KeyRange // set on EvRangeGained and EvRangeLost
 	ResponseCh    chan interface{}
 }
-
-// emit emits EventCtx to all registered DelegateHooks.
-func (r *Ring) emit(ctx *EventCtx) {
-	for _, dh := range r.delegateHooks {
-		go dh.EmitEvent(ctx)
-	}
-}
@@ -16,6 +16,16 @@
 	Node to node (network) communication is built on top of ZeroMQ sockets over TCP for speed, clustering
 	and reliability. Dendrite starts configurable number of goroutines (default: 10) for load balanced
 	serving of remote requests, but scales that number up and down depending on the load (aka prefork model).
+	TCPTransport is a pure Go alternative to ZMQTransport, which does not require libzmq or cgo. It speaks the same
+	message format over length-prefixed TCP frames and can be used in place of ZMQTransport everywhere.
+	When too many requests are queued, both transports refuse new ones with an "overloaded" error instead of
+	letting them pile up. Clients then back off from that peer for a while and get ErrPeerOverloaded, while
+	stabilization treats such peer as alive.
+	Ring maintenance messages (ping, notify, successor and predecessor lookups) travel in a separate control lane,
+	served by a small pool of reserved workers. They are never refused and never wait behind data messages claimed by
+	other packages, so heavy dtable traffic can not make healthy nodes look dead to their neighbours.
+	Pings carry timestamps of both sides, from which transports estimate clock offset and round-trip time of each
+	peer. Ring's PeerClocks() and ClockSkew() report them.
 
 	All messages sent through dendrite are encapsulated in ChordMsg structure, where first byte indicates message type,
 	and actual data follows. Data part is serialized with protocol buffers.
@@ -29,5 +39,27 @@
 		EvPredecessorJoined
 		EvPredecessorLeft
 		EvReplicasChanged
+		EvSuccessorChanged
+		EvFingerChanged
+		EvVnodeStabilized
+		EvVnodeIsolated
+		EvRangeGained
+		EvRangeLost
+
+	Events can also be received through Ring's Subscribe(), optionally filtered by event type, and Unsubscribe().
+	Every event carries a sequence number (Seq), and each subscriber - DelegateHooks included - receives events
+	one at a time, in the order they were emitted. Slow subscribers never block the ring, their events are queued.
+	Pending EvVnodeStabilized event is replaced by a newer one for the same vnode. Other than that, Subscribe()
+	queue is bounded, and once it is full, the oldest events are dropped. Subscription's Dropped() and Ring's
+	DroppedEvents() count them. SubscribeLossless() never drops events, its queue grows instead. DelegateHooks,
+	RangeHooks and dtable subscribe this way, as they can't afford to miss a vnode joining or leaving.
+
+	Ring's OwnedRanges() returns key ranges (predecessor, vnode] owned by local vnodes, and IsLocalOwner() checks
+	if a key belongs to one of them. Range changes are emitted as EvRangeGained and EvRangeLost events with
+	the exact range in EventCtx.Range, and can be captured with RangeHook, registered through RegisterRangeHook().
+
+	Message types are claimed explicitly with MsgTypeClaim through Transport's ClaimMsgTypes(). A claim reserves
+	a range of message types with a decoder and handler for each type, and is rejected if it overlaps with
+	an existing claim. Range 0x00-0x1F is reserved for dendrite, and dtable claims 0x20-0x3F.
 */
 package dendrite
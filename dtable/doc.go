@@ -2,9 +2,31 @@
 	Package dtable implements highly available, distributed in-memory key/value datastore.
 
 	DTable is built on top of dendrite for key distribution and high availability, replication
-	and failover. It exposes Query interface for Get() and Set() operations.
+	and failover. It exposes Query interface for Get(), Set() and Delete() operations.
 
-	It hooks on dendrite as a TransportHook and uses ZeroMQ for communication between remote nodes.
+	SetWithTTL() writes a key that expires after given duration; expired keys are removed by background reaper.
+	CompareAndSet() and SetIfAbsent() are conditional writes, checked against key's version on its primary.
+	Scan() pages through keys of the whole cluster in key hash order, with a cursor that survives ownership changes.
+	SetMulti() and GetMulti() batch multiple keys into one request per primary vnode, with per-key results.
+	Delete() writes a tombstone, which is replicated like a regular value and purged after TombstoneGrace.
+
+	Versions of a key are ordered by hybrid logical clock timestamps. New writes are timestamped by key's
+	primary, and each node merges timestamps it receives from other nodes into its own clock, so that ordering
+	does not depend on clock skew between the hosts.
+
+	Each primary vnode periodically runs anti-entropy with its replicas. Both sides build a Merkle tree over
+	the primary's key range once per sync, compare it level by level, and repair only the keys under differing
+	leaves, with the same timestamp rules as regular writes.
+
+	Replica writes that fail are kept as hints on the primary, and replayed when the replica is reachable again
+	(hinted handoff). Limits for hints are set in Config, see InitWithConfig.
+
+	When vnodes join or leave, keys are migrated and re-replicated in batches of at most Config.BatchSize items.
+
+	Tables of local vnodes are kept by a StorageEngine, set with Config.Storage. MemoryStorage keeps them
+	in memory only, while NewDiskStorage() logs each change to disk, so that tables survive restarts.
+
+	It claims its message types within dendrite's transport, which is used for communication between remote nodes.
 	All messages between the nodes are serialized with protocol buffers.
 */
 package dtable
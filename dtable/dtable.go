@@ -1,6 +1,7 @@
 package dtable
 
 import (
+	"errors"
 	"fmt"
 	"github.com/fastfn/dendrite"
 	"github.com/golang/protobuf/proto"
@@ -13,10 +14,22 @@ type dtableEventType int
 
 // KVItem is basic database item struct.
 type KVItem struct {
-	Key []byte
-	Val []byte
+	Key     []byte
+	Val     []byte
+	Version uint64 // assigned by key's primary, increases with each write to the key
 }
 
+// ErrVersionConflict is returned by conditional writes when key's current version does not match
+// the expected one.
+var ErrVersionConflict = errors.New("dtable: key version does not match expected version")
+
+// ErrClockSkew is returned by writes when key's primary refuses them because its clock is too far
+// from clocks of its peers, see Config.MaxClockSkew.
+var ErrClockSkew = errors.New("dtable: primary's clock is skewed from its peers")
+
+// ErrClosed is returned by writes once dtable is closing.
+var ErrClosed = errors.New("dtable: table is closed")
+
 type kvReplicaInfo struct {
 	master        *dendrite.Vnode
 	vnodes        []*dendrite.Vnode
@@ -27,11 +40,19 @@ type kvReplicaInfo struct {
 
 type kvItem struct {
 	KVItem
-	timestamp   time.Time
+	timestamp   hlcTimestamp
 	commited    bool
+	tombstone   bool      // item is deleted, kept until TombstoneGrace expires
+	expires     time.Time // zero if item never expires
 	keyHash     []byte
 	lock        *sync.Mutex
 	replicaInfo *kvReplicaInfo
+
+	// write requests only, not stored nor replicated:
+	// conditional writes succeed if key's current version matches (0 if key does not exist),
+	expectedVersion *uint64
+	// and new writes from Query are timestamped by key's primary
+	stamp bool
 }
 
 type demotedKvItem struct {
@@ -44,6 +65,7 @@ type dtableEvent struct {
 	evType dtableEventType
 	vnode  *dendrite.Vnode
 	item   *kvItem
+	items  []*kvItem
 }
 type itemMap map[string]*kvItem
 type demotedItemMap map[string]*demotedKvItem
@@ -51,23 +73,83 @@ type demotedItemMap map[string]*demotedKvItem
 // DTable is main dtable struct.
 type DTable struct {
 	// base structures
-	table         map[string]itemMap        // primary k/v table
-	rtable        map[string]itemMap        // rtable is table of replicas
-	demoted_table map[string]demotedItemMap // demoted items
+	table         map[string]Storage        // primary k/v table
+	rtable        map[string]Storage        // rtable is table of replicas
+	demoted_table map[string]DemotedStorage // demoted items
+	expiry        *expiryIndex              // keys with TTL of all local tables, by expiry time
 	ring          *dendrite.Ring
 	transport     dendrite.Transport
+	conf          *Config
 	confLogLevel  LogLevel
 	// communication channels
 	event_c         chan *dendrite.EventCtx // dendrite sends events here
 	dtable_c        chan *dtableEvent       // internal dtable events
 	selfcheck_t     *time.Ticker
+	antientropy_t   *time.Ticker
+	reaper_t        *time.Ticker
 	captureKeyHooks []CaptureKeyHook
+	// hinted handoff
+	hints      map[string]*hintQueue // pending hints per target vnode
+	hints_lock sync.Mutex
+	// orders version checks and writes to primary tables
+	put_lock sync.Mutex
+	clock    *hlClock
+	// replica's merkle trees for ongoing anti-entropy sessions
+	merkle_sessions map[string]*merkleSession
+	merkle_lock     sync.Mutex
+	// shutdown
+	events       *dendrite.Subscription
+	shutdown     chan struct{} // closed by Close()
+	closing      bool
+	closing_lock sync.RWMutex
+	running      sync.WaitGroup // background goroutines and in-flight writes
+}
+
+// Config holds dtable settings.
+type Config struct {
+	LogLevel     LogLevel      // logLevel, 0 = null, 1 = info, 2 = debug
+	MaxHints     int           // max number of pending hints for failed replica writes, 0 disables hinted handoff
+	HintTTL      time.Duration // hints older than this are dropped
+	HintRetryMin time.Duration // delay before first replay of hints to failed replica
+	HintRetryMax time.Duration // replay delay doubles on each failure, up to this value
+	// deleted items are kept as tombstones for this long, so that older copies of the item can't bring it back.
+	// It should be longer than HintTTL and the time it takes for failed nodes to come back.
+	TombstoneGrace time.Duration
+	// writes coordinated by this node are refused with ErrClockSkew if majority of peers' clocks
+	// is further from local clock than this (see Ring's ClockSkew()). 0 disables the check.
+	// Timestamps received from peers are not merged into local clock if they are further ahead
+	// of it than this, or 5 minutes if the check is disabled.
+	MaxClockSkew time.Duration
+	// max number of items sent in one request when keys are replicated or migrated between vnodes
+	BatchSize int
+	// engine that stores tables of local vnodes, MemoryStorage or NewDiskStorage(dir)
+	Storage StorageEngine
+}
+
+// DefaultConfig returns *Config with default values.
+func DefaultConfig() *Config {
+	return &Config{
+		LogLevel:       LogInfo,
+		MaxHints:       10000,
+		HintTTL:        1 * time.Hour,
+		HintRetryMin:   5 * time.Second,
+		HintRetryMax:   5 * time.Minute,
+		TombstoneGrace: 24 * time.Hour,
+		BatchSize:      500,
+		Storage:        MemoryStorage,
+	}
 }
 
 type CaptureKeyHook interface {
 	CaptureKeyHandler(key []byte)
 }
 
+// ExpireKeyHook can optionally be implemented by CaptureKeyHook subscribers that want to be notified
+// when a key expires. It is called on key's primary node only.
+type ExpireKeyHook interface {
+	ExpireKeyHandler(key []byte)
+}
+
 const (
 	PbDtableStatus            dendrite.MsgType = 0x20 // status request to see if remote dtable is initialized
 	PbDtableResponse          dendrite.MsgType = 0x21 // generic response
@@ -81,69 +163,156 @@ const (
 	PbDtableSetReplicaInfo    dendrite.MsgType = 0x29 // setReplicaInfo request
 	PbDtablePromoteKey        dendrite.MsgType = 0x30 // promote remote vnode for given key
 
+	PbDtableMerkleNodes         dendrite.MsgType = 0x2a // request hashes of merkle tree nodes on remote replica
+	PbDtableMerkleNodesResponse dendrite.MsgType = 0x2b // response with hashes of merkle tree nodes
+	PbDtableMerkleItems         dendrite.MsgType = 0x2c // request items under merkle tree leaves on remote replica
+	PbDtableRepairReplica       dendrite.MsgType = 0x2d // anti-entropy repair of remote replica
+	PbDtableGetMultiItem        dendrite.MsgType = 0x2e // getMultiItem request
+
+	PbDtableSetReplicaBatch     dendrite.MsgType = 0x31 // write batch of replicas to remote vnode
+	PbDtableSetReplicaInfoBatch dendrite.MsgType = 0x32 // update metadata for batch of replicated items
+	PbDtableClearReplicaBatch   dendrite.MsgType = 0x33 // remove batch of replicated or demoted items
+	PbDtableDemoteBatch         dendrite.MsgType = 0x34 // demote batch of keys to new predecessor
+	PbDtablePromoteBatch        dendrite.MsgType = 0x35 // promote remote vnode for batch of keys
+	PbDtableScan                dendrite.MsgType = 0x36 // read key hash range from remote vnode
+
+	// dtable claims message types in range [pbDtableMinMsgType, pbDtableMaxMsgType]
+	pbDtableMinMsgType dendrite.MsgType = 0x20
+	pbDtableMaxMsgType dendrite.MsgType = 0x3f
+
 	replicaStable     replicaState = 0 // all replicas commited
 	replicaPartial    replicaState = 1 // all available replicas commited but there's no enough remote nodes
 	replicaIncomplete replicaState = 2 // some of the replicas did not commit
 
-	evPromoteKey dtableEventType = 0
+	evPromoteKey  dtableEventType = 0
+	evPromoteKeys dtableEventType = 1
 )
 
-func (m itemMap) put(item *kvItem) error {
-	if oldItem, ok := m[item.keyHashString()]; ok {
-		if oldItem.timestamp.UnixNano() <= item.timestamp.UnixNano() {
-			// key exists but the record is older than new one
-			if item.Val == nil {
-				delete(m, item.keyHashString())
-			} else {
-				m[item.keyHashString()] = item
-			}
-		} else {
-			return fmt.Errorf("map.put() refused write for key %s. Record too old: %d > %d",
-				item.keyHashString(), oldItem.timestamp.UnixNano(), item.timestamp.UnixNano())
-		}
-	} else {
-		if item.Val != nil {
-			m[item.keyHashString()] = item
-		} else {
-			return fmt.Errorf("map.put() - empty value not allowed")
-		}
+// Init initializes dtable with default config and given log level, and panics if that fails. See New.
+func Init(ring *dendrite.Ring, transport dendrite.Transport, level LogLevel) *DTable {
+	conf := DefaultConfig()
+	conf.LogLevel = level
+	return InitWithConfig(ring, transport, conf)
+}
+
+// InitWithConfig initializes dtable with given config, and panics if that fails. See NewWithConfig.
+func InitWithConfig(ring *dendrite.Ring, transport dendrite.Transport, conf *Config) *DTable {
+	dt, err := NewWithConfig(ring, transport, conf)
+	if err != nil {
+		panic(err.Error())
 	}
-	return nil
+	return dt
 }
 
-// Init initializes dtable and registers with dendrite as a TransportHook and DelegateHook.
-func Init(ring *dendrite.Ring, transport dendrite.Transport, level LogLevel) *DTable {
+// New initializes dtable with default config and given log level. See NewWithConfig.
+func New(ring *dendrite.Ring, transport dendrite.Transport, level LogLevel) (*DTable, error) {
+	conf := DefaultConfig()
+	conf.LogLevel = level
+	return NewWithConfig(ring, transport, conf)
+}
+
+// NewWithConfig initializes dtable, claims dtable's message types within the transport and registers with dendrite
+// as a DelegateHook. It fails if tables of local vnodes can't be opened, or if dtable's message types are
+// already claimed by another extension.
+func NewWithConfig(ring *dendrite.Ring, transport dendrite.Transport, conf *Config) (*DTable, error) {
 	dt := &DTable{
-		table:           make(map[string]itemMap),
-		rtable:          make(map[string]itemMap),
-		demoted_table:   make(map[string]demotedItemMap),
+		table:           make(map[string]Storage),
+		rtable:          make(map[string]Storage),
+		demoted_table:   make(map[string]DemotedStorage),
+		expiry:          newExpiryIndex(),
 		ring:            ring,
 		transport:       transport,
-		confLogLevel:    level,
+		conf:            conf,
+		confLogLevel:    conf.LogLevel,
 		event_c:         make(chan *dendrite.EventCtx),
 		dtable_c:        make(chan *dtableEvent),
-		selfcheck_t:     time.NewTicker(10 * time.Minute),
 		captureKeyHooks: make([]CaptureKeyHook, 0),
+		hints:           make(map[string]*hintQueue),
+		merkle_sessions: make(map[string]*merkleSession),
+		shutdown:        make(chan struct{}),
+	}
+	max_offset := conf.MaxClockSkew
+	if max_offset <= 0 {
+		max_offset = defaultMaxClockOffset
+	}
+	dt.clock = newHLClock(max_offset, func(t hlcTimestamp, ahead time.Duration, rejected int) {
+		dt.Logf(LogInfo, "hlClock.update() - ignored %d timestamps more than %s ahead of local clock, last one %s ahead (%s)\n", rejected, max_offset, ahead, t)
+	})
+	engine := conf.Storage
+	if engine == nil {
+		engine = MemoryStorage
 	}
 	// each local vnode needs to be separate key in dtable
 	for _, vnode := range ring.MyVnodes() {
-		node_kv := make(map[string]*kvItem)
-		node_rkv := make(map[string]*kvItem)
-		node_demoted := make(map[string]*demotedKvItem)
+		node_kv, node_rkv, node_demoted, err := engine.Open(vnode)
+		if err != nil {
+			dt.Close()
+			return nil, fmt.Errorf("dtable: failed to open tables of vnode %x - %s", vnode.Id, err)
+		}
 		vn_key_str := fmt.Sprintf("%x", vnode.Id)
-		dt.table[vn_key_str] = node_kv
-		dt.rtable[vn_key_str] = node_rkv
-		dt.demoted_table[vn_key_str] = node_demoted
+		dt.table[vn_key_str] = &expiringStorage{Storage: node_kv, index: dt.expiry, kind: primaryTable, vn_key_str: vn_key_str}
+		dt.rtable[vn_key_str] = &expiringStorage{Storage: node_rkv, index: dt.expiry, kind: replicaTable, vn_key_str: vn_key_str}
+		dt.demoted_table[vn_key_str] = &expiringDemotedStorage{DemotedStorage: node_demoted, index: dt.expiry, vn_key_str: vn_key_str}
+		// stored items may be ahead of local clock, and may expire
+		for kind, vn_table := range map[tableKind]Storage{primaryTable: node_kv, replicaTable: node_rkv} {
+			vn_table.ForEach(func(key_str string, item *kvItem) bool {
+				dt.clock.update(item.timestamp)
+				dt.expiry.add(kind, vn_key_str, item)
+				return true
+			})
+		}
+		node_demoted.ForEach(func(key_str string, demoted_item *demotedKvItem) bool {
+			dt.expiry.add(demotedTable, vn_key_str, demoted_item.item)
+			return true
+		})
+	}
+	if err := transport.ClaimMsgTypes(dt.msgTypeClaim()); err != nil {
+		dt.Close()
+		return nil, fmt.Errorf("dtable: %s", err)
 	}
-	transport.RegisterHook(dt)
+	dt.selfcheck_t = time.NewTicker(10 * time.Minute)
+	dt.antientropy_t = time.NewTicker(antiEntropyInterval)
+	dt.reaper_t = time.NewTicker(reapInterval)
+	// subscribe only to events delegator cares about. Missing one would skip a key migration, so none are dropped
+	dt.events = ring.SubscribeLossless(0, dendrite.EvPredecessorJoined, dendrite.EvPredecessorLeft, dendrite.EvReplicasChanged)
+	dt.running.Add(3)
 	go dt.delegator()
-	ring.RegisterDelegateHook(dt)
-	return dt
+	go dt.hintReplayer()
+	go func() {
+		defer dt.running.Done()
+		for event := range dt.events.C {
+			dt.EmitEvent(event)
+		}
+	}()
+	return dt, nil
 }
 
 // EmitEvent implements dendrite's DelegateHook.
 func (dt *DTable) EmitEvent(ctx *dendrite.EventCtx) {
-	dt.event_c <- ctx
+	select {
+	case dt.event_c <- ctx:
+	case <-dt.shutdown:
+	}
+}
+
+// emitInternal sends internal event to delegator, unless dtable is closing.
+func (dt *DTable) emitInternal(ev *dtableEvent) {
+	select {
+	case dt.dtable_c <- ev:
+	case <-dt.shutdown:
+	}
+}
+
+// begin registers an in-flight write, which Close() waits for. It returns false once dtable is closing,
+// in which case the write must not start. Each successful begin() is paired with running.Done().
+func (dt *DTable) begin() bool {
+	dt.closing_lock.RLock()
+	defer dt.closing_lock.RUnlock()
+	if dt.closing {
+		return false
+	}
+	dt.running.Add(1)
+	return true
 }
 
 func (dt *DTable) RegisterCaptureKeyHook(hook CaptureKeyHook) {
@@ -151,109 +320,180 @@ func (dt *DTable) RegisterCaptureKeyHook(hook CaptureKeyHook) {
 }
 
 func (dt *DTable) callHooks(item *kvItem) {
-	if item.Val != nil {
+	if item.Val != nil && !item.tombstone {
 		for _, hook := range dt.captureKeyHooks {
 			hook.CaptureKeyHandler(item.Key)
 		}
 	}
 }
 
-// Decode implements dendrite's TransportHook.
-func (dt *DTable) Decode(data []byte) (*dendrite.ChordMsg, error) {
-	data_len := len(data)
-	if data_len == 0 {
-		return nil, fmt.Errorf("data too short: %d", len(data))
+// msgTypeClaim returns dtable's claim over its range of message types, together with decoders
+// and request handlers for each of them.
+func (dt *DTable) msgTypeClaim() *dendrite.MsgTypeClaim {
+	return &dendrite.MsgTypeClaim{
+		Owner: "dtable",
+		Min:   pbDtableMinMsgType,
+		Max:   pbDtableMaxMsgType,
+		Handlers: map[dendrite.MsgType]*dendrite.MsgTypeHandler{
+			PbDtableStatus:              {Decoder: decodeStatus, Handler: dt.zmq_status_handler},
+			PbDtableResponse:            {Decoder: decodeResponse},
+			PbDtableItem:                {Decoder: decodeItem},
+			PbDtableMultiItemResponse:   {Decoder: decodeMultiItemResponse},
+			PbDtableGetItem:             {Decoder: decodeGetItem, Handler: dt.zmq_get_handler},
+			PbDtableSetItem:             {Decoder: decodeSetItem, Handler: dt.zmq_set_handler},
+			PbDtableClearReplica:        {Decoder: decodeClearReplica, Handler: dt.zmq_clearreplica_handler},
+			PbDtableSetReplica:          {Decoder: decodeSetItem, Handler: dt.zmq_setReplica_handler},
+			PbDtableSetReplicaInfo:      {Decoder: decodeSetReplicaInfo, Handler: dt.zmq_setReplicaInfo_handler},
+			PbDtablePromoteKey:          {Decoder: decodePromoteKey, Handler: dt.zmq_promoteKey_handler},
+			PbDtableMerkleNodes:         {Decoder: decodeMerkleNodes, Handler: dt.zmq_merkleNodes_handler},
+			PbDtableMerkleNodesResponse: {Decoder: decodeMerkleNodesResponse},
+			PbDtableMerkleItems:         {Decoder: decodeMerkleNodes, Handler: dt.zmq_merkleItems_handler},
+			PbDtableRepairReplica:       {Decoder: decodeSetMultiItem, Handler: dt.zmq_repairReplica_handler},
+			PbDtableSetMultiItem:        {Decoder: decodeSetMultiItem, Handler: dt.zmq_setMulti_handler},
+			PbDtableGetMultiItem:        {Decoder: decodeGetMultiItem, Handler: dt.zmq_getMulti_handler},
+			PbDtableSetReplicaBatch:     {Decoder: decodeSetMultiItem, Handler: dt.zmq_setReplicaBatch_handler},
+			PbDtableSetReplicaInfoBatch: {Decoder: decodeSetReplicaInfoBatch, Handler: dt.zmq_setReplicaInfoBatch_handler},
+			PbDtableClearReplicaBatch:   {Decoder: decodeClearReplicaBatch, Handler: dt.zmq_clearReplicaBatch_handler},
+			PbDtableDemoteBatch:         {Decoder: decodeSetMultiItem, Handler: dt.zmq_demoteBatch_handler},
+			PbDtablePromoteBatch:        {Decoder: decodeSetMultiItem, Handler: dt.zmq_promoteBatch_handler},
+			PbDtableScan:                {Decoder: decodeScan, Handler: dt.zmq_scan_handler},
+		},
 	}
+}
 
-	cm := &dendrite.ChordMsg{Type: dendrite.MsgType(data[0])}
+func decodeStatus(data []byte) (interface{}, error) {
+	var dtableStatusMsg PBDTableStatus
+	if err := proto.Unmarshal(data, &dtableStatusMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableStatus message - %s", err)
+	}
+	return dtableStatusMsg, nil
+}
 
-	if data_len > 1 {
-		cm.Data = data[1:]
+func decodeResponse(data []byte) (interface{}, error) {
+	var dtableResponseMsg PBDTableResponse
+	if err := proto.Unmarshal(data, &dtableResponseMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableResponse message - %s", err)
 	}
+	return dtableResponseMsg, nil
+}
 
-	// parse the data and set the handler
-	switch cm.Type {
-	case PbDtableStatus:
-		var dtableStatusMsg PBDTableStatus
-		err := proto.Unmarshal(cm.Data, &dtableStatusMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableStatus message - %s", err)
-		}
-		cm.TransportMsg = dtableStatusMsg
-		cm.TransportHandler = dt.zmq_status_handler
-	case PbDtableGetItem:
-		var dtableGetItemMsg PBDTableGetItem
-		err := proto.Unmarshal(cm.Data, &dtableGetItemMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableGetItem message - %s", err)
-		}
-		cm.TransportMsg = dtableGetItemMsg
-		cm.TransportHandler = dt.zmq_get_handler
-	case PbDtableItem:
-		var dtableItemMsg PBDTableItem
-		err := proto.Unmarshal(cm.Data, &dtableItemMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableItem message - %s", err)
-		}
-		cm.TransportMsg = dtableItemMsg
-	case PbDtableSetItem:
-		var dtableSetItemMsg PBDTableSetItem
-		err := proto.Unmarshal(cm.Data, &dtableSetItemMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableSetItem message - %s", err)
-		}
-		cm.TransportMsg = dtableSetItemMsg
-		cm.TransportHandler = dt.zmq_set_handler
-	case PbDtableSetReplicaInfo:
-		var dtableSetReplicaInfoMsg PBDTableSetReplicaInfo
-		err := proto.Unmarshal(cm.Data, &dtableSetReplicaInfoMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableSetReplicaInfo message - %s", err)
-		}
-		cm.TransportMsg = dtableSetReplicaInfoMsg
-		cm.TransportHandler = dt.zmq_setReplicaInfo_handler
-	case PbDtableClearReplica:
-		var dtableClearReplicaMsg PBDTableClearReplica
-		err := proto.Unmarshal(cm.Data, &dtableClearReplicaMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableClearReplica message - %s", err)
-		}
-		cm.TransportMsg = dtableClearReplicaMsg
-		cm.TransportHandler = dt.zmq_clearreplica_handler
-	case PbDtableSetReplica:
-		var dtableSetReplicaMsg PBDTableSetItem
-		err := proto.Unmarshal(cm.Data, &dtableSetReplicaMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableSetReplica message - %s", err)
-		}
-		cm.TransportMsg = dtableSetReplicaMsg
-		cm.TransportHandler = dt.zmq_setReplica_handler
-	case PbDtablePromoteKey:
-		var dtablePromoteKeyMsg PBDTablePromoteKey
-		err := proto.Unmarshal(cm.Data, &dtablePromoteKeyMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTablePromoteKey message - %s", err)
-		}
-		cm.TransportMsg = dtablePromoteKeyMsg
-		cm.TransportHandler = dt.zmq_promoteKey_handler
-	case PbDtableResponse:
-		var dtableResponseMsg PBDTableResponse
-		err := proto.Unmarshal(cm.Data, &dtableResponseMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBDTableResponse message - %s", err)
-		}
-		cm.TransportMsg = dtableResponseMsg
-	default:
-		// must return unknownType error
-		//fmt.Printf("GOT UNKNOWN!!!!!!! %x - %x\n", cm.Type, byte(cm.Type))
-		var rv dendrite.ErrHookUnknownType = "unknown request type"
-		return nil, rv
+func decodeItem(data []byte) (interface{}, error) {
+	var dtableItemMsg PBDTableItem
+	if err := proto.Unmarshal(data, &dtableItemMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableItem message - %s", err)
+	}
+	return dtableItemMsg, nil
+}
+
+func decodeMultiItemResponse(data []byte) (interface{}, error) {
+	var dtableMultiItemResponseMsg PBDTableMultiItemResponse
+	if err := proto.Unmarshal(data, &dtableMultiItemResponseMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableMultiItemResponse message - %s", err)
+	}
+	return dtableMultiItemResponseMsg, nil
+}
+
+func decodeGetItem(data []byte) (interface{}, error) {
+	var dtableGetItemMsg PBDTableGetItem
+	if err := proto.Unmarshal(data, &dtableGetItemMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableGetItem message - %s", err)
+	}
+	return dtableGetItemMsg, nil
+}
+
+func decodeSetItem(data []byte) (interface{}, error) {
+	var dtableSetItemMsg PBDTableSetItem
+	if err := proto.Unmarshal(data, &dtableSetItemMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableSetItem message - %s", err)
+	}
+	return dtableSetItemMsg, nil
+}
+
+func decodeSetMultiItem(data []byte) (interface{}, error) {
+	var dtableSetMultiItemMsg PBDTableSetMultiItem
+	if err := proto.Unmarshal(data, &dtableSetMultiItemMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableSetMultiItem message - %s", err)
+	}
+	return dtableSetMultiItemMsg, nil
+}
+
+func decodeGetMultiItem(data []byte) (interface{}, error) {
+	var dtableGetMultiItemMsg PBDTableGetMultiItem
+	if err := proto.Unmarshal(data, &dtableGetMultiItemMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableGetMultiItem message - %s", err)
+	}
+	return dtableGetMultiItemMsg, nil
+}
+
+func decodeScan(data []byte) (interface{}, error) {
+	var dtableScanMsg PBDTableScan
+	if err := proto.Unmarshal(data, &dtableScanMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableScan message - %s", err)
+	}
+	return dtableScanMsg, nil
+}
+
+func decodeClearReplica(data []byte) (interface{}, error) {
+	var dtableClearReplicaMsg PBDTableClearReplica
+	if err := proto.Unmarshal(data, &dtableClearReplicaMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableClearReplica message - %s", err)
+	}
+	return dtableClearReplicaMsg, nil
+}
+
+func decodeClearReplicaBatch(data []byte) (interface{}, error) {
+	var dtableClearReplicaBatchMsg PBDTableClearReplicaBatch
+	if err := proto.Unmarshal(data, &dtableClearReplicaBatchMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableClearReplicaBatch message - %s", err)
+	}
+	return dtableClearReplicaBatchMsg, nil
+}
+
+func decodeSetReplicaInfoBatch(data []byte) (interface{}, error) {
+	var dtableSetReplicaInfoBatchMsg PBDTableSetReplicaInfoBatch
+	if err := proto.Unmarshal(data, &dtableSetReplicaInfoBatchMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableSetReplicaInfoBatch message - %s", err)
+	}
+	return dtableSetReplicaInfoBatchMsg, nil
+}
+
+func decodeSetReplicaInfo(data []byte) (interface{}, error) {
+	var dtableSetReplicaInfoMsg PBDTableSetReplicaInfo
+	if err := proto.Unmarshal(data, &dtableSetReplicaInfoMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableSetReplicaInfo message - %s", err)
 	}
-	return cm, nil
+	return dtableSetReplicaInfoMsg, nil
 }
 
-// get returns value for a given key
-func (dt *DTable) get(reqItem *kvItem) (*kvItem, error) {
+func decodePromoteKey(data []byte) (interface{}, error) {
+	var dtablePromoteKeyMsg PBDTablePromoteKey
+	if err := proto.Unmarshal(data, &dtablePromoteKeyMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTablePromoteKey message - %s", err)
+	}
+	return dtablePromoteKeyMsg, nil
+}
+
+func decodeMerkleNodes(data []byte) (interface{}, error) {
+	var dtableMerkleNodesMsg PBDTableMerkleNodes
+	if err := proto.Unmarshal(data, &dtableMerkleNodesMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableMerkleNodes message - %s", err)
+	}
+	return dtableMerkleNodesMsg, nil
+}
+
+func decodeMerkleNodesResponse(data []byte) (interface{}, error) {
+	var dtableMerkleNodesResponseMsg PBDTableMerkleNodesResponse
+	if err := proto.Unmarshal(data, &dtableMerkleNodesResponseMsg); err != nil {
+		return nil, fmt.Errorf("error decoding PBDTableMerkleNodesResponse message - %s", err)
+	}
+	return dtableMerkleNodesResponseMsg, nil
+}
+
+// get returns value for a given key. With minReads above 1, it's read with getConsistent().
+func (dt *DTable) get(reqItem *kvItem, minReads int) (*kvItem, error) {
+	if minReads > 1 {
+		return dt.getConsistent(reqItem, minReads)
+	}
 	succs, err := dt.ring.Lookup(3, reqItem.keyHash)
 	if err != nil {
 		return nil, err
@@ -262,15 +502,14 @@ func (dt *DTable) get(reqItem *kvItem) (*kvItem, error) {
 	vn_table, ok := dt.table[succs[0].String()]
 	key_str := reqItem.keyHashString()
 	if ok {
-		if item, exists := vn_table[key_str]; exists && item.commited {
-			return item.dup(), nil
-		} else {
-			return nil, nil
-		}
+		return primaryItem(vn_table, key_str), nil
 	} else {
 		// check against replica tables
 		for _, rtable := range dt.rtable {
-			if item, exists := rtable[key_str]; exists && item.replicaInfo.state == replicaIncomplete {
+			if item, exists := rtable.Get(key_str); exists && item.replicaInfo.state == replicaIncomplete {
+				if item.tombstone || item.expired() {
+					return nil, nil
+				}
 				return item, nil
 			}
 		}
@@ -279,28 +518,30 @@ func (dt *DTable) get(reqItem *kvItem) (*kvItem, error) {
 	// make remote call to all successors
 	var last_err error
 	for _, succ := range succs {
-		respItem, _, err := dt.remoteGet(succ, reqItem)
+		respItem, _, err := dt.remoteGet(succ, reqItem, false)
 		if err != nil {
 			last_err = err
-			dt.Logln(LogDebug, "ZMQ::remoteGet error - ", err)
+			dt.Logln(LogDebug, "remoteGet error - ", err)
 			continue
 		}
+		if respItem != nil && (respItem.tombstone || respItem.expired()) {
+			return nil, nil
+		}
 		return respItem, nil
 	}
 	return nil, last_err
 }
 
 // handle remote replica requests
-func (dt *DTable) setReplica(vnode *dendrite.Vnode, item *kvItem) {
+func (dt *DTable) setReplica(vnode *dendrite.Vnode, item *kvItem) error {
 	key_str := item.keyHashString()
-	if item.Val == nil {
+	if item.Val == nil && !item.tombstone {
 		//log.Println("SetReplica() - value for key", key_str, "is nil, removing item")
-		delete(dt.rtable[vnode.String()], key_str)
-	} else {
-		//log.Println("SetReplica() - success for key", key_str)
-		item.commited = true
-		dt.rtable[vnode.String()][key_str] = item
+		return dt.rtable[vnode.String()].Delete(key_str)
 	}
+	//log.Println("SetReplica() - success for key", key_str)
+	item.commited = true
+	return dt.rtable[vnode.String()].Put(item)
 }
 
 /* set writes to dtable's primary(non-replica table). It is called from both Query api and
@@ -310,12 +551,21 @@ It reports back on done chan when minAcks is reached so that clients can continu
 blocking while replication takes place.
 */
 func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan error) {
+	if !dt.begin() {
+		done <- ErrClosed
+		return
+	}
+	defer dt.running.Done()
 	// make sure we have local handler before doing any write
 	handler, _ := dt.transport.GetVnodeHandler(vn)
 	if handler == nil {
 		done <- fmt.Errorf("local handler could not be found for vnode %x", vn.Id)
 		return
 	}
+	if err := dt.checkClockSkew(); err != nil {
+		done <- err
+		return
+	}
 	write_count := 0
 	vn_table, _ := dt.table[vn.String()]
 
@@ -323,7 +573,7 @@ func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan e
 	defer item.lock.Unlock()
 
 	item.replicaInfo.master = vn
-	err := vn_table.put(item)
+	previous, err := dt.putVersioned(vn_table, item)
 	if err != nil {
 		done <- err
 		return
@@ -340,6 +590,7 @@ func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan e
 		if dt.ring.Replicas() == repwrite_count {
 			item.replicaInfo.state = replicaStable
 			item.commited = true
+			dt.persist(vn_table, item)
 			done <- nil
 			dt.callHooks(item)
 			return
@@ -356,14 +607,14 @@ func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan e
 			done <- fmt.Errorf("could not find replica nodes due to error %s", err)
 		}
 		dt.Logf(LogDebug, "could not find replica nodes due to error %s\n", err)
-		dt.rollback(vn, item)
+		dt.rollback(vn, item, previous, nil)
 		return
 	}
 
 	// don't write any replica if not enough replica nodes have been found for requested consistency
 	if minAcks > len(remote_succs)+1 {
 		done <- fmt.Errorf("insufficient nodes found for requested consistency level (%d)\n", minAcks)
-		dt.rollback(vn, item)
+		dt.rollback(vn, item, previous, nil)
 		return
 	}
 
@@ -376,6 +627,7 @@ func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan e
 		err := dt.remoteWriteReplica(vn, succ, repl_item)
 		if err != nil {
 			dt.Logf(LogDebug, "could not write replica due to error: %s\n", err)
+			dt.storeHint(vn, succ, item)
 			continue
 		}
 		item_replicas = append(item_replicas, succ)
@@ -384,7 +636,7 @@ func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan e
 	// check if we have enough written replicas for requested minAcks
 	if minAcks > len(item_replicas)+1 {
 		done <- fmt.Errorf("insufficient active nodes found for requested consistency level (%d)\n", minAcks)
-		dt.rollback(vn, item)
+		dt.rollback(vn, item, previous, item_replicas)
 		return
 	}
 
@@ -412,7 +664,7 @@ func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan e
 			fail_count++
 			if !returned && len(item_replicas)-fail_count < minAcks {
 				done <- fmt.Errorf("insufficient (phase2) active nodes found for requested consistency level (%d)\n", minAcks)
-				dt.rollback(vn, item)
+				dt.rollback(vn, item, previous, item_replicas)
 				return
 			}
 			continue
@@ -428,20 +680,110 @@ func (dt *DTable) set(vn *dendrite.Vnode, item *kvItem, minAcks int, done chan e
 	}
 	item.replicaInfo.state = target_state
 	item.commited = true
+	dt.persist(vn_table, item)
 	dt.callHooks(item)
 
 }
 
-// rollback is called on failed set()
-func (dt *DTable) rollback(vn *dendrite.Vnode, item *kvItem) {
-	if item.replicaInfo != nil {
-		for _, replica := range item.replicaInfo.vnodes {
-			if replica != nil {
-				dt.remoteClearReplica(replica, item, false)
+/* putVersioned writes item to primary table, with version next to key's current version. If item has
+expectedVersion set, ErrVersionConflict is returned unless it matches current version of the key, which
+is 0 if key does not exist, is deleted or expired. New writes from Query get their timestamp from primary's
+clock, so that they are ordered after the current item. Item that was replaced, if any, is returned,
+so that the write can be rolled back.
+
+Current item's lock is held during the check, so that new write waits for the previous write to the same key
+to finish, and the check and the write are done atomically. Caller holds item's lock.
+*/
+func (dt *DTable) putVersioned(vn_table Storage, item *kvItem) (*kvItem, error) {
+	key_str := item.keyHashString()
+	for {
+		current, exists := vn_table.Get(key_str)
+		if exists && current.lock != nil && current.lock != item.lock {
+			current.lock.Lock()
+		}
+		dt.put_lock.Lock()
+		latest, latest_exists := vn_table.Get(key_str)
+		if latest_exists != exists || latest != current {
+			// key was written while we were waiting for its lock
+			dt.put_lock.Unlock()
+			if exists && current.lock != nil && current.lock != item.lock {
+				current.lock.Unlock()
 			}
+			continue
+		}
+		err := dt.checkVersion(current, item)
+		if err == nil {
+			if item.stamp {
+				if exists {
+					dt.clock.update(current.timestamp)
+				}
+				item.timestamp = dt.clock.now()
+			}
+			err = putItem(vn_table, item)
+		}
+		dt.put_lock.Unlock()
+		if exists && current.lock != nil && current.lock != item.lock {
+			current.lock.Unlock()
+		}
+		if !exists {
+			current = nil
 		}
+		return current, err
 	}
-	delete(dt.table[vn.String()], item.keyHashString())
+}
+
+// checkVersion checks item's write condition against current item, which is nil if key does not exist,
+// and assigns item's version.
+func (dt *DTable) checkVersion(current, item *kvItem) error {
+	var current_version, visible_version uint64
+	if current != nil {
+		current_version = current.Version
+		if !current.tombstone && !current.expired() {
+			visible_version = current.Version
+		}
+	}
+	if item.expectedVersion != nil && *item.expectedVersion != visible_version {
+		return ErrVersionConflict
+	}
+	// items written by repairs already carry their version
+	if item.Version <= current_version {
+		item.Version = current_version + 1
+	}
+	return nil
+}
+
+/* rollback is called on failed set(). It clears replicas that were written, and puts previous item of the key
+back to primary table, or removes the key if it did not exist, unless the key was overwritten in the meantime.
+Previous item keeps its version and timestamp. If any replicas were written, previous item is replicated
+again, as the failed write may have overwritten its replicas. Caller holds item's lock.
+*/
+func (dt *DTable) rollback(vn *dendrite.Vnode, item *kvItem, previous *kvItem, replicas []*dendrite.Vnode) {
+	for _, replica := range replicas {
+		dt.remoteClearReplica(replica, item, false)
+	}
+	vn_table := dt.table[vn.String()]
+	key_str := item.keyHashString()
+	dt.put_lock.Lock()
+	if current, ok := vn_table.Get(key_str); !ok || current != item {
+		dt.put_lock.Unlock()
+		return
+	}
+	if previous == nil {
+		vn_table.Delete(key_str)
+		dt.put_lock.Unlock()
+		return
+	}
+	vn_table.Put(previous)
+	dt.put_lock.Unlock()
+	if len(replicas) == 0 {
+		return
+	}
+
+	if previous.lock != nil && previous.lock != item.lock {
+		previous.lock.Lock()
+		defer previous.lock.Unlock()
+	}
+	dt.replicateKey(vn, previous, dt.ring.Replicas())
 }
 
 // DumpStr dumps dtable keys per vnode on stdout. Mostly used for debugging.
@@ -449,35 +791,86 @@ func (dt *DTable) DumpStr() {
 	fmt.Println("Dumping DTABLE")
 	for vn_id, vn_table := range dt.table {
 		fmt.Printf("\tvnode: %s\n", vn_id)
-		for key, item := range vn_table {
-			fmt.Printf("\t\t%s - %s - %v - commited:%v\n", key, item.Val, item.replicaInfo.state, item.commited)
-		}
-		rt, _ := dt.rtable[vn_id]
-		for key, item := range rt {
-			fmt.Printf("\t\t- r%d - %s - %s - %d - commited:%v\n", item.replicaInfo.depth, key, item.Val, item.replicaInfo.state, item.commited)
-		}
-		for key, item := range dt.demoted_table[vn_id] {
+		vn_table.ForEach(func(key string, item *kvItem) bool {
+			fmt.Printf("\t\t%s - %s - %v - commited:%v tombstone:%v\n", key, item.Val, item.replicaInfo.state, item.commited, item.tombstone)
+			return true
+		})
+		dt.rtable[vn_id].ForEach(func(key string, item *kvItem) bool {
+			fmt.Printf("\t\t- r%d - %s - %s - %d - commited:%v tombstone:%v\n", item.replicaInfo.depth, key, item.Val, item.replicaInfo.state, item.commited, item.tombstone)
+			return true
+		})
+		dt.demoted_table[vn_id].ForEach(func(key string, item *demotedKvItem) bool {
 			fmt.Printf("\t\t- d - %s - %s - %v\n", key, item.new_master.String(), item.demoted_ts)
-		}
+			return true
+		})
 	}
 }
 
-// processDemoteKey is called when our successor is demoting key to us.
-// We fix replicas for the key and when we're done we make a call to origin
-// (old primary for this key) to clear demotedItem there.
-func (dt *DTable) processDemoteKey(vnode, origin, old_master *dendrite.Vnode, reqItem *kvItem) {
-	// find the key in our primary table
-	key_str := reqItem.keyHashString()
-	if _, ok := dt.table[vnode.String()][key_str]; ok {
-		dt.replicateKey(vnode, reqItem, dt.ring.Replicas())
+/*
+	Close stops dtable's background work and closes tables of local vnodes. New writes are refused with
+	ErrClosed, while Close waits for in-flight ones and for the work already in progress (such as key migration)
+	to complete. It should be called when node is shutting down, before the transport is closed, after which
+	dtable should no longer be used. Subsequent calls do nothing.
+*/
+func (dt *DTable) Close() error {
+	dt.closing_lock.Lock()
+	if dt.closing {
+		dt.closing_lock.Unlock()
+		return nil
+	}
+	dt.closing = true
+	close(dt.shutdown)
+	dt.closing_lock.Unlock()
 
-		// now clear demoted item on origin
-		err := dt.remoteClearReplica(origin, reqItem, true)
-		if err != nil {
-			dt.Logf(LogInfo, "processDemoteKey() - failed while removing demoted key from origin %x for key %s\n", origin.Id, key_str)
+	if dt.events != nil {
+		dt.ring.Unsubscribe(dt.events)
+	}
+	for _, ticker := range []*time.Ticker{dt.selfcheck_t, dt.antientropy_t, dt.reaper_t} {
+		if ticker != nil {
+			ticker.Stop()
 		}
-	} else {
-		dt.Logln(LogInfo, "processDemoteKey failed - key not found:", key_str)
+	}
+	dt.running.Wait()
+
+	var last_err error
+	for vn_id := range dt.table {
+		for _, err := range []error{dt.table[vn_id].Close(), dt.rtable[vn_id].Close(), dt.demoted_table[vn_id].Close()} {
+			if err != nil {
+				last_err = err
+			}
+		}
+	}
+	return last_err
+}
+
+// processDemoteKeys is called when our successor is demoting batch of keys to us.
+// We fix replicas for the keys and when we're done we make a call to origin
+// (old primary for these keys) to clear demotedItems there.
+func (dt *DTable) processDemoteKeys(vnode, origin *dendrite.Vnode, items []*kvItem) {
+	if !dt.begin() {
 		return
 	}
+	defer dt.running.Done()
+	// find the keys in our primary table
+	vn_table := dt.table[vnode.String()]
+	found := make([]*kvItem, 0, len(items))
+	for _, reqItem := range items {
+		if item, ok := vn_table.Get(reqItem.keyHashString()); ok {
+			found = append(found, item)
+		} else {
+			dt.Logln(LogInfo, "processDemoteKeys failed - key not found:", reqItem.keyHashString())
+		}
+	}
+	dt.inBatches(found, func(batch []*kvItem) {
+		lockItems(batch)
+		dt.replicateKeys(vnode, batch, dt.ring.Replicas())
+		unlockItems(batch)
+
+		// now clear demoted items on origin
+		for idx, err := range dt.remoteClearReplicas(origin, batch, true) {
+			if err != nil {
+				dt.Logf(LogInfo, "processDemoteKeys() - failed while removing demoted key from origin %x for key %s\n", origin.Id, batch[idx].keyHashString())
+			}
+		}
+	})
 }
@@ -12,6 +12,10 @@ var _ = math.Inf
 type PBDTableResponse struct {
 	Ok               *bool   `protobuf:"varint,1,req,name=ok" json:"ok,omitempty"`
 	Error            *string `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
+	Conflict         *bool   `protobuf:"varint,3,opt,name=conflict" json:"conflict,omitempty"`
+	ClockWall        *int64  `protobuf:"varint,4,opt,name=clockWall" json:"clockWall,omitempty"`
+	ClockLogical     *int32  `protobuf:"varint,5,opt,name=clockLogical" json:"clockLogical,omitempty"`
+	ClockSkew        *bool   `protobuf:"varint,6,opt,name=clockSkew" json:"clockSkew,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -33,6 +37,34 @@ func (m *PBDTableResponse) GetError() string {
 	return ""
 }
 
+func (m *PBDTableResponse) GetConflict() bool {
+	if m != nil && m.Conflict != nil {
+		return *m.Conflict
+	}
+	return false
+}
+
+func (m *PBDTableResponse) GetClockWall() int64 {
+	if m != nil && m.ClockWall != nil {
+		return *m.ClockWall
+	}
+	return 0
+}
+
+func (m *PBDTableResponse) GetClockLogical() int32 {
+	if m != nil && m.ClockLogical != nil {
+		return *m.ClockLogical
+	}
+	return 0
+}
+
+func (m *PBDTableResponse) GetClockSkew() bool {
+	if m != nil && m.ClockSkew != nil {
+		return *m.ClockSkew
+	}
+	return false
+}
+
 // PBDTableStatus is a message to request the status of remote vnode.
 type PBDTableStatus struct {
 	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
@@ -109,6 +141,10 @@ type PBDTableItem struct {
 	ReplicaInfo      *PBDTableReplicaInfo   `protobuf:"bytes,6,opt,name=replicaInfo" json:"replicaInfo,omitempty"`
 	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,7,opt,name=origin" json:"origin,omitempty"`
 	Found            *bool                  `protobuf:"varint,8,opt,name=found" json:"found,omitempty"`
+	Tombstone        *bool                  `protobuf:"varint,9,opt,name=tombstone" json:"tombstone,omitempty"`
+	Expires          *int64                 `protobuf:"varint,10,opt,name=expires" json:"expires,omitempty"`
+	Version          *uint64                `protobuf:"varint,11,opt,name=version" json:"version,omitempty"`
+	Logical          *int32                 `protobuf:"varint,12,opt,name=logical" json:"logical,omitempty"`
 	XXX_unrecognized []byte                 `json:"-"`
 }
 
@@ -172,11 +208,40 @@ func (m *PBDTableItem) GetFound() bool {
 	return false
 }
 
+func (m *PBDTableItem) GetTombstone() bool {
+	if m != nil && m.Tombstone != nil {
+		return *m.Tombstone
+	}
+	return false
+}
+
+func (m *PBDTableItem) GetExpires() int64 {
+	if m != nil && m.Expires != nil {
+		return *m.Expires
+	}
+	return 0
+}
+
+func (m *PBDTableItem) GetVersion() uint64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *PBDTableItem) GetLogical() int32 {
+	if m != nil && m.Logical != nil {
+		return *m.Logical
+	}
+	return 0
+}
+
 // PBDTableDemotedItem message represents demotedItem's structure.
 type PBDTableDemotedItem struct {
 	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
 	Item             *PBDTableItem          `protobuf:"bytes,2,req,name=item" json:"item,omitempty"`
 	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,3,opt,name=origin" json:"origin,omitempty"`
+	DemotedTs        *int64                 `protobuf:"varint,4,opt,name=demotedTs" json:"demotedTs,omitempty"`
 	XXX_unrecognized []byte                 `json:"-"`
 }
 
@@ -205,10 +270,19 @@ func (m *PBDTableDemotedItem) GetOrigin() *dendrite.PBProtoVnode {
 	return nil
 }
 
+func (m *PBDTableDemotedItem) GetDemotedTs() int64 {
+	if m != nil && m.DemotedTs != nil {
+		return *m.DemotedTs
+	}
+	return 0
+}
+
 // PBDTableMultiItemResponse is a response message used to send multiple kvItems to the caller.
+// For batch requests, items and errors are in the same order as requested keys, with empty error on success.
 type PBDTableMultiItemResponse struct {
 	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,1,opt,name=origin" json:"origin,omitempty"`
 	Items            []*PBDTableItem        `protobuf:"bytes,2,rep,name=items" json:"items,omitempty"`
+	Errors           []string               `protobuf:"bytes,3,rep,name=errors" json:"errors,omitempty"`
 	XXX_unrecognized []byte                 `json:"-"`
 }
 
@@ -230,11 +304,53 @@ func (m *PBDTableMultiItemResponse) GetItems() []*PBDTableItem {
 	return nil
 }
 
+func (m *PBDTableMultiItemResponse) GetErrors() []string {
+	if m != nil {
+		return m.Errors
+	}
+	return nil
+}
+
+// PBDTableGetMultiItem is a request message used to get multiple items from remote primary vnode.
+type PBDTableGetMultiItem struct {
+	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
+	KeyHashes        [][]byte               `protobuf:"bytes,2,rep,name=keyHashes" json:"keyHashes,omitempty"`
+	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,3,opt,name=origin" json:"origin,omitempty"`
+	XXX_unrecognized []byte                 `json:"-"`
+}
+
+func (m *PBDTableGetMultiItem) Reset()         { *m = PBDTableGetMultiItem{} }
+func (m *PBDTableGetMultiItem) String() string { return proto.CompactTextString(m) }
+func (*PBDTableGetMultiItem) ProtoMessage()    {}
+
+func (m *PBDTableGetMultiItem) GetDest() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Dest
+	}
+	return nil
+}
+
+func (m *PBDTableGetMultiItem) GetKeyHashes() [][]byte {
+	if m != nil {
+		return m.KeyHashes
+	}
+	return nil
+}
+
+func (m *PBDTableGetMultiItem) GetOrigin() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Origin
+	}
+	return nil
+}
+
 // PBDTableGetItem is a request message used to get an item from remote vnode.
+// If replica is set, item is read from vnode's replica table.
 type PBDTableGetItem struct {
 	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
 	KeyHash          []byte                 `protobuf:"bytes,2,req,name=keyHash" json:"keyHash,omitempty"`
 	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,3,opt,name=origin" json:"origin,omitempty"`
+	Replica          *bool                  `protobuf:"varint,4,opt,name=replica" json:"replica,omitempty"`
 	XXX_unrecognized []byte                 `json:"-"`
 }
 
@@ -263,6 +379,13 @@ func (m *PBDTableGetItem) GetOrigin() *dendrite.PBProtoVnode {
 	return nil
 }
 
+func (m *PBDTableGetItem) GetReplica() bool {
+	if m != nil && m.Replica != nil {
+		return *m.Replica
+	}
+	return false
+}
+
 // PBDTableSetItem is a request message used to set an item to remote vnode.
 type PBDTableSetItem struct {
 	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
@@ -270,6 +393,8 @@ type PBDTableSetItem struct {
 	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,3,opt,name=origin" json:"origin,omitempty"`
 	Demoting         *bool                  `protobuf:"varint,4,opt,name=demoting" json:"demoting,omitempty"`
 	MinAcks          *int32                 `protobuf:"varint,5,opt,name=minAcks" json:"minAcks,omitempty"`
+	ExpectedVersion  *uint64                `protobuf:"varint,6,opt,name=expectedVersion" json:"expectedVersion,omitempty"`
+	Stamp            *bool                  `protobuf:"varint,7,opt,name=stamp" json:"stamp,omitempty"`
 	XXX_unrecognized []byte                 `json:"-"`
 }
 
@@ -312,11 +437,26 @@ func (m *PBDTableSetItem) GetMinAcks() int32 {
 	return 0
 }
 
+func (m *PBDTableSetItem) GetExpectedVersion() uint64 {
+	if m != nil && m.ExpectedVersion != nil {
+		return *m.ExpectedVersion
+	}
+	return 0
+}
+
+func (m *PBDTableSetItem) GetStamp() bool {
+	if m != nil && m.Stamp != nil {
+		return *m.Stamp
+	}
+	return false
+}
+
 // PBDTableSetMultiItem is a request message used to set multiple items on remote vnode.
 type PBDTableSetMultiItem struct {
 	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
 	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,2,opt,name=origin" json:"origin,omitempty"`
 	Items            []*PBDTableItem        `protobuf:"bytes,3,rep,name=items" json:"items,omitempty"`
+	MinAcks          *int32                 `protobuf:"varint,4,opt,name=minAcks" json:"minAcks,omitempty"`
 	XXX_unrecognized []byte                 `json:"-"`
 }
 
@@ -345,6 +485,13 @@ func (m *PBDTableSetMultiItem) GetItems() []*PBDTableItem {
 	return nil
 }
 
+func (m *PBDTableSetMultiItem) GetMinAcks() int32 {
+	if m != nil && m.MinAcks != nil {
+		return *m.MinAcks
+	}
+	return 0
+}
+
 // PBDTableClearReplica is a request message used to remove replicated item from remote vnode.
 type PBDTableClearReplica struct {
 	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
@@ -427,6 +574,89 @@ func (m *PBDTableSetReplicaInfo) GetOrigin() *dendrite.PBProtoVnode {
 	return nil
 }
 
+// PBDTableClearReplicaBatch is a request message used to remove multiple replicated (or demoted) items from remote vnode.
+type PBDTableClearReplicaBatch struct {
+	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
+	KeyHashes        [][]byte               `protobuf:"bytes,2,rep,name=keyHashes" json:"keyHashes,omitempty"`
+	Demoted          *bool                  `protobuf:"varint,3,req,name=demoted" json:"demoted,omitempty"`
+	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,4,opt,name=origin" json:"origin,omitempty"`
+	XXX_unrecognized []byte                 `json:"-"`
+}
+
+func (m *PBDTableClearReplicaBatch) Reset()         { *m = PBDTableClearReplicaBatch{} }
+func (m *PBDTableClearReplicaBatch) String() string { return proto.CompactTextString(m) }
+func (*PBDTableClearReplicaBatch) ProtoMessage()    {}
+
+func (m *PBDTableClearReplicaBatch) GetDest() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Dest
+	}
+	return nil
+}
+
+func (m *PBDTableClearReplicaBatch) GetKeyHashes() [][]byte {
+	if m != nil {
+		return m.KeyHashes
+	}
+	return nil
+}
+
+func (m *PBDTableClearReplicaBatch) GetDemoted() bool {
+	if m != nil && m.Demoted != nil {
+		return *m.Demoted
+	}
+	return false
+}
+
+func (m *PBDTableClearReplicaBatch) GetOrigin() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Origin
+	}
+	return nil
+}
+
+// PBDTableSetReplicaInfoBatch is a request message used to update metadata for multiple replicated items on remote vnode.
+// ReplicaInfos are in the same order as keyHashes.
+type PBDTableSetReplicaInfoBatch struct {
+	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
+	KeyHashes        [][]byte               `protobuf:"bytes,2,rep,name=keyHashes" json:"keyHashes,omitempty"`
+	ReplicaInfos     []*PBDTableReplicaInfo `protobuf:"bytes,3,rep,name=replicaInfos" json:"replicaInfos,omitempty"`
+	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,4,opt,name=origin" json:"origin,omitempty"`
+	XXX_unrecognized []byte                 `json:"-"`
+}
+
+func (m *PBDTableSetReplicaInfoBatch) Reset()         { *m = PBDTableSetReplicaInfoBatch{} }
+func (m *PBDTableSetReplicaInfoBatch) String() string { return proto.CompactTextString(m) }
+func (*PBDTableSetReplicaInfoBatch) ProtoMessage()    {}
+
+func (m *PBDTableSetReplicaInfoBatch) GetDest() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Dest
+	}
+	return nil
+}
+
+func (m *PBDTableSetReplicaInfoBatch) GetKeyHashes() [][]byte {
+	if m != nil {
+		return m.KeyHashes
+	}
+	return nil
+}
+
+func (m *PBDTableSetReplicaInfoBatch) GetReplicaInfos() []*PBDTableReplicaInfo {
+	if m != nil {
+		return m.ReplicaInfos
+	}
+	return nil
+}
+
+func (m *PBDTableSetReplicaInfoBatch) GetOrigin() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Origin
+	}
+	return nil
+}
+
 // PBDTablePromoteKey is a request message used to request a promotion of a key on the remote vnode.
 type PBDTablePromoteKey struct {
 	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
@@ -460,5 +690,139 @@ func (m *PBDTablePromoteKey) GetOrigin() *dendrite.PBProtoVnode {
 	return nil
 }
 
+// PBDTableScan is a request message used to read items in key hash range (start, end] from remote vnode,
+// in key hash order. Empty start reads from the beginning of hash space. If replica is set, items are read
+// from vnode's replica table. If values is not set, items are returned without values.
+type PBDTableScan struct {
+	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
+	Start            []byte                 `protobuf:"bytes,2,opt,name=start" json:"start,omitempty"`
+	End              []byte                 `protobuf:"bytes,3,req,name=end" json:"end,omitempty"`
+	Limit            *int32                 `protobuf:"varint,4,req,name=limit" json:"limit,omitempty"`
+	Values           *bool                  `protobuf:"varint,5,opt,name=values" json:"values,omitempty"`
+	Replica          *bool                  `protobuf:"varint,6,opt,name=replica" json:"replica,omitempty"`
+	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,7,opt,name=origin" json:"origin,omitempty"`
+	XXX_unrecognized []byte                 `json:"-"`
+}
+
+func (m *PBDTableScan) Reset()         { *m = PBDTableScan{} }
+func (m *PBDTableScan) String() string { return proto.CompactTextString(m) }
+func (*PBDTableScan) ProtoMessage()    {}
+
+func (m *PBDTableScan) GetDest() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Dest
+	}
+	return nil
+}
+
+func (m *PBDTableScan) GetStart() []byte {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *PBDTableScan) GetEnd() []byte {
+	if m != nil {
+		return m.End
+	}
+	return nil
+}
+
+func (m *PBDTableScan) GetLimit() int32 {
+	if m != nil && m.Limit != nil {
+		return *m.Limit
+	}
+	return 0
+}
+
+func (m *PBDTableScan) GetValues() bool {
+	if m != nil && m.Values != nil {
+		return *m.Values
+	}
+	return false
+}
+
+func (m *PBDTableScan) GetReplica() bool {
+	if m != nil && m.Replica != nil {
+		return *m.Replica
+	}
+	return false
+}
+
+func (m *PBDTableScan) GetOrigin() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Origin
+	}
+	return nil
+}
+
+// PBDTableMerkleNodes is a request message used to get Merkle tree nodes for a key range on remote replica vnode.
+// It is used for both inner nodes and leaves. Nodes are indexed as in a heap, root being 1.
+type PBDTableMerkleNodes struct {
+	Dest             *dendrite.PBProtoVnode `protobuf:"bytes,1,req,name=dest" json:"dest,omitempty"`
+	Start            []byte                 `protobuf:"bytes,2,req,name=start" json:"start,omitempty"`
+	End              []byte                 `protobuf:"bytes,3,req,name=end" json:"end,omitempty"`
+	Nodes            []int32                `protobuf:"varint,4,rep,name=nodes" json:"nodes,omitempty"`
+	Origin           *dendrite.PBProtoVnode `protobuf:"bytes,5,opt,name=origin" json:"origin,omitempty"`
+	XXX_unrecognized []byte                 `json:"-"`
+}
+
+func (m *PBDTableMerkleNodes) Reset()         { *m = PBDTableMerkleNodes{} }
+func (m *PBDTableMerkleNodes) String() string { return proto.CompactTextString(m) }
+func (*PBDTableMerkleNodes) ProtoMessage()    {}
+
+func (m *PBDTableMerkleNodes) GetDest() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Dest
+	}
+	return nil
+}
+
+func (m *PBDTableMerkleNodes) GetStart() []byte {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *PBDTableMerkleNodes) GetEnd() []byte {
+	if m != nil {
+		return m.End
+	}
+	return nil
+}
+
+func (m *PBDTableMerkleNodes) GetNodes() []int32 {
+	if m != nil {
+		return m.Nodes
+	}
+	return nil
+}
+
+func (m *PBDTableMerkleNodes) GetOrigin() *dendrite.PBProtoVnode {
+	if m != nil {
+		return m.Origin
+	}
+	return nil
+}
+
+// PBDTableMerkleNodesResponse is a response message with hashes of requested Merkle tree nodes, in the same order.
+type PBDTableMerkleNodesResponse struct {
+	Hashes           [][]byte `protobuf:"bytes,1,rep,name=hashes" json:"hashes,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *PBDTableMerkleNodesResponse) Reset()         { *m = PBDTableMerkleNodesResponse{} }
+func (m *PBDTableMerkleNodesResponse) String() string { return proto.CompactTextString(m) }
+func (*PBDTableMerkleNodesResponse) ProtoMessage()    {}
+
+func (m *PBDTableMerkleNodesResponse) GetHashes() [][]byte {
+	if m != nil {
+		return m.Hashes
+	}
+	return nil
+}
+
 func init() {
 }
@@ -8,8 +8,11 @@ import (
 // delegator() - captures dendrite events as well as internal dtable events
 //               and synchronizes data operations
 func (dt *DTable) delegator() {
+	defer dt.running.Done()
 	for {
 		select {
+		case <-dt.shutdown:
+			return
 		case event := <-dt.event_c:
 			switch event.EvType {
 			case dendrite.EvPredecessorLeft:
@@ -56,11 +59,20 @@ func (dt *DTable) delegator() {
 			case evPromoteKey:
 				dt.Logf(LogDebug, "delegator() - promotekey() event - on %s, for key %s", event.vnode.String(), event.item.keyHashString())
 				dt.promoteKey(event.vnode, event.item)
+			case evPromoteKeys:
+				dt.Logf(LogDebug, "delegator() - promotekeys() event - on %s, for %d keys", event.vnode.String(), len(event.items))
+				dt.promoteKeys(event.vnode, event.items)
 			}
 		case <-dt.selfcheck_t.C:
 			dt.Logln(LogDebug, "delegator() - selfcheck() started")
 			dt.selfCheck()
 			dt.Logln(LogDebug, "delegator() - selfcheck() completed")
+		case <-dt.antientropy_t.C:
+			dt.Logln(LogDebug, "delegator() - antiEntropy() started")
+			dt.antiEntropy()
+			dt.Logln(LogDebug, "delegator() - antiEntropy() completed")
+		case <-dt.reaper_t.C:
+			dt.reapExpired()
 		}
 	}
 
@@ -73,6 +85,9 @@ func (dt *DTable) checkPeer(remote *dendrite.Vnode) error {
 // replayEvent() is called when remote node does not have dtable initialized
 func (dt *DTable) replayEvent(event *dendrite.EventCtx) {
 	dt.Logln(LogDebug, "- replayEvent scheduled")
-	time.Sleep(5 * time.Second)
-	dt.EmitEvent(event)
+	select {
+	case <-time.After(5 * time.Second):
+		dt.EmitEvent(event)
+	case <-dt.shutdown:
+	}
 }
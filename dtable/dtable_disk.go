@@ -0,0 +1,443 @@
+package dtable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/fastfn/dendrite"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	diskOpPut    byte = 1
+	diskOpDelete byte = 2
+	// logs are compacted once they hold this many records and more than twice as many as live items
+	diskCompactMin = 10000
+)
+
+type diskEngine struct {
+	dir string
+}
+
+/* NewDiskStorage returns StorageEngine that keeps items in memory, and logs each change to disk, so that
+tables survive restarts. Each table of each local vnode has its own log in dir, named after vnode's id, which
+stays the same as long as ring's Hostname and number of vnodes do. Logs are read back when dtable is
+initialized.
+
+Changes are written to the OS on each write, and synced to disk when logs are compacted or closed.
+*/
+func NewDiskStorage(dir string) StorageEngine {
+	return &diskEngine{dir: dir}
+}
+
+func (e *diskEngine) Open(vnode *dendrite.Vnode) (Storage, Storage, DemotedStorage, error) {
+	if err := os.MkdirAll(e.dir, 0755); err != nil {
+		return nil, nil, nil, err
+	}
+	base := filepath.Join(e.dir, vnode.String())
+	primary, err := openDiskTable(base + ".primary")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	replica, err := openDiskTable(base + ".replica")
+	if err != nil {
+		primary.Close()
+		return nil, nil, nil, err
+	}
+	demoted, err := openDiskDemotedTable(base + ".demoted")
+	if err != nil {
+		primary.Close()
+		replica.Close()
+		return nil, nil, nil, err
+	}
+	return primary, replica, demoted, nil
+}
+
+/* diskLog is append-only log of table's changes. Each record is an op byte, followed by uvarint length
+of its data and the data itself: encoded item for puts, key hash for deletes. Incomplete record at
+the end of the log, left by interrupted write, is dropped when log is opened.
+*/
+type diskLog struct {
+	path    string
+	file    *os.File
+	size    int64 // bytes of complete records
+	records int
+}
+
+// openDiskLog opens log at path, creating it if needed, and calls replay for each of its records.
+func openDiskLog(path string, replay func(op byte, data []byte) error) (*diskLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &diskLog{path: path, file: file}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		op, data, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// drop the rest of the log
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		if err := replay(op, data); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("DTable:storage - bad record in %s at offset %d - %s", path, offset, err)
+		}
+		offset += size
+		l.records++
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	l.size = offset
+	return l, nil
+}
+
+// readRecord reads one record, and returns its op, data and size in bytes.
+func readRecord(reader *bufio.Reader) (byte, []byte, int64, error) {
+	op, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if op != diskOpPut && op != diskOpDelete {
+		return 0, nil, 0, fmt.Errorf("unknown op %d", op)
+	}
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	return op, data, int64(1 + uvarintLen(length) + len(data)), nil
+}
+
+func uvarintLen(x uint64) int {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(buf, x)
+}
+
+func encodeRecord(op byte, data []byte) []byte {
+	rv := make([]byte, 1+binary.MaxVarintLen64+len(data))
+	rv[0] = op
+	n := binary.PutUvarint(rv[1:], uint64(len(data)))
+	copy(rv[1+n:], data)
+	return rv[:1+n+len(data)]
+}
+
+func (l *diskLog) append(op byte, data []byte) error {
+	record := encodeRecord(op, data)
+	if _, err := l.file.Write(record); err != nil {
+		// drop partial record, so that records written after it can be read back
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, io.SeekStart)
+		return err
+	}
+	l.size += int64(len(record))
+	l.records++
+	return nil
+}
+
+// compact rewrites the log with put records of live items only, which snapshot passes to write.
+func (l *diskLog) compact(snapshot func(write func(data []byte) error) error) error {
+	tmp_path := l.path + ".tmp"
+	file, err := os.OpenFile(tmp_path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	records := 0
+	var size int64
+	err = snapshot(func(data []byte) error {
+		records++
+		n, err := writer.Write(encodeRecord(diskOpPut, data))
+		size += int64(n)
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp_path, l.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp_path)
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.size = size
+	l.records = records
+	return nil
+}
+
+func (l *diskLog) close() error {
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// needsCompaction checks if log holds too many records for live items.
+func (l *diskLog) needsCompaction(live int) bool {
+	return l.records > diskCompactMin && l.records > 2*live
+}
+
+/* diskTable is Storage that keeps items in itemMap, and logs each change. Changes are logged before they
+are applied to items, so a change that failed to reach the log is not visible to readers either.
+ForEach and Range iterate over a snapshot of items, taken under read lock, so that fn can write to the table.
+*/
+type diskTable struct {
+	items itemMap
+	log   *diskLog
+	lock  sync.RWMutex // orders changes of items with their records in log
+}
+
+func openDiskTable(path string) (*diskTable, error) {
+	t := &diskTable{items: make(itemMap)}
+	l, err := openDiskLog(path, func(op byte, data []byte) error {
+		if op == diskOpDelete {
+			delete(t.items, fmt.Sprintf("%x", data))
+			return nil
+		}
+		var pb PBDTableItem
+		if err := proto.Unmarshal(data, &pb); err != nil {
+			return err
+		}
+		item := new(kvItem)
+		item.from_protobuf(&pb)
+		item.lock = new(sync.Mutex)
+		t.items[item.keyHashString()] = item
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.log = l
+	return t, nil
+}
+
+func (t *diskTable) Get(key_str string) (*kvItem, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Get(key_str)
+}
+
+func (t *diskTable) Put(item *kvItem) error {
+	data, err := proto.Marshal(item.to_protobuf())
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.log.append(diskOpPut, data); err != nil {
+		return err
+	}
+	t.items.Put(item)
+	t.compact()
+	return nil
+}
+
+func (t *diskTable) Delete(key_str string) error {
+	keyHash, err := hex.DecodeString(key_str)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.items[key_str]; !ok {
+		return nil
+	}
+	if err := t.log.append(diskOpDelete, keyHash); err != nil {
+		return err
+	}
+	t.items.Delete(key_str)
+	t.compact()
+	return nil
+}
+
+// compact rewrites the log when needed. Caller holds table's lock. Failed compaction leaves the log as it
+// was, and is retried on the next change.
+func (t *diskTable) compact() {
+	if !t.log.needsCompaction(len(t.items)) {
+		return
+	}
+	t.log.compact(func(write func(data []byte) error) error {
+		for _, item := range t.items {
+			data, err := proto.Marshal(item.to_protobuf())
+			if err != nil {
+				return err
+			}
+			if err := write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (t *diskTable) ForEach(fn func(key_str string, item *kvItem) bool) {
+	t.lock.RLock()
+	snapshot := t.items.snapshot()
+	t.lock.RUnlock()
+	snapshot.ForEach(fn)
+}
+
+func (t *diskTable) Range(start, end []byte, fn func(item *kvItem) bool) {
+	t.lock.RLock()
+	items := t.items.rangeHeap(start, end)
+	t.lock.RUnlock()
+	items.each(fn)
+}
+
+func (t *diskTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Len()
+}
+
+func (t *diskTable) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.log.close()
+}
+
+// diskDemotedTable is DemotedStorage that keeps items in demotedItemMap, and logs each change, same as diskTable.
+type diskDemotedTable struct {
+	items demotedItemMap
+	log   *diskLog
+	lock  sync.RWMutex
+}
+
+func openDiskDemotedTable(path string) (*diskDemotedTable, error) {
+	t := &diskDemotedTable{items: make(demotedItemMap)}
+	l, err := openDiskLog(path, func(op byte, data []byte) error {
+		if op == diskOpDelete {
+			delete(t.items, fmt.Sprintf("%x", data))
+			return nil
+		}
+		var pb PBDTableDemotedItem
+		if err := proto.Unmarshal(data, &pb); err != nil {
+			return err
+		}
+		item := &demotedKvItem{
+			item:       new(kvItem),
+			new_master: dendrite.VnodeFromProtobuf(pb.GetDest()),
+			demoted_ts: time.Unix(0, pb.GetDemotedTs()),
+		}
+		item.item.from_protobuf(pb.GetItem())
+		item.item.lock = new(sync.Mutex)
+		t.items[item.item.keyHashString()] = item
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.log = l
+	return t, nil
+}
+
+func (item *demotedKvItem) to_protobuf() *PBDTableDemotedItem {
+	return &PBDTableDemotedItem{
+		Dest:      item.new_master.ToProtobuf(),
+		Item:      item.item.to_protobuf(),
+		DemotedTs: proto.Int64(item.demoted_ts.UnixNano()),
+	}
+}
+
+func (t *diskDemotedTable) Get(key_str string) (*demotedKvItem, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Get(key_str)
+}
+
+func (t *diskDemotedTable) Put(item *demotedKvItem) error {
+	data, err := proto.Marshal(item.to_protobuf())
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.log.append(diskOpPut, data); err != nil {
+		return err
+	}
+	t.items.Put(item)
+	t.compact()
+	return nil
+}
+
+func (t *diskDemotedTable) Delete(key_str string) error {
+	keyHash, err := hex.DecodeString(key_str)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.items[key_str]; !ok {
+		return nil
+	}
+	if err := t.log.append(diskOpDelete, keyHash); err != nil {
+		return err
+	}
+	t.items.Delete(key_str)
+	t.compact()
+	return nil
+}
+
+// compact rewrites the log when needed. Caller holds table's lock.
+func (t *diskDemotedTable) compact() {
+	if !t.log.needsCompaction(len(t.items)) {
+		return
+	}
+	t.log.compact(func(write func(data []byte) error) error {
+		for _, item := range t.items {
+			data, err := proto.Marshal(item.to_protobuf())
+			if err != nil {
+				return err
+			}
+			if err := write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (t *diskDemotedTable) ForEach(fn func(key_str string, item *demotedKvItem) bool) {
+	t.lock.RLock()
+	snapshot := t.items.snapshot()
+	t.lock.RUnlock()
+	snapshot.ForEach(fn)
+}
+
+func (t *diskDemotedTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Len()
+}
+
+func (t *diskDemotedTable) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.log.close()
+}
@@ -0,0 +1,209 @@
+package dtable
+
+import (
+	"fmt"
+	"github.com/fastfn/dendrite"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func diskItem(i, version int) *kvItem {
+	item := new(kvItem)
+	item.Key = []byte(fmt.Sprintf("key%d", i))
+	item.Val = []byte(fmt.Sprintf("val%d", version))
+	item.Version = uint64(version)
+	item.keyHash = dendrite.HashKey(item.Key)
+	item.timestamp = hlcTimestamp{wall: int64(version + 1)}
+	item.lock = new(sync.Mutex)
+	item.commited = true
+	item.replicaInfo = &kvReplicaInfo{
+		master: &dendrite.Vnode{Id: []byte{1}, Host: "host1"},
+		vnodes: []*dendrite.Vnode{{Id: []byte{2}, Host: "host2"}},
+	}
+	return item
+}
+
+func openTestTable(t *testing.T, path string) *diskTable {
+	table, err := openDiskTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func checkItem(t *testing.T, table *diskTable, i, version int) {
+	item, ok := table.Get(diskItem(i, 0).keyHashString())
+	if !ok {
+		t.Fatalf("key%d not found", i)
+	}
+	if string(item.Val) != fmt.Sprintf("val%d", version) || item.Version != uint64(version) || !item.commited || item.lock == nil {
+		t.Fatalf("key%d - unexpected item %+v", i, item)
+	}
+	if item.replicaInfo == nil || item.replicaInfo.master.Host != "host1" {
+		t.Fatalf("key%d - replica info not restored", i)
+	}
+}
+
+func TestDiskTableReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vnode.primary")
+	table := openTestTable(t, path)
+	for version := 0; version < 3; version++ {
+		for i := 0; i < 100; i++ {
+			if err := table.Put(diskItem(i, version)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := table.Delete(diskItem(i, 0).keyHashString()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tombstone := diskItem(10, 3)
+	tombstone.Val = nil
+	tombstone.tombstone = true
+	table.Put(tombstone)
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	table = openTestTable(t, path)
+	defer table.Close()
+	if table.Len() != 90 || table.log.records != 311 {
+		t.Fatalf("expected 90 items from 311 records, got %d from %d", table.Len(), table.log.records)
+	}
+	if _, ok := table.Get(diskItem(5, 0).keyHashString()); ok {
+		t.Fatal("deleted key was restored")
+	}
+	if item, ok := table.Get(tombstone.keyHashString()); !ok || !item.tombstone || item.timestamp != tombstone.timestamp {
+		t.Fatal("tombstone was not restored")
+	}
+	checkItem(t, table, 50, 2)
+}
+
+func TestDiskTableTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vnode.replica")
+	table := openTestTable(t, path)
+	for i := 0; i < 10; i++ {
+		table.Put(diskItem(i, 1))
+	}
+	table.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut the last record in half, as interrupted write would
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	table = openTestTable(t, path)
+	if table.Len() != 9 {
+		t.Fatalf("expected 9 items, got %d", table.Len())
+	}
+	if _, ok := table.Get(diskItem(9, 1).keyHashString()); ok {
+		t.Fatal("partial record was read")
+	}
+	// records written after recovery are read back
+	table.Put(diskItem(9, 2))
+	table.Put(diskItem(3, 2))
+	table.Close()
+
+	table = openTestTable(t, path)
+	defer table.Close()
+	if table.Len() != 10 {
+		t.Fatalf("expected 10 items, got %d", table.Len())
+	}
+	checkItem(t, table, 9, 2)
+	checkItem(t, table, 3, 2)
+	checkItem(t, table, 4, 1)
+}
+
+func TestDiskTableCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vnode.primary")
+	table := openTestTable(t, path)
+	for version := 0; version*100 <= diskCompactMin; version++ {
+		for i := 0; i < 100; i++ {
+			table.Put(diskItem(i, version))
+		}
+	}
+	if table.log.records > diskCompactMin {
+		t.Fatalf("log was not compacted, it holds %d records", table.log.records)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary log was left behind")
+	}
+	table.Put(diskItem(0, 1000))
+	table.Close()
+
+	table = openTestTable(t, path)
+	defer table.Close()
+	if table.Len() != 100 {
+		t.Fatalf("expected 100 items, got %d", table.Len())
+	}
+	checkItem(t, table, 0, 1000)
+	checkItem(t, table, 99, diskCompactMin/100)
+}
+
+func TestDiskTableWriteFromForEach(t *testing.T) {
+	table := openTestTable(t, filepath.Join(t.TempDir(), "vnode.primary"))
+	defer table.Close()
+	for i := 0; i < 10; i++ {
+		table.Put(diskItem(i, 1))
+	}
+	done := make(chan bool)
+	go func() {
+		table.ForEach(func(key_str string, item *kvItem) bool {
+			table.Delete(key_str)
+			table.Put(diskItem(100, 1))
+			return true
+		})
+		table.Range(nil, hashAt(0xff, 0xff), func(item *kvItem) bool {
+			table.Delete(item.keyHashString())
+			return true
+		})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing from ForEach blocked")
+	}
+	if table.Len() != 0 {
+		t.Fatalf("expected empty table, got %d items", table.Len())
+	}
+}
+
+func TestDiskDemotedTableReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vnode.demoted")
+	table, err := openDiskDemotedTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	demoted_ts := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		table.Put(&demotedKvItem{
+			item:       diskItem(i, 1),
+			new_master: &dendrite.Vnode{Id: []byte{3}, Host: "host3"},
+			demoted_ts: demoted_ts,
+		})
+	}
+	table.Delete(diskItem(0, 1).keyHashString())
+	table.Close()
+
+	table, err = openDiskDemotedTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if table.Len() != 9 {
+		t.Fatalf("expected 9 items, got %d", table.Len())
+	}
+	item, ok := table.Get(diskItem(5, 1).keyHashString())
+	if !ok || item.new_master.Host != "host3" || !item.demoted_ts.Equal(demoted_ts) || string(item.item.Val) != "val1" || item.item.lock == nil {
+		t.Fatalf("unexpected item %+v", item)
+	}
+}
@@ -0,0 +1,197 @@
+package dtable
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how often expired items are removed from local tables
+const reapInterval = 10 * time.Second
+
+type tableKind int
+
+const (
+	primaryTable tableKind = iota
+	replicaTable
+	demotedTable
+)
+
+// expiryEntry is a key of one of local tables, that expires at given time.
+type expiryEntry struct {
+	expires    time.Time
+	kind       tableKind
+	vn_key_str string
+	key_str    string
+}
+
+func (e *expiryEntry) id() string {
+	return fmt.Sprintf("%d/%s/%s", e.kind, e.vn_key_str, e.key_str)
+}
+
+// expiryHeap is a min-heap of entries by expiry time.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(*expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+/* expiryIndex orders keys with TTL by their expiry time, so that reaper only visits keys that are due,
+instead of scanning whole tables. Keys are added as they're written to local tables (see expiringStorage).
+Entries are not removed when keys are overwritten or deleted; reaper checks the current item when entry
+is due. Each key is scheduled once per expiry time, so in-place updates of an item don't add entries.
+*/
+type expiryIndex struct {
+	lock      sync.Mutex
+	entries   expiryHeap
+	scheduled map[string]time.Time // expiry time of each scheduled key, by entry id
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{
+		entries:   make(expiryHeap, 0),
+		scheduled: make(map[string]time.Time),
+	}
+}
+
+// add schedules key of an item for expiry check, if item has TTL.
+func (idx *expiryIndex) add(kind tableKind, vn_key_str string, item *kvItem) {
+	if item.expires.IsZero() {
+		return
+	}
+	entry := &expiryEntry{expires: item.expires, kind: kind, vn_key_str: vn_key_str, key_str: item.keyHashString()}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if expires, ok := idx.scheduled[entry.id()]; ok && expires.Equal(entry.expires) {
+		return
+	}
+	idx.scheduled[entry.id()] = entry.expires
+	heap.Push(&idx.entries, entry)
+}
+
+// due removes and returns entries that expire at or before now.
+func (idx *expiryIndex) due(now time.Time) []*expiryEntry {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	rv := make([]*expiryEntry, 0)
+	for idx.entries.Len() > 0 && !idx.entries[0].expires.After(now) {
+		entry := heap.Pop(&idx.entries).(*expiryEntry)
+		if expires, ok := idx.scheduled[entry.id()]; ok && expires.Equal(entry.expires) {
+			delete(idx.scheduled, entry.id())
+		}
+		rv = append(rv, entry)
+	}
+	return rv
+}
+
+func (idx *expiryIndex) len() int {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.entries.Len()
+}
+
+// expiringStorage adds items with TTL to expiry index as they're written to the table.
+type expiringStorage struct {
+	Storage
+	index      *expiryIndex
+	kind       tableKind
+	vn_key_str string
+}
+
+func (s *expiringStorage) Put(item *kvItem) error {
+	if err := s.Storage.Put(item); err != nil {
+		return err
+	}
+	s.index.add(s.kind, s.vn_key_str, item)
+	return nil
+}
+
+// expiringDemotedStorage adds demoted items with TTL to expiry index as they're written to the table.
+type expiringDemotedStorage struct {
+	DemotedStorage
+	index      *expiryIndex
+	vn_key_str string
+}
+
+func (s *expiringDemotedStorage) Put(demoted_item *demotedKvItem) error {
+	if err := s.DemotedStorage.Put(demoted_item); err != nil {
+		return err
+	}
+	s.index.add(demotedTable, s.vn_key_str, demoted_item.item)
+	return nil
+}
+
+/* reapExpired removes expired items from primary, replica and demoted tables of local vnodes. Each node
+reaps its own tables, so replicas don't wait for primary to remove their copies. Hooks implementing
+ExpireKeyHook are notified for keys removed from primary tables. Only keys that are due in expiry index
+are visited.
+
+Items are checked under their locks, and only removed if they were not replaced in the meantime, so that
+concurrent write of the key is not lost.
+*/
+func (dt *DTable) reapExpired() {
+	expired := make([]*kvItem, 0)
+	reaped := 0
+	for _, entry := range dt.expiry.due(time.Now()) {
+		switch entry.kind {
+		case primaryTable, replicaTable:
+			vn_table := dt.table[entry.vn_key_str]
+			if entry.kind == replicaTable {
+				vn_table = dt.rtable[entry.vn_key_str]
+			}
+			if vn_table == nil {
+				continue
+			}
+			item, ok := vn_table.Get(entry.key_str)
+			if !ok {
+				continue
+			}
+			// uncommited primary item is scheduled again when set() stores it as commited
+			if dt.removeItem(vn_table, item, func() bool {
+				return (item.commited || entry.kind == replicaTable) && item.expired()
+			}) {
+				reaped++
+				if entry.kind == primaryTable {
+					expired = append(expired, item)
+				}
+			}
+		case demotedTable:
+			demoted_table := dt.demoted_table[entry.vn_key_str]
+			if demoted_table == nil {
+				continue
+			}
+			demoted_item, ok := demoted_table.Get(entry.key_str)
+			if !ok {
+				continue
+			}
+			demoted_item.item.lock.Lock()
+			if current, ok := demoted_table.Get(entry.key_str); ok && current == demoted_item && demoted_item.item.expired() {
+				demoted_table.Delete(entry.key_str)
+			}
+			demoted_item.item.lock.Unlock()
+		}
+	}
+	if reaped > 0 {
+		dt.Logf(LogDebug, "reapExpired() - removed %d expired items\n", reaped)
+	}
+	for _, item := range expired {
+		dt.callExpireHooks(item)
+	}
+}
+
+func (dt *DTable) callExpireHooks(item *kvItem) {
+	for _, hook := range dt.captureKeyHooks {
+		if expireHook, ok := hook.(ExpireKeyHook); ok {
+			expireHook.ExpireKeyHandler(item.Key)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package dtable
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type expireRecorder struct {
+	keys []string
+}
+
+func (r *expireRecorder) CaptureKeyHandler(key []byte) {}
+func (r *expireRecorder) ExpireKeyHandler(key []byte)  { r.keys = append(r.keys, string(key)) }
+
+func ttlItem(keyHash []byte, expires time.Time) *kvItem {
+	item := testItem(keyHash, "v", 1)
+	item.expires = expires
+	item.lock = new(sync.Mutex)
+	return item
+}
+
+func TestReapExpired(t *testing.T) {
+	index := newExpiryIndex()
+	primary := &expiringStorage{Storage: make(itemMap), index: index, kind: primaryTable, vn_key_str: "vn"}
+	replica := &expiringStorage{Storage: make(itemMap), index: index, kind: replicaTable, vn_key_str: "vn"}
+	demoted := &expiringDemotedStorage{DemotedStorage: make(demotedItemMap), index: index, vn_key_str: "vn"}
+	hook := &expireRecorder{}
+	dt := &DTable{
+		conf:            DefaultConfig(),
+		table:           map[string]Storage{"vn": primary},
+		rtable:          map[string]Storage{"vn": replica},
+		demoted_table:   map[string]DemotedStorage{"vn": demoted},
+		expiry:          index,
+		captureKeyHooks: []CaptureKeyHook{hook},
+	}
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+
+	expired := ttlItem(hashAt(0x10, 1), past)
+	primary.Put(expired)
+	primary.Put(ttlItem(hashAt(0x10, 2), future))
+	primary.Put(testItem(hashAt(0x10, 3), "v", 1))
+	uncommited := ttlItem(hashAt(0x10, 4), past)
+	uncommited.commited = false
+	primary.Put(uncommited)
+	replica.Put(ttlItem(hashAt(0x10, 1), past))
+	demoted.Put(&demotedKvItem{item: ttlItem(hashAt(0x10, 5), past)})
+	// in-place update of an item does not schedule it again
+	primary.Put(expired)
+	if n := index.len(); n != 5 {
+		t.Fatalf("expected 5 scheduled keys, got %d", n)
+	}
+
+	dt.reapExpired()
+	if primary.Len() != 3 || replica.Len() != 0 || demoted.Len() != 0 {
+		t.Fatalf("expected 3 primary, 0 replica and 0 demoted items, got %d, %d and %d", primary.Len(), replica.Len(), demoted.Len())
+	}
+	if len(hook.keys) != 1 || hook.keys[0] != string(expired.Key) {
+		t.Fatalf("expire hooks called for %v", hook.keys)
+	}
+	if n := index.len(); n != 1 {
+		t.Fatalf("expected only the future key to stay scheduled, got %d", n)
+	}
+
+	// uncommited item is left to its writer, which schedules it again once commited
+	uncommited.commited = true
+	dt.persist(primary, uncommited)
+	dt.reapExpired()
+	if _, ok := primary.Get(uncommited.keyHashString()); ok {
+		t.Fatal("commited expired item was not reaped")
+	}
+
+	// key overwritten without TTL is not removed by its old entry
+	primary.Put(ttlItem(hashAt(0x10, 6), time.Now().Add(50*time.Millisecond)))
+	overwrite := testItem(hashAt(0x10, 6), "v", 2)
+	overwrite.lock = new(sync.Mutex)
+	primary.Put(overwrite)
+	time.Sleep(100 * time.Millisecond)
+	dt.reapExpired()
+	if _, ok := primary.Get(overwrite.keyHashString()); !ok {
+		t.Fatal("overwritten key was reaped")
+	}
+}
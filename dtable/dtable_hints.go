@@ -0,0 +1,331 @@
+package dtable
+
+import (
+	"bytes"
+	"github.com/fastfn/dendrite"
+	"time"
+)
+
+// hint is a replica write that failed. Coordinator (key's primary vnode) keeps it until
+// the target replica responds again, and then replays it.
+type hint struct {
+	master  *dendrite.Vnode
+	item    *kvItem
+	created time.Time
+}
+
+// hintQueue holds pending hints for one target vnode, with its replay backoff.
+type hintQueue struct {
+	target  *dendrite.Vnode
+	hints   map[string]*hint // hints by keyHash, newer write replaces older hint
+	backoff time.Duration
+	next    time.Time
+}
+
+// PendingHints returns the number of replica writes waiting to be replayed to replicas that were unavailable.
+func (dt *DTable) PendingHints() int {
+	dt.hints_lock.Lock()
+	defer dt.hints_lock.Unlock()
+	return dt.pendingHints()
+}
+
+func (dt *DTable) pendingHints() int {
+	rv := 0
+	for _, queue := range dt.hints {
+		rv += len(queue.hints)
+	}
+	return rv
+}
+
+// storeHint is called when replica write of an item to target fails. Caller holds item's lock.
+func (dt *DTable) storeHint(master, target *dendrite.Vnode, item *kvItem) {
+	if dt.conf.MaxHints <= 0 {
+		return
+	}
+	dt.hints_lock.Lock()
+	defer dt.hints_lock.Unlock()
+
+	key_str := item.keyHashString()
+	queue, ok := dt.hints[target.String()]
+	if ok {
+		if old, exists := queue.hints[key_str]; exists {
+			if old.item.timestamp.After(item.timestamp) {
+				return
+			}
+			if old.item.timestamp.Equal(item.timestamp) {
+				// same write failed again during replay, keep the original hint so that TTL still applies
+				return
+			}
+			queue.hints[key_str] = &hint{master: master, item: item.dup(), created: time.Now()}
+			return
+		}
+	}
+	if dt.pendingHints() >= dt.conf.MaxHints {
+		dt.Logf(LogInfo, "storeHint() - dropping hint for key %s to %s, too many pending hints (%d)\n", key_str, target.String(), dt.conf.MaxHints)
+		return
+	}
+	if !ok {
+		queue = &hintQueue{
+			target:  target,
+			hints:   make(map[string]*hint),
+			backoff: dt.conf.HintRetryMin,
+			next:    time.Now().Add(dt.conf.HintRetryMin),
+		}
+		dt.hints[target.String()] = queue
+	}
+	queue.hints[key_str] = &hint{master: master, item: item.dup(), created: time.Now()}
+	dt.Logf(LogDebug, "storeHint() - stored hint for key %s to %s\n", key_str, target.String())
+}
+
+// hintReplayer periodically replays hints to targets that are due for retry.
+func (dt *DTable) hintReplayer() {
+	defer dt.running.Done()
+	if dt.conf.MaxHints <= 0 {
+		return
+	}
+	interval := dt.conf.HintRetryMin
+	if interval <= 0 {
+		interval = DefaultConfig().HintRetryMin
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dt.replayHints()
+		case <-dt.shutdown:
+			return
+		}
+	}
+}
+
+// replayHints drops expired hints, and replays the rest to targets that respond to status request.
+// Targets that don't respond are retried with exponential backoff.
+func (dt *DTable) replayHints() {
+	now := time.Now()
+	due := make([]*hintQueue, 0)
+	dt.hints_lock.Lock()
+	for target_str, queue := range dt.hints {
+		for key_str, h := range queue.hints {
+			if now.Sub(h.created) > dt.conf.HintTTL {
+				dt.Logf(LogInfo, "replayHints() - hint for key %s to %s expired\n", key_str, target_str)
+				delete(queue.hints, key_str)
+			}
+		}
+		if len(queue.hints) == 0 {
+			delete(dt.hints, target_str)
+			continue
+		}
+		if !queue.next.After(now) {
+			due = append(due, queue)
+		}
+	}
+	dt.hints_lock.Unlock()
+
+	for _, queue := range due {
+		if err := dt.remoteStatus(queue.target); err != nil {
+			dt.hints_lock.Lock()
+			queue.backoff *= 2
+			if queue.backoff > dt.conf.HintRetryMax {
+				queue.backoff = dt.conf.HintRetryMax
+			}
+			queue.next = time.Now().Add(queue.backoff)
+			dt.hints_lock.Unlock()
+			dt.Logf(LogDebug, "replayHints() - target %s still unavailable, next retry in %s\n", queue.target.String(), queue.backoff)
+			continue
+		}
+
+		dt.hints_lock.Lock()
+		hints := make(map[string]*hint)
+		for key_str, h := range queue.hints {
+			hints[key_str] = h
+		}
+		queue.backoff = dt.conf.HintRetryMin
+		queue.next = time.Now().Add(queue.backoff)
+		dt.hints_lock.Unlock()
+
+		// group hints by master, each group is replayed in batches
+		masters := make(map[string][]*hint)
+		for _, h := range hints {
+			masters[h.master.String()] = append(masters[h.master.String()], h)
+		}
+		replayed := 0
+		for _, group := range masters {
+			dt.inBatches(hintItems(group), func(batch []*kvItem) {
+				batch_hints := make([]*hint, len(batch))
+				for idx, item := range batch {
+					batch_hints[idx] = hints[item.keyHashString()]
+				}
+				done := dt.replayHintBatch(queue.target, batch_hints)
+				dt.hints_lock.Lock()
+				for idx, h := range batch_hints {
+					if !done[idx] {
+						continue
+					}
+					replayed++
+					key_str := h.item.keyHashString()
+					if queue.hints[key_str] == h {
+						delete(queue.hints, key_str)
+					}
+				}
+				dt.hints_lock.Unlock()
+			})
+		}
+		dt.Logf(LogInfo, "replayHints() - replayed %d of %d hints to %s\n", replayed, len(hints), queue.target.String())
+	}
+}
+
+// hintItems returns hinted items, in the same order as hints.
+func hintItems(hints []*hint) []*kvItem {
+	rv := make([]*kvItem, len(hints))
+	for idx, h := range hints {
+		rv[idx] = h.item
+	}
+	return rv
+}
+
+/* replayHintBatch writes hinted items of one master to target, if they're still current on master and target
+is still one of master's replicas. Only target is written to, with one request for all the items, and replica
+metadata of the items is then updated on all of their replicas. It reports, in the same order as hints, whether
+each hint is done with, either because replica was written or because the hint is no longer relevant. If writing
+to target fails again, hints are kept.
+*/
+func (dt *DTable) replayHintBatch(target *dendrite.Vnode, hints []*hint) []bool {
+	done := make([]bool, len(hints))
+	if len(hints) == 0 {
+		return done
+	}
+	master := hints[0].master
+	vn_table, ok := dt.table[master.String()]
+	if !ok {
+		for idx := range done {
+			done[idx] = true
+		}
+		return done
+	}
+	handler, _ := dt.transport.GetVnodeHandler(master)
+	if handler == nil {
+		for idx := range done {
+			done[idx] = true
+		}
+		return done
+	}
+	remote_succs, err := handler.FindRemoteSuccessors(dt.ring.Replicas())
+	if err != nil {
+		return done
+	}
+	is_replica := false
+	for _, succ := range remote_succs {
+		if succ != nil && bytes.Equal(succ.Id, target.Id) {
+			is_replica = true
+		}
+	}
+	if !is_replica {
+		// replica set changed, changeReplicas() re-replicates the items
+		for idx := range done {
+			done[idx] = true
+		}
+		return done
+	}
+
+	// collect current items, hints whose items were removed are done with
+	items := make([]*kvItem, 0, len(hints))
+	item_hints := make([]int, 0, len(hints))
+	for idx, h := range hints {
+		item, ok := vn_table.Get(h.item.keyHashString())
+		if !ok {
+			done[idx] = true
+			continue
+		}
+		items = append(items, item)
+		item_hints = append(item_hints, idx)
+	}
+	lockItems(items)
+	defer unlockItems(items)
+
+	// items that were overwritten since, or already replicated to target, are done with
+	current := make([]*kvItem, 0, len(items))
+	current_hints := make([]int, 0, len(items))
+	for idx, item := range items {
+		h_idx := item_hints[idx]
+		if !item.timestamp.Equal(hints[h_idx].item.timestamp) || hasReplica(item, target) {
+			// newer write takes care of its replicas
+			done[h_idx] = true
+			continue
+		}
+		current = append(current, item)
+		current_hints = append(current_hints, h_idx)
+	}
+	if len(current) == 0 {
+		return done
+	}
+
+	repl_items := make([]*kvItem, len(current))
+	for idx, item := range current {
+		repl_items[idx] = item.dup()
+		repl_items[idx].replicaInfo.state = replicaIncomplete
+		repl_items[idx].commited = false
+	}
+	if err := dt.remoteWriteReplicas(master, target, repl_items); err != nil {
+		dt.Logf(LogInfo, "replayHintBatch() - error writing %d replicas to %s: %s\n", len(current), target.String(), err.Error())
+		return done
+	}
+
+	// add target to items' replicas
+	for idx, item := range current {
+		done[current_hints[idx]] = true
+		added := false
+		for r_idx, replica := range item.replicaInfo.vnodes {
+			if replica == nil {
+				item.replicaInfo.vnodes[r_idx] = target
+				added = true
+				break
+			}
+		}
+		if !added {
+			item.replicaInfo.vnodes = append(item.replicaInfo.vnodes, target)
+		}
+		replica_count := 0
+		for _, replica := range item.replicaInfo.vnodes {
+			if replica != nil {
+				replica_count++
+			}
+		}
+		if replica_count >= dt.ring.Replicas() {
+			item.replicaInfo.state = replicaStable
+		} else {
+			item.replicaInfo.state = replicaPartial
+		}
+	}
+
+	// update metadata on all replicas of the items
+	for _, batch := range replicaBatches(current) {
+		meta_items := make([]*kvItem, len(batch.items))
+		for idx, item := range batch.items {
+			meta_items[idx] = item.dup()
+			meta_items[idx].replicaInfo.depth = batch.pos[idx]
+		}
+		errs := dt.remoteSetReplicaInfos(batch.owner, meta_items)
+		for idx, item := range batch.items {
+			if errs[idx] != nil {
+				item.replicaInfo.state = replicaIncomplete
+				item.replicaInfo.vnodes[batch.pos[idx]] = nil
+				item.replicaInfo.orphan_vnodes = append(item.replicaInfo.orphan_vnodes, batch.owner)
+			}
+		}
+	}
+	for _, item := range current {
+		dt.persist(vn_table, item)
+	}
+	return done
+}
+
+// hasReplica reports whether vnode is one of item's replicas.
+func hasReplica(item *kvItem, vnode *dendrite.Vnode) bool {
+	for _, replica := range item.replicaInfo.vnodes {
+		if replica != nil && bytes.Equal(replica.Id, vnode.Id) {
+			return true
+		}
+	}
+	return false
+}
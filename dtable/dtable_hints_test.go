@@ -0,0 +1,79 @@
+package dtable
+
+import (
+	"github.com/fastfn/dendrite"
+	"testing"
+	"time"
+)
+
+func testHintTable(max_hints int) *DTable {
+	conf := DefaultConfig()
+	conf.MaxHints = max_hints
+	return &DTable{conf: conf, hints: make(map[string]*hintQueue)}
+}
+
+func TestStoreHintCap(t *testing.T) {
+	dt := testHintTable(3)
+	master := &dendrite.Vnode{Id: hashAt(0x01, 0), Host: "master:1"}
+	target1 := &dendrite.Vnode{Id: hashAt(0x02, 0), Host: "target1:1"}
+	target2 := &dendrite.Vnode{Id: hashAt(0x03, 0), Host: "target2:1"}
+
+	dt.storeHint(master, target1, testItem(hashAt(0x10, 1), "v", 1))
+	dt.storeHint(master, target1, testItem(hashAt(0x10, 2), "v", 1))
+	dt.storeHint(master, target2, testItem(hashAt(0x10, 1), "v", 1))
+	// cap is shared by all targets
+	dt.storeHint(master, target2, testItem(hashAt(0x10, 3), "v", 1))
+	if n := dt.PendingHints(); n != 3 {
+		t.Fatalf("expected 3 pending hints, got %d", n)
+	}
+	if _, ok := dt.hints[target2.String()].hints[testItem(hashAt(0x10, 3), "v", 1).keyHashString()]; ok {
+		t.Fatal("hint over the cap was stored")
+	}
+
+	// newer write of a hinted key replaces its hint, even when at cap
+	dt.storeHint(master, target1, testItem(hashAt(0x10, 1), "new", 2))
+	h := dt.hints[target1.String()].hints[testItem(hashAt(0x10, 1), "v", 1).keyHashString()]
+	if dt.PendingHints() != 3 || string(h.item.Val) != "new" {
+		t.Fatalf("hint was not replaced, %d pending, value %q", dt.PendingHints(), h.item.Val)
+	}
+	// older write, or retry of the same one, keeps the hint
+	created := h.created
+	dt.storeHint(master, target1, testItem(hashAt(0x10, 1), "old", 1))
+	dt.storeHint(master, target1, testItem(hashAt(0x10, 1), "new", 2))
+	h = dt.hints[target1.String()].hints[testItem(hashAt(0x10, 1), "v", 1).keyHashString()]
+	if string(h.item.Val) != "new" || !h.created.Equal(created) {
+		t.Fatalf("hint was replaced, value %q", h.item.Val)
+	}
+
+	disabled := testHintTable(0)
+	disabled.storeHint(master, target1, testItem(hashAt(0x10, 1), "v", 1))
+	if disabled.PendingHints() != 0 {
+		t.Fatal("hint stored with hinted handoff disabled")
+	}
+}
+
+func TestReplayHintsTTL(t *testing.T) {
+	dt := testHintTable(10)
+	master := &dendrite.Vnode{Id: hashAt(0x01, 0), Host: "master:1"}
+	target1 := &dendrite.Vnode{Id: hashAt(0x02, 0), Host: "target1:1"}
+	target2 := &dendrite.Vnode{Id: hashAt(0x03, 0), Host: "target2:1"}
+
+	dt.storeHint(master, target1, testItem(hashAt(0x10, 1), "v", 1))
+	dt.storeHint(master, target1, testItem(hashAt(0x10, 2), "v", 1))
+	dt.storeHint(master, target2, testItem(hashAt(0x10, 1), "v", 1))
+	expired := time.Now().Add(-dt.conf.HintTTL - time.Second)
+	dt.hints[target1.String()].hints[testItem(hashAt(0x10, 1), "v", 1).keyHashString()].created = expired
+	dt.hints[target2.String()].hints[testItem(hashAt(0x10, 1), "v", 1).keyHashString()].created = expired
+
+	// no target is due for retry yet, so only expiry applies
+	dt.replayHints()
+	if n := dt.PendingHints(); n != 1 {
+		t.Fatalf("expected 1 pending hint, got %d", n)
+	}
+	if _, ok := dt.hints[target1.String()].hints[testItem(hashAt(0x10, 2), "v", 1).keyHashString()]; !ok {
+		t.Fatal("live hint was dropped")
+	}
+	if _, ok := dt.hints[target2.String()]; ok {
+		t.Fatal("empty hint queue was kept")
+	}
+}
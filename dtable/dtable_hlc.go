@@ -0,0 +1,127 @@
+package dtable
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"time"
+)
+
+/* hlcTimestamp is a hybrid logical clock timestamp. Wall is physical time in nanoseconds, taken from local
+clock or merged from clocks of other nodes, and logical orders timestamps that share the same wall time.
+
+Timestamps generated by one node always increase, and every node merges timestamps it receives from other
+nodes, so a write that follows another write it has seen is ordered after it, regardless of clock skew
+between the hosts.
+*/
+type hlcTimestamp struct {
+	wall    int64
+	logical int32
+}
+
+func (t hlcTimestamp) Before(o hlcTimestamp) bool {
+	return t.wall < o.wall || (t.wall == o.wall && t.logical < o.logical)
+}
+
+func (t hlcTimestamp) After(o hlcTimestamp) bool {
+	return o.Before(t)
+}
+
+func (t hlcTimestamp) Equal(o hlcTimestamp) bool {
+	return t == o
+}
+
+func (t hlcTimestamp) IsZero() bool {
+	return t.wall == 0 && t.logical == 0
+}
+
+// Time returns wall time of the timestamp.
+func (t hlcTimestamp) Time() time.Time {
+	return time.Unix(0, t.wall)
+}
+
+func (t hlcTimestamp) String() string {
+	return fmt.Sprintf("%d.%d", t.wall, t.logical)
+}
+
+const (
+	// remote timestamps further ahead of local time than this are not merged, unless Config.MaxClockSkew is set
+	defaultMaxClockOffset = 5 * time.Minute
+	// rejected timestamps are reported at most this often
+	clockReportInterval = 10 * time.Second
+)
+
+/* hlClock is node's hybrid logical clock. Timestamps more than maxOffset ahead of local time are not
+merged, so that a peer with broken clock (or a corrupt message) can't push the clock far into the future,
+where every timestamp it generates would win over later writes. Rejected timestamps are passed to report,
+at most once per clockReportInterval, along with the number of them since the last report.
+*/
+type hlClock struct {
+	lock        sync.Mutex
+	last        hlcTimestamp
+	maxOffset   time.Duration // 0 merges any timestamp
+	report      func(t hlcTimestamp, ahead time.Duration, rejected int)
+	rejected    int
+	last_report time.Time
+}
+
+func newHLClock(maxOffset time.Duration, report func(t hlcTimestamp, ahead time.Duration, rejected int)) *hlClock {
+	return &hlClock{maxOffset: maxOffset, report: report}
+}
+
+// now returns new timestamp, greater than any timestamp generated or seen by this clock.
+func (c *hlClock) now() hlcTimestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if wall := time.Now().UnixNano(); wall > c.last.wall {
+		c.last = hlcTimestamp{wall: wall}
+	} else {
+		c.last.logical++
+	}
+	return c.last
+}
+
+// update merges timestamp received from another node into the clock. It returns false if timestamp
+// is too far ahead of local time and was not merged.
+func (c *hlClock) update(t hlcTimestamp) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.maxOffset > 0 {
+		now := time.Now()
+		if ahead := time.Duration(t.wall - now.UnixNano()); ahead > c.maxOffset {
+			c.rejected++
+			if c.report != nil && now.Sub(c.last_report) >= clockReportInterval {
+				c.report(t, ahead, c.rejected)
+				c.rejected = 0
+				c.last_report = now
+			}
+			return false
+		}
+	}
+	if t.After(c.last) {
+		c.last = t
+	}
+	return true
+}
+
+// checkClockSkew fails with ErrClockSkew if MaxClockSkew is set, and the majority of peers' clocks is
+// further from local clock than that.
+func (dt *DTable) checkClockSkew() error {
+	if dt.conf.MaxClockSkew <= 0 {
+		return nil
+	}
+	skew, ok := dt.ring.ClockSkew()
+	if !ok || (skew <= dt.conf.MaxClockSkew && skew >= -dt.conf.MaxClockSkew) {
+		return nil
+	}
+	dt.Logf(LogDebug, "checkClockSkew() - refusing write, peers' clocks are %s from local clock\n", skew)
+	return ErrClockSkew
+}
+
+// withClock adds local clock to response, so that requesting node can merge it.
+func (dt *DTable) withClock(resp *PBDTableResponse) *PBDTableResponse {
+	now := dt.clock.now()
+	resp.ClockWall = proto.Int64(now.wall)
+	resp.ClockLogical = proto.Int32(now.logical)
+	return resp
+}
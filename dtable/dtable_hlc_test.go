@@ -0,0 +1,82 @@
+package dtable
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLClockNow(t *testing.T) {
+	c := newHLClock(time.Minute, nil)
+	last := c.now()
+	for i := 0; i < 10000; i++ {
+		ts := c.now()
+		if !ts.After(last) {
+			t.Fatalf("timestamp %s is not after %s", ts, last)
+		}
+		last = ts
+	}
+}
+
+func TestHLClockUpdate(t *testing.T) {
+	c := newHLClock(time.Minute, nil)
+	local := c.now()
+
+	// older timestamps don't move the clock back
+	if !c.update(hlcTimestamp{wall: local.wall - int64(time.Hour)}) {
+		t.Fatal("old timestamp was rejected")
+	}
+	if ts := c.now(); !ts.After(local) {
+		t.Fatalf("timestamp %s is not after %s", ts, local)
+	}
+
+	// timestamps ahead of local time, within offset, are merged
+	remote := hlcTimestamp{wall: time.Now().Add(30 * time.Second).UnixNano(), logical: 5}
+	if !c.update(remote) {
+		t.Fatal("timestamp within offset was rejected")
+	}
+	ts := c.now()
+	if !ts.After(remote) || ts.wall != remote.wall || ts.logical != remote.logical+1 {
+		t.Fatalf("expected %d.%d after merge, got %s", remote.wall, remote.logical+1, ts)
+	}
+	if next := c.now(); !next.After(ts) {
+		t.Fatalf("timestamp %s is not after %s", next, ts)
+	}
+}
+
+func TestHLClockRejectsFarAhead(t *testing.T) {
+	reports := 0
+	var reported hlcTimestamp
+	c := newHLClock(time.Minute, func(ts hlcTimestamp, ahead time.Duration, rejected int) {
+		reports++
+		reported = ts
+		if ahead <= time.Minute || rejected != 1 {
+			t.Errorf("unexpected report - %s ahead, %d rejected", ahead, rejected)
+		}
+	})
+	far := hlcTimestamp{wall: time.Now().Add(time.Hour).UnixNano()}
+	if c.update(far) {
+		t.Fatal("timestamp an hour ahead was merged")
+	}
+	if ts := c.now(); !ts.Before(far) {
+		t.Fatalf("clock moved to %s", ts)
+	}
+	if reports != 1 || !reported.Equal(far) {
+		t.Fatalf("expected one report of %s, got %d of %s", far, reports, reported)
+	}
+	// further rejects are counted, but not reported until clockReportInterval passes
+	for i := 0; i < 10; i++ {
+		c.update(far)
+	}
+	if reports != 1 || c.rejected != 10 {
+		t.Fatalf("expected 1 report and 10 pending rejects, got %d and %d", reports, c.rejected)
+	}
+
+	// without offset, any timestamp is merged
+	c = newHLClock(0, nil)
+	if !c.update(far) {
+		t.Fatal("timestamp was rejected without offset")
+	}
+	if ts := c.now(); !ts.After(far) {
+		t.Fatalf("timestamp %s is not after %s", ts, far)
+	}
+}
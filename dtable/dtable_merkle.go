@@ -0,0 +1,358 @@
+package dtable
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"github.com/fastfn/dendrite"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// key range is split into 2^merkleDepth leaves
+	merkleDepth = 8
+	// how often primaries compare their keys with remote replicas
+	antiEntropyInterval = 1 * time.Minute
+	// how long replica keeps the tree it built for primary's sync session
+	merkleSessionTTL = 30 * time.Second
+)
+
+/* merkleTree is a hash tree over commited, unexpired items of one key range. Range is split into equal leaves,
+and each leaf hashes (keyHash, timestamp, tombstone, value) of its items, sorted by keyHash. Inner nodes
+hash their children. Nodes are stored as in a heap: root is nodes[1], children of node i are 2i and 2i+1,
+and leaves are nodes [2^merkleDepth, 2^(merkleDepth+1)).
+
+Primary builds the tree over its table, and replica over its rtable, so that both sides can compare
+the same range level by level and find leaves that differ. Each side builds its tree once per sync session,
+so all levels and items of a session come from the same snapshot.
+*/
+type merkleTree struct {
+	kr     *dendrite.KeyRange
+	nodes  [][]byte
+	leaves [][]*kvItem
+}
+
+func newMerkleTree(kr *dendrite.KeyRange, items Storage) *merkleTree {
+	numLeaves := 1 << merkleDepth
+	mt := &merkleTree{
+		kr:     kr,
+		nodes:  make([][]byte, 2*numLeaves),
+		leaves: make([][]*kvItem, numLeaves),
+	}
+	forRange(items, kr, func(item *kvItem) bool {
+		if item.commited && !item.expired() {
+			idx := mt.leafIndex(item.keyHash)
+			mt.leaves[idx] = append(mt.leaves[idx], item)
+		}
+		return true
+	})
+	for idx, leaf := range mt.leaves {
+		sort.Sort(byKeyHash(leaf))
+		h := sha1.New()
+		ts := make([]byte, 8)
+		for _, item := range leaf {
+			h.Write(item.keyHash)
+			binary.BigEndian.PutUint64(ts, uint64(item.timestamp.wall))
+			h.Write(ts)
+			binary.BigEndian.PutUint64(ts, uint64(item.timestamp.logical))
+			h.Write(ts)
+			if item.tombstone {
+				h.Write([]byte{1})
+			} else {
+				h.Write([]byte{0})
+			}
+			h.Write(item.Val)
+		}
+		mt.nodes[numLeaves+idx] = h.Sum(nil)
+	}
+	for idx := numLeaves - 1; idx > 0; idx-- {
+		h := sha1.New()
+		h.Write(mt.nodes[2*idx])
+		h.Write(mt.nodes[2*idx+1])
+		mt.nodes[idx] = h.Sum(nil)
+	}
+	return mt
+}
+
+// forRange calls fn for items of key range kr, which may wrap around the end of hash space, until fn returns false.
+func forRange(items Storage, kr *dendrite.KeyRange, fn func(item *kvItem) bool) {
+	if bytes.Compare(kr.Start, kr.End) < 0 {
+		items.Range(kr.Start, kr.End, fn)
+		return
+	}
+	// (start, max] and [0, end]. Range with start equal to end spans the whole ring.
+	stopped := false
+	items.Range(kr.Start, bytes.Repeat([]byte{0xff}, len(kr.End)), func(item *kvItem) bool {
+		stopped = !fn(item)
+		return !stopped
+	})
+	if !stopped {
+		items.Range(nil, kr.End, fn)
+	}
+}
+
+// merkleSession is replica's tree for primary's ongoing sync of a key range.
+type merkleSession struct {
+	tree    *merkleTree
+	created time.Time
+}
+
+/* replicaMerkleTree returns replica's tree for primary's sync session of key range kr. Session starts when
+primary asks for the root, which builds new tree over replica's rtable. Further levels and items are served
+from the same tree, until primary asks for the items or the session expires.
+*/
+func (dt *DTable) replicaMerkleTree(vn_key_str string, r_table Storage, kr *dendrite.KeyRange, start bool) *merkleTree {
+	session_key := merkleSessionKey(vn_key_str, kr)
+	dt.merkle_lock.Lock()
+	defer dt.merkle_lock.Unlock()
+	if session, ok := dt.merkle_sessions[session_key]; ok && !start && time.Since(session.created) < merkleSessionTTL {
+		return session.tree
+	}
+	for key, session := range dt.merkle_sessions {
+		if time.Since(session.created) >= merkleSessionTTL {
+			delete(dt.merkle_sessions, key)
+		}
+	}
+	tree := newMerkleTree(kr, r_table)
+	dt.merkle_sessions[session_key] = &merkleSession{tree: tree, created: time.Now()}
+	return tree
+}
+
+func merkleSessionKey(vn_key_str string, kr *dendrite.KeyRange) string {
+	return fmt.Sprintf("%s-%x-%x", vn_key_str, kr.Start, kr.End)
+}
+
+// endMerkleSession drops replica's tree for key range kr, once primary got the items.
+func (dt *DTable) endMerkleSession(vn_key_str string, kr *dendrite.KeyRange) {
+	dt.merkle_lock.Lock()
+	delete(dt.merkle_sessions, merkleSessionKey(vn_key_str, kr))
+	dt.merkle_lock.Unlock()
+}
+
+// leafIndex returns the leaf for keyHash, by its offset from the start of the range (start, end].
+func (mt *merkleTree) leafIndex(keyHash []byte) int {
+	ring_size := new(big.Int).Lsh(big.NewInt(1), uint(8*len(keyHash)))
+	start := new(big.Int).SetBytes(mt.kr.Start)
+	size := new(big.Int).Sub(new(big.Int).SetBytes(mt.kr.End), start)
+	size.Mod(size, ring_size)
+	if size.Sign() == 0 {
+		// range spans the whole ring
+		size = ring_size
+	}
+	offset := new(big.Int).Sub(new(big.Int).SetBytes(keyHash), start)
+	offset.Mod(offset, ring_size)
+	offset.Sub(offset, big.NewInt(1)) // start is exclusive
+	offset.Mod(offset, ring_size)
+
+	offset.Lsh(offset, merkleDepth)
+	offset.Div(offset, size)
+	idx := int(offset.Int64())
+	if idx >= len(mt.leaves) {
+		idx = len(mt.leaves) - 1
+	}
+	return idx
+}
+
+// isLeaf checks if node index points to a leaf.
+func (mt *merkleTree) isLeaf(node int) bool {
+	return node >= len(mt.leaves)
+}
+
+// leafItems returns items under given leaf nodes.
+func (mt *merkleTree) leafItems(nodes []int) []*kvItem {
+	rv := make([]*kvItem, 0)
+	for _, node := range nodes {
+		if mt.isLeaf(node) && node < len(mt.nodes) {
+			rv = append(rv, mt.leaves[node-len(mt.leaves)]...)
+		}
+	}
+	return rv
+}
+
+/* diffLeaves walks down the tree level by level, comparing its nodes with remote tree's nodes, which
+remote returns for given node indexes. Only children of differing nodes are compared on the next level.
+It returns indexes of leaves that differ, or none if trees are equal.
+*/
+func (mt *merkleTree) diffLeaves(remote func(nodes []int) ([][]byte, error)) ([]int, error) {
+	nodes := []int{1}
+	for {
+		hashes, err := remote(nodes)
+		if err != nil {
+			return nil, err
+		}
+		if len(hashes) != len(nodes) {
+			return nil, fmt.Errorf("replica returned %d hashes for %d nodes", len(hashes), len(nodes))
+		}
+		diff := make([]int, 0)
+		for idx, node := range nodes {
+			if !bytes.Equal(mt.nodes[node], hashes[idx]) {
+				diff = append(diff, node)
+			}
+		}
+		if len(diff) == 0 || mt.isLeaf(diff[0]) {
+			return diff, nil
+		}
+		nodes = make([]int, 0, 2*len(diff))
+		for _, node := range diff {
+			nodes = append(nodes, 2*node, 2*node+1)
+		}
+	}
+}
+
+type byKeyHash []*kvItem
+
+func (s byKeyHash) Len() int           { return len(s) }
+func (s byKeyHash) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKeyHash) Less(i, j int) bool { return bytes.Compare(s[i].keyHash, s[j].keyHash) == -1 }
+
+// antiEntropy compares each local vnode's primary keys with its remote replicas and repairs the differences.
+func (dt *DTable) antiEntropy() {
+	for _, kr := range dt.ring.OwnedRanges() {
+		if _, ok := dt.table[kr.Vnode.String()]; !ok {
+			continue
+		}
+		handler, _ := dt.transport.GetVnodeHandler(kr.Vnode)
+		if handler == nil {
+			continue
+		}
+		remote_succs, err := handler.FindRemoteSuccessors(dt.ring.Replicas())
+		if err != nil {
+			dt.Logf(LogDebug, "antiEntropy() - could not find replica nodes for %s - %s\n", kr.Vnode.String(), err)
+			continue
+		}
+		// one tree serves all replicas of the range
+		local := newMerkleTree(kr, dt.table[kr.Vnode.String()])
+		for _, replica := range remote_succs {
+			if replica == nil {
+				continue
+			}
+			if err := dt.syncReplica(kr, local, replica); err != nil {
+				dt.Logf(LogInfo, "antiEntropy() - failed to sync %s with replica %s - %s\n", kr.Vnode.String(), replica.String(), err)
+			}
+		}
+	}
+}
+
+// syncReplica walks down merkle trees of primary vnode and its replica, comparing only the nodes that differ,
+// and then repairs the keys under differing leaves.
+func (dt *DTable) syncReplica(kr *dendrite.KeyRange, local *merkleTree, replica *dendrite.Vnode) error {
+	nodes, err := local.diffLeaves(func(nodes []int) ([][]byte, error) {
+		return dt.remoteMerkleNodes(kr, replica, nodes)
+	})
+	if err != nil || len(nodes) == 0 {
+		return err
+	}
+
+	remote_items, err := dt.remoteMerkleItems(kr, replica, nodes)
+	if err != nil {
+		return err
+	}
+	dt.Logf(LogDebug, "syncReplica() - %s and replica %s differ in %d leaves\n", kr.Vnode.String(), replica.String(), len(nodes))
+	dt.repairReplica(kr.Vnode, replica, local.leafItems(nodes), remote_items)
+	return nil
+}
+
+/* repairReplica compares primary's items with replica's items from differing leaves:
+	- if replica's version is newer, it is written to primary table, subject to putItem() rules,
+	  and replicated again
+	- if replica's version is older or missing, primary's version is streamed to replica, where it is
+	  written with the same rules
+	- keys that replica holds and primary doesn't are written to primary table and replicated, as
+	  primary may have lost them (i.e. restarted without disk storage). Deletes are kept as tombstones
+	  for TombstoneGrace, so a key that primary deleted is written back as a tombstone, not as a value.
+	  Keys older than TombstoneGrace are skipped, as primary may have deleted them and purged the tombstone.
+*/
+func (dt *DTable) repairReplica(vnode, replica *dendrite.Vnode, local_items, remote_items []*kvItem) {
+	remote := make(map[string]*kvItem)
+	for _, ritem := range remote_items {
+		remote[ritem.keyHashString()] = ritem
+	}
+	push := make([]*kvItem, 0)
+	for _, item := range local_items {
+		key_str := item.keyHashString()
+		ritem, ok := remote[key_str]
+		delete(remote, key_str)
+		if ok && ritem.timestamp.Equal(item.timestamp) && ritem.tombstone == item.tombstone && bytes.Equal(ritem.Val, item.Val) {
+			continue
+		}
+		if ok && ritem.timestamp.After(item.timestamp) {
+			dt.repairPrimary(vnode, ritem)
+			continue
+		}
+
+		item.lock.Lock()
+		depth := -1
+		if item.replicaInfo != nil {
+			for idx, rvn := range item.replicaInfo.vnodes {
+				if rvn != nil && bytes.Equal(rvn.Id, replica.Id) {
+					depth = idx
+				}
+			}
+		}
+		if depth == -1 {
+			// replica is not in item's replica set yet, so all of item's replicas need to be rewritten
+			dt.replicateKey(vnode, item, dt.ring.Replicas())
+		} else {
+			repl_item := item.dup()
+			repl_item.replicaInfo.depth = depth
+			push = append(push, repl_item)
+		}
+		item.lock.Unlock()
+	}
+
+	deadline := time.Now().Add(-dt.conf.TombstoneGrace)
+	for _, ritem := range remote {
+		if ritem.timestamp.Time().Before(deadline) {
+			continue
+		}
+		dt.repairPrimary(vnode, ritem)
+	}
+	if len(push) > 0 {
+		if err := dt.remoteRepairReplica(vnode, replica, push); err != nil {
+			dt.Logf(LogInfo, "repairReplica() - failed to repair replica %s - %s\n", replica.String(), err)
+		}
+	}
+}
+
+// repairPrimary writes replica's newer version of an item to primary table and replicates it. Like set(), it
+// writes through putVersioned(), so the write is ordered with concurrent writes to the key, and key's version
+// never goes back.
+func (dt *DTable) repairPrimary(vnode *dendrite.Vnode, ritem *kvItem) {
+	item := ritem.dup()
+	item.lock = new(sync.Mutex)
+	item.commited = true
+	if item.replicaInfo == nil {
+		item.replicaInfo = new(kvReplicaInfo)
+		item.replicaInfo.vnodes = make([]*dendrite.Vnode, 0)
+		item.replicaInfo.orphan_vnodes = make([]*dendrite.Vnode, 0)
+	}
+	item.replicaInfo.master = vnode
+	item.replicaInfo.depth = 0
+
+	item.lock.Lock()
+	defer item.lock.Unlock()
+	if _, err := dt.putVersioned(dt.table[vnode.String()], item); err != nil {
+		dt.Logf(LogDebug, "repairPrimary() - %s\n", err)
+		return
+	}
+	dt.replicateKey(vnode, item, dt.ring.Replicas())
+}
+
+// repairReplicaItems is called on replica to write items streamed by primary during anti-entropy.
+func (dt *DTable) repairReplicaItems(vnode *dendrite.Vnode, items []*kvItem) error {
+	rtable, ok := dt.rtable[vnode.String()]
+	if !ok {
+		return fmt.Errorf("local replica table not found for vnode %s", vnode.String())
+	}
+	for _, item := range items {
+		item.commited = true
+		if err := putItem(rtable, item); err != nil {
+			dt.Logf(LogDebug, "repairReplicaItems() - %s\n", err)
+		}
+	}
+	return nil
+}
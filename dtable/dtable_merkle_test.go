@@ -0,0 +1,183 @@
+package dtable
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fastfn/dendrite"
+	"testing"
+	"time"
+)
+
+// hashAt returns 20 byte key hash with given leading byte, and last byte set to low.
+func hashAt(high, low byte) []byte {
+	rv := make([]byte, 20)
+	rv[0] = high
+	rv[19] = low
+	return rv
+}
+
+func testItem(keyHash []byte, val string, wall int64) *kvItem {
+	item := new(kvItem)
+	item.Key = []byte(fmt.Sprintf("%x", keyHash))
+	item.Val = []byte(val)
+	item.keyHash = keyHash
+	item.timestamp = hlcTimestamp{wall: wall}
+	item.commited = true
+	return item
+}
+
+func TestMerkleLeafIndex(t *testing.T) {
+	last := 1<<merkleDepth - 1
+	cases := []struct {
+		name       string
+		start, end []byte
+		key        []byte
+		leaf       int
+	}{
+		{"first key", hashAt(0x10, 0), hashAt(0x20, 0), hashAt(0x10, 1), 0},
+		{"middle", hashAt(0x10, 0), hashAt(0x20, 0), hashAt(0x18, 1), 1 << (merkleDepth - 1)},
+		{"end is inclusive", hashAt(0x10, 0), hashAt(0x20, 0), hashAt(0x20, 0), last},
+		{"wrap, before zero", hashAt(0xf0, 0), hashAt(0x10, 0), hashAt(0xf0, 1), 0},
+		{"wrap, last before zero", hashAt(0xf0, 0), hashAt(0x10, 0), bytes.Repeat([]byte{0xff}, 20), 1<<(merkleDepth-1) - 1},
+		{"wrap, zero", hashAt(0xf0, 0), hashAt(0x10, 0), hashAt(0x00, 1), 1 << (merkleDepth - 1)},
+		{"wrap, end", hashAt(0xf0, 0), hashAt(0x10, 0), hashAt(0x10, 0), last},
+		{"whole ring, first key", hashAt(0x80, 0), hashAt(0x80, 0), hashAt(0x80, 1), 0},
+		{"whole ring, zero", hashAt(0x80, 0), hashAt(0x80, 0), hashAt(0x00, 0), 1<<(merkleDepth-1) - 1},
+		{"whole ring, start", hashAt(0x80, 0), hashAt(0x80, 0), hashAt(0x80, 0), last},
+	}
+	for _, c := range cases {
+		kr := &dendrite.KeyRange{Start: c.start, End: c.end}
+		mt := newMerkleTree(kr, make(itemMap))
+		if leaf := mt.leafIndex(c.key); leaf != c.leaf {
+			t.Errorf("%s: key %x is in leaf %d, expected %d", c.name, c.key, leaf, c.leaf)
+		}
+	}
+}
+
+// treeFetcher answers diffLeaves() with node hashes of tree, as replica would, and counts the rounds.
+func treeFetcher(mt *merkleTree, rounds *int) func(nodes []int) ([][]byte, error) {
+	return func(nodes []int) ([][]byte, error) {
+		*rounds++
+		rv := make([][]byte, len(nodes))
+		for idx, node := range nodes {
+			rv[idx] = mt.nodes[node]
+		}
+		return rv, nil
+	}
+}
+
+func TestMerkleDiffLeaves(t *testing.T) {
+	kr := &dendrite.KeyRange{Start: hashAt(0xf0, 0), End: hashAt(0x70, 0)}
+	primary := make(itemMap)
+	replica := make(itemMap)
+	// keys wrap around zero, all within the range
+	keyAt := func(i int) []byte {
+		return hashAt(byte(0xf1+i), byte(i))
+	}
+	for i := 0; i < 100; i++ {
+		keyHash := keyAt(i)
+		primary.Put(testItem(keyHash, "v", 1))
+		replica.Put(testItem(keyHash, "v", 1))
+	}
+	// outside of the range, not compared
+	replica.Put(testItem(hashAt(0x80, 1), "v", 1))
+
+	rounds := 0
+	local := newMerkleTree(kr, primary)
+	diff, err := local.diffLeaves(treeFetcher(newMerkleTree(kr, replica), &rounds))
+	if err != nil || len(diff) != 0 || rounds != 1 {
+		t.Fatalf("equal trees - diff %v, err %v, rounds %d", diff, err, rounds)
+	}
+
+	changed := keyAt(10)
+	replica.Put(testItem(changed, "v", 2))
+	extra := hashAt(0x30, 0xaa)
+	replica.Put(testItem(extra, "v", 1))
+	deleted := testItem(keyAt(60), "", 3)
+	deleted.tombstone = true
+	replica.Put(deleted)
+
+	rounds = 0
+	diff, err = local.diffLeaves(treeFetcher(newMerkleTree(kr, replica), &rounds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rounds != merkleDepth+1 {
+		t.Errorf("expected %d rounds, got %d", merkleDepth+1, rounds)
+	}
+	numLeaves := 1 << merkleDepth
+	expected := map[int]bool{
+		numLeaves + local.leafIndex(changed):         true,
+		numLeaves + local.leafIndex(extra):           true,
+		numLeaves + local.leafIndex(deleted.keyHash): true,
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("expected %d differing leaves, got %v", len(expected), diff)
+	}
+	for _, node := range diff {
+		if !expected[node] {
+			t.Fatalf("leaf %d should not differ", node)
+		}
+	}
+	items := local.leafItems(diff)
+	found := false
+	for _, item := range items {
+		if bytes.Equal(item.keyHash, changed) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("changed key is not among items of differing leaves")
+	}
+}
+
+func TestMerkleDiffLeavesErrors(t *testing.T) {
+	kr := &dendrite.KeyRange{Start: hashAt(0x10, 0), End: hashAt(0x20, 0)}
+	local := newMerkleTree(kr, make(itemMap))
+	if _, err := local.diffLeaves(func(nodes []int) ([][]byte, error) {
+		return nil, fmt.Errorf("unreachable")
+	}); err == nil {
+		t.Fatal("expected remote error")
+	}
+	if _, err := local.diffLeaves(func(nodes []int) ([][]byte, error) {
+		return make([][]byte, len(nodes)+1), nil
+	}); err == nil {
+		t.Fatal("expected error on wrong number of hashes")
+	}
+}
+
+func TestReplicaMerkleSession(t *testing.T) {
+	dt := &DTable{merkle_sessions: make(map[string]*merkleSession)}
+	kr := &dendrite.KeyRange{Start: hashAt(0x10, 0), End: hashAt(0x20, 0)}
+	rtable := make(itemMap)
+	rtable.Put(testItem(hashAt(0x15, 1), "v", 1))
+
+	tree := dt.replicaMerkleTree("vn", rtable, kr, true)
+	rtable.Put(testItem(hashAt(0x15, 2), "v", 1))
+	// lower levels of the same session come from the same snapshot
+	if same := dt.replicaMerkleTree("vn", rtable, kr, false); same != tree {
+		t.Fatal("tree was rebuilt within the session")
+	}
+	// other ranges and vnodes have their own sessions
+	other := &dendrite.KeyRange{Start: hashAt(0x20, 0), End: hashAt(0x30, 0)}
+	if dt.replicaMerkleTree("vn", rtable, other, false) == tree || dt.replicaMerkleTree("vn2", rtable, kr, false) == tree {
+		t.Fatal("session was shared")
+	}
+	// new session sees the change
+	fresh := dt.replicaMerkleTree("vn", rtable, kr, true)
+	if fresh == tree || bytes.Equal(fresh.nodes[1], tree.nodes[1]) {
+		t.Fatal("new session did not rebuild the tree")
+	}
+	dt.endMerkleSession("vn", kr)
+	if dt.replicaMerkleTree("vn", rtable, kr, false) == fresh {
+		t.Fatal("ended session was reused")
+	}
+	dt.merkle_sessions[merkleSessionKey("vn", kr)].created = time.Now().Add(-merkleSessionTTL)
+	if len(dt.merkle_sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %d", len(dt.merkle_sessions))
+	}
+	dt.replicaMerkleTree("vn", rtable, kr, false)
+	if len(dt.merkle_sessions) != 3 {
+		t.Fatalf("expired session was not replaced, %d sessions", len(dt.merkle_sessions))
+	}
+}
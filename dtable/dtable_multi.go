@@ -0,0 +1,173 @@
+package dtable
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fastfn/dendrite"
+	"sync"
+)
+
+// max number of keys of a batch request that are written or read at the same time
+const maxBatchWorkers = 32
+
+// multiBatch holds items of a batch request that are owned by the same primary vnode.
+type multiBatch struct {
+	owner *dendrite.Vnode
+	pos   []int // positions of items in caller's request
+	items []*kvItem
+}
+
+// batchByOwner groups items by their primary vnode. Items whose primary could not be found get an error in errs.
+func (dt *DTable) batchByOwner(items []*kvItem, errs []error) []*multiBatch {
+	batches := make(map[string]*multiBatch)
+	rv := make([]*multiBatch, 0)
+	for pos, item := range items {
+		succs, err := dt.ring.Lookup(1, item.keyHash)
+		if err != nil {
+			errs[pos] = err
+			continue
+		}
+		if len(succs) == 0 || succs[0] == nil {
+			errs[pos] = fmt.Errorf("successor lookup failed for key, %x", item.keyHash)
+			continue
+		}
+		batch, ok := batches[succs[0].String()]
+		if !ok {
+			batch = &multiBatch{owner: succs[0]}
+			batches[succs[0].String()] = batch
+			rv = append(rv, batch)
+		}
+		batch.pos = append(batch.pos, pos)
+		batch.items = append(batch.items, item)
+	}
+	return rv
+}
+
+// setMulti writes items to their primaries, with one request per primary vnode, sent in parallel.
+// It returns errors in the same order as items.
+func (dt *DTable) setMulti(items []*kvItem, minAcks int) []error {
+	errs := make([]error, len(items))
+	var wg sync.WaitGroup
+	for _, batch := range dt.batchByOwner(items, errs) {
+		wg.Add(1)
+		go func(batch *multiBatch) {
+			defer wg.Done()
+			var batch_errs []error
+			if _, ok := dt.table[batch.owner.String()]; ok {
+				batch_errs = dt.setBatch(batch.owner, batch.items, minAcks)
+			} else {
+				batch_errs = dt.remoteSetMulti(batch.owner, batch.items, minAcks)
+			}
+			for idx, pos := range batch.pos {
+				errs[pos] = batch_errs[idx]
+			}
+		}(batch)
+	}
+	wg.Wait()
+	return errs
+}
+
+// setBatch writes items to local primary vnode, up to maxBatchWorkers at a time, and returns errors
+// in the same order as items.
+func (dt *DTable) setBatch(vn *dendrite.Vnode, items []*kvItem, minAcks int) []error {
+	errs := make([]error, len(items))
+	inParallel(len(items), func(idx int) {
+		done := make(chan error)
+		go dt.set(vn, items[idx], minAcks, done)
+		errs[idx] = <-done
+	})
+	return errs
+}
+
+// inParallel calls fn for each index in [0, n), from at most maxBatchWorkers goroutines, and waits for them.
+func inParallel(n int, fn func(idx int)) {
+	workers := maxBatchWorkers
+	if n < workers {
+		workers = n
+	}
+	idx_c := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idx_c {
+				fn(idx)
+			}
+		}()
+	}
+	for idx := 0; idx < n; idx++ {
+		idx_c <- idx
+	}
+	close(idx_c)
+	wg.Wait()
+}
+
+/* getMulti reads items from their primaries, with one request per primary vnode, sent in parallel. If request
+to primary fails, its keys are read one by one, as with get(). With minReads above 1, each key is read
+with getConsistent(), up to maxBatchWorkers at a time.
+
+It returns items and errors in the same order as requested items. Item is nil if key was not found.
+*/
+func (dt *DTable) getMulti(reqItems []*kvItem, minReads int) ([]*kvItem, []error) {
+	rv := make([]*kvItem, len(reqItems))
+	errs := make([]error, len(reqItems))
+	if minReads > 1 {
+		inParallel(len(reqItems), func(idx int) {
+			rv[idx], errs[idx] = dt.getConsistent(reqItems[idx], minReads)
+		})
+		return rv, errs
+	}
+
+	var wg sync.WaitGroup
+	for _, batch := range dt.batchByOwner(reqItems, errs) {
+		wg.Add(1)
+		go func(batch *multiBatch) {
+			defer wg.Done()
+			if vn_table, ok := dt.table[batch.owner.String()]; ok {
+				for idx, pos := range batch.pos {
+					rv[pos] = primaryItem(vn_table, batch.items[idx].keyHashString())
+				}
+				return
+			}
+			items, err := dt.remoteGetMulti(batch.owner, batch.items)
+			if err != nil {
+				dt.Logln(LogDebug, "getMulti() - remoteGetMulti error -", err)
+				for idx, pos := range batch.pos {
+					rv[pos], errs[pos] = dt.get(batch.items[idx], 1)
+				}
+				return
+			}
+			for idx, pos := range batch.pos {
+				if item := items[idx]; item != nil && !item.tombstone && !item.expired() {
+					rv[pos] = item
+				}
+			}
+		}(batch)
+	}
+	wg.Wait()
+	return rv, errs
+}
+
+// primaryItem returns a copy of commited item from local primary table, or nil if key is not found,
+// deleted or expired.
+func primaryItem(vn_table Storage, key_str string) *kvItem {
+	if item, exists := vn_table.Get(key_str); exists && item.commited && !item.tombstone && !item.expired() {
+		return item.dup()
+	}
+	return nil
+}
+
+// batchError converts error returned for an item of remote batch request. Known errors are
+// converted back to their values.
+func batchError(msg string) error {
+	switch msg {
+	case "":
+		return nil
+	case ErrVersionConflict.Error():
+		return ErrVersionConflict
+	case ErrClockSkew.Error():
+		return ErrClockSkew
+	}
+	return errors.New(msg)
+}
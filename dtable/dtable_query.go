@@ -13,14 +13,22 @@ const (
 	qErr queryType = -1
 	qGet queryType = 0
 	qSet queryType = 1
+	qDel queryType = 2
 )
 
 // Query is dtable's native interface for doing data operations.
 type Query interface {
 	Consistency(int) Query
 	Get([]byte) (*KVItem, error)
-	Set([]byte, []byte) error // (key, val)
+	Set([]byte, []byte) error                       // (key, val)
+	SetWithTTL([]byte, []byte, time.Duration) error // (key, val, ttl)
+	CompareAndSet([]byte, uint64, []byte) error     // (key, expectedVersion, val)
+	SetIfAbsent([]byte, []byte) error               // (key, val)
+	SetMulti([]*KVItem) []error
+	GetMulti([][]byte) ([]*KVItem, []error)
+	Delete([]byte) error
 	GetLocalKeys() [][]byte
+	Scan([]byte, int, bool) (*ScanResult, error) // (cursor, limit, values)
 }
 
 // Query defines a dtable query.
@@ -43,7 +51,8 @@ func (dt *DTable) NewQuery() Query {
 
 // Consistency is used prior to Set() to request minimum writes before operation returns success.
 // If dtable runs with 2 replicas, user may request 2 writes (primary + 1 replica) and let dtable
-// handle final write in the background. If requested value is larger than configured dendrite replicas,
+// handle final write in the background. Used prior to Get(), it requests minimum number of copies
+// (primary + replicas) to read, see Get(). If requested value is larger than configured dendrite replicas,
 // value is reset to 1. Default is 1.
 func (q *query) Consistency(n int) Query {
 	if n >= 1 && n <= q.dt.ring.Replicas()+1 {
@@ -55,6 +64,10 @@ func (q *query) Consistency(n int) Query {
 // Get returns *KVItem for a key. If key is not found on this node, but node holds key replica, replica is returned.
 // If key is not found on this node, and node does not hold replica, request is forwarded to the node responsible
 // for this key. *KVItem is nil if key was not found, and error is set if there was an error during request.
+//
+// With Consistency(n) above 1, key is read from the primary and n-1 replicas in parallel, and the newest
+// version is returned. Stale or missing copies are updated with that version in the background (read repair).
+// Error is returned if fewer than n copies could be read.
 func (q *query) Get(key []byte) (*KVItem, error) {
 	if key == nil || len(key) == 0 {
 		return nil, fmt.Errorf("key can not be nil or empty")
@@ -63,7 +76,7 @@ func (q *query) Get(key []byte) (*KVItem, error) {
 	reqItem.Key = key
 	reqItem.keyHash = dendrite.HashKey(key)
 
-	item, err := q.dt.get(reqItem)
+	item, err := q.dt.get(reqItem, q.minAcks)
 	if err != nil {
 		return nil, err
 	}
@@ -74,29 +87,96 @@ func (q *query) Get(key []byte) (*KVItem, error) {
 	return &item.KVItem, nil
 }
 
-// Set writes to dtable.
+// Set writes to dtable. Setting nil value is the same as Delete().
 func (q *query) Set(key, val []byte) error {
 	if key == nil || len(key) == 0 {
 		return fmt.Errorf("key can not be nil or empty")
 	}
+	if val == nil {
+		return q.Delete(key)
+	}
+	q.qType = qSet
+	reqItem := q.newItem(key)
+	reqItem.Val = make([]byte, len(val))
+	copy(reqItem.Val, val)
+	return q.write(reqItem)
+}
+
+// SetWithTTL writes to dtable, with the key expiring after ttl. Expired key is not returned by Get(), and is
+// removed from primary and replicas by background reaper. Consistency() applies as with Set().
+func (q *query) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	if key == nil || len(key) == 0 {
+		return fmt.Errorf("key can not be nil or empty")
+	}
+	if val == nil {
+		return fmt.Errorf("value can not be nil")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
 	q.qType = qSet
+	reqItem := q.newItem(key)
+	reqItem.Val = make([]byte, len(val))
+	copy(reqItem.Val, val)
+	reqItem.expires = time.Now().Add(ttl)
+	return q.write(reqItem)
+}
+
+// CompareAndSet writes to dtable only if key's current version is expectedVersion, as returned in
+// KVItem.Version by Get(). Check is done on key's primary, atomically with the write. ErrVersionConflict
+// is returned if versions don't match. Expected version 0 means that key must not exist.
+func (q *query) CompareAndSet(key []byte, expectedVersion uint64, val []byte) error {
+	if key == nil || len(key) == 0 {
+		return fmt.Errorf("key can not be nil or empty")
+	}
+	if val == nil {
+		return fmt.Errorf("value can not be nil")
+	}
+	q.qType = qSet
+	reqItem := q.newItem(key)
+	reqItem.Val = make([]byte, len(val))
+	copy(reqItem.Val, val)
+	reqItem.expectedVersion = &expectedVersion
+	return q.write(reqItem)
+}
+
+// SetIfAbsent writes to dtable only if key does not exist. ErrVersionConflict is returned if it does.
+func (q *query) SetIfAbsent(key, val []byte) error {
+	return q.CompareAndSet(key, 0, val)
+}
+
+// Delete removes the key from dtable. Deleted key is kept as timestamped tombstone, which is replicated like
+// any other value, so that older copies of the key can't bring it back. Tombstones are purged after
+// Config.TombstoneGrace. Consistency() applies as with Set().
+func (q *query) Delete(key []byte) error {
+	if key == nil || len(key) == 0 {
+		return fmt.Errorf("key can not be nil or empty")
+	}
+	q.qType = qDel
+	reqItem := q.newItem(key)
+	reqItem.tombstone = true
+	return q.write(reqItem)
+}
+
+// newItem prepares new item for write.
+func (q *query) newItem(key []byte) *kvItem {
 	reqItem := new(kvItem)
 	reqItem.lock = new(sync.Mutex)
 
 	reqItem.Key = make([]byte, len(key))
 	copy(reqItem.Key, key)
 
-	if val != nil {
-		reqItem.Val = make([]byte, len(val))
-		copy(reqItem.Val, val)
-	}
-
 	reqItem.keyHash = dendrite.HashKey(key)
-	reqItem.timestamp = time.Now()
+	reqItem.timestamp = q.dt.clock.now()
+	reqItem.stamp = true
 	reqItem.replicaInfo = new(kvReplicaInfo)
 	reqItem.replicaInfo.vnodes = make([]*dendrite.Vnode, q.dt.ring.Replicas())
 	reqItem.replicaInfo.orphan_vnodes = make([]*dendrite.Vnode, 0)
+	return reqItem
+}
 
+// write sends the item to its primary vnode.
+func (q *query) write(reqItem *kvItem) error {
 	wait := make(chan error)
 	succs, err := q.dt.ring.Lookup(1, reqItem.keyHash)
 	if err != nil {
@@ -118,15 +198,91 @@ func (q *query) Set(key, val []byte) error {
 	return err
 }
 
+// SetMulti writes multiple items to dtable. Items are grouped by their primary vnode, and each group is sent
+// as a single request, in parallel with other groups. Item with nil value is deleted, as with Set().
+// Consistency() applies to each item. Errors are returned in the same order as items, nil for items
+// that were written.
+func (q *query) SetMulti(items []*KVItem) []error {
+	errs := make([]error, len(items))
+	reqItems := make([]*kvItem, 0, len(items))
+	pos := make([]int, 0, len(items))
+	q.qType = qSet
+	for idx, item := range items {
+		if item == nil || len(item.Key) == 0 {
+			errs[idx] = fmt.Errorf("key can not be nil or empty")
+			continue
+		}
+		reqItem := q.newItem(item.Key)
+		if item.Val == nil {
+			reqItem.tombstone = true
+		} else {
+			reqItem.Val = make([]byte, len(item.Val))
+			copy(reqItem.Val, item.Val)
+		}
+		reqItems = append(reqItems, reqItem)
+		pos = append(pos, idx)
+	}
+	for idx, err := range q.dt.setMulti(reqItems, q.minAcks) {
+		errs[pos[idx]] = err
+	}
+	return errs
+}
+
+// GetMulti reads multiple keys from dtable. Keys are grouped by their primary vnode, and each group is read
+// with a single request, in parallel with other groups. With Consistency(n) above 1, each key is read as
+// with Get(). Items and errors are returned in the same order as keys. Item is nil if key was not found.
+func (q *query) GetMulti(keys [][]byte) ([]*KVItem, []error) {
+	rv := make([]*KVItem, len(keys))
+	errs := make([]error, len(keys))
+	reqItems := make([]*kvItem, 0, len(keys))
+	pos := make([]int, 0, len(keys))
+	q.qType = qGet
+	for idx, key := range keys {
+		if len(key) == 0 {
+			errs[idx] = fmt.Errorf("key can not be nil or empty")
+			continue
+		}
+		reqItem := new(kvItem)
+		reqItem.Key = key
+		reqItem.keyHash = dendrite.HashKey(key)
+		reqItems = append(reqItems, reqItem)
+		pos = append(pos, idx)
+	}
+	items, item_errs := q.dt.getMulti(reqItems, q.minAcks)
+	for idx, item := range items {
+		errs[pos[idx]] = item_errs[idx]
+		if item != nil {
+			rv[pos[idx]] = &item.KVItem
+		}
+	}
+	return rv, errs
+}
+
+/* Scan returns up to limit items from the whole cluster, in key hash order, starting after cursor. Pass nil
+cursor to start from the beginning, and Cursor from returned ScanResult to get the next page. Scan is complete
+when returned Cursor is nil. Values are returned only if values is set.
+
+Each key range is read from its current primary, or from replicas if primary fails, so scan continues
+correctly when ranges move between vnodes. Keys written or deleted during the scan may or may not be seen.
+*/
+func (q *query) Scan(cursor []byte, limit int, values bool) (*ScanResult, error) {
+	q.qType = qGet
+	return q.dt.scan(cursor, limit, values)
+}
+
 // GetLocalKeys returns the list of keys that are stored on this node (across all vnodes).
 func (q *query) GetLocalKeys() [][]byte {
 	rv := make([][]byte, 0)
 	for _, table := range q.dt.table {
-		for _, item := range table {
+		table.ForEach(func(key_str string, item *kvItem) bool {
+			if item.tombstone || item.expired() {
+				return true
+			}
 			copy_key := make([]byte, len(item.Key))
 			copy(copy_key, item.Key)
 			rv = append(rv, copy_key)
-		}
+			return true
+		})
 	}
 	return rv
 }
@@ -0,0 +1,170 @@
+package dtable
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fastfn/dendrite"
+	"sync"
+)
+
+// readCopy is a copy of an item, as read from key's primary vnode or one of its replicas.
+type readCopy struct {
+	vnode   *dendrite.Vnode
+	replica bool
+	depth   int     // replica's position among remote successors of primary
+	item    *kvItem // nil if copy was not found
+	err     error
+}
+
+/* getConsistent reads a key from primary and minReads-1 replicas in parallel. If some of them fail,
+next replicas are tried until minReads copies are read. Newest copy by timestamp is returned, and written
+back to stale or missing copies in the background (read repair). If newest copy is a tombstone or has expired,
+key is not found.
+
+Copy missing on primary is no different from a stale one: primary may have lost the key, and replica's copy
+is written back to it. Deletes are kept as tombstones, which are newer than the values they delete, so
+a delete that did not reach a replica is not brought back.
+*/
+func (dt *DTable) getConsistent(reqItem *kvItem, minReads int) (*kvItem, error) {
+	succs, err := dt.ring.Lookup(dt.ring.NumSuccessors(), reqItem.keyHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(succs) == 0 || succs[0] == nil {
+		return nil, fmt.Errorf("successor lookup failed for key, %x", reqItem.keyHash)
+	}
+	targets := dt.readTargets(succs)
+	if minReads > len(targets) {
+		return nil, fmt.Errorf("insufficient nodes found for requested read consistency level (%d)", minReads)
+	}
+
+	read := make([]*readCopy, 0, minReads)
+	next := 0
+	for len(read) < minReads && next < len(targets) {
+		batch := targets[next:]
+		if len(batch) > minReads-len(read) {
+			batch = batch[:minReads-len(read)]
+		}
+		next += len(batch)
+		var wg sync.WaitGroup
+		for _, target := range batch {
+			wg.Add(1)
+			go func(target *readCopy) {
+				defer wg.Done()
+				target.item, target.err = dt.readCopy(target, reqItem)
+			}(target)
+		}
+		wg.Wait()
+		for _, target := range batch {
+			if target.err != nil {
+				dt.Logln(LogDebug, "getConsistent() - read failed on", target.vnode.String(), "-", target.err)
+				continue
+			}
+			read = append(read, target)
+		}
+	}
+	if len(read) < minReads {
+		return nil, fmt.Errorf("insufficient active nodes found for requested read consistency level (%d)", minReads)
+	}
+
+	var newest *kvItem
+	for _, c := range read {
+		if c.item != nil && (newest == nil || c.item.timestamp.After(newest.timestamp)) {
+			newest = c.item
+		}
+	}
+	if newest == nil {
+		return nil, nil
+	}
+	go dt.readRepair(targets[0].vnode, newest, read)
+	if newest.tombstone || newest.expired() {
+		return nil, nil
+	}
+	return newest.dup(), nil
+}
+
+// readTargets returns key's primary, followed by its replicas: first successors on distinct remote hosts,
+// same as primary's remote successors.
+func (dt *DTable) readTargets(succs []*dendrite.Vnode) []*readCopy {
+	primary := succs[0]
+	rv := []*readCopy{{vnode: primary}}
+	seen_hosts := map[string]bool{primary.Host: true}
+	for _, succ := range succs[1:] {
+		if len(rv) == dt.ring.Replicas()+1 {
+			break
+		}
+		if succ == nil || seen_hosts[succ.Host] {
+			continue
+		}
+		seen_hosts[succ.Host] = true
+		rv = append(rv, &readCopy{vnode: succ, replica: true, depth: len(rv) - 1})
+	}
+	return rv
+}
+
+// readCopy reads a copy from local table if target vnode is local, or from remote vnode.
+func (dt *DTable) readCopy(target *readCopy, reqItem *kvItem) (*kvItem, error) {
+	tables := dt.table
+	if target.replica {
+		tables = dt.rtable
+	}
+	if vn_table, ok := tables[target.vnode.String()]; ok {
+		if item, exists := vn_table.Get(reqItem.keyHashString()); exists && item.commited {
+			return item.dup(), nil
+		}
+		return nil, nil
+	}
+	item, _, err := dt.remoteGet(target.vnode, reqItem, target.replica)
+	return item, err
+}
+
+// readRepair writes newest version of an item to copies that are stale or missing. If primary is stale,
+// newest version is written through primary, which replicates it further. Otherwise, or if primary could
+// not be repaired, stale replicas are repaired directly, with the same timestamp rules as in anti-entropy.
+func (dt *DTable) readRepair(primary *dendrite.Vnode, newest *kvItem, read []*readCopy) {
+	stale := make([]*readCopy, 0)
+	for _, c := range read {
+		if c.item != nil && c.item.timestamp.Equal(newest.timestamp) && c.item.tombstone == newest.tombstone && bytes.Equal(c.item.Val, newest.Val) {
+			continue
+		}
+		stale = append(stale, c)
+	}
+	for _, c := range stale {
+		item := newest.dup()
+		item.lock = new(sync.Mutex)
+		if item.replicaInfo == nil {
+			item.replicaInfo = new(kvReplicaInfo)
+			item.replicaInfo.orphan_vnodes = make([]*dendrite.Vnode, 0)
+		}
+		item.replicaInfo.master = primary
+
+		if !c.replica {
+			dt.Logf(LogDebug, "readRepair() - repairing key %s on primary %s\n", item.keyHashString(), c.vnode.String())
+			item.replicaInfo.vnodes = make([]*dendrite.Vnode, dt.ring.Replicas())
+			done := make(chan error)
+			if _, ok := dt.table[c.vnode.String()]; ok {
+				go dt.set(c.vnode, item, 1, done)
+			} else {
+				go dt.remoteSet(c.vnode, c.vnode, item, 1, false, done)
+			}
+			if err := <-done; err != nil {
+				dt.Logf(LogDebug, "readRepair() - failed to repair primary %s - %s\n", c.vnode.String(), err)
+				continue
+			}
+			// primary replicates the item further
+			return
+		}
+
+		dt.Logf(LogDebug, "readRepair() - repairing key %s on replica %s\n", item.keyHashString(), c.vnode.String())
+		item.replicaInfo.depth = c.depth
+		var err error
+		if _, ok := dt.rtable[c.vnode.String()]; ok {
+			err = dt.repairReplicaItems(c.vnode, []*kvItem{item})
+		} else {
+			err = dt.remoteRepairReplica(primary, c.vnode, []*kvItem{item})
+		}
+		if err != nil {
+			dt.Logf(LogDebug, "readRepair() - failed to repair replica %s - %s\n", c.vnode.String(), err)
+		}
+	}
+}
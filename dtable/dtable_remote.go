@@ -4,559 +4,474 @@ import (
 	"fmt"
 	"github.com/fastfn/dendrite"
 	"github.com/golang/protobuf/proto"
-	zmq "github.com/pebbe/zmq4"
-	"time"
 )
 
-// Client Request: Get value for a key from remote host
-func (dt *DTable) remoteGet(remote *dendrite.Vnode, reqItem *kvItem) (*kvItem, bool, error) {
-	error_c := make(chan error, 1)
-	resp_c := make(chan *kvItem, 1)
-	notfound_c := make(chan bool, 1)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
-	go func() {
-
-		req_sock, err := zmq_transport.ZMQContext.NewSocket(zmq.REQ)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteGet - newsocket error - %s", err)
-			return
-		}
-		req_sock.SetRcvtimeo(2 * time.Second)
-		req_sock.SetSndtimeo(2 * time.Second)
-
-		defer req_sock.Close()
-		err = req_sock.Connect("tcp://" + remote.Host)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteGet - connect error - %s", err)
-			return
-		}
-		// Build request protobuf
-		req := &PBDTableGetItem{
-			Dest:    remote.ToProtobuf(),
-			KeyHash: reqItem.keyHash,
-		}
-
-		reqData, _ := proto.Marshal(req)
-		encoded := dt.transport.Encode(PbDtableGetItem, reqData)
-		_, err = req_sock.SendBytes(encoded, 0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteGet - error while sending request - %s", err)
-			return
-		}
-
-		// read response and decode it
-		resp, err := req_sock.RecvBytes(0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteGet - error while reading response - %s", err)
-			return
-		}
-		decoded, err := dt.transport.Decode(resp)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteGet - error while decoding response - %s", err)
-			return
-		}
-
-		switch decoded.Type {
-		case dendrite.PbErr:
-			pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteGet - got error response - %s", pbMsg.GetError())
-		case PbDtableItem:
-			pbMsg := decoded.TransportMsg.(PBDTableItem)
-			if found := pbMsg.GetFound(); !found {
-				notfound_c <- true
-				return
-			}
-			item := new(kvItem)
-			copy(item.Key, reqItem.Key)
-			copy(item.keyHash, reqItem.keyHash)
-			item.Val = pbMsg.GetVal()
-			resp_c <- item
-			return
-		default:
-			// unexpected response
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteGet - unexpected response")
-			return
-		}
-	}()
+// Client Request: Get value for a key from remote host, from its primary or replica table
+func (dt *DTable) remoteGet(remote *dendrite.Vnode, reqItem *kvItem, replica bool) (*kvItem, bool, error) {
+	// Build request protobuf
+	req := &PBDTableGetItem{
+		Dest:    remote.ToProtobuf(),
+		KeyHash: reqItem.keyHash,
+		Replica: proto.Bool(replica),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableGetItem, reqData)
+	if err != nil {
+		return nil, false, fmt.Errorf("DTable:remoteGet - %s", err)
+	}
 
-	select {
-	case <-time.After(zmq_transport.ClientTimeout):
-		return nil, false, fmt.Errorf("ZMQ:DTable:remoteGet - command timed out!")
-	case err := <-error_c:
-		return nil, false, err
-	case _ = <-notfound_c:
-		return nil, false, nil
-	case item := <-resp_c:
+	switch decoded.Type {
+	case dendrite.PbErr:
+		pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
+		return nil, false, fmt.Errorf("DTable:remoteGet - got error response - %s", pbMsg.GetError())
+	case PbDtableItem:
+		pbMsg := decoded.TransportMsg.(PBDTableItem)
+		if found := pbMsg.GetFound(); !found {
+			return nil, false, nil
+		}
+		item := new(kvItem)
+		item.from_protobuf(&pbMsg)
+		dt.clock.update(item.timestamp)
+		item.Key = reqItem.Key
+		item.keyHash = reqItem.keyHash
 		return item, true, nil
+	default:
+		// unexpected response
+		return nil, false, fmt.Errorf("DTable:remoteGet - unexpected response")
 	}
 }
 
 // Client Request: set value for a key to remote host
 func (dt *DTable) remoteSet(origin, remote *dendrite.Vnode, reqItem *kvItem, minAcks int, demoting bool, done chan error) {
-	//fmt.Printf("REMOTESET CALLED from %s to %s for key %s\n", origin.String(), remote.String(), reqItem.keyHashString())
-	error_c := make(chan error, 1)
-	resp_c := make(chan bool, 1)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
-
-	go func() {
-		req_sock, err := zmq_transport.ZMQContext.NewSocket(zmq.REQ)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - newsocket error - %s", err)
-			return
-		}
-		req_sock.SetRcvtimeo(5 * time.Second)
-		req_sock.SetSndtimeo(5 * time.Second)
-
-		defer req_sock.Close()
-		err = req_sock.Connect("tcp://" + remote.Host)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - connect error - %s", err)
-			return
-		}
-		// Build request protobuf
-		req := &PBDTableSetItem{
-			Origin:   origin.ToProtobuf(),
-			Dest:     remote.ToProtobuf(),
-			Item:     reqItem.to_protobuf(),
-			MinAcks:  proto.Int32(int32(minAcks)),
-			Demoting: proto.Bool(demoting),
-		}
-
-		reqData, _ := proto.Marshal(req)
-		encoded := dt.transport.Encode(PbDtableSetItem, reqData)
-		_, err = req_sock.SendBytes(encoded, 0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - error while sending request - %s", err)
-			return
-		}
-
-		// read response and decode it
-		resp, err := req_sock.RecvBytes(0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - error while reading response - %s", err)
-			return
-		}
-		decoded, err := dt.transport.Decode(resp)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - error while decoding response - %s", err)
-			return
-		}
-
-		switch decoded.Type {
-		case dendrite.PbErr:
-			pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - got error response - %s", pbMsg.GetError())
-		case PbDtableResponse:
-			pbMsg := decoded.TransportMsg.(PBDTableResponse)
-			success := pbMsg.GetOk()
-			if success {
-				resp_c <- true
-				return
-			}
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - write error - %s", pbMsg.GetError())
-			return
-		default:
-			// unexpected response
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSet - unexpected response")
-			return
-		}
-	}()
-
-	select {
-	case <-time.After(zmq_transport.ClientTimeout):
-		done <- fmt.Errorf("ZMQ:DTable:remoteSet - command timed out!")
-	case err := <-error_c:
-		done <- err
-	case _ = <-resp_c:
-		done <- nil
+	// Build request protobuf
+	req := &PBDTableSetItem{
+		Origin:   origin.ToProtobuf(),
+		Dest:     remote.ToProtobuf(),
+		Item:     reqItem.to_protobuf(),
+		MinAcks:  proto.Int32(int32(minAcks)),
+		Demoting: proto.Bool(demoting),
+	}
+	if reqItem.expectedVersion != nil {
+		req.ExpectedVersion = proto.Uint64(*reqItem.expectedVersion)
 	}
+	if reqItem.stamp {
+		req.Stamp = proto.Bool(true)
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableSetItem, reqData)
+	if err != nil {
+		done <- fmt.Errorf("DTable:remoteSet - %s", err)
+		return
+	}
+	done <- dt.checkResponse("remoteSet", decoded)
 }
 
 // Client Request: set replicaInfo for replicated item to remote host
 func (dt *DTable) remoteSetReplicaInfo(remote *dendrite.Vnode, reqItem *kvItem) error {
-	error_c := make(chan error, 1)
-	resp_c := make(chan bool, 1)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
-
-	go func() {
-		req_sock, err := zmq_transport.ZMQContext.NewSocket(zmq.REQ)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - newsocket error - %s", err)
-			return
-		}
-		req_sock.SetRcvtimeo(5 * time.Second)
-		req_sock.SetSndtimeo(5 * time.Second)
-
-		defer req_sock.Close()
-		err = req_sock.Connect("tcp://" + remote.Host)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - connect error - %s", err)
-			return
-		}
-		// Build request protobuf
-		req := &PBDTableSetReplicaInfo{
-			Dest:        remote.ToProtobuf(),
-			KeyHash:     reqItem.keyHash,
-			ReplicaInfo: reqItem.replicaInfo.to_protobuf(),
-		}
-
-		reqData, _ := proto.Marshal(req)
-		encoded := dt.transport.Encode(PbDtableSetReplicaInfo, reqData)
-		_, err = req_sock.SendBytes(encoded, 0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - error while sending request - %s", err)
-			return
-		}
-
-		// read response and decode it
-		resp, err := req_sock.RecvBytes(0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - error while reading response - %s", err)
-			return
-		}
-		decoded, err := dt.transport.Decode(resp)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - error while decoding response - %s", err)
-			return
-		}
-
-		switch decoded.Type {
-		case dendrite.PbErr:
-			pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - got error response - %s", pbMsg.GetError())
-		case PbDtableResponse:
-			pbMsg := decoded.TransportMsg.(PBDTableResponse)
-			success := pbMsg.GetOk()
-			if success {
-				resp_c <- true
-				return
-			}
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - write error - %s", pbMsg.GetError())
-			return
-		default:
-			// unexpected response
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - unexpected response")
-			return
-		}
-	}()
-
-	select {
-	case <-time.After(zmq_transport.ClientTimeout):
-		return fmt.Errorf("ZMQ:DTable:remoteSetReplicaInfo - command timed out!")
-	case err := <-error_c:
-		return err
-	case _ = <-resp_c:
-		return nil
+	// Build request protobuf
+	req := &PBDTableSetReplicaInfo{
+		Dest:        remote.ToProtobuf(),
+		KeyHash:     reqItem.keyHash,
+		ReplicaInfo: reqItem.replicaInfo.to_protobuf(),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableSetReplicaInfo, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remoteSetReplicaInfo - %s", err)
 	}
+	return dt.checkResponse("remoteSetReplicaInfo", decoded)
 }
 
 // Client Request: remove replica
 func (dt *DTable) remoteClearReplica(remote *dendrite.Vnode, reqItem *kvItem, demoted bool) error {
-	error_c := make(chan error, 1)
-	resp_c := make(chan bool, 1)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
-
-	go func() {
-		req_sock, err := zmq_transport.ZMQContext.NewSocket(zmq.REQ)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - newsocket error - %s", err)
-			return
-		}
-		req_sock.SetRcvtimeo(5 * time.Second)
-		req_sock.SetSndtimeo(5 * time.Second)
-
-		defer req_sock.Close()
-		err = req_sock.Connect("tcp://" + remote.Host)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - connect error - %s", err)
-			return
-		}
-		// Build request protobuf
-		req := &PBDTableClearReplica{
-			Dest:    remote.ToProtobuf(),
-			KeyHash: reqItem.keyHash,
-			Demoted: proto.Bool(demoted),
-		}
-
-		reqData, _ := proto.Marshal(req)
-		encoded := dt.transport.Encode(PbDtableClearReplica, reqData)
-		_, err = req_sock.SendBytes(encoded, 0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - error while sending request - %s", err)
-			return
-		}
-
-		// read response and decode it
-		resp, err := req_sock.RecvBytes(0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - error while reading response - %s", err)
-			return
-		}
-		decoded, err := dt.transport.Decode(resp)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - error while decoding response - %s", err)
-			return
-		}
-
-		switch decoded.Type {
-		case dendrite.PbErr:
-			pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - got error response - %s", pbMsg.GetError())
-		case PbDtableResponse:
-			pbMsg := decoded.TransportMsg.(PBDTableResponse)
-			success := pbMsg.GetOk()
-			if success {
-				resp_c <- true
-				return
-			}
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - error - %s", pbMsg.GetError())
-			return
-		default:
-			// unexpected response
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteClearReplica - unexpected response")
-			return
-		}
-	}()
-
-	select {
-	case <-time.After(zmq_transport.ClientTimeout):
-		return fmt.Errorf("ZMQ:DTable:remoteClearReplica - command timed out!")
-	case err := <-error_c:
-		return err
-	case _ = <-resp_c:
-		return nil
+	// Build request protobuf
+	req := &PBDTableClearReplica{
+		Dest:    remote.ToProtobuf(),
+		KeyHash: reqItem.keyHash,
+		Demoted: proto.Bool(demoted),
 	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableClearReplica, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remoteClearReplica - %s", err)
+	}
+	return dt.checkResponse("remoteClearReplica", decoded)
 }
 
 // Client Request: take a rvalue and write replica to another host
 func (dt *DTable) remoteWriteReplica(origin, remote *dendrite.Vnode, reqItem *kvItem) error {
-	error_c := make(chan error, 1)
-	resp_c := make(chan bool, 1)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
-
-	go func() {
-		req_sock, err := zmq_transport.ZMQContext.NewSocket(zmq.REQ)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - newsocket error - %s", err)
-			return
-		}
-		req_sock.SetRcvtimeo(5 * time.Second)
-		req_sock.SetSndtimeo(5 * time.Second)
+	// Build request protobuf
+	req := &PBDTableSetItem{
+		Origin: origin.ToProtobuf(),
+		Dest:   remote.ToProtobuf(),
+		Item:   reqItem.to_protobuf(),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableSetReplica, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remoteWriteReplica - %s", err)
+	}
+	return dt.checkResponse("remoteWriteReplica", decoded)
+}
 
-		defer req_sock.Close()
-		err = req_sock.Connect("tcp://" + remote.Host)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - connect error - %s", err)
-			return
-		}
-		// Build request protobuf
-		req := &PBDTableSetItem{
-			Origin: origin.ToProtobuf(),
-			Dest:   remote.ToProtobuf(),
-			Item:   reqItem.to_protobuf(),
-		}
+// Client Request: get dtable status of remote vnode
+func (dt *DTable) remoteStatus(remote *dendrite.Vnode) error {
+	// Build request protobuf
+	req := &PBDTableStatus{
+		Dest: remote.ToProtobuf(),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableStatus, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remoteStatus - %s", err)
+	}
+	return dt.checkResponse("remoteStatus", decoded)
+}
 
-		reqData, _ := proto.Marshal(req)
-		encoded := dt.transport.Encode(PbDtableSetReplica, reqData)
-		_, err = req_sock.SendBytes(encoded, 0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - error while sending request - %s", err)
-			return
-		}
+// Status checks if dtable is initialized on remote vnode and ready to serve requests.
+func (dt *DTable) Status(remote *dendrite.Vnode) error {
+	return dt.remoteStatus(remote)
+}
 
-		// read response and decode it
-		resp, err := req_sock.RecvBytes(0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - error while reading response - %s", err)
-			return
-		}
-		decoded, err := dt.transport.Decode(resp)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - error while decoding response - %s", err)
-			return
-		}
+// Client Request: promote remote vnode for a key
+func (dt *DTable) remotePromoteKey(origin, remote *dendrite.Vnode, reqItem *kvItem) error {
+	// Build request protobuf
+	req := &PBDTablePromoteKey{
+		Dest:   remote.ToProtobuf(),
+		Origin: origin.ToProtobuf(),
+		Item:   reqItem.to_protobuf(),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtablePromoteKey, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remotePromoteKey - %s", err)
+	}
+	return dt.checkResponse("remotePromoteKey", decoded)
+}
 
-		switch decoded.Type {
-		case dendrite.PbErr:
-			pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - got error response - %s", pbMsg.GetError())
-		case PbDtableResponse:
-			pbMsg := decoded.TransportMsg.(PBDTableResponse)
-			success := pbMsg.GetOk()
-			if success {
-				resp_c <- true
-				return
-			}
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - write error - %s", pbMsg.GetError())
-			return
-		default:
-			// unexpected response
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteWriteReplica - unexpected response")
-			return
-		}
-	}()
+// Client Request: get hashes of merkle tree nodes for primary's key range from remote replica
+func (dt *DTable) remoteMerkleNodes(kr *dendrite.KeyRange, remote *dendrite.Vnode, nodes []int) ([][]byte, error) {
+	req := merkleRequest(kr, remote, nodes)
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableMerkleNodes, reqData)
+	if err != nil {
+		return nil, fmt.Errorf("DTable:remoteMerkleNodes - %s", err)
+	}
+	switch decoded.Type {
+	case dendrite.PbErr:
+		pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
+		return nil, fmt.Errorf("DTable:remoteMerkleNodes - got error response - %s", pbMsg.GetError())
+	case PbDtableMerkleNodesResponse:
+		pbMsg := decoded.TransportMsg.(PBDTableMerkleNodesResponse)
+		return pbMsg.GetHashes(), nil
+	default:
+		// unexpected response
+		return nil, fmt.Errorf("DTable:remoteMerkleNodes - unexpected response")
+	}
+}
 
-	select {
-	case <-time.After(zmq_transport.ClientTimeout):
-		return fmt.Errorf("ZMQ:DTable:remoteWriteReplica - command timed out!")
-	case err := <-error_c:
-		return err
-	case _ = <-resp_c:
-		return nil
+// Client Request: get items under merkle tree leaves for primary's key range from remote replica
+func (dt *DTable) remoteMerkleItems(kr *dendrite.KeyRange, remote *dendrite.Vnode, leaves []int) ([]*kvItem, error) {
+	req := merkleRequest(kr, remote, leaves)
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableMerkleItems, reqData)
+	if err != nil {
+		return nil, fmt.Errorf("DTable:remoteMerkleItems - %s", err)
+	}
+	switch decoded.Type {
+	case dendrite.PbErr:
+		pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
+		return nil, fmt.Errorf("DTable:remoteMerkleItems - got error response - %s", pbMsg.GetError())
+	case PbDtableMultiItemResponse:
+		pbMsg := decoded.TransportMsg.(PBDTableMultiItemResponse)
+		items := make([]*kvItem, 0, len(pbMsg.GetItems()))
+		for _, pbItem := range pbMsg.GetItems() {
+			item := new(kvItem)
+			item.from_protobuf(pbItem)
+			dt.clock.update(item.timestamp)
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		// unexpected response
+		return nil, fmt.Errorf("DTable:remoteMerkleItems - unexpected response")
 	}
 }
 
-// Client Request: get dtable status of remote vnode
-func (dt *DTable) remoteStatus(remote *dendrite.Vnode) error {
-	error_c := make(chan error, 1)
-	resp_c := make(chan bool, 1)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
+// Client Request: stream repaired items to remote replica
+func (dt *DTable) remoteRepairReplica(origin, remote *dendrite.Vnode, items []*kvItem) error {
+	// Build request protobuf
+	req := &PBDTableSetMultiItem{
+		Dest:   remote.ToProtobuf(),
+		Origin: origin.ToProtobuf(),
+		Items:  make([]*PBDTableItem, 0, len(items)),
+	}
+	for _, item := range items {
+		req.Items = append(req.Items, item.to_protobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableRepairReplica, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remoteRepairReplica - %s", err)
+	}
+	return dt.checkResponse("remoteRepairReplica", decoded)
+}
 
-	go func() {
-		req_sock, err := zmq_transport.ZMQContext.NewSocket(zmq.REQ)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - newsocket error - %s", err)
-			return
-		}
-		req_sock.SetRcvtimeo(5 * time.Second)
-		req_sock.SetSndtimeo(5 * time.Second)
+// Client Request: write batch of items to remote primary vnode. Errors are returned in the same order as items.
+func (dt *DTable) remoteSetMulti(remote *dendrite.Vnode, items []*kvItem, minAcks int) []error {
+	// Build request protobuf
+	req := &PBDTableSetMultiItem{
+		Dest:    remote.ToProtobuf(),
+		Items:   make([]*PBDTableItem, 0, len(items)),
+		MinAcks: proto.Int32(int32(minAcks)),
+	}
+	for _, item := range items {
+		item.replicaInfo.master = remote
+		req.Items = append(req.Items, item.to_protobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableSetMultiItem, reqData)
+	return dt.multiErrors("remoteSetMulti", decoded, err, len(items))
+}
 
-		defer req_sock.Close()
-		err = req_sock.Connect("tcp://" + remote.Host)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - connect error - %s", err)
-			return
-		}
-		// Build request protobuf
-		req := &PBDTableStatus{
-			Dest: remote.ToProtobuf(),
-		}
+// Client Request: get batch of items from remote primary vnode. Items are returned in the same order as
+// requested items, with nil for keys that were not found.
+func (dt *DTable) remoteGetMulti(remote *dendrite.Vnode, reqItems []*kvItem) ([]*kvItem, error) {
+	// Build request protobuf
+	req := &PBDTableGetMultiItem{
+		Dest:      remote.ToProtobuf(),
+		KeyHashes: make([][]byte, 0, len(reqItems)),
+	}
+	for _, reqItem := range reqItems {
+		req.KeyHashes = append(req.KeyHashes, reqItem.keyHash)
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableGetMultiItem, reqData)
+	if err != nil {
+		return nil, fmt.Errorf("DTable:remoteGetMulti - %s", err)
+	}
+	if err := dt.checkMultiResponse("remoteGetMulti", decoded, len(reqItems)); err != nil {
+		return nil, err
+	}
+	pbMsg := decoded.TransportMsg.(PBDTableMultiItemResponse)
+	rv := make([]*kvItem, len(reqItems))
+	for idx, pbItem := range pbMsg.GetItems() {
+		if !pbItem.GetFound() {
+			continue
+		}
+		item := new(kvItem)
+		item.from_protobuf(pbItem)
+		dt.clock.update(item.timestamp)
+		item.Key = reqItems[idx].Key
+		item.keyHash = reqItems[idx].keyHash
+		rv[idx] = item
+	}
+	return rv, nil
+}
 
-		reqData, _ := proto.Marshal(req)
-		encoded := dt.transport.Encode(PbDtableStatus, reqData)
-		_, err = req_sock.SendBytes(encoded, 0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - error while sending request - %s", err)
-			return
-		}
+// Client Request: read items in key hash range (start, end] from remote vnode, from its primary or replica table
+func (dt *DTable) remoteScan(remote *dendrite.Vnode, start, end []byte, limit int, values, replica bool) ([]*kvItem, error) {
+	// Build request protobuf
+	req := &PBDTableScan{
+		Dest:    remote.ToProtobuf(),
+		Start:   start,
+		End:     end,
+		Limit:   proto.Int32(int32(limit)),
+		Values:  proto.Bool(values),
+		Replica: proto.Bool(replica),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableScan, reqData)
+	if err != nil {
+		return nil, fmt.Errorf("DTable:remoteScan - %s", err)
+	}
 
-		// read response and decode it
-		resp, err := req_sock.RecvBytes(0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - error while reading response - %s", err)
-			return
-		}
-		decoded, err := dt.transport.Decode(resp)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - error while decoding response - %s", err)
-			return
-		}
+	switch decoded.Type {
+	case dendrite.PbErr:
+		pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
+		return nil, fmt.Errorf("DTable:remoteScan - got error response - %s", pbMsg.GetError())
+	case PbDtableMultiItemResponse:
+		pbMsg := decoded.TransportMsg.(PBDTableMultiItemResponse)
+		rv := make([]*kvItem, 0, len(pbMsg.GetItems()))
+		for _, pbItem := range pbMsg.GetItems() {
+			item := new(kvItem)
+			item.from_protobuf(pbItem)
+			dt.clock.update(item.timestamp)
+			rv = append(rv, item)
+		}
+		return rv, nil
+	default:
+		// unexpected response
+		return nil, fmt.Errorf("DTable:remoteScan - unexpected response")
+	}
+}
 
-		switch decoded.Type {
-		case dendrite.PbErr:
-			pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - got error response - %s", pbMsg.GetError())
-		case PbDtableResponse:
-			pbMsg := decoded.TransportMsg.(PBDTableResponse)
-			success := pbMsg.GetOk()
-			if success {
-				resp_c <- true
-				return
-			}
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - error - %s", pbMsg.GetError())
-			return
-		default:
-			// unexpected response
-			error_c <- fmt.Errorf("ZMQ:DTable:remoteStatus - unexpected response")
-			return
+// multiErrors returns per-item errors from response to batch request. If request itself failed,
+// its error is returned for each item.
+func (dt *DTable) multiErrors(op string, decoded *dendrite.ChordMsg, err error, numItems int) []error {
+	errs := make([]error, numItems)
+	if err != nil {
+		err = fmt.Errorf("DTable:%s - %s", op, err)
+	} else {
+		err = dt.checkMultiResponse(op, decoded, numItems)
+	}
+	if err != nil {
+		for idx := range errs {
+			errs[idx] = err
 		}
-	}()
-
-	select {
-	case <-time.After(zmq_transport.ClientTimeout):
-		return fmt.Errorf("ZMQ:DTable:remoteStatus - command timed out!")
-	case err := <-error_c:
-		return err
-	case _ = <-resp_c:
-		return nil
+		return errs
+	}
+	pbMsg := decoded.TransportMsg.(PBDTableMultiItemResponse)
+	for idx, msg := range pbMsg.GetErrors() {
+		errs[idx] = batchError(msg)
 	}
+	return errs
 }
 
-// Client Request: promote remote vnode for a key
-func (dt *DTable) remotePromoteKey(origin, remote *dendrite.Vnode, reqItem *kvItem) error {
-	error_c := make(chan error, 1)
-	resp_c := make(chan bool, 1)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
+// Client Request: write batch of replicas to remote host
+func (dt *DTable) remoteWriteReplicas(origin, remote *dendrite.Vnode, items []*kvItem) error {
+	// Build request protobuf
+	req := &PBDTableSetMultiItem{
+		Dest:   remote.ToProtobuf(),
+		Origin: origin.ToProtobuf(),
+		Items:  make([]*PBDTableItem, 0, len(items)),
+	}
+	for _, item := range items {
+		req.Items = append(req.Items, item.to_protobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableSetReplicaBatch, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remoteWriteReplicas - %s", err)
+	}
+	return dt.checkResponse("remoteWriteReplicas", decoded)
+}
 
-	go func() {
-		req_sock, err := zmq_transport.ZMQContext.NewSocket(zmq.REQ)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - newsocket error - %s", err)
-			return
-		}
-		req_sock.SetRcvtimeo(5 * time.Second)
-		req_sock.SetSndtimeo(5 * time.Second)
+// Client Request: set replicaInfo for batch of replicated items on remote host. Errors are returned in the same
+// order as items.
+func (dt *DTable) remoteSetReplicaInfos(remote *dendrite.Vnode, items []*kvItem) []error {
+	// Build request protobuf
+	req := &PBDTableSetReplicaInfoBatch{
+		Dest:         remote.ToProtobuf(),
+		KeyHashes:    make([][]byte, 0, len(items)),
+		ReplicaInfos: make([]*PBDTableReplicaInfo, 0, len(items)),
+	}
+	for _, item := range items {
+		req.KeyHashes = append(req.KeyHashes, item.keyHash)
+		req.ReplicaInfos = append(req.ReplicaInfos, item.replicaInfo.to_protobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableSetReplicaInfoBatch, reqData)
+	return dt.multiErrors("remoteSetReplicaInfos", decoded, err, len(items))
+}
 
-		defer req_sock.Close()
-		err = req_sock.Connect("tcp://" + remote.Host)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - connect error - %s", err)
-			return
-		}
+// Client Request: remove batch of replicas, or demoted items, from remote host. Errors are returned in the same
+// order as items.
+func (dt *DTable) remoteClearReplicas(remote *dendrite.Vnode, items []*kvItem, demoted bool) []error {
+	// Build request protobuf
+	req := &PBDTableClearReplicaBatch{
+		Dest:      remote.ToProtobuf(),
+		KeyHashes: make([][]byte, 0, len(items)),
+		Demoted:   proto.Bool(demoted),
+	}
+	for _, item := range items {
+		req.KeyHashes = append(req.KeyHashes, item.keyHash)
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableClearReplicaBatch, reqData)
+	return dt.multiErrors("remoteClearReplicas", decoded, err, len(items))
+}
 
-		// Build request protobuf
-		req := &PBDTablePromoteKey{
-			Dest:   remote.ToProtobuf(),
-			Origin: origin.ToProtobuf(),
-			Item:   reqItem.to_protobuf(),
-		}
+// Client Request: demote batch of keys to new predecessor on remote host. Errors are returned in the same
+// order as items.
+func (dt *DTable) remoteDemoteKeys(origin, remote *dendrite.Vnode, items []*kvItem) []error {
+	// Build request protobuf
+	req := &PBDTableSetMultiItem{
+		Dest:   remote.ToProtobuf(),
+		Origin: origin.ToProtobuf(),
+		Items:  make([]*PBDTableItem, 0, len(items)),
+	}
+	for _, item := range items {
+		req.Items = append(req.Items, item.to_protobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtableDemoteBatch, reqData)
+	return dt.multiErrors("remoteDemoteKeys", decoded, err, len(items))
+}
 
-		reqData, _ := proto.Marshal(req)
-		encoded := dt.transport.Encode(PbDtablePromoteKey, reqData)
-		_, err = req_sock.SendBytes(encoded, 0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - error while sending request - %s", err)
-			return
-		}
+// Client Request: promote remote vnode for batch of keys
+func (dt *DTable) remotePromoteKeys(origin, remote *dendrite.Vnode, items []*kvItem) error {
+	// Build request protobuf
+	req := &PBDTableSetMultiItem{
+		Dest:   remote.ToProtobuf(),
+		Origin: origin.ToProtobuf(),
+		Items:  make([]*PBDTableItem, 0, len(items)),
+	}
+	for _, item := range items {
+		req.Items = append(req.Items, item.to_protobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := dt.transport.Request(remote.Host, PbDtablePromoteBatch, reqData)
+	if err != nil {
+		return fmt.Errorf("DTable:remotePromoteKeys - %s", err)
+	}
+	return dt.checkResponse("remotePromoteKeys", decoded)
+}
 
-		// read response and decode it
-		resp, err := req_sock.RecvBytes(0)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - error while reading response - %s", err)
-			return
-		}
-		decoded, err := dt.transport.Decode(resp)
-		if err != nil {
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - error while decoding response - %s", err)
-			return
+// checkMultiResponse checks that response to batch request holds a result for each of numItems items.
+func (dt *DTable) checkMultiResponse(op string, decoded *dendrite.ChordMsg, numItems int) error {
+	switch decoded.Type {
+	case dendrite.PbErr:
+		pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
+		return fmt.Errorf("DTable:%s - got error response - %s", op, pbMsg.GetError())
+	case PbDtableMultiItemResponse:
+		pbMsg := decoded.TransportMsg.(PBDTableMultiItemResponse)
+		if len(pbMsg.GetErrors()) != numItems && len(pbMsg.GetItems()) != numItems {
+			return fmt.Errorf("DTable:%s - got %d results for %d items", op, len(pbMsg.GetItems()), numItems)
 		}
+		return nil
+	default:
+		// unexpected response
+		return fmt.Errorf("DTable:%s - unexpected response", op)
+	}
+}
 
-		switch decoded.Type {
-		case dendrite.PbErr:
-			pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - got error response - %s", pbMsg.GetError())
-		case PbDtableResponse:
-			pbMsg := decoded.TransportMsg.(PBDTableResponse)
-			success := pbMsg.GetOk()
-			if success {
-				resp_c <- true
-				return
-			}
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - error - %s", pbMsg.GetError())
-			return
-		default:
-			// unexpected response
-			error_c <- fmt.Errorf("ZMQ:DTable:remotePromoteKey - unexpected response")
-			return
-		}
-	}()
+// merkleRequest builds a request for merkle tree nodes of key range on remote replica.
+func merkleRequest(kr *dendrite.KeyRange, remote *dendrite.Vnode, nodes []int) *PBDTableMerkleNodes {
+	req := &PBDTableMerkleNodes{
+		Dest:   remote.ToProtobuf(),
+		Start:  kr.Start,
+		End:    kr.End,
+		Nodes:  make([]int32, len(nodes)),
+		Origin: kr.Vnode.ToProtobuf(),
+	}
+	for idx, node := range nodes {
+		req.Nodes[idx] = int32(node)
+	}
+	return req
+}
 
-	select {
-	case <-time.After(zmq_transport.ClientTimeout):
-		return fmt.Errorf("ZMQ:DTable:remotePromoteKey - command timed out!")
-	case err := <-error_c:
-		return err
-	case _ = <-resp_c:
-		return nil
+// checkResponse converts decoded PbErr or unsuccessful PbDtableResponse into an error.
+func (dt *DTable) checkResponse(op string, decoded *dendrite.ChordMsg) error {
+	switch decoded.Type {
+	case dendrite.PbErr:
+		pbMsg := decoded.TransportMsg.(dendrite.PBProtoErr)
+		return fmt.Errorf("DTable:%s - got error response - %s", op, pbMsg.GetError())
+	case PbDtableResponse:
+		pbMsg := decoded.TransportMsg.(PBDTableResponse)
+		dt.clock.update(hlcTimestamp{wall: pbMsg.GetClockWall(), logical: pbMsg.GetClockLogical()})
+		if pbMsg.GetOk() {
+			return nil
+		}
+		if pbMsg.GetConflict() {
+			return ErrVersionConflict
+		}
+		if pbMsg.GetClockSkew() {
+			return ErrClockSkew
+		}
+		return fmt.Errorf("DTable:%s - error - %s", op, pbMsg.GetError())
+	default:
+		// unexpected response
+		return fmt.Errorf("DTable:%s - unexpected response", op)
 	}
 }
@@ -2,24 +2,34 @@ package dtable
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/fastfn/dendrite"
+	"sort"
+	"sync"
 	"time"
 )
 
 // promoteKey() -- called when remote wants to promote a key to us
 func (dt *DTable) promoteKey(vnode *dendrite.Vnode, reqItem *kvItem) {
+	dt.promoteKeys(vnode, []*kvItem{reqItem})
+}
+
+// promoteKeys() -- called when remote wants to promote batch of keys to us
+func (dt *DTable) promoteKeys(vnode *dendrite.Vnode, items []*kvItem) {
 	rtable := dt.rtable[vnode.String()]
 	vn_table := dt.table[vnode.String()]
-	// if we're already primary node for this key, just replicate again because one replica could be deleted
-	if _, ok := vn_table[reqItem.keyHashString()]; ok {
-		dt.replicateKey(vnode, reqItem, dt.ring.Replicas())
-		return
+	promoted := make([]*kvItem, 0, len(items))
+	for _, reqItem := range items {
+		// if we're already primary node for this key, just replicate again because one replica could be deleted
+		if existing, ok := vn_table.Get(reqItem.keyHashString()); ok {
+			promoted = append(promoted, existing)
+			continue
+		}
+		rtable.Delete(reqItem.keyHashString())
+		putItem(vn_table, reqItem)
+		promoted = append(promoted, reqItem)
 	}
-	delete(rtable, reqItem.keyHashString())
-	reqItem.lock.Lock()
-	vn_table.put(reqItem)
-	dt.replicateKey(vnode, reqItem, dt.ring.Replicas())
-	reqItem.lock.Unlock()
+	dt.replicateInBatches(vnode, promoted)
 }
 
 // promote() - called when remote predecessor died or left the ring
@@ -31,35 +41,48 @@ func (dt *DTable) promote(vnode *dendrite.Vnode) {
 	//log.Printf("Node left me: %X for %X now replicating to:\n", localVn.Id, new_pred.Id)
 	rtable := dt.rtable[vnode.String()]
 	vn_table := dt.table[vnode.String()]
-	for key_str, ritem := range rtable {
+	promoted := make([]*kvItem, 0)
+	remote_promoted := make(map[string]*multiBatch)
+	rtable.ForEach(func(key_str string, ritem *kvItem) bool {
 		if ritem.replicaInfo.depth != 0 {
-			continue
+			return true
 		}
 		// check if we're real successor for this key
 		succs, err := dt.ring.Lookup(1, ritem.keyHash)
 		if err != nil {
 			dt.Logf(LogInfo, "Could not promote key, Lookup() failed: %s\n", err.Error())
-			continue
+			return true
 		}
 		if bytes.Compare(succs[0].Id, vnode.Id) == 0 {
 			// this key should be promoted locally
 			new_ritem := ritem.dup()
 			new_ritem.replicaInfo.vnodes[0] = nil
 			new_ritem.commited = true
-			new_ritem.lock.Lock()
-			vn_table.put(new_ritem)
-			dt.Logf(LogDebug, "Promoted local key: %s - running replicator now replicas are %+v \n", key_str, new_ritem.replicaInfo.vnodes)
-			delete(rtable, key_str)
-			dt.Logf(LogDebug, "Promote calling replicateKey for key %s\n", key_str)
-			dt.replicateKey(vnode, new_ritem, dt.ring.Replicas())
-			new_ritem.lock.Unlock()
-			dt.Logf(LogDebug, "Promote finishing key %s, replicaVnodes are: %+v\n", key_str, new_ritem.replicaInfo.vnodes)
+			putItem(vn_table, new_ritem)
+			dt.Logf(LogDebug, "Promoted local key: %s - replicas are %+v \n", key_str, new_ritem.replicaInfo.vnodes)
+			rtable.Delete(key_str)
+			promoted = append(promoted, new_ritem)
 		} else {
-			// TODO promote remote vnode
 			dt.Logf(LogDebug, "Promoting remote vnode %s for key %s\n", succs[0].String(), key_str)
-			delete(rtable, key_str)
-			dt.remotePromoteKey(vnode, succs[0], ritem)
+			rtable.Delete(key_str)
+			batch, ok := remote_promoted[succs[0].String()]
+			if !ok {
+				batch = &multiBatch{owner: succs[0]}
+				remote_promoted[succs[0].String()] = batch
+			}
+			batch.items = append(batch.items, ritem)
 		}
+		return true
+	})
+	dt.Logf(LogDebug, "Promote calling replicateKeys for %d keys\n", len(promoted))
+	dt.replicateInBatches(vnode, promoted)
+
+	for _, batch := range remote_promoted {
+		dt.inBatches(batch.items, func(items []*kvItem) {
+			if err := dt.remotePromoteKeys(vnode, batch.owner, items); err != nil {
+				dt.Logf(LogInfo, "Error promoting %d keys on remote vnode %s - %s\n", len(items), batch.owner.String(), err)
+			}
+		})
 	}
 }
 
@@ -71,14 +94,16 @@ if new predecessor is local:
 if new predecessor is remote:
   - for all keys in primary table, that are <= new_pred.Id:
   	1. move key to demoted table and wait there for cleanup call from new master
-  	2. call demoteKey() to commit to new_pred's primary table + let that vnode know where existing replicas are
-  	3. demoteKey() will callback to cleanup each key from demoted table after it's written new replicas
+  	2. call demoteKeys() to commit to new_pred's primary table + let that vnode know where existing replicas are
+  	3. demoteKeys() will callback to cleanup each key from demoted table after it's written new replicas
   - handle replica-0 table such that:
   	1. for each key, check if master vnode is located on same physical node as new_pred
   	- if it is, we don't need to do anything because we're still natural remote successor
   	- if not
   		1. call demoteReplica() to let master know existing replica setup and about newRemoteSucc
   		2. master will reconfigure replicas around and delete unnecessary copies (if any)
+
+Keys are sent in batches of at most Config.BatchSize items, with one request per remote vnode for each batch.
 */
 func (dt *DTable) demote(vnode, new_pred *dendrite.Vnode) {
 	// determine if new_pred is on this node
@@ -92,57 +117,66 @@ func (dt *DTable) demote(vnode, new_pred *dendrite.Vnode) {
 	case true:
 		// move all replica keys to new vnode
 		vn_rtable := dt.rtable[vnode.String()]
-		for rkey, ritem := range vn_rtable {
+		moved := make([]*kvItem, 0)
+		vn_rtable.ForEach(func(rkey string, ritem *kvItem) bool {
 			if !ritem.commited {
-				continue
+				return true
 			}
-
 			ritem.replicaInfo.vnodes[ritem.replicaInfo.depth] = new_pred
-			ritem.lock.Lock()
-			dt.rtable[new_pred.String()].put(ritem)
-			delete(vn_rtable, rkey)
+			putItem(dt.rtable[new_pred.String()], ritem)
+			vn_rtable.Delete(rkey)
+			moved = append(moved, ritem)
+			return true
+		})
 
-			// update metadata on all replicas
-			new_state := ritem.replicaInfo.state
-			for idx, replica := range ritem.replicaInfo.vnodes {
-				// skip ourselves
-				if idx == ritem.replicaInfo.depth {
-					continue
+		// update metadata on all replicas
+		dt.inBatches(moved, func(items []*kvItem) {
+			lockItems(items)
+			defer unlockItems(items)
+			for _, batch := range replicaBatches(items) {
+				repl_items := make([]*kvItem, 0, len(batch.items))
+				for idx, ritem := range batch.items {
+					// skip ourselves
+					if batch.pos[idx] == ritem.replicaInfo.depth {
+						continue
+					}
+					new_ritem := ritem.dup()
+					new_ritem.replicaInfo.depth = batch.pos[idx]
+					repl_items = append(repl_items, new_ritem)
 				}
-				new_ritem := ritem.dup()
-				new_ritem.replicaInfo.depth = idx
-				new_ritem.replicaInfo.state = new_state
-
-				err := dt.remoteSetReplicaInfo(replica, new_ritem)
-				if err != nil {
-					dt.Logf(LogInfo, "Error updating replicaMeta on demote() -", err)
-					new_state = replicaIncomplete
+				if len(repl_items) == 0 {
 					continue
 				}
+				for _, err := range dt.remoteSetReplicaInfos(batch.owner, repl_items) {
+					if err != nil {
+						dt.Logln(LogInfo, "Error updating replicaMeta on demote() -", err)
+					}
+				}
 			}
-			ritem.lock.Unlock()
-		}
+		})
 	case false:
 		// loop over primary table to find keys that should belong to new predecessor
 		vn_table := dt.table[vnode.String()]
-		for key_str, item := range vn_table {
+		demoted := make([]*kvItem, 0)
+		vn_table.ForEach(func(key_str string, item *kvItem) bool {
 			if !item.commited {
-				continue
+				return true
 			}
 			if dendrite.Between(vnode.Id, new_pred.Id, item.keyHash, true) {
-				//log.Printf("Analyzed key for demoting %s and pushing to %s\n", key_str, new_pred.String())
 				// copy the key to demoted table and remove it from primary one
-				dt.demoted_table[vnode.String()][item.keyHashString()] = item.to_demoted(new_pred)
-				delete(vn_table, key_str)
-				done_c := make(chan error)
-				go dt.remoteSet(vnode, new_pred, item, dt.ring.Replicas(), true, done_c)
-				err := <-done_c
+				dt.demoted_table[vnode.String()].Put(item.to_demoted(new_pred))
+				vn_table.Delete(key_str)
+				demoted = append(demoted, item)
+			}
+			return true
+		})
+		dt.inBatches(demoted, func(items []*kvItem) {
+			for idx, err := range dt.remoteDemoteKeys(vnode, new_pred, items) {
 				if err != nil {
-					dt.Logln(LogInfo, "Error demoting key to new predecessor -", err)
-					continue
+					dt.Logf(LogInfo, "Error demoting key %s to new predecessor - %s\n", items[idx].keyHashString(), err)
 				}
 			}
-		}
+		})
 	}
 
 }
@@ -150,17 +184,38 @@ func (dt *DTable) demote(vnode, new_pred *dendrite.Vnode) {
 // changeReplicas() -- callend when replica set changes
 //
 func (dt *DTable) changeReplicas(vnode *dendrite.Vnode, new_replicas []*dendrite.Vnode) {
-	for _, item := range dt.table[vnode.String()] {
-		if !item.commited {
-			continue
+	vn_table := dt.table[vnode.String()]
+	items := make([]*kvItem, 0, vn_table.Len())
+	vn_table.ForEach(func(key_str string, item *kvItem) bool {
+		if item.commited {
+			items = append(items, item)
 		}
-		item.lock.Lock()
-		dt.replicateKey(vnode, item, dt.ring.Replicas())
-		item.lock.Unlock()
-	}
+		return true
+	})
+	dt.replicateInBatches(vnode, items)
+}
+
+// replicateInBatches locks and replicates items of vnode's primary table, in batches of at most Config.BatchSize items.
+func (dt *DTable) replicateInBatches(vnode *dendrite.Vnode, items []*kvItem) {
+	dt.inBatches(items, func(batch []*kvItem) {
+		lockItems(batch)
+		dt.replicateKeys(vnode, batch, dt.ring.Replicas())
+		unlockItems(batch)
+	})
 }
 
 func (dt *DTable) replicateKey(vnode *dendrite.Vnode, reqItem *kvItem, limit int) {
+	dt.replicateKeys(vnode, []*kvItem{reqItem}, limit)
+}
+
+/* replicateKeys writes replicas for items of vnode's primary table. Existing replicas are cleared first,
+then items are written to remote successors and replica metadata is updated. Each step sends one request
+per remote vnode for all the items. Caller must hold the lock of each item.
+*/
+func (dt *DTable) replicateKeys(vnode *dendrite.Vnode, items []*kvItem, limit int) {
+	if len(items) == 0 {
+		return
+	}
 	handler, _ := dt.transport.GetVnodeHandler(vnode)
 	if handler == nil {
 		return
@@ -172,17 +227,14 @@ func (dt *DTable) replicateKey(vnode *dendrite.Vnode, reqItem *kvItem, limit int
 	}
 
 	// first, lets remove existing replicas
-	for idx, existing := range reqItem.replicaInfo.vnodes {
-		if existing == nil {
-			continue
-		}
-		if err := dt.remoteClearReplica(existing, reqItem, false); err != nil {
-			// lets add this replica to orphans
-			reqItem.replicaInfo.orphan_vnodes = append(reqItem.replicaInfo.orphan_vnodes, existing)
-			reqItem.replicaInfo.vnodes[idx] = nil
-			continue
-		} else {
-			reqItem.replicaInfo.vnodes[idx] = nil
+	for _, batch := range replicaBatches(items) {
+		errs := dt.remoteClearReplicas(batch.owner, batch.items, false)
+		for idx, item := range batch.items {
+			if errs[idx] != nil {
+				// lets add this replica to orphans
+				item.replicaInfo.orphan_vnodes = append(item.replicaInfo.orphan_vnodes, batch.owner)
+			}
+			item.replicaInfo.vnodes[batch.pos[idx]] = nil
 		}
 	}
 
@@ -195,63 +247,145 @@ func (dt *DTable) replicateKey(vnode *dendrite.Vnode, reqItem *kvItem, limit int
 	} else {
 		new_replica_state = replicaPartial
 	}
+	item_states := make([]replicaState, len(items))
+	for idx := range item_states {
+		item_states[idx] = new_replica_state
+	}
 
 	// now lets write replicas
-	new_replicas := make([]*dendrite.Vnode, 0)
-
+	new_replicas := make([][]*dendrite.Vnode, len(items))
+	repl_items := make([]*kvItem, len(items))
 	for _, succ := range remote_succs {
 		if succ == nil {
 			continue
 		}
-		dt.Logf(LogDebug, "replicating to: %x\n", succ.Id)
-		new_ritem := reqItem.dup()
-		new_ritem.replicaInfo.state = replicaIncomplete
-		new_ritem.commited = false
-
-		err := dt.remoteWriteReplica(vnode, succ, new_ritem)
-		if err != nil {
-			dt.Logf(LogInfo, "Error writing replica to %s for key %s due to error: %s\n", succ.String(), new_ritem.keyHashString(), err.Error())
-			new_replica_state = replicaIncomplete
+		dt.Logf(LogDebug, "replicating %d keys to: %x\n", len(items), succ.Id)
+		for idx, item := range items {
+			repl_items[idx] = item.dup()
+			repl_items[idx].replicaInfo.state = replicaIncomplete
+			repl_items[idx].commited = false
+		}
+		if err := dt.remoteWriteReplicas(vnode, succ, repl_items); err != nil {
+			dt.Logf(LogInfo, "Error writing %d replicas to %s due to error: %s\n", len(items), succ.String(), err.Error())
+			for idx, item := range items {
+				item_states[idx] = replicaIncomplete
+				dt.storeHint(vnode, succ, item)
+			}
 			continue
 		}
-		new_replicas = append(new_replicas, succ)
+		for idx := range items {
+			new_replicas[idx] = append(new_replicas[idx], succ)
+		}
 	}
 
-	// update metadata on original item
-	reqItem.replicaInfo.vnodes = make([]*dendrite.Vnode, limit)
-	for idx, new_replica := range new_replicas {
-		reqItem.replicaInfo.vnodes[idx] = new_replica
+	// update metadata on original items
+	for idx, item := range items {
+		item.replicaInfo.vnodes = make([]*dendrite.Vnode, limit)
+		copy(item.replicaInfo.vnodes, new_replicas[idx])
+		item.replicaInfo.state = item_states[idx]
 	}
-	reqItem.replicaInfo.state = new_replica_state
 
 	// update metadata on successful replicas
-	for idx, replica := range reqItem.replicaInfo.vnodes {
-		if replica == nil {
-			break
+	for _, batch := range replicaBatches(items) {
+		meta_items := make([]*kvItem, len(batch.items))
+		for idx, item := range batch.items {
+			meta_items[idx] = item.dup()
+			meta_items[idx].replicaInfo.depth = batch.pos[idx]
+		}
+		errs := dt.remoteSetReplicaInfos(batch.owner, meta_items)
+		for idx, item := range batch.items {
+			if errs[idx] != nil {
+				// this should not happen. It means another replica node failed in the meantime
+				// need to trigger orphan cleaner, which will restart this process
+				item.replicaInfo.state = replicaIncomplete
+				item.replicaInfo.vnodes[batch.pos[idx]] = nil
+				item.replicaInfo.orphan_vnodes = append(item.replicaInfo.orphan_vnodes, batch.owner)
+			}
 		}
-		new_ritem := reqItem.dup()
-		new_ritem.replicaInfo.depth = idx
-		new_ritem.replicaInfo.state = new_replica_state
+	}
 
-		err := dt.remoteSetReplicaInfo(replica, new_ritem)
-		if err != nil {
-			// this should not happen. It means another replica node failed in the meantime
-			// need to trigger orphan cleaner, which will restart this process
-			reqItem.replicaInfo.state = replicaIncomplete
-			reqItem.replicaInfo.vnodes[idx] = nil
-			reqItem.replicaInfo.orphan_vnodes = append(reqItem.replicaInfo.orphan_vnodes, replica)
+	// store updated metadata
+	if vn_table, ok := dt.table[vnode.String()]; ok {
+		for _, item := range items {
+			dt.persist(vn_table, item)
+		}
+	}
+}
+
+// replicaBatches groups items by their replica vnodes. Batch's pos holds replica's index in item's replicaInfo.vnodes.
+func replicaBatches(items []*kvItem) []*multiBatch {
+	batches := make(map[string]*multiBatch)
+	rv := make([]*multiBatch, 0)
+	for _, item := range items {
+		for idx, replica := range item.replicaInfo.vnodes {
+			if replica == nil {
+				continue
+			}
+			batch, ok := batches[replica.String()]
+			if !ok {
+				batch = &multiBatch{owner: replica}
+				batches[replica.String()] = batch
+				rv = append(rv, batch)
+			}
+			batch.pos = append(batch.pos, idx)
+			batch.items = append(batch.items, item)
+		}
+	}
+	return rv
+}
+
+// inBatches calls fn for consecutive parts of items, each holding at most Config.BatchSize items.
+func (dt *DTable) inBatches(items []*kvItem, fn func([]*kvItem)) {
+	size := dt.conf.BatchSize
+	if size < 1 {
+		size = 1
+	}
+	for start := 0; start < len(items); start += size {
+		end := start + size
+		if end > len(items) {
+			end = len(items)
+		}
+		fn(items[start:end])
+	}
+}
+
+// lockItems locks each item of the batch. Items that share the lock (eg. the same key listed twice) lock it once.
+// Locks are taken in key hash order, so that batches with common items can't deadlock each other.
+func lockItems(items []*kvItem) {
+	for _, lock := range itemLocks(items) {
+		lock.Lock()
+	}
+}
+
+func unlockItems(items []*kvItem) {
+	for _, lock := range itemLocks(items) {
+		lock.Unlock()
+	}
+}
+
+// itemLocks returns distinct locks of items, ordered by items' key hashes.
+func itemLocks(items []*kvItem) []*sync.Mutex {
+	sorted := make([]*kvItem, len(items))
+	copy(sorted, items)
+	sort.Stable(byKeyHash(sorted))
+	seen := make(map[*sync.Mutex]bool)
+	rv := make([]*sync.Mutex, 0, len(items))
+	for _, item := range sorted {
+		if item.lock == nil || seen[item.lock] {
 			continue
 		}
+		seen[item.lock] = true
+		rv = append(rv, item.lock)
 	}
+	return rv
 }
 
 func (dt *DTable) selfCheck() {
 	//check for orphaned keys
 	for _, vn_table := range dt.table {
-	ITEM_LOOP:
-		for _, item := range vn_table {
+		vn_table.ForEach(func(key_str string, item *kvItem) bool {
 			if len(item.replicaInfo.orphan_vnodes) == 0 {
-				continue ITEM_LOOP
+				return true
 			}
 			item.lock.Lock()
 			new_orphans := make([]*dendrite.Vnode, 0)
@@ -283,33 +417,88 @@ func (dt *DTable) selfCheck() {
 			item.replicaInfo.orphan_vnodes = new_orphans
 			if replicate_again {
 				dt.replicateKey(item.replicaInfo.master, item, dt.ring.Replicas())
+			} else {
+				dt.persist(vn_table, item)
 			}
 			item.lock.Unlock()
-		}
+			return true
+		})
 	}
 
 	//check for demoted keys
 	for _, demoted_table := range dt.demoted_table {
-		for _, demoted_item := range demoted_table {
+		demoted_table.ForEach(func(key_str string, demoted_item *demotedKvItem) bool {
 			if demoted_item.demoted_ts.Add(time.Minute * 3).Before(time.Now()) {
 				// new master did not process this item to the end when we demoted the key
-				// lets see if we can lookup the key
-				val, err := dt.NewQuery().Get([]byte(demoted_item.item.keyHashString()))
-				if err != nil {
-					dt.Logf(LogInfo, "selfCheck() tried to check demoted key: %s, but Get() failed: %s\n", demoted_item.item.keyHashString(), err.Error())
-					continue
-				}
-				if val == nil {
-					dt.Logf(LogInfo, "selfCheck() found old demoted key: %s. Restoring it now...", demoted_item.item.keyHashString())
-					err = dt.NewQuery().Set(demoted_item.item.Key, demoted_item.item.Val)
-					if err != nil {
-						dt.Logf(LogInfo, "selfCheck() failed while restoring demoted key %s. Err: %s\n", demoted_item.item.keyHashString(), err.Error())
-						continue
-					}
-					delete(demoted_table, demoted_item.item.keyHashString())
-					dt.Logf(LogInfo, "selfCheck() restored demoted key: %s\n", demoted_item.item.keyHashString())
+				dt.Logf(LogInfo, "selfCheck() found old demoted key: %s. Restoring it now...", key_str)
+				if err := dt.restoreDemoted(demoted_item.item); err != nil {
+					dt.Logf(LogInfo, "selfCheck() failed while restoring demoted key %s. Err: %s\n", key_str, err.Error())
+					return true
 				}
+				demoted_table.Delete(key_str)
+				dt.Logf(LogInfo, "selfCheck() restored demoted key: %s\n", key_str)
 			}
+			return true
+		})
+	}
+
+	dt.purgeTombstones()
+}
+
+// restoreDemoted writes demoted item back to key's primary, with item's original timestamp. If primary
+// already holds the same or newer version of the key (or its tombstone), primary's version is kept.
+func (dt *DTable) restoreDemoted(item *kvItem) error {
+	if item.expired() {
+		return nil
+	}
+	succs, err := dt.ring.Lookup(1, item.keyHash)
+	if err != nil {
+		return err
+	}
+	if len(succs) == 0 || succs[0] == nil {
+		return fmt.Errorf("successor lookup failed for key, %x", item.keyHash)
+	}
+	current, err := dt.readCopy(&readCopy{vnode: succs[0]}, item)
+	if err != nil {
+		return err
+	}
+	if current != nil && !current.timestamp.Before(item.timestamp) {
+		return nil
+	}
+
+	new_item := item.dup()
+	new_item.lock = new(sync.Mutex)
+	new_item.replicaInfo = new(kvReplicaInfo)
+	new_item.replicaInfo.master = succs[0]
+	new_item.replicaInfo.vnodes = make([]*dendrite.Vnode, dt.ring.Replicas())
+	new_item.replicaInfo.orphan_vnodes = make([]*dendrite.Vnode, 0)
+	done := make(chan error)
+	if _, ok := dt.table[succs[0].String()]; ok {
+		go dt.set(succs[0], new_item, 1, done)
+	} else {
+		go dt.remoteSet(succs[0], succs[0], new_item, 1, false, done)
+	}
+	return <-done
+}
+
+// purgeTombstones removes tombstones older than TombstoneGrace from primary and replica tables.
+func (dt *DTable) purgeTombstones() {
+	deadline := time.Now().Add(-dt.conf.TombstoneGrace)
+	purged := 0
+	for _, tables := range []map[string]Storage{dt.table, dt.rtable} {
+		for _, vn_table := range tables {
+			vn_table.ForEach(func(key_str string, item *kvItem) bool {
+				// tombstone may be overwritten concurrently, so it is checked under its lock
+				if dt.removeItem(vn_table, item, func() bool {
+					return item.tombstone && item.timestamp.Time().Before(deadline)
+				}) {
+					purged++
+				}
+				return true
+			})
 		}
 	}
+	if purged > 0 {
+		dt.Logf(LogDebug, "purgeTombstones() - purged %d tombstones\n", purged)
+	}
 }
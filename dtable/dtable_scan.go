@@ -0,0 +1,130 @@
+package dtable
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fastfn/dendrite"
+)
+
+// length of key hashes, and scan cursors
+var scanHashLen = len(dendrite.HashKey(nil))
+
+// ScanResult holds one page of Scan() results.
+type ScanResult struct {
+	Items  []*KVItem // items in key hash order, Val is nil if values were not requested
+	Cursor []byte    // pass to next Scan() to continue after the last item, nil when scan is complete
+}
+
+/* scan reads up to limit items that follow cursor in key hash order. Ring is walked one primary range
+at a time, from the range holding the cursor towards the end of hash space. Cursor is key hash of the
+last item returned by previous scan, or nil to start from the beginning.
+
+Owner of each range is looked up when the range is read, so that pages follow ownership changes between
+them. If owner can't be read, its range is read from replica tables of its successors.
+*/
+func (dt *DTable) scan(cursor []byte, limit int, values bool) (*ScanResult, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("scan limit must be positive")
+	}
+	if cursor != nil && len(cursor) != scanHashLen {
+		return nil, fmt.Errorf("invalid scan cursor")
+	}
+	rv := &ScanResult{
+		Items: make([]*KVItem, 0),
+	}
+	start := cursor
+	for {
+		var next []byte
+		if start == nil {
+			next = make([]byte, scanHashLen)
+		} else if next = nextHash(start); next == nil {
+			// start is the last hash
+			return rv, nil
+		}
+		succs, err := dt.ring.Lookup(dt.ring.NumSuccessors(), next)
+		if err != nil {
+			return nil, err
+		}
+		if len(succs) == 0 || succs[0] == nil {
+			return nil, fmt.Errorf("successor lookup failed for key, %x", next)
+		}
+		// range of the first vnode wraps around; read it up to the end of hash space
+		end := succs[0].Id
+		last := bytes.Compare(end, next) == -1
+		if last {
+			end = bytes.Repeat([]byte{0xff}, scanHashLen)
+		}
+		items, err := dt.scanRange(succs, start, end, limit-len(rv.Items), values)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			rv.Items = append(rv.Items, &item.KVItem)
+		}
+		if len(rv.Items) == limit {
+			rv.Cursor = make([]byte, scanHashLen)
+			copy(rv.Cursor, items[len(items)-1].keyHash)
+			return rv, nil
+		}
+		if last {
+			return rv, nil
+		}
+		start = end
+	}
+}
+
+// scanRange reads up to limit items in key hash range (start, end] from primary vnode, or from its replicas
+// if primary fails.
+func (dt *DTable) scanRange(succs []*dendrite.Vnode, start, end []byte, limit int, values bool) ([]*kvItem, error) {
+	var last_err error
+	for _, target := range dt.readTargets(succs) {
+		tables := dt.table
+		if target.replica {
+			tables = dt.rtable
+		}
+		if vn_table, ok := tables[target.vnode.String()]; ok {
+			return scanTable(vn_table, start, end, limit, values), nil
+		}
+		items, err := dt.remoteScan(target.vnode, start, end, limit, values, target.replica)
+		if err == nil {
+			return items, nil
+		}
+		dt.Logf(LogDebug, "scanRange() - failed to read range from %s - %s\n", target.vnode.String(), err)
+		last_err = err
+	}
+	return nil, last_err
+}
+
+// scanTable returns copies of up to limit items from vn_table in key hash range (start, end], in key hash order.
+// Empty start reads from the beginning of hash space. Deleted, expired and uncommited items are left out.
+func scanTable(vn_table Storage, start, end []byte, limit int, values bool) []*kvItem {
+	rv := make([]*kvItem, 0)
+	if limit < 1 {
+		return rv
+	}
+	vn_table.Range(start, end, func(item *kvItem) bool {
+		if !item.commited || item.tombstone || item.expired() {
+			return true
+		}
+		rv_item := item.dup()
+		if !values {
+			rv_item.Val = nil
+		}
+		rv = append(rv, rv_item)
+		return len(rv) < limit
+	})
+	return rv
+}
+
+// nextHash returns the key hash that follows h, or nil if h is the last one.
+func nextHash(h []byte) []byte {
+	rv := make([]byte, len(h))
+	copy(rv, h)
+	for idx := len(rv) - 1; idx >= 0; idx-- {
+		rv[idx]++
+		if rv[idx] != 0 {
+			return rv
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package dtable
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"github.com/fastfn/dendrite"
+	"sync"
+)
+
+/* Storage holds one of local vnode's tables of items: primary table, or table of replicas. Items are
+addressed by their hex encoded key hash.
+
+Storage keeps the items it's given and returns the same items back, so that readers share their locks.
+Items that are changed in place after Put are persisted by writing them again with Put.
+*/
+type Storage interface {
+	Get(key_str string) (*kvItem, bool)
+	// Put writes item as it is, replacing current item with the same key. See putItem() for conflict rules.
+	Put(item *kvItem) error
+	Delete(key_str string) error
+	// ForEach calls fn for each item, in no particular order, until fn returns false.
+	// Items may be written and deleted from fn.
+	ForEach(fn func(key_str string, item *kvItem) bool)
+	// Range calls fn for items in key hash range (start, end], in key hash order, until fn returns false.
+	// Empty start reads from the beginning of hash space.
+	Range(start, end []byte, fn func(item *kvItem) bool)
+	Len() int
+	Close() error
+}
+
+// DemotedStorage holds items demoted by local vnode, until its new predecessor takes them over.
+type DemotedStorage interface {
+	Get(key_str string) (*demotedKvItem, bool)
+	Put(item *demotedKvItem) error
+	Delete(key_str string) error
+	ForEach(fn func(key_str string, item *demotedKvItem) bool)
+	Len() int
+	Close() error
+}
+
+// StorageEngine opens tables of local vnodes. See Config.Storage.
+type StorageEngine interface {
+	// Open returns primary, replica and demoted tables of vnode, holding items stored by previous runs.
+	Open(vnode *dendrite.Vnode) (primary, replica Storage, demoted DemotedStorage, err error)
+}
+
+type memoryEngine struct{}
+
+// MemoryStorage keeps items in memory only, they are lost when process exits. It's the default engine.
+var MemoryStorage StorageEngine = memoryEngine{}
+
+func (memoryEngine) Open(vnode *dendrite.Vnode) (Storage, Storage, DemotedStorage, error) {
+	return newMemoryTable(), newMemoryTable(), newMemoryDemotedTable(), nil
+}
+
+/* memoryTable is Storage that keeps items in itemMap, guarded by read/write lock, as tables are read and
+written from many goroutines. ForEach and Range iterate over a snapshot of items, taken under read lock,
+so that fn can write to the table.
+*/
+type memoryTable struct {
+	items itemMap
+	lock  sync.RWMutex
+}
+
+func newMemoryTable() *memoryTable {
+	return &memoryTable{items: make(itemMap)}
+}
+
+func (t *memoryTable) Get(key_str string) (*kvItem, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Get(key_str)
+}
+
+func (t *memoryTable) Put(item *kvItem) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.items.Put(item)
+}
+
+func (t *memoryTable) Delete(key_str string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.items.Delete(key_str)
+}
+
+func (t *memoryTable) ForEach(fn func(key_str string, item *kvItem) bool) {
+	t.lock.RLock()
+	snapshot := t.items.snapshot()
+	t.lock.RUnlock()
+	snapshot.ForEach(fn)
+}
+
+func (t *memoryTable) Range(start, end []byte, fn func(item *kvItem) bool) {
+	t.lock.RLock()
+	items := t.items.rangeHeap(start, end)
+	t.lock.RUnlock()
+	items.each(fn)
+}
+
+func (t *memoryTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Len()
+}
+
+func (t *memoryTable) Close() error {
+	return nil
+}
+
+// memoryDemotedTable is DemotedStorage that keeps items in demotedItemMap, guarded by read/write lock, same as memoryTable.
+type memoryDemotedTable struct {
+	items demotedItemMap
+	lock  sync.RWMutex
+}
+
+func newMemoryDemotedTable() *memoryDemotedTable {
+	return &memoryDemotedTable{items: make(demotedItemMap)}
+}
+
+func (t *memoryDemotedTable) Get(key_str string) (*demotedKvItem, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Get(key_str)
+}
+
+func (t *memoryDemotedTable) Put(item *demotedKvItem) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.items.Put(item)
+}
+
+func (t *memoryDemotedTable) Delete(key_str string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.items.Delete(key_str)
+}
+
+func (t *memoryDemotedTable) ForEach(fn func(key_str string, item *demotedKvItem) bool) {
+	t.lock.RLock()
+	snapshot := t.items.snapshot()
+	t.lock.RUnlock()
+	snapshot.ForEach(fn)
+}
+
+func (t *memoryDemotedTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items.Len()
+}
+
+func (t *memoryDemotedTable) Close() error {
+	return nil
+}
+
+// putItem writes item to storage, unless it holds newer version of it. Tombstones are written as any other
+// item, while nil value without tombstone removes the key.
+func putItem(s Storage, item *kvItem) error {
+	key_str := item.keyHashString()
+	if oldItem, ok := s.Get(key_str); ok {
+		if oldItem.timestamp.After(item.timestamp) {
+			return fmt.Errorf("map.put() refused write for key %s. Record too old: %s > %s",
+				key_str, oldItem.timestamp, item.timestamp)
+		}
+		// key exists but the record is older than new one
+		if item.Val == nil && !item.tombstone {
+			return s.Delete(key_str)
+		}
+		return s.Put(item)
+	}
+	if item.Val == nil && !item.tombstone {
+		return fmt.Errorf("map.put() - empty value not allowed")
+	}
+	return s.Put(item)
+}
+
+// persist writes item, changed in place, back to storage, unless it was replaced in the meantime.
+func (dt *DTable) persist(s Storage, item *kvItem) {
+	if current, ok := s.Get(item.keyHashString()); !ok || current != item {
+		return
+	}
+	if err := s.Put(item); err != nil {
+		dt.Logf(LogInfo, "persist() - failed to store key %s - %s\n", item.keyHashString(), err)
+	}
+}
+
+// removeItem deletes item from storage under item's lock, if it is still the current one and check passes.
+// It returns true if item was deleted. Items replaced in the meantime are left alone.
+func (dt *DTable) removeItem(s Storage, item *kvItem, check func() bool) bool {
+	item.lock.Lock()
+	defer item.lock.Unlock()
+	key_str := item.keyHashString()
+	if current, ok := s.Get(key_str); !ok || current != item || !check() {
+		return false
+	}
+	if err := s.Delete(key_str); err != nil {
+		dt.Logf(LogInfo, "removeItem() - failed to delete key %s - %s\n", key_str, err)
+		return false
+	}
+	return true
+}
+
+// inHashRange checks if key hash is in range (start, end]. Empty start means the beginning of hash space.
+func inHashRange(keyHash, start, end []byte) bool {
+	if len(start) > 0 && bytes.Compare(keyHash, start) <= 0 {
+		return false
+	}
+	return bytes.Compare(keyHash, end) <= 0
+}
+
+// itemMap is in-memory Storage without locking. Tables that are shared between goroutines keep their items
+// in itemMap under their own lock (see memoryTable and diskTable).
+
+func (m itemMap) Get(key_str string) (*kvItem, bool) {
+	item, ok := m[key_str]
+	return item, ok
+}
+
+func (m itemMap) Put(item *kvItem) error {
+	m[item.keyHashString()] = item
+	return nil
+}
+
+func (m itemMap) Delete(key_str string) error {
+	delete(m, key_str)
+	return nil
+}
+
+func (m itemMap) ForEach(fn func(key_str string, item *kvItem) bool) {
+	for key_str, item := range m {
+		if !fn(key_str, item) {
+			return
+		}
+	}
+}
+
+// Range builds a heap of items in range and pops them in order, so that a page of k items costs
+// O(n + k log n), instead of sorting the whole range.
+func (m itemMap) Range(start, end []byte, fn func(item *kvItem) bool) {
+	m.rangeHeap(start, end).each(fn)
+}
+
+// rangeHeap returns heap of items in range (start, end].
+func (m itemMap) rangeHeap(start, end []byte) *keyHashHeap {
+	items := make(keyHashHeap, 0)
+	for _, item := range m {
+		if inHashRange(item.keyHash, start, end) {
+			items = append(items, item)
+		}
+	}
+	heap.Init(&items)
+	return &items
+}
+
+// each pops items in key hash order, until fn returns false.
+func (items *keyHashHeap) each(fn func(item *kvItem) bool) {
+	for items.Len() > 0 {
+		if !fn(heap.Pop(items).(*kvItem)) {
+			return
+		}
+	}
+}
+
+// keyHashHeap is a min-heap of items by key hash.
+type keyHashHeap []*kvItem
+
+func (h keyHashHeap) Len() int            { return len(h) }
+func (h keyHashHeap) Less(i, j int) bool  { return bytes.Compare(h[i].keyHash, h[j].keyHash) == -1 }
+func (h keyHashHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHashHeap) Push(x interface{}) { *h = append(*h, x.(*kvItem)) }
+func (h *keyHashHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// snapshot returns a copy of the map, sharing the items.
+func (m itemMap) snapshot() itemMap {
+	rv := make(itemMap, len(m))
+	for key_str, item := range m {
+		rv[key_str] = item
+	}
+	return rv
+}
+
+func (m itemMap) Len() int {
+	return len(m)
+}
+
+func (m itemMap) Close() error {
+	return nil
+}
+
+// demotedItemMap is in-memory DemotedStorage without locking, same as itemMap.
+
+func (m demotedItemMap) Get(key_str string) (*demotedKvItem, bool) {
+	item, ok := m[key_str]
+	return item, ok
+}
+
+func (m demotedItemMap) Put(item *demotedKvItem) error {
+	m[item.item.keyHashString()] = item
+	return nil
+}
+
+func (m demotedItemMap) Delete(key_str string) error {
+	delete(m, key_str)
+	return nil
+}
+
+func (m demotedItemMap) ForEach(fn func(key_str string, item *demotedKvItem) bool) {
+	for key_str, item := range m {
+		if !fn(key_str, item) {
+			return
+		}
+	}
+}
+
+// snapshot returns a copy of the map, sharing the items.
+func (m demotedItemMap) snapshot() demotedItemMap {
+	rv := make(demotedItemMap, len(m))
+	for key_str, item := range m {
+		rv[key_str] = item
+	}
+	return rv
+}
+
+func (m demotedItemMap) Len() int {
+	return len(m)
+}
+
+func (m demotedItemMap) Close() error {
+	return nil
+}
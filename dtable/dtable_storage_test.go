@@ -0,0 +1,140 @@
+package dtable
+
+import (
+	"bytes"
+	"github.com/fastfn/dendrite"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestItemMapRange(t *testing.T) {
+	m := make(itemMap)
+	for _, i := range rand.Perm(200) {
+		m.Put(testItem(hashAt(byte(i), byte(i)), "v", 1))
+	}
+	// (0x10, 0x80], in order
+	var last []byte
+	n := 0
+	m.Range(hashAt(0x10, 0x10), hashAt(0x80, 0x80), func(item *kvItem) bool {
+		if last != nil && bytes.Compare(last, item.keyHash) != -1 {
+			t.Fatalf("key %x returned after %x", item.keyHash, last)
+		}
+		last = item.keyHash
+		n++
+		return true
+	})
+	if n != 0x80-0x10 || !bytes.Equal(last, hashAt(0x80, 0x80)) {
+		t.Fatalf("expected %d items up to %x, got %d up to %x", 0x80-0x10, hashAt(0x80, 0x80), n, last)
+	}
+
+	// empty start reads from the beginning, and fn stops the iteration
+	first := make([][]byte, 0)
+	m.Range(nil, hashAt(0xff, 0xff), func(item *kvItem) bool {
+		first = append(first, item.keyHash)
+		return len(first) < 5
+	})
+	if len(first) != 5 {
+		t.Fatalf("expected 5 items, got %d", len(first))
+	}
+	for idx, keyHash := range first {
+		if !bytes.Equal(keyHash, hashAt(byte(idx), byte(idx))) {
+			t.Fatalf("item %d is %x", idx, keyHash)
+		}
+	}
+}
+
+func TestTombstoneBeatsOlderCopy(t *testing.T) {
+	now := time.Now().UnixNano()
+	key := hashAt(0x15, 1)
+	m := make(itemMap)
+	if err := putItem(m, testItem(key, "v", now-2)); err != nil {
+		t.Fatal(err)
+	}
+	tombstone := testItem(key, "", now-1)
+	tombstone.Val = nil
+	tombstone.tombstone = true
+	tombstone.lock = new(sync.Mutex)
+	if err := putItem(m, tombstone); err != nil {
+		t.Fatalf("tombstone refused: %s", err)
+	}
+	// replica or demoted copy that missed the delete can't bring the value back
+	if err := putItem(m, testItem(key, "v", now-2)); err == nil {
+		t.Fatal("older value overwrote the tombstone")
+	}
+	if item, ok := m.Get(tombstone.keyHashString()); !ok || !item.tombstone {
+		t.Fatal("tombstone was lost")
+	}
+
+	// anti-entropy sees the tombstone and older value as different
+	kr := &dendrite.KeyRange{Start: hashAt(0x10, 0), End: hashAt(0x20, 0)}
+	stale := make(itemMap)
+	stale.Put(testItem(key, "v", now-2))
+	if bytes.Equal(newMerkleTree(kr, m).nodes[1], newMerkleTree(kr, stale).nodes[1]) {
+		t.Fatal("tombstone and older value hash the same")
+	}
+
+	// tombstone is kept until TombstoneGrace expires
+	dt := &DTable{conf: DefaultConfig(), table: map[string]Storage{"vn": m}, rtable: map[string]Storage{}}
+	dt.purgeTombstones()
+	if _, ok := m.Get(tombstone.keyHashString()); !ok {
+		t.Fatal("tombstone purged before grace period")
+	}
+	tombstone.timestamp = hlcTimestamp{wall: now - int64(dt.conf.TombstoneGrace) - int64(time.Second)}
+	dt.purgeTombstones()
+	if _, ok := m.Get(tombstone.keyHashString()); ok {
+		t.Fatal("tombstone kept after grace period")
+	}
+}
+
+// TestMemoryStorageConcurrent is meant to be run with -race.
+func TestMemoryStorageConcurrent(t *testing.T) {
+	table, _, demoted, _ := MemoryStorage.Open(&dendrite.Vnode{Id: hashAt(0x01, 0)})
+	table.Put(testItem(hashAt(0xff, 0xff), "v", 1))
+	demoted.Put(&demotedKvItem{item: testItem(hashAt(0xff, 0xff), "v", 1)})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			item := testItem(hashAt(byte(i), byte(i>>8)), "v", int64(i))
+			table.Put(item)
+			demoted.Put(&demotedKvItem{item: item})
+			if i%3 == 0 {
+				table.Delete(item.keyHashString())
+				demoted.Delete(item.keyHashString())
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			// fn may write to the table it iterates over
+			table.ForEach(func(key_str string, item *kvItem) bool {
+				table.Put(testItem(hashAt(0xff, 0xff), "v", 1))
+				return true
+			})
+			demoted.ForEach(func(key_str string, item *demotedKvItem) bool {
+				demoted.Put(&demotedKvItem{item: testItem(hashAt(0xff, 0xff), "v", 1)})
+				return true
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			table.Range(nil, hashAt(0x80, 0), func(item *kvItem) bool {
+				table.Get(item.keyHashString())
+				return true
+			})
+			table.Len()
+			demoted.Len()
+		}
+	}()
+	wg.Wait()
+	// writer's keys that were not deleted, and the one rewritten from ForEach
+	if table.Len() != 667 || demoted.Len() != 667 {
+		t.Fatalf("expected 667 items, got %d and %d", table.Len(), demoted.Len())
+	}
+}
@@ -0,0 +1,93 @@
+package dtable
+
+import (
+	"github.com/fastfn/dendrite"
+	"sync"
+	"testing"
+)
+
+func versionedItem(keyHash []byte, val string, wall int64, expected *uint64) *kvItem {
+	item := testItem(keyHash, val, wall)
+	item.lock = new(sync.Mutex)
+	item.expectedVersion = expected
+	return item
+}
+
+func TestPutVersionedConflict(t *testing.T) {
+	dt := &DTable{}
+	vn_table := make(itemMap)
+	key := hashAt(0x10, 1)
+	zero, one, two := uint64(0), uint64(1), uint64(2)
+
+	// SetIfAbsent of a new key
+	first := versionedItem(key, "a", 1, &zero)
+	if previous, err := dt.putVersioned(vn_table, first); err != nil || previous != nil || first.Version != 1 {
+		t.Fatalf("first write: previous %v, version %d, err %v", previous, first.Version, err)
+	}
+	// SetIfAbsent of existing key conflicts, and the key is left alone
+	if _, err := dt.putVersioned(vn_table, versionedItem(key, "b", 2, &zero)); err != ErrVersionConflict {
+		t.Fatalf("expected version conflict, got %v", err)
+	}
+	// CompareAndSet with stale version conflicts
+	if _, err := dt.putVersioned(vn_table, versionedItem(key, "b", 2, &two)); err != ErrVersionConflict {
+		t.Fatalf("expected version conflict, got %v", err)
+	}
+	if current, _ := vn_table.Get(first.keyHashString()); current != first {
+		t.Fatal("conflicting write replaced the key")
+	}
+	// CompareAndSet with current version replaces the key, and returns previous item for rollback
+	second := versionedItem(key, "b", 2, &one)
+	if previous, err := dt.putVersioned(vn_table, second); err != nil || previous != first || second.Version != 2 {
+		t.Fatalf("second write: previous %v, version %d, err %v", previous, second.Version, err)
+	}
+
+	// deleted key has version 0 for SetIfAbsent, but its version keeps growing
+	tombstone := versionedItem(key, "", 3, nil)
+	tombstone.Val = nil
+	tombstone.tombstone = true
+	if _, err := dt.putVersioned(vn_table, tombstone); err != nil || tombstone.Version != 3 {
+		t.Fatalf("delete: version %d, err %v", tombstone.Version, err)
+	}
+	if _, err := dt.putVersioned(vn_table, versionedItem(key, "c", 4, &two)); err != ErrVersionConflict {
+		t.Fatalf("expected version conflict on deleted key, got %v", err)
+	}
+	again := versionedItem(key, "c", 4, &zero)
+	if _, err := dt.putVersioned(vn_table, again); err != nil || again.Version != 4 {
+		t.Fatalf("SetIfAbsent of deleted key: version %d, err %v", again.Version, err)
+	}
+}
+
+func TestRollbackRestoresPrevious(t *testing.T) {
+	key := hashAt(0x10, 1)
+	vn := &dendrite.Vnode{Id: hashAt(0x01, 0), Host: "local:1"}
+	vn_table := make(itemMap)
+	dt := &DTable{table: map[string]Storage{vn.String(): vn_table}}
+
+	first := versionedItem(key, "a", 1, nil)
+	dt.putVersioned(vn_table, first)
+	second := versionedItem(key, "b", 2, nil)
+	previous, _ := dt.putVersioned(vn_table, second)
+	// failed write puts previous item back, with its version
+	dt.rollback(vn, second, previous, nil)
+	if current, ok := vn_table.Get(first.keyHashString()); !ok || current != first || current.Version != 1 {
+		t.Fatalf("previous item was not restored: %v", current)
+	}
+
+	// new key is removed
+	other := versionedItem(hashAt(0x10, 2), "a", 1, nil)
+	previous, _ = dt.putVersioned(vn_table, other)
+	dt.rollback(vn, other, previous, nil)
+	if _, ok := vn_table.Get(other.keyHashString()); ok {
+		t.Fatal("new key was not removed")
+	}
+
+	// key overwritten in the meantime is left alone
+	third := versionedItem(key, "c", 3, nil)
+	previous, _ = dt.putVersioned(vn_table, third)
+	fourth := versionedItem(key, "d", 4, nil)
+	dt.putVersioned(vn_table, fourth)
+	dt.rollback(vn, third, previous, nil)
+	if current, _ := vn_table.Get(fourth.keyHashString()); current != fourth {
+		t.Fatal("newer write was rolled back")
+	}
+}
@@ -16,7 +16,10 @@ func (item *kvItem) keyHashString() string {
 }
 
 func (rinfo *kvReplicaInfo) to_protobuf() *PBDTableReplicaInfo {
-	pb_master := rinfo.master.ToProtobuf()
+	var pb_master *dendrite.PBProtoVnode
+	if rinfo.master != nil {
+		pb_master = rinfo.master.ToProtobuf()
+	}
 	pb_vnodes := make([]*dendrite.PBProtoVnode, 0)
 	for _, rvn := range rinfo.vnodes {
 		if rvn == nil {
@@ -60,9 +63,15 @@ func (item *kvItem) to_protobuf() *PBDTableItem {
 	rv := &PBDTableItem{
 		Key:       item.Key,
 		Val:       item.Val,
-		Timestamp: proto.Int64(item.timestamp.UnixNano()),
+		Timestamp: proto.Int64(item.timestamp.wall),
+		Logical:   proto.Int32(item.timestamp.logical),
 		KeyHash:   item.keyHash,
 		Commited:  proto.Bool(item.commited),
+		Tombstone: proto.Bool(item.tombstone),
+		Version:   proto.Uint64(item.Version),
+	}
+	if !item.expires.IsZero() {
+		rv.Expires = proto.Int64(item.expires.UnixNano())
 	}
 	if item.replicaInfo != nil {
 		rv.ReplicaInfo = item.replicaInfo.to_protobuf()
@@ -73,9 +82,16 @@ func (item *kvItem) to_protobuf() *PBDTableItem {
 func (item *kvItem) from_protobuf(pb *PBDTableItem) {
 	item.Key = pb.GetKey()
 	item.Val = pb.GetVal()
-	item.timestamp = time.Unix(0, pb.GetTimestamp())
+	item.timestamp = hlcTimestamp{wall: pb.GetTimestamp(), logical: pb.GetLogical()}
 	item.keyHash = pb.GetKeyHash()
 	item.commited = pb.GetCommited()
+	item.tombstone = pb.GetTombstone()
+	item.Version = pb.GetVersion()
+	if expires := pb.GetExpires(); expires != 0 {
+		item.expires = time.Unix(0, expires)
+	} else {
+		item.expires = time.Time{}
+	}
 	item.replicaInfo = replicaInfo_from_protobuf(pb.GetReplicaInfo())
 }
 
@@ -87,6 +103,11 @@ func (item *kvItem) to_demoted(new_master *dendrite.Vnode) *demotedKvItem {
 	return rv
 }
 
+// expired checks if item has expiry time set, and that time has passed.
+func (item *kvItem) expired() bool {
+	return !item.expires.IsZero() && !time.Now().Before(item.expires)
+}
+
 func (item *kvItem) numActiveReplicas() int {
 	if item.replicaInfo == nil {
 		return 0
@@ -103,14 +124,20 @@ func (item *kvItem) numActiveReplicas() int {
 func (item *kvItem) dup() *kvItem {
 	new_item := new(kvItem)
 	new_item.timestamp = item.timestamp
+	new_item.Version = item.Version
 	new_item.commited = item.commited
+	new_item.tombstone = item.tombstone
+	new_item.expires = item.expires
 	new_item.lock = item.lock
 
 	new_item.Key = make([]byte, len(item.Key))
 	copy(new_item.Key, item.Key)
 
-	new_item.Val = make([]byte, len(item.Val))
-	copy(new_item.Val, item.Val)
+	// keep nil value nil, it marks the deletion
+	if item.Val != nil {
+		new_item.Val = make([]byte, len(item.Val))
+		copy(new_item.Val, item.Val)
+	}
 
 	new_item.keyHash = make([]byte, len(item.keyHash))
 	copy(new_item.keyHash, item.keyHash)
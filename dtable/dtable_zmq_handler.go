@@ -12,7 +12,6 @@ func (dt *DTable) zmq_status_handler(request *dendrite.ChordMsg, w chan *dendrit
 
 	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
 	dest_key_str := fmt.Sprintf("%x", dest.Id)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
 
 	// make sure destination vnode exists locally
 	_, ok := dt.table[dest_key_str]
@@ -25,9 +24,9 @@ func (dt *DTable) zmq_status_handler(request *dendrite.ChordMsg, w chan *dendrit
 	}
 
 	// encode and send the response
-	pbdata, err := proto.Marshal(setResp)
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
 	if err != nil {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::StatusHandler - failed to marshal response - " + err.Error())
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::StatusHandler - failed to marshal response - " + err.Error())
 		w <- errorMsg
 		return
 	}
@@ -43,12 +42,14 @@ func (dt *DTable) zmq_get_handler(request *dendrite.ChordMsg, w chan *dendrite.C
 	keyHash := pbMsg.GetKeyHash()
 	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
 	dest_key_str := fmt.Sprintf("%x", dest.Id)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
 
 	// make sure destination vnode exists locally
 	vn_table, ok := dt.table[dest_key_str]
+	if pbMsg.GetReplica() {
+		vn_table, ok = dt.rtable[dest_key_str]
+	}
 	if !ok {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::GetHandler - local vnode table not found")
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::GetHandler - local vnode table not found")
 		w <- errorMsg
 		return
 	}
@@ -56,7 +57,7 @@ func (dt *DTable) zmq_get_handler(request *dendrite.ChordMsg, w chan *dendrite.C
 
 	var itemResp *PBDTableItem
 
-	if localItem, ok := vn_table[key_str]; ok {
+	if localItem, ok := vn_table.Get(key_str); ok && (localItem.commited || !pbMsg.GetReplica()) {
 		itemResp = localItem.to_protobuf()
 		itemResp.Found = proto.Bool(true)
 	} else {
@@ -68,7 +69,7 @@ func (dt *DTable) zmq_get_handler(request *dendrite.ChordMsg, w chan *dendrite.C
 	// encode and send the response
 	pbdata, err := proto.Marshal(itemResp)
 	if err != nil {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::GetHandler - failed to marshal response - " + err.Error())
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::GetHandler - failed to marshal response - " + err.Error())
 		w <- errorMsg
 		return
 	}
@@ -84,17 +85,22 @@ func (dt *DTable) zmq_set_handler(request *dendrite.ChordMsg, w chan *dendrite.C
 	reqItem := new(kvItem)
 	reqItem.lock = new(sync.Mutex)
 	reqItem.from_protobuf(pbMsg.GetItem())
+	dt.clock.update(reqItem.timestamp)
+	if pbMsg.ExpectedVersion != nil {
+		expected := pbMsg.GetExpectedVersion()
+		reqItem.expectedVersion = &expected
+	}
+	reqItem.stamp = pbMsg.GetStamp()
 	demoting := pbMsg.GetDemoting()
 	minAcks := int(pbMsg.GetMinAcks())
 	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
 	origin := dendrite.VnodeFromProtobuf(pbMsg.GetOrigin())
 	dest_key_str := fmt.Sprintf("%x", dest.Id)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
 
 	// make sure destination vnode exists locally
 	_, ok := dt.table[dest_key_str]
 	if !ok {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetHandler - local vnode table not found")
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetHandler - local vnode table not found")
 		w <- errorMsg
 		return
 	}
@@ -103,17 +109,16 @@ func (dt *DTable) zmq_set_handler(request *dendrite.ChordMsg, w chan *dendrite.C
 	}
 
 	if demoting {
-		old_master := reqItem.replicaInfo.master
 		reqItem.replicaInfo.master = dest
 		reqItem.lock.Lock()
-		err := dt.table[dest_key_str].put(reqItem)
+		err := putItem(dt.table[dest_key_str], reqItem)
 		if err != nil {
-			errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetHandler - demote received error on - " + err.Error())
+			errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetHandler - demote received error on - " + err.Error())
 			w <- errorMsg
 			reqItem.lock.Unlock()
 			return
 		}
-		go dt.processDemoteKey(dest, origin, old_master, reqItem)
+		go dt.processDemoteKeys(dest, origin, []*kvItem{reqItem})
 		setResp.Ok = proto.Bool(true)
 		reqItem.lock.Unlock()
 	} else {
@@ -122,15 +127,17 @@ func (dt *DTable) zmq_set_handler(request *dendrite.ChordMsg, w chan *dendrite.C
 		err := <-wait
 		if err != nil {
 			setResp.Error = proto.String("ZMQ::DTable::SetHandler - error executing transaction - " + err.Error())
+			setResp.Conflict = proto.Bool(err == ErrVersionConflict)
+			setResp.ClockSkew = proto.Bool(err == ErrClockSkew)
 		} else {
 			setResp.Ok = proto.Bool(true)
 		}
 	}
 
 	// encode and send the response
-	pbdata, err := proto.Marshal(setResp)
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
 	if err != nil {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetHandler - failed to marshal response - " + err.Error())
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetHandler - failed to marshal response - " + err.Error())
 		w <- errorMsg
 		return
 	}
@@ -147,26 +154,29 @@ func (dt *DTable) zmq_setReplica_handler(request *dendrite.ChordMsg, w chan *den
 	reqItem := new(kvItem)
 	reqItem.lock = new(sync.Mutex)
 	reqItem.from_protobuf(pbMsg.GetItem())
+	dt.clock.update(reqItem.timestamp)
 	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
 	dest_key_str := fmt.Sprintf("%x", dest.Id)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
 
 	// make sure destination vnode exists locally
 	_, ok := dt.table[dest_key_str]
 	if !ok {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetReplicaHandler - local vnode table not found")
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetReplicaHandler - local vnode table not found")
 		w <- errorMsg
 		return
 	}
 	setResp := &PBDTableResponse{
 		Ok: proto.Bool(true),
 	}
-	dt.setReplica(dest, reqItem)
+	if err := dt.setReplica(dest, reqItem); err != nil {
+		setResp.Ok = proto.Bool(false)
+		setResp.Error = proto.String("ZMQ::DTable::SetReplicaHandler - failed to store replica - " + err.Error())
+	}
 
 	// encode and send the response
-	pbdata, err := proto.Marshal(setResp)
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
 	if err != nil {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetReplicaHandler - failed to marshal response - " + err.Error())
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetReplicaHandler - failed to marshal response - " + err.Error())
 		w <- errorMsg
 		return
 	}
@@ -184,31 +194,35 @@ func (dt *DTable) zmq_setReplicaInfo_handler(request *dendrite.ChordMsg, w chan
 	keyHash := pbMsg.GetKeyHash()
 	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
 	dest_key_str := fmt.Sprintf("%x", dest.Id)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
 
 	// make sure destination vnode exists locally
 	vn_table, ok := dt.rtable[dest_key_str]
 	if !ok {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetMetaHandler - local vnode table not found")
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMetaHandler - local vnode table not found")
 		w <- errorMsg
 		return
 	}
 	key_str := fmt.Sprintf("%x", keyHash)
-	item, ok := vn_table[key_str]
+	item, ok := vn_table.Get(key_str)
 	if !ok {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetMetaHandler - key not found")
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMetaHandler - key not found")
 		w <- errorMsg
 		return
 	}
 	item.replicaInfo = rInfo
+	if err := vn_table.Put(item); err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMetaHandler - failed to store replica info - " + err.Error())
+		w <- errorMsg
+		return
+	}
 
 	// encode and send the response
 	setResp := &PBDTableResponse{
 		Ok: proto.Bool(true),
 	}
-	pbdata, err := proto.Marshal(setResp)
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
 	if err != nil {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetMetaHandler - failed to marshal response - " + err.Error())
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMetaHandler - failed to marshal response - " + err.Error())
 		w <- errorMsg
 		return
 	}
@@ -225,12 +239,11 @@ func (dt *DTable) zmq_clearreplica_handler(request *dendrite.ChordMsg, w chan *d
 	demoted := pbMsg.GetDemoted()
 	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
 	dest_key_str := fmt.Sprintf("%x", dest.Id)
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
 
 	// make sure destination vnode exists locally
 	r_table, ok := dt.rtable[dest_key_str]
 	if !ok {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - local vnode table not found")
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - local vnode table not found")
 		w <- errorMsg
 		return
 	}
@@ -238,18 +251,18 @@ func (dt *DTable) zmq_clearreplica_handler(request *dendrite.ChordMsg, w chan *d
 	key_str := fmt.Sprintf("%x", keyHash)
 	if demoted {
 		d_table, _ := dt.demoted_table[dest_key_str]
-		if _, ok := d_table[key_str]; ok {
-			delete(d_table, key_str)
+		if _, ok := d_table.Get(key_str); ok {
+			d_table.Delete(key_str)
 		} else {
-			errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - key " + key_str + " not found in demoted table")
+			errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - key " + key_str + " not found in demoted table")
 			w <- errorMsg
 			return
 		}
 	} else {
-		if _, ok := r_table[key_str]; ok {
-			delete(r_table, key_str)
+		if _, ok := r_table.Get(key_str); ok {
+			r_table.Delete(key_str)
 		} else {
-			errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - key " + key_str + " not found in replica table on vnode " + dest.String())
+			errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - key " + key_str + " not found in replica table on vnode " + dest.String())
 			w <- errorMsg
 			return
 		}
@@ -259,9 +272,9 @@ func (dt *DTable) zmq_clearreplica_handler(request *dendrite.ChordMsg, w chan *d
 	setResp := &PBDTableResponse{
 		Ok: proto.Bool(true),
 	}
-	pbdata, err := proto.Marshal(setResp)
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
 	if err != nil {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - failed to marshal response - " + err.Error())
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ClearReplicaHandler - failed to marshal response - " + err.Error())
 		w <- errorMsg
 		return
 	}
@@ -277,6 +290,7 @@ func (dt *DTable) zmq_promoteKey_handler(request *dendrite.ChordMsg, w chan *den
 	reqItem := new(kvItem)
 	reqItem.lock = new(sync.Mutex)
 	reqItem.from_protobuf(pbMsg.GetItem())
+	dt.clock.update(reqItem.timestamp)
 
 	// send out the event to delegator
 	ev := &dtableEvent{
@@ -284,18 +298,450 @@ func (dt *DTable) zmq_promoteKey_handler(request *dendrite.ChordMsg, w chan *den
 		vnode:  dendrite.VnodeFromProtobuf(pbMsg.GetDest()),
 		item:   reqItem,
 	}
-	dt.dtable_c <- ev
+	dt.emitInternal(ev)
+
+
+	setResp := &PBDTableResponse{
+		Ok: proto.Bool(true),
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetReplicaHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_merkleNodes_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableMerkleNodes)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	r_table, ok := dt.rtable[dest_key_str]
+	if !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::MerkleNodesHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	kr := &dendrite.KeyRange{Start: pbMsg.GetStart(), End: pbMsg.GetEnd()}
+	// request for the root starts primary's sync session
+	start := len(pbMsg.GetNodes()) == 1 && pbMsg.GetNodes()[0] == 1
+	tree := dt.replicaMerkleTree(dest_key_str, r_table, kr, start)
+	nodesResp := &PBDTableMerkleNodesResponse{
+		Hashes: make([][]byte, 0, len(pbMsg.GetNodes())),
+	}
+	for _, node := range pbMsg.GetNodes() {
+		if node < 1 || int(node) >= len(tree.nodes) {
+			errorMsg := dendrite.NewErrorMsg(fmt.Sprintf("ZMQ::DTable::MerkleNodesHandler - invalid node index %d", node))
+			w <- errorMsg
+			return
+		}
+		nodesResp.Hashes = append(nodesResp.Hashes, tree.nodes[node])
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(nodesResp)
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::MerkleNodesHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMerkleNodesResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_merkleItems_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableMerkleNodes)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	r_table, ok := dt.rtable[dest_key_str]
+	if !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::MerkleItemsHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	kr := &dendrite.KeyRange{Start: pbMsg.GetStart(), End: pbMsg.GetEnd()}
+	tree := dt.replicaMerkleTree(dest_key_str, r_table, kr, false)
+	dt.endMerkleSession(dest_key_str, kr)
+	leaves := make([]int, len(pbMsg.GetNodes()))
+	for idx, node := range pbMsg.GetNodes() {
+		leaves[idx] = int(node)
+	}
+	itemsResp := &PBDTableMultiItemResponse{
+		Origin: dest.ToProtobuf(),
+		Items:  make([]*PBDTableItem, 0),
+	}
+	for _, item := range tree.leafItems(leaves) {
+		itemsResp.Items = append(itemsResp.Items, item.to_protobuf())
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(itemsResp)
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::MerkleItemsHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMultiItemResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_repairReplica_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableSetMultiItem)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	items := make([]*kvItem, 0, len(pbMsg.GetItems()))
+	for _, pbItem := range pbMsg.GetItems() {
+		reqItem := new(kvItem)
+		reqItem.lock = new(sync.Mutex)
+		reqItem.from_protobuf(pbItem)
+		dt.clock.update(reqItem.timestamp)
+		items = append(items, reqItem)
+	}
+
+	setResp := &PBDTableResponse{
+		Ok: proto.Bool(true),
+	}
+	if err := dt.repairReplicaItems(dest, items); err != nil {
+		setResp.Ok = proto.Bool(false)
+		setResp.Error = proto.String("ZMQ::DTable::RepairReplicaHandler - " + err.Error())
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::RepairReplicaHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_setMulti_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableSetMultiItem)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	if _, ok := dt.table[dest_key_str]; !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMultiHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	items := make([]*kvItem, 0, len(pbMsg.GetItems()))
+	for _, pbItem := range pbMsg.GetItems() {
+		reqItem := new(kvItem)
+		reqItem.lock = new(sync.Mutex)
+		reqItem.from_protobuf(pbItem)
+		dt.clock.update(reqItem.timestamp)
+		reqItem.stamp = true
+		if reqItem.replicaInfo == nil {
+			reqItem.replicaInfo = new(kvReplicaInfo)
+			reqItem.replicaInfo.orphan_vnodes = make([]*dendrite.Vnode, 0)
+		}
+		reqItem.replicaInfo.vnodes = make([]*dendrite.Vnode, dt.ring.Replicas())
+		items = append(items, reqItem)
+	}
+
+	itemsResp := &PBDTableMultiItemResponse{
+		Origin: dest.ToProtobuf(),
+		Errors: make([]string, len(items)),
+	}
+	for idx, err := range dt.setBatch(dest, items, int(pbMsg.GetMinAcks())) {
+		if err != nil {
+			itemsResp.Errors[idx] = err.Error()
+		}
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(itemsResp)
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMultiHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMultiItemResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_getMulti_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableGetMultiItem)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	vn_table, ok := dt.table[dest_key_str]
+	if !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::GetMultiHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	itemsResp := &PBDTableMultiItemResponse{
+		Origin: dest.ToProtobuf(),
+		Items:  make([]*PBDTableItem, 0, len(pbMsg.GetKeyHashes())),
+	}
+	for _, keyHash := range pbMsg.GetKeyHashes() {
+		var itemResp *PBDTableItem
+		if localItem, ok := vn_table.Get(fmt.Sprintf("%x", keyHash)); ok {
+			itemResp = localItem.to_protobuf()
+			itemResp.Found = proto.Bool(true)
+		} else {
+			itemResp = &PBDTableItem{
+				Found: proto.Bool(false),
+			}
+		}
+		itemsResp.Items = append(itemsResp.Items, itemResp)
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(itemsResp)
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::GetMultiHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMultiItemResponse,
+		Data: pbdata,
+	}
+	return
+}
 
-	zmq_transport := dt.transport.(*dendrite.ZMQTransport)
+func (dt *DTable) zmq_setReplicaBatch_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableSetMultiItem)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
 
+	// make sure destination vnode exists locally
+	if _, ok := dt.rtable[dest_key_str]; !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetReplicaBatchHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
 	setResp := &PBDTableResponse{
 		Ok: proto.Bool(true),
 	}
+	for _, pbItem := range pbMsg.GetItems() {
+		reqItem := new(kvItem)
+		reqItem.lock = new(sync.Mutex)
+		reqItem.from_protobuf(pbItem)
+		dt.clock.update(reqItem.timestamp)
+		if err := dt.setReplica(dest, reqItem); err != nil {
+			setResp.Ok = proto.Bool(false)
+			setResp.Error = proto.String("ZMQ::DTable::SetReplicaBatchHandler - failed to store replica - " + err.Error())
+		}
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetReplicaBatchHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_setReplicaInfoBatch_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableSetReplicaInfoBatch)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	vn_table, ok := dt.rtable[dest_key_str]
+	if !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMetaBatchHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	keyHashes := pbMsg.GetKeyHashes()
+	rInfos := pbMsg.GetReplicaInfos()
+	if len(keyHashes) != len(rInfos) {
+		errorMsg := dendrite.NewErrorMsg(fmt.Sprintf("ZMQ::DTable::SetMetaBatchHandler - got %d replicaInfos for %d keys", len(rInfos), len(keyHashes)))
+		w <- errorMsg
+		return
+	}
+	itemsResp := &PBDTableMultiItemResponse{
+		Origin: dest.ToProtobuf(),
+		Errors: make([]string, len(keyHashes)),
+	}
+	for idx, keyHash := range keyHashes {
+		key_str := fmt.Sprintf("%x", keyHash)
+		item, ok := vn_table.Get(key_str)
+		if !ok {
+			itemsResp.Errors[idx] = "key " + key_str + " not found"
+			continue
+		}
+		item.replicaInfo = replicaInfo_from_protobuf(rInfos[idx])
+		if err := vn_table.Put(item); err != nil {
+			itemsResp.Errors[idx] = "failed to store replica info - " + err.Error()
+		}
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(itemsResp)
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::SetMetaBatchHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMultiItemResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_clearReplicaBatch_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableClearReplicaBatch)
+	demoted := pbMsg.GetDemoted()
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	r_table, ok := dt.rtable[dest_key_str]
+	if !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ClearReplicaBatchHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	itemsResp := &PBDTableMultiItemResponse{
+		Origin: dest.ToProtobuf(),
+		Errors: make([]string, len(pbMsg.GetKeyHashes())),
+	}
+	for idx, keyHash := range pbMsg.GetKeyHashes() {
+		key_str := fmt.Sprintf("%x", keyHash)
+		if demoted {
+			d_table, _ := dt.demoted_table[dest_key_str]
+			if _, ok := d_table.Get(key_str); ok {
+				d_table.Delete(key_str)
+			} else {
+				itemsResp.Errors[idx] = "key " + key_str + " not found in demoted table"
+			}
+		} else {
+			if _, ok := r_table.Get(key_str); ok {
+				r_table.Delete(key_str)
+			} else {
+				itemsResp.Errors[idx] = "key " + key_str + " not found in replica table on vnode " + dest.String()
+			}
+		}
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(itemsResp)
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ClearReplicaBatchHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMultiItemResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_demoteBatch_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableSetMultiItem)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	origin := dendrite.VnodeFromProtobuf(pbMsg.GetOrigin())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	vn_table, ok := dt.table[dest_key_str]
+	if !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::DemoteBatchHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	itemsResp := &PBDTableMultiItemResponse{
+		Origin: dest.ToProtobuf(),
+		Errors: make([]string, len(pbMsg.GetItems())),
+	}
+	demoted := make([]*kvItem, 0, len(pbMsg.GetItems()))
+	for idx, pbItem := range pbMsg.GetItems() {
+		reqItem := new(kvItem)
+		reqItem.lock = new(sync.Mutex)
+		reqItem.from_protobuf(pbItem)
+		dt.clock.update(reqItem.timestamp)
+		reqItem.replicaInfo.master = dest
+		reqItem.lock.Lock()
+		err := putItem(vn_table, reqItem)
+		reqItem.lock.Unlock()
+		if err != nil {
+			itemsResp.Errors[idx] = "demote received error on - " + err.Error()
+			continue
+		}
+		demoted = append(demoted, reqItem)
+	}
+	go dt.processDemoteKeys(dest, origin, demoted)
 
 	// encode and send the response
-	pbdata, err := proto.Marshal(setResp)
+	pbdata, err := proto.Marshal(itemsResp)
 	if err != nil {
-		errorMsg := zmq_transport.NewErrorMsg("ZMQ::DTable::SetReplicaHandler - failed to marshal response - " + err.Error())
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::DemoteBatchHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMultiItemResponse,
+		Data: pbdata,
+	}
+	return
+}
+
+func (dt *DTable) zmq_promoteBatch_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableSetMultiItem)
+	items := make([]*kvItem, 0, len(pbMsg.GetItems()))
+	for _, pbItem := range pbMsg.GetItems() {
+		reqItem := new(kvItem)
+		reqItem.lock = new(sync.Mutex)
+		reqItem.from_protobuf(pbItem)
+		dt.clock.update(reqItem.timestamp)
+		items = append(items, reqItem)
+	}
+
+	// send out the event to delegator
+	ev := &dtableEvent{
+		evType: evPromoteKeys,
+		vnode:  dendrite.VnodeFromProtobuf(pbMsg.GetDest()),
+		items:  items,
+	}
+	dt.emitInternal(ev)
+
+	// encode and send the response
+	setResp := &PBDTableResponse{
+		Ok: proto.Bool(true),
+	}
+	pbdata, err := proto.Marshal(dt.withClock(setResp))
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::PromoteBatchHandler - failed to marshal response - " + err.Error())
 		w <- errorMsg
 		return
 	}
@@ -305,3 +751,42 @@ func (dt *DTable) zmq_promoteKey_handler(request *dendrite.ChordMsg, w chan *den
 	}
 	return
 }
+
+func (dt *DTable) zmq_scan_handler(request *dendrite.ChordMsg, w chan *dendrite.ChordMsg) {
+	pbMsg := request.TransportMsg.(PBDTableScan)
+	dest := dendrite.VnodeFromProtobuf(pbMsg.GetDest())
+	dest_key_str := fmt.Sprintf("%x", dest.Id)
+
+	// make sure destination vnode exists locally
+	vn_table, ok := dt.table[dest_key_str]
+	if pbMsg.GetReplica() {
+		vn_table, ok = dt.rtable[dest_key_str]
+	}
+	if !ok {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ScanHandler - local vnode table not found")
+		w <- errorMsg
+		return
+	}
+	itemsResp := &PBDTableMultiItemResponse{
+		Origin: dest.ToProtobuf(),
+		Items:  make([]*PBDTableItem, 0),
+	}
+	for _, item := range scanTable(vn_table, pbMsg.GetStart(), pbMsg.GetEnd(), int(pbMsg.GetLimit()), pbMsg.GetValues()) {
+		itemResp := item.to_protobuf()
+		itemResp.Found = proto.Bool(true)
+		itemsResp.Items = append(itemsResp.Items, itemResp)
+	}
+
+	// encode and send the response
+	pbdata, err := proto.Marshal(itemsResp)
+	if err != nil {
+		errorMsg := dendrite.NewErrorMsg("ZMQ::DTable::ScanHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &dendrite.ChordMsg{
+		Type: PbDtableMultiItemResponse,
+		Data: pbdata,
+	}
+	return
+}
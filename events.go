@@ -0,0 +1,212 @@
+package dendrite
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxSubscriptionQueue is the number of events queued for a subscriber, before the oldest ones are dropped.
+const maxSubscriptionQueue = 1024
+
+/* Subscription delivers ring events to a subscriber. Events are received on C in the order they
+were emitted (ascending EventCtx.Seq). Subscriber that falls behind does not block the ring,
+pending events are queued until it catches up.
+
+Pending EvVnodeStabilized event is replaced by newer one for the same vnode. Otherwise, queue of lossless
+subscription grows for as long as subscriber is behind. Queue of other subscriptions is bounded, once it is full,
+the oldest events are dropped to make room for new ones. Dropped() reports how many.
+*/
+type Subscription struct {
+	C       <-chan *EventCtx
+	c       chan *EventCtx
+	types    map[RingEventType]bool // nil means all types
+	lossless bool
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []*EventCtx
+	dropped uint64
+	closed  bool
+	done    chan struct{}
+}
+
+// newSubscription creates Subscription with given channel buffer, filtered on types, and starts its delivery.
+func newSubscription(buffer int, lossless bool, types []RingEventType) *Subscription {
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &Subscription{
+		c:        make(chan *EventCtx, buffer),
+		lossless: lossless,
+		queue:    make([]*EventCtx, 0),
+		done:     make(chan struct{}),
+	}
+	s.C = s.c
+	s.cond = sync.NewCond(&s.lock)
+	if len(types) > 0 {
+		s.types = make(map[RingEventType]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	go s.deliver()
+	return s
+}
+
+// push queues the event for delivery, if subscriber is interested in it. It returns false if an event
+// had to be dropped.
+func (s *Subscription) push(ctx *EventCtx) bool {
+	if s.types != nil && !s.types[ctx.EvType] {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return true
+	}
+	if ctx.EvType == EvVnodeStabilized {
+		// only the latest round matters, drop the pending one
+		for i, old := range s.queue {
+			if old.EvType == EvVnodeStabilized && sameVnode(old.Target, ctx.Target) {
+				copy(s.queue[i:], s.queue[i+1:])
+				s.queue[len(s.queue)-1] = nil
+				s.queue = s.queue[:len(s.queue)-1]
+				break
+			}
+		}
+	}
+	ok := true
+	if !s.lossless && len(s.queue) >= maxSubscriptionQueue {
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.dropped++
+		ok = false
+	}
+	s.queue = append(s.queue, ctx)
+	s.cond.Signal()
+	return ok
+}
+
+// Dropped returns the number of events that were dropped, because subscriber fell too far behind.
+func (s *Subscription) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+// deliver sends queued events to subscriber's channel, one by one, until subscription is closed.
+func (s *Subscription) deliver() {
+	defer close(s.c)
+	for {
+		s.lock.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.lock.Unlock()
+			return
+		}
+		ctx := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.lock.Unlock()
+
+		select {
+		case s.c <- ctx:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close stops the delivery, dropping events that are still queued.
+func (s *Subscription) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	close(s.done)
+	s.cond.Signal()
+}
+
+// eventBus numbers emitted events and fans them out to subscriptions.
+type eventBus struct {
+	lock    sync.Mutex
+	seq     uint64
+	subs    map[*Subscription]bool
+	dropped uint64 // events dropped by all subscriptions, updated atomically
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*Subscription]bool),
+	}
+}
+
+// emit assigns next sequence number to the event and queues it on every subscription. It never blocks
+// on subscribers. Events are queued under the lock, so every subscription sees them in Seq order.
+func (b *eventBus) emit(ctx *EventCtx) {
+	b.lock.Lock()
+	b.seq++
+	ctx.Seq = b.seq
+	for s := range b.subs {
+		if !s.push(ctx) {
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+	b.lock.Unlock()
+}
+
+func (b *eventBus) subscribe(s *Subscription) {
+	b.lock.Lock()
+	b.subs[s] = true
+	b.lock.Unlock()
+}
+
+func (b *eventBus) unsubscribe(s *Subscription) {
+	b.lock.Lock()
+	delete(b.subs, s)
+	b.lock.Unlock()
+	s.close()
+}
+
+/*
+	Subscribe creates new Subscription for ring events. Buffer is the capacity of subscription's channel.
+	If types are given, only events of those types are delivered, otherwise subscriber receives all events.
+	Subscription's channel is closed after Unsubscribe(). Once subscriber falls too far behind, the oldest
+	of its events are dropped, see SubscribeLossless.
+*/
+func (r *Ring) Subscribe(buffer int, types ...RingEventType) *Subscription {
+	s := newSubscription(buffer, false, types)
+	r.events.subscribe(s)
+	return s
+}
+
+/*
+	SubscribeLossless works like Subscribe, but events are never dropped. They are queued for as long as
+	subscriber is behind, so it should be used by subscribers that must see every event, such as ones that
+	move data around when vnodes join or leave, and that keep consuming the events.
+*/
+func (r *Ring) SubscribeLossless(buffer int, types ...RingEventType) *Subscription {
+	s := newSubscription(buffer, true, types)
+	r.events.subscribe(s)
+	return s
+}
+
+// Unsubscribe stops delivering events to the subscription and closes its channel. Events that were
+// not yet received are dropped.
+func (r *Ring) Unsubscribe(s *Subscription) {
+	r.events.unsubscribe(s)
+}
+
+// DroppedEvents returns the number of events dropped by all subscribers, because they fell too far behind.
+func (r *Ring) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&r.events.dropped)
+}
+
+// emit emits EventCtx to all subscribers, including registered DelegateHooks.
+func (r *Ring) emit(ctx *EventCtx) {
+	r.events.emit(ctx)
+}
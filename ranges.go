@@ -0,0 +1,108 @@
+package dendrite
+
+import (
+	"bytes"
+)
+
+// KeyRange is a range of keys (Start, End] owned by Vnode. Range where Start equals End spans the whole ring.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+	Vnode *Vnode
+}
+
+// Contains checks if keyHash falls within the range.
+func (kr *KeyRange) Contains(keyHash []byte) bool {
+	if bytes.Compare(kr.Start, kr.End) == 0 {
+		return true
+	}
+	return between(kr.Start, kr.End, keyHash, true)
+}
+
+// RangeHook provides interface to capture key ranges that local vnodes gain or lose, as their predecessors change.
+type RangeHook interface {
+	RangeGained(*KeyRange)
+	RangeLost(*KeyRange)
+}
+
+// RegisterRangeHook registers RangeHook for range changes. Like DelegateHook, its methods are called for one
+// range change at a time, in order, and no change is dropped.
+func (r *Ring) RegisterRangeHook(rh RangeHook) {
+	sub := r.SubscribeLossless(0, EvRangeGained, EvRangeLost)
+	go func() {
+		for ctx := range sub.C {
+			if ctx.EvType == EvRangeGained {
+				rh.RangeGained(ctx.Range)
+			} else {
+				rh.RangeLost(ctx.Range)
+			}
+		}
+	}()
+}
+
+/*
+	OwnedRanges returns key ranges (predecessor, vnode] owned by local vnodes. If vnode's predecessor
+	failed, and no other vnode took its place yet, vnode is still responsible for failed predecessor's range.
+	Vnodes that never had a predecessor are not included. In client mode, the list is empty.
+*/
+func (r *Ring) OwnedRanges() []*KeyRange {
+	rv := make([]*KeyRange, 0, len(r.vnodes))
+	for _, vn := range r.vnodes {
+		if kr := vn.ownedRange(); kr != nil {
+			rv = append(rv, kr)
+		}
+	}
+	return rv
+}
+
+// IsLocalOwner checks if keyHash belongs to one of local vnodes.
+func (r *Ring) IsLocalOwner(keyHash []byte) bool {
+	for _, kr := range r.OwnedRanges() {
+		if kr.Contains(keyHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedRange returns vnode's current key range, or nil if it's not known yet.
+func (vn *localVnode) ownedRange() *KeyRange {
+	pred := vn.predecessor
+	if pred == nil {
+		pred = vn.old_predecessor
+	}
+	if pred == nil {
+		return nil
+	}
+	return &KeyRange{
+		Start: pred.Id,
+		End:   vn.Id,
+		Vnode: &vn.Vnode,
+	}
+}
+
+// emitRangeChange emits the range vnode gained or lost when its predecessor changed from old_pred to new_pred.
+func (vn *localVnode) emitRangeChange(old_pred, new_pred *Vnode) {
+	ctx := &EventCtx{
+		Target:        &vn.Vnode,
+		PrimaryItem:   new_pred,
+		SecondaryItem: old_pred,
+	}
+	switch {
+	case sameVnode(old_pred, new_pred):
+		return
+	case old_pred == nil:
+		// first predecessor
+		ctx.EvType = EvRangeGained
+		ctx.Range = &KeyRange{Start: new_pred.Id, End: vn.Id, Vnode: &vn.Vnode}
+	case sameVnode(old_pred, &vn.Vnode) || between(old_pred.Id, vn.Id, new_pred.Id, false):
+		// new vnode joined between us and our predecessor, it took (old_pred, new_pred]
+		ctx.EvType = EvRangeLost
+		ctx.Range = &KeyRange{Start: old_pred.Id, End: new_pred.Id, Vnode: &vn.Vnode}
+	default:
+		// predecessor left, we took over (new_pred, old_pred]
+		ctx.EvType = EvRangeGained
+		ctx.Range = &KeyRange{Start: new_pred.Id, End: old_pred.Id, Vnode: &vn.Vnode}
+	}
+	vn.ring.emit(ctx)
+}
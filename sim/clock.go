@@ -0,0 +1,170 @@
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/fastfn/dendrite"
+)
+
+// Clock is a virtual clock implementing dendrite.Clock. Time moves only through Advance(), which
+// runs scheduled functions in order of their due time. Functions due at the same time run in
+// the order they were scheduled.
+type Clock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+}
+
+// NewClock creates Clock set to given time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{
+		now:    start,
+		timers: make(timerHeap, 0),
+	}
+}
+
+// Now implements dendrite.Clock's Now().
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc implements dendrite.Clock's AfterFunc().
+func (c *Clock) AfterFunc(d time.Duration, f func()) dendrite.Timer {
+	return c.schedule(d, f, nil)
+}
+
+// schedule adds a timer owned by given node. Timers without owner are never stopped by the network.
+func (c *Clock) schedule(d time.Duration, f func(), owner *Node) *timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	t := &timer{
+		clock: c,
+		when:  c.now.Add(d),
+		seq:   c.seq,
+		f:     f,
+		owner: owner,
+	}
+	heap.Push(&c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, running all functions that become due on the way.
+// Clock is set to function's due time while the function runs.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	c.lock.Unlock()
+	for c.step(end) {
+	}
+	c.lock.Lock()
+	c.now = end
+	c.lock.Unlock()
+}
+
+// step runs the next function due before end. It returns false if there is none.
+func (c *Clock) step(end time.Time) bool {
+	c.lock.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(end) {
+		c.lock.Unlock()
+		return false
+	}
+	t := heap.Pop(&c.timers).(*timer)
+	t.index = -1
+	c.now = t.when
+	c.lock.Unlock()
+	t.f()
+	return true
+}
+
+// stopOwned stops all pending timers owned by given node.
+func (c *Clock) stopOwned(owner *Node) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pending := make(timerHeap, 0, len(c.timers))
+	for _, t := range c.timers {
+		if t.owner != owner {
+			t.index = len(pending)
+			pending = append(pending, t)
+		} else {
+			t.index = -1
+		}
+	}
+	c.timers = pending
+	heap.Init(&c.timers)
+}
+
+// timer implements dendrite.Timer.
+type timer struct {
+	clock *Clock
+	when  time.Time
+	seq   uint64
+	f     func()
+	owner *Node
+	index int
+}
+
+// Stop implements dendrite.Timer's Stop().
+func (t *timer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	t.index = -1
+	return true
+}
+
+// timerHeap implements heap.Interface, ordering timers by due time and sequence.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return t
+}
+
+// nodeClock is a Clock view given to a single node. Timers it schedules are owned by the node,
+// so they can be stopped when the node goes down.
+type nodeClock struct {
+	clock *Clock
+	node  *Node
+}
+
+func (nc *nodeClock) Now() time.Time {
+	return nc.clock.Now()
+}
+
+func (nc *nodeClock) AfterFunc(d time.Duration, f func()) dendrite.Timer {
+	if !nc.node.Alive() {
+		// nothing runs on nodes that are down
+		return &timer{clock: nc.clock, index: -1}
+	}
+	return nc.clock.schedule(d, f, nc.node)
+}
@@ -0,0 +1,22 @@
+/*
+	Package sim runs many dendrite rings in a single process, on a virtual clock, for reproducing
+	stabilization bugs.
+
+	Network connects simulated nodes through in-memory Transport. Every node's Ring is configured with
+	the network's Clock, so stabilization runs only when the clock is advanced, one timer at a time,
+	in a deterministic order. Nodes can be created, joined, crashed, made to leave, and split into
+	partitions, either directly or through a script of Steps.
+
+	Check() verifies Chord invariants on all live nodes:
+		successor      - vnode's successor is the next live vnode in the ring
+		predecessor    - vnode's predecessor is the previous live vnode in the ring
+		successor-list - successor list follows the ring, without loops or dead vnodes
+		finger         - fingers point to live vnodes
+		coverage       - every key is owned by exactly one vnode
+		lookup         - all nodes agree on the owner of a key
+
+	Nodes in different partitions can not reach each other, so invariants are checked within each
+	partition separately. Note that Chord has no way to merge rings that were split: after Heal(),
+	partitions that stabilized into separate rings stay separate, and Check() reports it.
+*/
+package sim
@@ -0,0 +1,146 @@
+package sim
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+
+	"github.com/fastfn/dendrite"
+)
+
+// Violation describes a broken invariant.
+type Violation struct {
+	Invariant string
+	Vnode     *dendrite.Vnode // vnode where violation was found, nil if it's not specific to a vnode
+	Detail    string
+}
+
+func (v *Violation) Error() string {
+	if v.Vnode == nil {
+		return fmt.Sprintf("%s: %s", v.Invariant, v.Detail)
+	}
+	return fmt.Sprintf("%s: vnode %s@%s - %s", v.Invariant, v.Vnode.String(), v.Vnode.Host, v.Detail)
+}
+
+// Check verifies ring invariants on live nodes, within each partition, and returns violations found.
+func (n *Network) Check() []*Violation {
+	rv := make([]*Violation, 0)
+	for _, nodes := range n.partitions() {
+		rv = append(rv, n.checkPartition(nodes)...)
+	}
+	return rv
+}
+
+// checkPartition verifies invariants on nodes that can reach each other.
+func (n *Network) checkPartition(nodes []*Node) []*Violation {
+	rv := make([]*Violation, 0)
+	// expected ring, all live vnodes sorted by Id
+	snapshots := make([]*dendrite.VnodeSnapshot, 0)
+	for _, node := range nodes {
+		snapshots = append(snapshots, node.Ring.Snapshot().Vnodes...)
+	}
+	sort.Sort(bySnapshotId(snapshots))
+	num := len(snapshots)
+	if num == 0 {
+		return rv
+	}
+	live := make(map[string]bool)
+	for _, vs := range snapshots {
+		live[vs.Vnode.String()] = true
+	}
+	describe := func(vn *dendrite.Vnode) string {
+		if vn == nil {
+			return "nil"
+		}
+		return vn.String()
+	}
+
+	for idx, vs := range snapshots {
+		next := snapshots[(idx+1)%num].Vnode
+		prev := snapshots[(idx-1+num)%num].Vnode
+
+		if len(vs.Successors) == 0 || !sameVnode(vs.Successors[0], next) {
+			var succ *dendrite.Vnode
+			if len(vs.Successors) > 0 {
+				succ = vs.Successors[0]
+			}
+			rv = append(rv, &Violation{"successor", vs.Vnode,
+				fmt.Sprintf("successor is %s, expected %s", describe(succ), describe(next))})
+		}
+		if !sameVnode(vs.Predecessor, prev) {
+			rv = append(rv, &Violation{"predecessor", vs.Vnode,
+				fmt.Sprintf("predecessor is %s, expected %s", describe(vs.Predecessor), describe(prev))})
+		}
+		// successor list must follow the ring, until it wraps around to the vnode itself
+		for pos, succ := range vs.Successors {
+			if pos >= num-1 {
+				break
+			}
+			expected := snapshots[(idx+pos+1)%num].Vnode
+			if !sameVnode(succ, expected) {
+				rv = append(rv, &Violation{"successor-list", vs.Vnode,
+					fmt.Sprintf("successor %d is %s, expected %s", pos, describe(succ), describe(expected))})
+				break
+			}
+		}
+		for pos, finger := range vs.Fingers {
+			if finger != nil && !live[finger.String()] {
+				rv = append(rv, &Violation{"finger", vs.Vnode,
+					fmt.Sprintf("finger %d points to %s, which is not a live vnode", pos, describe(finger))})
+				break
+			}
+		}
+	}
+
+	for i := 0; i < n.CheckKeys; i++ {
+		key := sha1.Sum([]byte(fmt.Sprintf("sim-key-%d", i)))
+		// owner is the first vnode with Id >= key
+		pos := sort.Search(num, func(j int) bool {
+			return bytes.Compare(snapshots[j].Vnode.Id, key[:]) >= 0
+		})
+		owner := snapshots[pos%num].Vnode
+
+		owners := 0
+		for _, node := range nodes {
+			if node.Ring.IsLocalOwner(key[:]) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			rv = append(rv, &Violation{"coverage", nil,
+				fmt.Sprintf("key %X is owned by %d vnodes", key, owners)})
+		}
+		for _, node := range nodes {
+			succs, err := node.Ring.Lookup(1, key[:])
+			if err != nil {
+				rv = append(rv, &Violation{"lookup", nil,
+					fmt.Sprintf("lookup of key %X on %s failed - %s", key, node.Host, err)})
+				continue
+			}
+			if len(succs) == 0 || !sameVnode(succs[0], owner) {
+				var found *dendrite.Vnode
+				if len(succs) > 0 {
+					found = succs[0]
+				}
+				rv = append(rv, &Violation{"lookup", nil,
+					fmt.Sprintf("lookup of key %X on %s found %s, expected %s", key, node.Host, describe(found), describe(owner))})
+			}
+		}
+	}
+	return rv
+}
+
+func sameVnode(a, b *dendrite.Vnode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Compare(a.Id, b.Id) == 0
+}
+
+// bySnapshotId sorts vnode snapshots by vnode Id.
+type bySnapshotId []*dendrite.VnodeSnapshot
+
+func (s bySnapshotId) Len() int           { return len(s) }
+func (s bySnapshotId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySnapshotId) Less(i, j int) bool { return bytes.Compare(s[i].Vnode.Id, s[j].Vnode.Id) == -1 }
@@ -0,0 +1,214 @@
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/fastfn/dendrite"
+)
+
+// Node is a simulated dendrite node.
+type Node struct {
+	Host      string
+	Ring      *dendrite.Ring
+	Transport *Transport
+	net       *Network
+	down      bool
+}
+
+// Alive returns false if node crashed or left the network.
+func (nd *Node) Alive() bool {
+	nd.net.lock.RLock()
+	defer nd.net.lock.RUnlock()
+	return !nd.down
+}
+
+// Network connects simulated nodes. All rings share network's Clock.
+type Network struct {
+	Clock *Clock
+	// Config is a template for configuration of new nodes. Hostname, Clock and Rand are set by the network.
+	Config    *dendrite.Config
+	CheckKeys int // number of keys used by coverage and lookup checks
+	seed      int64
+	lock      sync.RWMutex
+	nodes     map[string]*Node
+	hosts     []string       // in order of creation, for deterministic iteration
+	partition map[string]int // host -> partition, hosts not listed are in partition 0
+}
+
+// NewNetwork creates empty Network. Runs with the same seed and the same actions are repeatable.
+func NewNetwork(seed int64) *Network {
+	conf := dendrite.DefaultConfig("")
+	conf.LogLevel = dendrite.LogNull
+	return &Network{
+		Clock:     NewClock(time.Unix(0, 0)),
+		Config:    conf,
+		CheckKeys: 64,
+		seed:      seed,
+		nodes:     make(map[string]*Node),
+		hosts:     make([]string, 0),
+		partition: make(map[string]int),
+	}
+}
+
+// newNode prepares a node for given host, replacing the one that went down before.
+func (n *Network) newNode(host string) (*Node, *dendrite.Config, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if old, ok := n.nodes[host]; ok && !old.down {
+		return nil, nil, fmt.Errorf("SIM - host %s is already running", host)
+	} else if !ok {
+		n.hosts = append(n.hosts, host)
+	}
+	node := &Node{
+		Host: host,
+		net:  n,
+	}
+	node.Transport = newTransport(n, host)
+	n.nodes[host] = node
+
+	conf := *n.Config
+	conf.Hostname = host
+	conf.Clock = &nodeClock{clock: n.Clock, node: node}
+	conf.Rand = rand.New(rand.NewSource(n.seed + int64(len(n.hosts))))
+	return node, &conf, nil
+}
+
+// Create bootstraps a new ring on given host.
+func (n *Network) Create(host string) (*Node, error) {
+	node, conf, err := n.newNode(host)
+	if err != nil {
+		return nil, err
+	}
+	node.Ring, err = dendrite.CreateRing(conf, node.Transport)
+	if err != nil {
+		n.Crash(host)
+		return nil, err
+	}
+	return node, nil
+}
+
+// Join starts a node on given host and joins it to the ring through existing host. Host that
+// went down earlier can join again, with the same vnodes.
+func (n *Network) Join(host, existing string) (*Node, error) {
+	node, conf, err := n.newNode(host)
+	if err != nil {
+		return nil, err
+	}
+	node.Ring, err = dendrite.JoinRing(conf, node.Transport, existing)
+	if err != nil {
+		n.Crash(host)
+		return nil, err
+	}
+	return node, nil
+}
+
+// Crash stops the node without notice. Its stabilization stops and other nodes can not reach it anymore.
+func (n *Network) Crash(host string) error {
+	n.lock.Lock()
+	node, ok := n.nodes[host]
+	if !ok || node.down {
+		n.lock.Unlock()
+		return fmt.Errorf("SIM - host %s is not running", host)
+	}
+	node.down = true
+	n.lock.Unlock()
+	n.Clock.stopOwned(node)
+	return nil
+}
+
+// Leave makes the node leave the ring gracefully, and takes it out of the network.
+func (n *Network) Leave(host string) error {
+	node := n.Node(host)
+	if node == nil {
+		return fmt.Errorf("SIM - host %s is not running", host)
+	}
+	err := node.Ring.Leave()
+	n.Crash(host)
+	return err
+}
+
+// Partition splits the network. Each group of hosts forms a partition, and hosts that are not
+// listed form another one. Nodes can only reach nodes within their own partition.
+func (n *Network) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partition = make(map[string]int)
+	for idx, group := range groups {
+		for _, host := range group {
+			n.partition[host] = idx + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Run advances network's clock by d, letting the nodes stabilize.
+func (n *Network) Run(d time.Duration) {
+	n.Clock.Advance(d)
+}
+
+// Nodes returns live nodes, in order of creation.
+func (n *Network) Nodes() []*Node {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	rv := make([]*Node, 0, len(n.hosts))
+	for _, host := range n.hosts {
+		if node := n.nodes[host]; !node.down {
+			rv = append(rv, node)
+		}
+	}
+	return rv
+}
+
+// Node returns node running on given host, or nil.
+func (n *Network) Node(host string) *Node {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	node, ok := n.nodes[host]
+	if !ok || node.down {
+		return nil
+	}
+	return node
+}
+
+// partitions returns live nodes grouped by partition, in order of partition.
+func (n *Network) partitions() [][]*Node {
+	groups := make(map[int][]*Node)
+	max_group := 0
+	for _, node := range n.Nodes() {
+		n.lock.RLock()
+		group := n.partition[node.Host]
+		n.lock.RUnlock()
+		groups[group] = append(groups[group], node)
+		if group > max_group {
+			max_group = group
+		}
+	}
+	rv := make([][]*Node, 0, len(groups))
+	for group := 0; group <= max_group; group++ {
+		if len(groups[group]) > 0 {
+			rv = append(rv, groups[group])
+		}
+	}
+	return rv
+}
+
+// route returns destination node, if it can be reached from source host.
+func (n *Network) route(from, to string) (*Node, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	node, ok := n.nodes[to]
+	if !ok || node.down {
+		return nil, fmt.Errorf("SIM - host %s is down", to)
+	}
+	if n.partition[from] != n.partition[to] {
+		return nil, fmt.Errorf("SIM - host %s is unreachable from %s", to, from)
+	}
+	return node, nil
+}
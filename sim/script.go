@@ -0,0 +1,93 @@
+package sim
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Step is a single scripted action on the network.
+type Step struct {
+	Name string
+	Do   func(*Network) error
+}
+
+// CreateStep bootstraps a new ring on host.
+func CreateStep(host string) Step {
+	return Step{"create " + host, func(n *Network) error {
+		_, err := n.Create(host)
+		return err
+	}}
+}
+
+// JoinStep joins host to the ring through existing host.
+func JoinStep(host, existing string) Step {
+	return Step{"join " + host + " via " + existing, func(n *Network) error {
+		_, err := n.Join(host, existing)
+		return err
+	}}
+}
+
+// CrashStep crashes host.
+func CrashStep(host string) Step {
+	return Step{"crash " + host, func(n *Network) error {
+		return n.Crash(host)
+	}}
+}
+
+// LeaveStep makes host leave the ring.
+func LeaveStep(host string) Step {
+	return Step{"leave " + host, func(n *Network) error {
+		return n.Leave(host)
+	}}
+}
+
+// PartitionStep splits the network into given groups.
+func PartitionStep(groups ...[]string) Step {
+	return Step{fmt.Sprintf("partition %v", groups), func(n *Network) error {
+		n.Partition(groups...)
+		return nil
+	}}
+}
+
+// HealStep removes all partitions.
+func HealStep() Step {
+	return Step{"heal", func(n *Network) error {
+		n.Heal()
+		return nil
+	}}
+}
+
+// ScriptError is returned by RunScript when a step fails, or leaves the ring in invalid state.
+type ScriptError struct {
+	Step       int
+	Name       string
+	Err        error        // error returned by the step
+	Violations []*Violation // invariants broken after the step
+}
+
+func (e *ScriptError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("step %d (%s) failed - %s", e.Step, e.Name, e.Err)
+	}
+	lines := make([]string, len(e.Violations))
+	for idx, v := range e.Violations {
+		lines[idx] = v.Error()
+	}
+	return fmt.Sprintf("step %d (%s) broke %d invariants:\n\t%s", e.Step, e.Name, len(e.Violations), strings.Join(lines, "\n\t"))
+}
+
+// RunScript runs steps one by one. After each step, the network runs for settle time and
+// invariants are checked. It stops on the first step that fails or breaks invariants.
+func (n *Network) RunScript(steps []Step, settle time.Duration) error {
+	for idx, step := range steps {
+		if err := step.Do(n); err != nil {
+			return &ScriptError{Step: idx, Name: step.Name, Err: err}
+		}
+		n.Run(settle)
+		if violations := n.Check(); len(violations) > 0 {
+			return &ScriptError{Step: idx, Name: step.Name, Violations: violations}
+		}
+	}
+	return nil
+}
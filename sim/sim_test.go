@@ -0,0 +1,212 @@
+package sim
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fastfn/dendrite"
+	"github.com/fastfn/dendrite/dtable"
+)
+
+const settle = 30 * time.Second
+
+func setupSteps() []Step {
+	return []Step{
+		CreateStep("n1"),
+		JoinStep("n2", "n1"),
+		JoinStep("n3", "n1"),
+		JoinStep("n4", "n2"),
+		JoinStep("n5", "n3"),
+	}
+}
+
+func runScript(t *testing.T, n *Network, steps []Step) {
+	if err := n.RunScript(steps, settle); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJoins(t *testing.T) {
+	n := NewNetwork(1)
+	runScript(t, n, setupSteps())
+	if live := len(n.Nodes()); live != 5 {
+		t.Fatalf("expected 5 live nodes, got %d", live)
+	}
+}
+
+func TestCrashes(t *testing.T) {
+	n := NewNetwork(2)
+	runScript(t, n, setupSteps())
+	runScript(t, n, []Step{
+		CrashStep("n2"),
+		CrashStep("n5"),
+		JoinStep("n6", "n4"),
+		CrashStep("n1"),
+	})
+}
+
+func TestLeaves(t *testing.T) {
+	n := NewNetwork(3)
+	runScript(t, n, setupSteps())
+	runScript(t, n, []Step{
+		LeaveStep("n3"),
+		LeaveStep("n1"),
+		JoinStep("n3", "n4"),
+		LeaveStep("n5"),
+	})
+}
+
+func TestChurn(t *testing.T) {
+	n := NewNetwork(4)
+	runScript(t, n, setupSteps())
+	runScript(t, n, []Step{
+		CrashStep("n4"),
+		LeaveStep("n2"),
+		JoinStep("n6", "n5"),
+		JoinStep("n7", "n1"),
+		CrashStep("n3"),
+		LeaveStep("n6"),
+		JoinStep("n8", "n7"),
+	})
+}
+
+func TestCheckDetectsStaleState(t *testing.T) {
+	n := NewNetwork(5)
+	runScript(t, n, setupSteps())
+	// crashed node is still referenced, until the ring stabilizes
+	if err := n.Crash("n3"); err != nil {
+		t.Fatal(err)
+	}
+	if violations := n.Check(); len(violations) == 0 {
+		t.Fatal("expected violations right after crash")
+	}
+	n.Run(settle)
+	if violations := n.Check(); len(violations) > 0 {
+		t.Fatal(&ScriptError{Name: "crash n3", Violations: violations})
+	}
+}
+
+func TestPartition(t *testing.T) {
+	n := NewNetwork(6)
+	runScript(t, n, setupSteps())
+	// each partition stabilizes into its own ring
+	runScript(t, n, []Step{
+		PartitionStep([]string{"n1", "n2", "n3"}, []string{"n4", "n5"}),
+	})
+	// and they stay separate after heal
+	n.Heal()
+	n.Run(settle)
+	if violations := n.Check(); len(violations) == 0 {
+		t.Fatal("expected split rings to be reported after heal")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	snapshot := func() []string {
+		n := NewNetwork(7)
+		runScript(t, n, setupSteps())
+		runScript(t, n, []Step{CrashStep("n2"), LeaveStep("n4")})
+		rv := make([]string, 0)
+		for _, node := range n.Nodes() {
+			for _, vn := range node.Ring.Snapshot().Vnodes {
+				rv = append(rv, vn.Vnode.String()+">"+vn.Successors[0].String())
+			}
+		}
+		return rv
+	}
+	a, b := snapshot(), snapshot()
+	if len(a) != len(b) {
+		t.Fatalf("runs differ - %d vs %d vnodes", len(a), len(b))
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			t.Fatalf("runs differ - %s vs %s", a[idx], b[idx])
+		}
+	}
+}
+
+// TestDTableMultiErrorOrder checks that SetMulti and GetMulti return results and errors in the order of
+// requested keys, when keys of one batch fail on their primary and others do not.
+func TestDTableMultiErrorOrder(t *testing.T) {
+	n := NewNetwork(8)
+	runScript(t, n, []Step{CreateStep("n1"), JoinStep("n2", "n1"), JoinStep("n3", "n1")})
+	tables := make(map[string]*dtable.DTable)
+	for _, node := range n.Nodes() {
+		dt, err := dtable.New(node.Ring, node.Transport, dtable.LogNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dt.Close()
+		tables[node.Host] = dt
+	}
+	tables["n3"].Close()
+
+	items := make([]*dtable.KVItem, 0)
+	for i := 0; i < 60; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if i%10 == 5 {
+			key = nil
+		}
+		items = append(items, &dtable.KVItem{Key: key, Val: []byte(fmt.Sprintf("val-%d", i))})
+	}
+	errs := tables["n1"].NewQuery().SetMulti(items)
+	owner := func(key []byte) string {
+		succs, err := n.Node("n1").Ring.Lookup(1, dendrite.HashKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return succs[0].Host
+	}
+	closed := 0
+	for i, item := range items {
+		switch {
+		case item.Key == nil:
+			if errs[i] == nil {
+				t.Fatalf("item %d: expected error for empty key", i)
+			}
+		case owner(item.Key) == "n3":
+			closed++
+			if errs[i] == nil {
+				t.Fatalf("item %d: expected error from closed table", i)
+			}
+		default:
+			if errs[i] != nil {
+				t.Fatalf("item %d: %s", i, errs[i])
+			}
+		}
+	}
+	if closed == 0 {
+		t.Fatal("no keys are owned by n3")
+	}
+
+	// reversed order, with keys that were never written
+	keys := make([][]byte, 0)
+	for i := 69; i >= 0; i-- {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+	}
+	keys[10] = nil
+	got, errs := tables["n2"].NewQuery().GetMulti(keys)
+	for i, key := range keys {
+		if key == nil {
+			if errs[i] == nil {
+				t.Fatalf("key %d: expected error for empty key", i)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Fatalf("key %s: %s", key, errs[i])
+		}
+		var idx int
+		fmt.Sscanf(string(key), "key-%d", &idx)
+		if idx >= 60 || idx%10 == 5 || owner(key) == "n3" {
+			if got[i] != nil {
+				t.Fatalf("key %s: expected no item, got %q", key, got[i].Val)
+			}
+			continue
+		}
+		if got[i] == nil || string(got[i].Key) != string(key) || string(got[i].Val) != fmt.Sprintf("val-%d", idx) {
+			t.Fatalf("key %s: got %v", key, got[i])
+		}
+	}
+}
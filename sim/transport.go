@@ -0,0 +1,265 @@
+package sim
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/fastfn/dendrite"
+	"github.com/golang/protobuf/proto"
+)
+
+// Transport implements dendrite.Transport between nodes of a simulated Network. Requests are
+// handled synchronously, in caller's goroutine, and fail immediately if destination host is down
+// or in another partition. Vnodes are copied on the way, as they would be by a real transport.
+type Transport struct {
+	net    *Network
+	host   string
+	lock   sync.RWMutex
+	table  map[string]dendrite.VnodeHandler
+	vnodes []*dendrite.Vnode
+	claims []*dendrite.MsgTypeClaim
+	hooks  []dendrite.TransportHook
+}
+
+func newTransport(net *Network, host string) *Transport {
+	return &Transport{
+		net:    net,
+		host:   host,
+		table:  make(map[string]dendrite.VnodeHandler),
+		vnodes: make([]*dendrite.Vnode, 0),
+		claims: []*dendrite.MsgTypeClaim{
+			// dendrite's own range, so that extensions can not claim it
+			&dendrite.MsgTypeClaim{Owner: "dendrite", Min: 0x00, Max: 0x1f},
+		},
+		hooks: make([]dendrite.TransportHook, 0),
+	}
+}
+
+// remote returns Transport of the destination host, if it can be reached from this one.
+func (t *Transport) remote(host string) (*Transport, error) {
+	node, err := t.net.route(t.host, host)
+	if err != nil {
+		return nil, err
+	}
+	return node.Transport, nil
+}
+
+// handler returns registered handler of destination vnode.
+func (t *Transport) handler(vn *dendrite.Vnode) (dendrite.VnodeHandler, error) {
+	remote, err := t.remote(vn.Host)
+	if err != nil {
+		return nil, err
+	}
+	h, ok := remote.GetVnodeHandler(vn)
+	if !ok {
+		return nil, fmt.Errorf("SIM - target vnode %s not found", vn.String())
+	}
+	return h, nil
+}
+
+// ListVnodes implements dendrite.Transport's ListVnodes().
+func (t *Transport) ListVnodes(host string) ([]*dendrite.Vnode, error) {
+	remote, err := t.remote(host)
+	if err != nil {
+		return nil, err
+	}
+	remote.lock.RLock()
+	defer remote.lock.RUnlock()
+	return copyVnodes(remote.vnodes), nil
+}
+
+// Ping implements dendrite.Transport's Ping().
+func (t *Transport) Ping(vn *dendrite.Vnode) (bool, error) {
+	if _, err := t.remote(vn.Host); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetPredecessor implements dendrite.Transport's GetPredecessor().
+func (t *Transport) GetPredecessor(vn *dendrite.Vnode) (*dendrite.Vnode, error) {
+	h, err := t.handler(vn)
+	if err != nil {
+		return nil, err
+	}
+	pred, err := h.GetPredecessor()
+	if err != nil {
+		return nil, err
+	}
+	return copyVnode(pred), nil
+}
+
+// Notify implements dendrite.Transport's Notify().
+func (t *Transport) Notify(dest, self *dendrite.Vnode) ([]*dendrite.Vnode, error) {
+	h, err := t.handler(dest)
+	if err != nil {
+		return nil, err
+	}
+	succs, err := h.Notify(copyVnode(self))
+	if err != nil {
+		return nil, err
+	}
+	return copyVnodes(succs), nil
+}
+
+// Leave implements dendrite.Transport's Leave().
+func (t *Transport) Leave(dest, self, pred *dendrite.Vnode, succs []*dendrite.Vnode) error {
+	h, err := t.handler(dest)
+	if err != nil {
+		return err
+	}
+	return h.Leave(copyVnode(self), copyVnode(pred), copyVnodes(succs))
+}
+
+// FindSuccessors implements dendrite.Transport's FindSuccessors().
+func (t *Transport) FindSuccessors(vn *dendrite.Vnode, limit int, key []byte) ([]*dendrite.Vnode, error) {
+	h, err := t.handler(vn)
+	if err != nil {
+		return nil, err
+	}
+	succs, forward, err := h.FindSuccessors(key, limit)
+	if err != nil {
+		return nil, err
+	}
+	if forward != nil {
+		return t.FindSuccessors(copyVnode(forward), limit, key)
+	}
+	return copyVnodes(succs), nil
+}
+
+// GetVnodeHandler implements dendrite.Transport's GetVnodeHandler().
+func (t *Transport) GetVnodeHandler(vn *dendrite.Vnode) (dendrite.VnodeHandler, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	h, ok := t.table[vn.String()]
+	return h, ok
+}
+
+// Register implements dendrite.Transport's Register().
+func (t *Transport) Register(vn *dendrite.Vnode, h dendrite.VnodeHandler) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.table[vn.String()] = h
+	t.vnodes = append(t.vnodes, vn)
+}
+
+// Encode implements dendrite.Transport's Encode().
+func (t *Transport) Encode(msgType dendrite.MsgType, data []byte) []byte {
+	buf := make([]byte, 0, len(data)+1)
+	buf = append(buf, byte(msgType))
+	return append(buf, data...)
+}
+
+// Decode implements dendrite.Transport's Decode(). Only message types claimed by extensions,
+// or known to registered TransportHooks, can be decoded.
+func (t *Transport) Decode(raw []byte) (*dendrite.ChordMsg, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("SIM - can not decode empty message")
+	}
+	cm := &dendrite.ChordMsg{
+		Type: dendrite.MsgType(raw[0]),
+		Data: raw[1:],
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, c := range t.claims {
+		if cm.Type < c.Min || cm.Type > c.Max {
+			continue
+		}
+		h, ok := c.Handlers[cm.Type]
+		if !ok || h == nil {
+			break
+		}
+		msg, err := h.Decoder(cm.Data)
+		if err != nil {
+			return nil, err
+		}
+		cm.TransportMsg = msg
+		cm.TransportHandler = h.Handler
+		return cm, nil
+	}
+	for _, hook := range t.hooks {
+		if decoded, err := hook.Decode(raw); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("SIM - unknown message type %#x", raw[0])
+}
+
+// RegisterHook implements dendrite.Transport's RegisterHook().
+func (t *Transport) RegisterHook(th dendrite.TransportHook) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.hooks = append(t.hooks, th)
+}
+
+// ClaimMsgTypes implements dendrite.Transport's ClaimMsgTypes().
+func (t *Transport) ClaimMsgTypes(c *dendrite.MsgTypeClaim) error {
+	if c == nil || c.Min > c.Max {
+		return fmt.Errorf("SIM - invalid claim")
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, existing := range t.claims {
+		if c.Min <= existing.Max && existing.Min <= c.Max {
+			return dendrite.ErrMsgTypeConflict(fmt.Sprintf("claim by %s for range [%#x, %#x] overlaps with range [%#x, %#x] owned by %s",
+				c.Owner, byte(c.Min), byte(c.Max), byte(existing.Min), byte(existing.Max), existing.Owner))
+		}
+	}
+	t.claims = append(t.claims, c)
+	return nil
+}
+
+// Request implements dendrite.Transport's Request(). Handler on remote host must respond before it returns.
+func (t *Transport) Request(host string, msgType dendrite.MsgType, data []byte) (*dendrite.ChordMsg, error) {
+	remote, err := t.remote(host)
+	if err != nil {
+		return nil, err
+	}
+	req, err := remote.Decode(t.Encode(msgType, data))
+	if err != nil {
+		return nil, err
+	}
+	if req.TransportHandler == nil {
+		return nil, fmt.Errorf("SIM - no handler for message type %#x", byte(msgType))
+	}
+	w := make(chan *dendrite.ChordMsg, 1)
+	req.TransportHandler(req, w)
+	var resp *dendrite.ChordMsg
+	select {
+	case resp = <-w:
+	default:
+		return nil, fmt.Errorf("SIM - handler for message type %#x did not respond", byte(msgType))
+	}
+	if resp.Type == dendrite.PbErr {
+		var pbMsg dendrite.PBProtoErr
+		if err := proto.Unmarshal(resp.Data, &pbMsg); err != nil {
+			return nil, fmt.Errorf("SIM - error decoding PBProtoErr message - %s", err)
+		}
+		resp.TransportMsg = pbMsg
+		return resp, nil
+	}
+	return t.Decode(t.Encode(resp.Type, resp.Data))
+}
+
+// Close implements dendrite.Transport's Close(). Host becomes unreachable.
+func (t *Transport) Close() error {
+	return t.net.Crash(t.host)
+}
+
+func copyVnode(vn *dendrite.Vnode) *dendrite.Vnode {
+	if vn == nil {
+		return nil
+	}
+	id := make([]byte, len(vn.Id))
+	copy(id, vn.Id)
+	return &dendrite.Vnode{Id: id, Host: vn.Host}
+}
+
+func copyVnodes(vnodes []*dendrite.Vnode) []*dendrite.Vnode {
+	rv := make([]*dendrite.Vnode, len(vnodes))
+	for idx, vn := range vnodes {
+		rv[idx] = copyVnode(vn)
+	}
+	return rv
+}
@@ -0,0 +1,41 @@
+package dendrite
+
+// VnodeSnapshot is a copy of local vnode's routing state.
+type VnodeSnapshot struct {
+	Vnode       *Vnode
+	Predecessor *Vnode
+	Successors  []*Vnode // known successors, closest first, without trailing nils
+	Fingers     []*Vnode // finger table up to the last finger set, may contain nils
+}
+
+// RingSnapshot is a copy of routing state of all local vnodes.
+type RingSnapshot struct {
+	Hostname string
+	Vnodes   []*VnodeSnapshot // sorted by vnode Id
+}
+
+// Snapshot returns a copy of ring's routing state, for inspection and debugging. Vnodes keep stabilizing
+// while the snapshot is taken, so it is not guaranteed to be consistent across vnodes.
+func (r *Ring) Snapshot() *RingSnapshot {
+	rs := &RingSnapshot{
+		Hostname: r.config.Hostname,
+		Vnodes:   make([]*VnodeSnapshot, len(r.vnodes)),
+	}
+	for idx, vn := range r.vnodes {
+		vs := &VnodeSnapshot{
+			Vnode:       &vn.Vnode,
+			Predecessor: vn.predecessor,
+			Successors:  make([]*Vnode, 0, len(vn.successors)),
+			Fingers:     make([]*Vnode, vn.last_finger+1),
+		}
+		for _, succ := range vn.successors {
+			if succ == nil {
+				break
+			}
+			vs.Successors = append(vs.Successors, succ)
+		}
+		copy(vs.Fingers, vn.finger[:vn.last_finger+1])
+		rs.Vnodes[idx] = vs
+	}
+	return rs
+}
@@ -0,0 +1,111 @@
+package dendrite
+
+import (
+	"github.com/golang/protobuf/proto"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// weight of a new sample in smoothed offset and round-trip time
+	clockSampleWeight = 0.25
+	// peers that were not pinged for this long are left out of ClockSkew()
+	clockSampleMaxAge = 5 * time.Minute
+)
+
+// PeerClock is clock offset and round-trip time of a remote host, estimated from Ping exchanges.
+type PeerClock struct {
+	Host    string
+	Offset  time.Duration // remote clock minus local clock, smoothed over samples
+	RTT     time.Duration // round-trip time, smoothed over samples
+	Samples int
+	Updated time.Time // local time of the last sample
+}
+
+// ClockReporter is implemented by transports that estimate clocks of remote peers from Ping exchanges.
+type ClockReporter interface {
+	PeerClocks() []*PeerClock
+}
+
+// peerClocks tracks PeerClock for each remote host that was pinged.
+type peerClocks struct {
+	lock  sync.Mutex
+	peers map[string]*PeerClock
+}
+
+func newPeerClocks() *peerClocks {
+	return &peerClocks{
+		peers: make(map[string]*PeerClock),
+	}
+}
+
+/* sample records one ping exchange with host. Sent and done are local times when ping was sent and pong
+was received, and received is remote time when ping was handled. Assuming symmetric network delay, remote
+clock read received at local time (sent+done)/2.
+*/
+func (pc *peerClocks) sample(host string, sent, received, done int64) {
+	if received == 0 || done < sent {
+		// peer does not report its time
+		return
+	}
+	rtt := time.Duration(done - sent)
+	offset := time.Duration(received - sent - (done-sent)/2)
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	peer, ok := pc.peers[host]
+	if !ok {
+		pc.peers[host] = &PeerClock{
+			Host:    host,
+			Offset:  offset,
+			RTT:     rtt,
+			Samples: 1,
+			Updated: time.Unix(0, done),
+		}
+		return
+	}
+	peer.Offset += time.Duration(clockSampleWeight * float64(offset-peer.Offset))
+	peer.RTT += time.Duration(clockSampleWeight * float64(rtt-peer.RTT))
+	peer.Samples++
+	peer.Updated = time.Unix(0, done)
+}
+
+// snapshot returns a copy of tracked peer clocks, sorted by host.
+func (pc *peerClocks) snapshot() []*PeerClock {
+	pc.lock.Lock()
+	rv := make([]*PeerClock, 0, len(pc.peers))
+	for _, peer := range pc.peers {
+		peer_copy := *peer
+		rv = append(rv, &peer_copy)
+	}
+	pc.lock.Unlock()
+	sort.Sort(peerClocksByHost(rv))
+	return rv
+}
+
+type peerClocksByHost []*PeerClock
+
+func (s peerClocksByHost) Len() int           { return len(s) }
+func (s peerClocksByHost) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s peerClocksByHost) Less(i, j int) bool { return s[i].Host < s[j].Host }
+
+// newPingMsg creates ping request with local time.
+func newPingMsg() *PBProtoPing {
+	return &PBProtoPing{
+		Version: proto.Int64(1),
+		Sent:    proto.Int64(time.Now().UnixNano()),
+	}
+}
+
+// newPongMsg creates response to ping request, echoing request's time together with local time.
+func newPongMsg(request *ChordMsg) *PBProtoPing {
+	pong := &PBProtoPing{
+		Version:  proto.Int64(1),
+		Received: proto.Int64(time.Now().UnixNano()),
+	}
+	if ping, ok := request.TransportMsg.(PBProtoPing); ok && ping.Sent != nil {
+		pong.Sent = proto.Int64(ping.GetSent())
+	}
+	return pong
+}
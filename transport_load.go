@@ -0,0 +1,90 @@
+package dendrite
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// overloadedError is sent in PBProtoErr when request is refused due to load
+	overloadedError = "dendrite: overloaded, try again later"
+
+	// defaultMaxQueuedRequests is the number of in-flight requests after which transports start shedding load
+	defaultMaxQueuedRequests = 2048
+
+	// defaultControlHandlers is the number of reserved workers serving control (ring maintenance) requests
+	defaultControlHandlers = 4
+
+	backoffMin = 50 * time.Millisecond
+	backoffMax = 5 * time.Second
+)
+
+// ErrPeerOverloaded is returned by client requests when remote peer refused the request due to load,
+// or when we're still backing off from it. The peer is alive and the request should be retried later.
+var ErrPeerOverloaded = errors.New("remote peer is overloaded")
+
+// newOverloadedMsg creates PBProtoErr *ChordMsg which is sent to clients when request is refused.
+func newOverloadedMsg() *ChordMsg {
+	return NewErrorMsg(overloadedError)
+}
+
+// isOverloadedMsg checks if decoded response is refusal due to load.
+func isOverloadedMsg(cm *ChordMsg) bool {
+	if cm.Type != PbErr {
+		return false
+	}
+	pbMsg, ok := cm.TransportMsg.(PBProtoErr)
+	return ok && pbMsg.GetError() == overloadedError
+}
+
+// backoffState holds backoff delay for a single host.
+type backoffState struct {
+	delay time.Duration
+	until time.Time
+}
+
+// peerBackoff keeps track of remote hosts that recently refused our requests due to load.
+// Clients back off from such hosts (with exponentially growing delay) instead of piling up more requests.
+type peerBackoff struct {
+	lock  sync.Mutex
+	peers map[string]*backoffState
+}
+
+func newPeerBackoff() *peerBackoff {
+	return &peerBackoff{
+		peers: make(map[string]*backoffState),
+	}
+}
+
+// overloaded registers refusal from host and extends the backoff period.
+func (b *peerBackoff) overloaded(host string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state, ok := b.peers[host]
+	if !ok {
+		state = &backoffState{delay: backoffMin}
+		b.peers[host] = state
+	} else if state.delay < backoffMax {
+		state.delay *= 2
+		if state.delay > backoffMax {
+			state.delay = backoffMax
+		}
+	}
+	state.until = time.Now().Add(state.delay)
+}
+
+// active returns true if we're still backing off from host.
+func (b *peerBackoff) active(host string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state, ok := b.peers[host]
+	return ok && time.Now().Before(state.until)
+}
+
+// reset is called when host served our request.
+func (b *peerBackoff) reset(host string) {
+	b.lock.Lock()
+	delete(b.peers, host)
+	b.lock.Unlock()
+}
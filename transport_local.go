@@ -25,14 +25,29 @@ func InitLocalTransport(remote Transport) Transport {
 func (lt *LocalTransport) RegisterHook(th TransportHook) {
 }
 
-// Decode does nothing in local transport. Just satisfying interface.
+// ClaimMsgTypes passes the claim to remote transport.
+func (lt *LocalTransport) ClaimMsgTypes(c *MsgTypeClaim) error {
+	return lt.remote.ClaimMsgTypes(c)
+}
+
+// Request passes the request to remote transport.
+func (lt *LocalTransport) Request(host string, msgType MsgType, data []byte) (*ChordMsg, error) {
+	return lt.remote.Request(host, msgType, data)
+}
+
+// Close shuts down remote transport.
+func (lt *LocalTransport) Close() error {
+	return lt.remote.Close()
+}
+
+// Decode passes the data to remote transport's Decode().
 func (lt *LocalTransport) Decode(raw []byte) (*ChordMsg, error) {
-	return nil, nil
+	return lt.remote.Decode(raw)
 }
 
-// Encode does nothing in local transport. Just satisfying interface.
+// Encode passes the data to remote transport's Encode().
 func (lt *LocalTransport) Encode(msgtype MsgType, data []byte) []byte {
-	return nil
+	return lt.remote.Encode(msgtype, data)
 }
 
 // Register registers a VnodeHandler within local and remote transports.
@@ -114,6 +129,14 @@ func (lt *LocalTransport) Ping(vn *Vnode) (bool, error) {
 	return lt.remote.Ping(vn)
 }
 
+// PeerClocks implements ClockReporter by passing the call to remote transport, if it tracks peer clocks.
+func (lt *LocalTransport) PeerClocks() []*PeerClock {
+	if reporter, ok := lt.remote.(ClockReporter); ok {
+		return reporter.PeerClocks()
+	}
+	return nil
+}
+
 // GetPredecessor implements Transport's GetPredecessor() in local transport.
 func (lt *LocalTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
 	local_vn, ok := lt.getVnodeHandler(vn)
@@ -136,3 +159,12 @@ func (lt *LocalTransport) Notify(dest, self *Vnode) ([]*Vnode, error) {
 	// Pass onto remote
 	return lt.remote.Notify(dest, self)
 }
+
+// Leave implements Transport's Leave() in local transport.
+func (lt *LocalTransport) Leave(dest, self, pred *Vnode, succs []*Vnode) error {
+	handler, ok := lt.getVnodeHandler(dest)
+	if ok {
+		return handler.Leave(self, pred, succs)
+	}
+	return lt.remote.Leave(dest, self, pred, succs)
+}
@@ -0,0 +1,217 @@
+package dendrite
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"sync"
+)
+
+const (
+	// message types in range [coreMsgTypeMin, coreMsgTypeMax] are reserved for dendrite itself
+	coreMsgTypeMin MsgType = 0x00
+	coreMsgTypeMax MsgType = 0x1f
+	coreMsgOwner           = "dendrite"
+)
+
+// coreDataMsgTypes are dendrite's own message types that carry application payload. They are served
+// in data lane, like messages claimed by other packages.
+var coreDataMsgTypes = map[MsgType]bool{
+	PbBroadcast: true,
+}
+
+// msgTypeEntry is a single slot in msgRegistry's dispatch table.
+type msgTypeEntry struct {
+	owner   string
+	handler *MsgTypeHandler
+}
+
+// msgRegistry keeps track of claimed message types. Every possible MsgType has its own slot
+// in dispatch table, so decoders and handlers are found in O(1).
+type msgRegistry struct {
+	lock   sync.RWMutex
+	claims []*MsgTypeClaim
+	table  [256]*msgTypeEntry
+}
+
+// newMsgRegistry creates empty msgRegistry.
+func newMsgRegistry() *msgRegistry {
+	return &msgRegistry{
+		claims: make([]*MsgTypeClaim, 0),
+	}
+}
+
+// claim validates MsgTypeClaim and registers it. Claims overlapping with any of the existing
+// claims are rejected.
+func (r *msgRegistry) claim(c *MsgTypeClaim) error {
+	if c == nil {
+		return fmt.Errorf("claim can not be nil")
+	}
+	if c.Owner == "" {
+		return fmt.Errorf("claim for range [%#x, %#x] has no owner", byte(c.Min), byte(c.Max))
+	}
+	if c.Min > c.Max {
+		return fmt.Errorf("invalid claim by %s - range [%#x, %#x] is empty", c.Owner, byte(c.Min), byte(c.Max))
+	}
+	for mt, h := range c.Handlers {
+		if mt < c.Min || mt > c.Max {
+			return fmt.Errorf("invalid claim by %s - message type %#x is outside of claimed range [%#x, %#x]",
+				c.Owner, byte(mt), byte(c.Min), byte(c.Max))
+		}
+		if h == nil || h.Decoder == nil {
+			return fmt.Errorf("invalid claim by %s - message type %#x has no decoder", c.Owner, byte(mt))
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, existing := range r.claims {
+		if c.Min <= existing.Max && existing.Min <= c.Max {
+			return ErrMsgTypeConflict(fmt.Sprintf("claim by %s for range [%#x, %#x] overlaps with range [%#x, %#x] owned by %s",
+				c.Owner, byte(c.Min), byte(c.Max), byte(existing.Min), byte(existing.Max), existing.Owner))
+		}
+	}
+	r.claims = append(r.claims, c)
+	for mt := int(c.Min); mt <= int(c.Max); mt++ {
+		r.table[mt] = &msgTypeEntry{
+			owner:   c.Owner,
+			handler: c.Handlers[MsgType(mt)],
+		}
+	}
+	return nil
+}
+
+// decode looks up registered decoder for cm.Type and uses it to set cm.TransportMsg and cm.TransportHandler.
+// First return value is false if message type was not claimed by anyone.
+func (r *msgRegistry) decode(cm *ChordMsg) (bool, error) {
+	r.lock.RLock()
+	entry := r.table[cm.Type]
+	r.lock.RUnlock()
+	if entry == nil {
+		return false, nil
+	}
+	if entry.handler == nil {
+		return true, fmt.Errorf("error decoding message - type %#x is claimed by %s but has no decoder", byte(cm.Type), entry.owner)
+	}
+	msg, err := entry.handler.Decoder(cm.Data)
+	if err != nil {
+		return true, err
+	}
+	cm.TransportMsg = msg
+	cm.TransportHandler = entry.handler.Handler
+	return true, nil
+}
+
+// isControl returns true if message type belongs to ring maintenance (control plane), i.e. is owned by dendrite.
+// Control messages are served from reserved workers and are never refused due to load.
+func (r *msgRegistry) isControl(mt MsgType) bool {
+	r.lock.RLock()
+	entry := r.table[mt]
+	r.lock.RUnlock()
+	return entry != nil && entry.owner == coreMsgOwner && !coreDataMsgTypes[mt]
+}
+
+// coreMsgTypeClaim returns the claim over dendrite's reserved message types, coupling core
+// decoders with given transport specific request handlers.
+func coreMsgTypeClaim(handlers map[MsgType]MsgHandler) *MsgTypeClaim {
+	claim := &MsgTypeClaim{
+		Owner:    coreMsgOwner,
+		Min:      coreMsgTypeMin,
+		Max:      coreMsgTypeMax,
+		Handlers: make(map[MsgType]*MsgTypeHandler),
+	}
+	for mt, decoder := range coreDecoders {
+		claim.Handlers[mt] = &MsgTypeHandler{
+			Decoder: decoder,
+			Handler: handlers[mt],
+		}
+	}
+	return claim
+}
+
+// coreDecoders maps dendrite's own message types to their protobuf decoders.
+var coreDecoders = map[MsgType]MsgDecoder{
+	PbPing: func(data []byte) (interface{}, error) {
+		var pingMsg PBProtoPing
+		if err := proto.Unmarshal(data, &pingMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoPing message - %s", err)
+		}
+		return pingMsg, nil
+	},
+	PbErr: func(data []byte) (interface{}, error) {
+		var errorMsg PBProtoErr
+		if err := proto.Unmarshal(data, &errorMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoErr message - %s", err)
+		}
+		return errorMsg, nil
+	},
+	PbForward: func(data []byte) (interface{}, error) {
+		var forwardMsg PBProtoForward
+		if err := proto.Unmarshal(data, &forwardMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoForward message - %s", err)
+		}
+		return forwardMsg, nil
+	},
+	PbLeave: func(data []byte) (interface{}, error) {
+		var leaveMsg PBProtoLeave
+		if err := proto.Unmarshal(data, &leaveMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoLeave message - %s", err)
+		}
+		return leaveMsg, nil
+	},
+	PbListVnodes: func(data []byte) (interface{}, error) {
+		var listVnodesMsg PBProtoListVnodes
+		if err := proto.Unmarshal(data, &listVnodesMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoListVnodes message - %s", err)
+		}
+		return listVnodesMsg, nil
+	},
+	PbListVnodesResp: func(data []byte) (interface{}, error) {
+		var listVnodesRespMsg PBProtoListVnodesResp
+		if err := proto.Unmarshal(data, &listVnodesRespMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoListVnodesResp message - %s", err)
+		}
+		return listVnodesRespMsg, nil
+	},
+	PbFindSuccessors: func(data []byte) (interface{}, error) {
+		var findSuccMsg PBProtoFindSuccessors
+		if err := proto.Unmarshal(data, &findSuccMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoFindSuccessors message - %s", err)
+		}
+		return findSuccMsg, nil
+	},
+	PbGetPredecessor: func(data []byte) (interface{}, error) {
+		var getPredMsg PBProtoGetPredecessor
+		if err := proto.Unmarshal(data, &getPredMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoGetPredecessor message - %s", err)
+		}
+		return getPredMsg, nil
+	},
+	PbNotify: func(data []byte) (interface{}, error) {
+		var notifyMsg PBProtoNotify
+		if err := proto.Unmarshal(data, &notifyMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoNotify message - %s", err)
+		}
+		return notifyMsg, nil
+	},
+	PbBroadcast: func(data []byte) (interface{}, error) {
+		var broadcastMsg PBProtoBroadcast
+		if err := proto.Unmarshal(data, &broadcastMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoBroadcast message - %s", err)
+		}
+		return broadcastMsg, nil
+	},
+	PbBroadcastResp: func(data []byte) (interface{}, error) {
+		var broadcastRespMsg PBProtoBroadcastResp
+		if err := proto.Unmarshal(data, &broadcastRespMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoBroadcastResp message - %s", err)
+		}
+		return broadcastRespMsg, nil
+	},
+	PbProtoVnode: func(data []byte) (interface{}, error) {
+		var vnodeMsg PBProtoVnode
+		if err := proto.Unmarshal(data, &vnodeMsg); err != nil {
+			return nil, fmt.Errorf("error decoding PBProtoVnode message - %s", err)
+		}
+		return vnodeMsg, nil
+	},
+}
@@ -0,0 +1,309 @@
+package dendrite
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"sync/atomic"
+	"time"
+)
+
+// Encode implement's Transport's Encode() in TCPTransport.
+func (transport *TCPTransport) Encode(mt MsgType, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(mt))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// Decode implements Transport's Decode() in TCPTransport. It uses the same registry of claimed
+// message types and TransportHooks as ZMQTransport.
+func (transport *TCPTransport) Decode(data []byte) (*ChordMsg, error) {
+	data_len := len(data)
+	if data_len == 0 {
+		return nil, fmt.Errorf("data too short: %d", len(data))
+	}
+
+	cm := &ChordMsg{Type: MsgType(data[0])}
+
+	if data_len > 1 {
+		cm.Data = data[1:]
+	}
+
+	// parse the data and set the handler
+	if claimed, err := transport.registry.decode(cm); claimed {
+		if err != nil {
+			return nil, err
+		}
+		return cm, nil
+	}
+
+	// maybe a TransportHook should handle this?
+	for _, hook := range transport.hooks {
+		if hook_cm, err := hook.Decode(data); err != nil {
+			_, ok := err.(ErrHookUnknownType)
+			if ok {
+				// this hook knows nothing about this message type, try next one
+				continue
+			}
+			return nil, err
+		} else {
+			// hook is handling this!
+			return hook_cm, nil
+		}
+	}
+	return nil, fmt.Errorf("error decoding message - unknown request type %x", cm.Type)
+}
+
+// getVnodeHandler returns registered local vnode handler, if one is found for given vnode.
+func (transport *TCPTransport) getVnodeHandler(dest *Vnode) (VnodeHandler, error) {
+	transport.lock.Lock()
+	h, ok := transport.table[dest.String()]
+	transport.lock.Unlock()
+	if ok {
+		return h.handler, nil
+	}
+	return nil, fmt.Errorf("local vnode handler not found")
+}
+
+// GetVnodeHandler returns registered local vnode handler, if one is found for given vnode.
+func (transport *TCPTransport) GetVnodeHandler(vnode *Vnode) (VnodeHandler, bool) {
+	handler, err := transport.getVnodeHandler(vnode)
+	if err != nil {
+		return nil, false
+	}
+	return handler, true
+}
+
+// Register registers a VnodeHandler within TCPTransport.
+func (transport *TCPTransport) Register(vnode *Vnode, handler VnodeHandler) {
+	transport.lock.Lock()
+	transport.table[vnode.String()] = &localHandler{vn: vnode, handler: handler}
+	transport.lock.Unlock()
+}
+
+// NewErrorMsg is a helper to create encoded *ChordMsg (PBProtoErr) with error in it.
+func (transport *TCPTransport) NewErrorMsg(msg string) *ChordMsg {
+	return NewErrorMsg(msg)
+}
+
+// Request - client request. Implements Transport's Request() in TCPTransport.
+func (transport *TCPTransport) Request(host string, msgType MsgType, data []byte) (*ChordMsg, error) {
+	// don't pile up data requests on a peer that refused us recently. Control requests
+	// are served in separate lane and never wait for backoff
+	control := transport.registry.isControl(msgType)
+	if !control && transport.backoff.active(host) {
+		return nil, ErrPeerOverloaded
+	}
+	if atomic.LoadInt32(&transport.closing) == 1 {
+		return nil, fmt.Errorf("TCP::Request - transport is closed")
+	}
+	conn, err := transport.getConn(host)
+	if err != nil {
+		return nil, fmt.Errorf("TCP::Request - connect error - %s", err)
+	}
+	id, resp_c, err := conn.send(transport.Encode(msgType, data))
+	if err != nil {
+		return nil, fmt.Errorf("TCP::Request - error while sending request - %s", err)
+	}
+
+	select {
+	case <-time.After(transport.clientTimeout):
+		conn.cancel(id)
+		return nil, fmt.Errorf("TCP::Request - command timed out!")
+	case resp, ok := <-resp_c:
+		if !ok {
+			return nil, fmt.Errorf("TCP::Request - connection to %s lost while waiting for response", host)
+		}
+		decoded, err := transport.Decode(resp)
+		if err != nil {
+			return nil, fmt.Errorf("TCP::Request - error while decoding response - %s", err)
+		}
+		if isOverloadedMsg(decoded) {
+			if !control {
+				transport.backoff.overloaded(host)
+			}
+			return nil, ErrPeerOverloaded
+		}
+		if !control {
+			transport.backoff.reset(host)
+		}
+		return decoded, nil
+	}
+}
+
+// ListVnodes - client request. Implements Transport's ListVnodes() in TCPTransport.
+func (transport *TCPTransport) ListVnodes(host string) ([]*Vnode, error) {
+	// Build request protobuf
+	req := new(PBProtoListVnodes)
+	reqData, _ := proto.Marshal(req)
+	decoded, err := transport.Request(host, PbListVnodes, reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch decoded.Type {
+	case PbErr:
+		pbMsg := decoded.TransportMsg.(PBProtoErr)
+		return nil, fmt.Errorf("TCP::ListVnodes - got error response - %s", pbMsg.GetError())
+	case PbListVnodesResp:
+		pbMsg := decoded.TransportMsg.(PBProtoListVnodesResp)
+		vnodes := make([]*Vnode, len(pbMsg.GetVnodes()))
+		for idx, pbVnode := range pbMsg.GetVnodes() {
+			vnodes[idx] = VnodeFromProtobuf(pbVnode)
+		}
+		return vnodes, nil
+	default:
+		// unexpected response
+		return nil, fmt.Errorf("TCP::ListVnodes - unexpected response")
+	}
+}
+
+// FindSuccessors - client request. Implements Transport's FindSuccessors() in TCPTransport.
+func (transport *TCPTransport) FindSuccessors(remote *Vnode, limit int, key []byte) ([]*Vnode, error) {
+	// Build request protobuf
+	req := &PBProtoFindSuccessors{
+		Dest:  remote.ToProtobuf(),
+		Key:   key,
+		Limit: proto.Int32(int32(limit)),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := transport.Request(remote.Host, PbFindSuccessors, reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch decoded.Type {
+	case PbErr:
+		pbMsg := decoded.TransportMsg.(PBProtoErr)
+		return nil, fmt.Errorf("TCP::FindSuccessors - got error response - %s", pbMsg.GetError())
+	case PbForward:
+		pbMsg := decoded.TransportMsg.(PBProtoForward)
+		return transport.FindSuccessors(VnodeFromProtobuf(pbMsg.GetVnode()), limit, key)
+	case PbListVnodesResp:
+		pbMsg := decoded.TransportMsg.(PBProtoListVnodesResp)
+		vnodes := make([]*Vnode, len(pbMsg.GetVnodes()))
+		for idx, pbVnode := range pbMsg.GetVnodes() {
+			vnodes[idx] = VnodeFromProtobuf(pbVnode)
+		}
+		return vnodes, nil
+	default:
+		// unexpected response
+		return nil, fmt.Errorf("TCP::FindSuccessors - unexpected response")
+	}
+}
+
+// GetPredecessor - client request. Implements Transport's GetPredecessor() in TCPTransport.
+func (transport *TCPTransport) GetPredecessor(remote *Vnode) (*Vnode, error) {
+	// Build request protobuf
+	req := &PBProtoGetPredecessor{
+		Dest: remote.ToProtobuf(),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := transport.Request(remote.Host, PbGetPredecessor, reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch decoded.Type {
+	case PbErr:
+		pbMsg := decoded.TransportMsg.(PBProtoErr)
+		return nil, fmt.Errorf("TCP::GetPredecessor - got error response - %s", pbMsg.GetError())
+	case PbProtoVnode:
+		pbMsg := decoded.TransportMsg.(PBProtoVnode)
+		return VnodeFromProtobuf(&pbMsg), nil
+	default:
+		// unexpected response
+		return nil, fmt.Errorf("TCP::GetPredecessor - unexpected response")
+	}
+}
+
+// Notify - client request. Implements Transport's Notify() in TCPTransport.
+func (transport *TCPTransport) Notify(remote, self *Vnode) ([]*Vnode, error) {
+	// Build request protobuf
+	req := &PBProtoNotify{
+		Dest:  remote.ToProtobuf(),
+		Vnode: self.ToProtobuf(),
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := transport.Request(remote.Host, PbNotify, reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch decoded.Type {
+	case PbErr:
+		pbMsg := decoded.TransportMsg.(PBProtoErr)
+		return nil, fmt.Errorf("TCP::Notify - got error response - %s", pbMsg.GetError())
+	case PbListVnodesResp:
+		pbMsg := decoded.TransportMsg.(PBProtoListVnodesResp)
+		vnodes := make([]*Vnode, len(pbMsg.GetVnodes()))
+		for idx, pbVnode := range pbMsg.GetVnodes() {
+			vnodes[idx] = VnodeFromProtobuf(pbVnode)
+		}
+		return vnodes, nil
+	default:
+		// unexpected response
+		return nil, fmt.Errorf("TCP::Notify - unexpected response")
+	}
+}
+
+// Leave - client request. Implements Transport's Leave() in TCPTransport.
+func (transport *TCPTransport) Leave(remote, self, pred *Vnode, succs []*Vnode) error {
+	// Build request protobuf
+	req := &PBProtoLeave{
+		Source: self.ToProtobuf(),
+		Dest:   remote.ToProtobuf(),
+	}
+	if pred != nil {
+		req.Predecessor = pred.ToProtobuf()
+	}
+	for _, succ := range succs {
+		if succ == nil {
+			break
+		}
+		req.Successors = append(req.Successors, succ.ToProtobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := transport.Request(remote.Host, PbLeave, reqData)
+	if err != nil {
+		return err
+	}
+
+	switch decoded.Type {
+	case PbErr:
+		pbMsg := decoded.TransportMsg.(PBProtoErr)
+		return fmt.Errorf("TCP::Leave - got error response - %s", pbMsg.GetError())
+	case PbListVnodesResp:
+		return nil
+	default:
+		// unexpected response
+		return fmt.Errorf("TCP::Leave - unexpected response")
+	}
+}
+
+// Ping - client request. Implements Transport's Ping() in TCPTransport.
+func (transport *TCPTransport) Ping(remote_vn *Vnode) (bool, error) {
+	PbPingMsg := newPingMsg()
+	PbPingData, _ := proto.Marshal(PbPingMsg)
+	decoded, err := transport.Request(remote_vn.Host, PbPing, PbPingData)
+	if err == ErrPeerOverloaded {
+		// peer that is shedding the load is still alive
+		return true, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if decoded.Type != PbPing {
+		return false, fmt.Errorf("TCP::Ping - unexpected response")
+	}
+	if pongMsg, ok := decoded.TransportMsg.(PBProtoPing); ok {
+		transport.clocks.sample(remote_vn.Host, pongMsg.GetSent(), pongMsg.GetReceived(), time.Now().UnixNano())
+	}
+	return true, nil
+}
+
+// PeerClocks implements ClockReporter in TCPTransport.
+func (transport *TCPTransport) PeerClocks() []*PeerClock {
+	return transport.clocks.snapshot()
+}
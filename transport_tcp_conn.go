@@ -0,0 +1,198 @@
+package dendrite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tcpFrameHeaderSize = 8                // 4 bytes length + 4 bytes request id
+	tcpMaxFrameSize    = 64 * 1024 * 1024 // refuse to read frames larger than this
+	tcpDialTimeout     = 2 * time.Second
+	tcpWriteTimeout    = 5 * time.Second
+)
+
+// writeFrame writes length prefixed frame, carrying request id and encoded message, to w.
+func writeFrame(w io.Writer, id uint32, payload []byte) error {
+	buf := make([]byte, tcpFrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(4+len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], id)
+	copy(buf[tcpFrameHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads single frame from r and returns its request id and encoded message.
+func readFrame(r *bufio.Reader) (uint32, []byte, error) {
+	header := make([]byte, tcpFrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 4 || length > tcpMaxFrameSize {
+		return 0, nil, fmt.Errorf("invalid frame length %d", length)
+	}
+	id := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return id, payload, nil
+}
+
+// tcpServerConn is incoming connection. Responses are written by multiple workers, so writes are serialized.
+type tcpServerConn struct {
+	conn  net.Conn
+	wlock sync.Mutex
+}
+
+func newTCPServerConn(conn net.Conn) *tcpServerConn {
+	return &tcpServerConn{conn: conn}
+}
+
+func (c *tcpServerConn) writeFrame(id uint32, payload []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	return writeFrame(c.conn, id, payload)
+}
+
+func (c *tcpServerConn) close() {
+	c.conn.Close()
+}
+
+// tcpClientConn is outgoing connection to remote TCPTransport. It is shared by all requests to the same host.
+// Each request is registered under unique id, and the reader goroutine routes responses back to it.
+type tcpClientConn struct {
+	host    string
+	conn    net.Conn
+	wlock   sync.Mutex
+	lock    sync.Mutex
+	next_id uint32
+	pending map[uint32]chan []byte
+	closed  bool
+}
+
+// tcpDial is connection being dialed. Other requests to the same host wait on done for its result.
+type tcpDial struct {
+	done chan struct{}
+	c    *tcpClientConn
+	err  error
+}
+
+/* getConn returns existing connection to host, or dials a new one. Dialing is done without holding connLock,
+so that slow or dead host does not hold up requests to other hosts. Concurrent requests to the host being
+dialed wait for the same dial to finish.
+*/
+func (transport *TCPTransport) getConn(host string) (*tcpClientConn, error) {
+	transport.connLock.Lock()
+	if c, ok := transport.conns[host]; ok {
+		transport.connLock.Unlock()
+		return c, nil
+	}
+	if d, ok := transport.dials[host]; ok {
+		transport.connLock.Unlock()
+		<-d.done
+		return d.c, d.err
+	}
+	d := &tcpDial{done: make(chan struct{})}
+	transport.dials[host] = d
+	transport.connLock.Unlock()
+
+	conn, err := net.DialTimeout("tcp", host, tcpDialTimeout)
+
+	transport.connLock.Lock()
+	delete(transport.dials, host)
+	switch {
+	case err != nil:
+		d.err = err
+	case atomic.LoadInt32(&transport.closing) == 1:
+		// Close() has already closed all connections, don't leave this one behind
+		conn.Close()
+		d.err = fmt.Errorf("TCP::Request - transport is closed")
+	default:
+		d.c = &tcpClientConn{
+			host:    host,
+			conn:    conn,
+			pending: make(map[uint32]chan []byte),
+		}
+		transport.conns[host] = d.c
+		go transport.readResponses(d.c)
+	}
+	transport.connLock.Unlock()
+	close(d.done)
+	return d.c, d.err
+}
+
+// readResponses routes responses to waiting requests until the connection fails.
+func (transport *TCPTransport) readResponses(c *tcpClientConn) {
+	reader := bufio.NewReader(c.conn)
+	for {
+		id, payload, err := readFrame(reader)
+		if err != nil {
+			break
+		}
+		c.lock.Lock()
+		resp_c, ok := c.pending[id]
+		delete(c.pending, id)
+		c.lock.Unlock()
+		if ok {
+			resp_c <- payload
+		}
+	}
+	// connection is broken, remove it from the pool and fail all pending requests
+	transport.connLock.Lock()
+	if transport.conns[c.host] == c {
+		delete(transport.conns, c.host)
+	}
+	transport.connLock.Unlock()
+
+	c.lock.Lock()
+	c.closed = true
+	for id, resp_c := range c.pending {
+		close(resp_c)
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+	c.conn.Close()
+}
+
+// send registers new request on the connection and writes it out. Response is delivered on returned channel,
+// which is closed if connection fails before response arrives.
+func (c *tcpClientConn) send(payload []byte) (uint32, chan []byte, error) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return 0, nil, fmt.Errorf("connection to %s is closed", c.host)
+	}
+	c.next_id++
+	id := c.next_id
+	resp_c := make(chan []byte, 1)
+	c.pending[id] = resp_c
+	c.lock.Unlock()
+
+	c.wlock.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	err := writeFrame(c.conn, id, payload)
+	c.wlock.Unlock()
+	if err != nil {
+		c.cancel(id)
+		// reader will notice broken connection as well
+		c.conn.Close()
+		return 0, nil, err
+	}
+	return id, resp_c, nil
+}
+
+// cancel forgets about pending request, eg. when it times out.
+func (c *tcpClientConn) cancel(id uint32) {
+	c.lock.Lock()
+	delete(c.pending, id)
+	c.lock.Unlock()
+}
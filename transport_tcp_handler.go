@@ -0,0 +1,224 @@
+package dendrite
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+func (transport *TCPTransport) tcp_ping_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbPongMsg := newPongMsg(request)
+	pbPong, _ := proto.Marshal(pbPongMsg)
+	pong := &ChordMsg{
+		Type: PbPing,
+		Data: pbPong,
+	}
+	w <- pong
+}
+
+func (transport *TCPTransport) tcp_listVnodes_handler(request *ChordMsg, w chan *ChordMsg) {
+	pblist := new(PBProtoListVnodesResp)
+	transport.lock.Lock()
+	for _, handler := range transport.table {
+		local_vn := handler.handler.(*localVnode)
+		for _, vnode := range local_vn.ring.vnodes {
+			pblist.Vnodes = append(pblist.Vnodes, vnode.ToProtobuf())
+		}
+		break
+	}
+	transport.lock.Unlock()
+	pbdata, err := proto.Marshal(pblist)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::ListVnodesHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &ChordMsg{
+		Type: PbListVnodesResp,
+		Data: pbdata,
+	}
+	return
+}
+
+func (transport *TCPTransport) tcp_find_successors_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbMsg := request.TransportMsg.(PBProtoFindSuccessors)
+	key := pbMsg.GetKey()
+	dest := VnodeFromProtobuf(pbMsg.GetDest())
+
+	// make sure destination vnode exists locally
+	local_vn, err := transport.getVnodeHandler(dest)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::FindSuccessorsHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	succs, forward_vn, err := local_vn.FindSuccessors(key, int(pbMsg.GetLimit()))
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::FindSuccessorsHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+
+	// if forward_vn is not set, return the list
+	if forward_vn == nil {
+		pblist := new(PBProtoListVnodesResp)
+		for _, s := range succs {
+			pblist.Vnodes = append(pblist.Vnodes, s.ToProtobuf())
+		}
+		pbdata, err := proto.Marshal(pblist)
+		if err != nil {
+			errorMsg := NewErrorMsg("TCP::FindSuccessorsHandler - failed to marshal response - " + err.Error())
+			w <- errorMsg
+			return
+		}
+		w <- &ChordMsg{
+			Type: PbListVnodesResp,
+			Data: pbdata,
+		}
+		return
+	}
+	// send forward response
+	pbfwd := &PBProtoForward{Vnode: forward_vn.ToProtobuf()}
+	pbdata, err := proto.Marshal(pbfwd)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::FindSuccessorsHandler - failed to marshal forward response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &ChordMsg{
+		Type: PbForward,
+		Data: pbdata,
+	}
+}
+
+func (transport *TCPTransport) tcp_get_predecessor_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbMsg := request.TransportMsg.(PBProtoGetPredecessor)
+	dest := VnodeFromProtobuf(pbMsg.GetDest())
+
+	// make sure destination vnode exists locally
+	local_vn, err := transport.getVnodeHandler(dest)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::GetPredecessorHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+
+	pred, err := local_vn.GetPredecessor()
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::GetPredecessorHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	pbpred := &PBProtoVnode{}
+	if pred != nil {
+		pbpred.Id = pred.Id
+		pbpred.Host = proto.String(pred.Host)
+	}
+	pbdata, err := proto.Marshal(pbpred)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::GetPredecessorHandler - Failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+
+	w <- &ChordMsg{
+		Type: PbProtoVnode,
+		Data: pbdata,
+	}
+
+}
+
+// handle Notify() request
+func (transport *TCPTransport) tcp_notify_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbMsg := request.TransportMsg.(PBProtoNotify)
+	dest := VnodeFromProtobuf(pbMsg.GetDest())
+
+	// make sure destination vnode exists locally
+	local_vn, err := transport.getVnodeHandler(dest)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::NotifyHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	pred := VnodeFromProtobuf(pbMsg.GetVnode())
+	succ_list, err := local_vn.Notify(pred)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::NotifyHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	pblist := new(PBProtoListVnodesResp)
+	for _, succ := range succ_list {
+		if succ == nil {
+			break
+		}
+		pblist.Vnodes = append(pblist.Vnodes, succ.ToProtobuf())
+	}
+
+	pbdata, err := proto.Marshal(pblist)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::Notify - Failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &ChordMsg{
+		Type: PbListVnodesResp,
+		Data: pbdata,
+	}
+}
+
+func (transport *TCPTransport) tcp_broadcast_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbMsg := request.TransportMsg.(PBProtoBroadcast)
+	dest := VnodeFromProtobuf(pbMsg.GetDest())
+
+	// make sure destination vnode exists locally
+	local_vn, err := transport.getVnodeHandler(dest)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::BroadcastHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	acks := local_vn.Broadcast(pbMsg.GetLimit(), MsgType(pbMsg.GetMsgType()), pbMsg.GetPayload(), broadcastTimeoutOf(&pbMsg))
+	pbdata, err := proto.Marshal(&PBProtoBroadcastResp{Acks: proto.Int32(int32(acks))})
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::BroadcastHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &ChordMsg{
+		Type: PbBroadcastResp,
+		Data: pbdata,
+	}
+}
+
+func (transport *TCPTransport) tcp_leave_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbMsg := request.TransportMsg.(PBProtoLeave)
+	dest := VnodeFromProtobuf(pbMsg.GetDest())
+
+	// make sure destination vnode exists locally
+	local_vn, err := transport.getVnodeHandler(dest)
+	if err != nil {
+		errorMsg := NewErrorMsg("TCP::LeaveHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	var pred *Vnode
+	if pbMsg.GetPredecessor() != nil {
+		pred = VnodeFromProtobuf(pbMsg.GetPredecessor())
+	}
+	succs := make([]*Vnode, len(pbMsg.GetSuccessors()))
+	for idx, pbVnode := range pbMsg.GetSuccessors() {
+		succs[idx] = VnodeFromProtobuf(pbVnode)
+	}
+	if err := local_vn.Leave(VnodeFromProtobuf(pbMsg.GetSource()), pred, succs); err != nil {
+		errorMsg := NewErrorMsg("TCP::LeaveHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	pbdata, _ := proto.Marshal(new(PBProtoListVnodesResp))
+	w <- &ChordMsg{
+		Type: PbListVnodesResp,
+		Data: pbdata,
+	}
+}
+func (transport *TCPTransport) tcp_error_handler(request *ChordMsg, w chan *ChordMsg) {
+
+}
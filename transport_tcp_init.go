@@ -0,0 +1,405 @@
+package dendrite
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TCPTransport implements Transport interface over plain TCP connections. It does not depend on
+// ZeroMQ (or cgo) and can be used as a drop-in replacement for ZMQTransport.
+type TCPTransport struct {
+	lock              *sync.Mutex
+	minHandlers       int
+	maxHandlers       int
+	incrHandlers      int
+	activeRequests    int32 // queued or running data requests
+	activeControl     int32 // queued or running control requests
+	maxQueuedRequests int32
+	controlHandlers   int
+	table             map[string]*localHandler
+	clientTimeout     time.Duration
+	ClientTimeout     time.Duration
+	control_c         chan *workerComm
+	request_c         chan *tcpRequest
+	ctl_request_c     chan *tcpRequest
+	listener          net.Listener
+	connLock          *sync.Mutex
+	conns             map[string]*tcpClientConn
+	dials             map[string]*tcpDial // dials in progress, by host
+	srvConns          map[*tcpServerConn]bool
+	workerIdleTimeout time.Duration
+	hooks             []TransportHook
+	registry          *msgRegistry
+	backoff           *peerBackoff
+	clocks            *peerClocks
+	closing           int32         // set to 1 by Close()
+	shutdown_c        chan struct{} // closed when workers should exit
+	sched_done        chan struct{}
+	Logger            *log.Logger
+}
+
+// tcpRequest is a decoded request waiting to be processed by a worker.
+type tcpRequest struct {
+	id   uint32
+	msg  *ChordMsg
+	conn *tcpServerConn
+}
+
+// RegisterHook registers TransportHook within TCPTransport.
+func (t *TCPTransport) RegisterHook(h TransportHook) {
+	t.hooks = append(t.hooks, h)
+}
+
+// ClaimMsgTypes registers MsgTypeClaim within TCPTransport.
+func (t *TCPTransport) ClaimMsgTypes(c *MsgTypeClaim) error {
+	return t.registry.claim(c)
+}
+
+/*
+	Close shuts down TCPTransport. Listener is closed and new requests are refused, while in-flight
+	ones are given up to ClientTimeout to complete. Then workers and the scheduler are stopped and all
+	connections are closed. Close can be called more than once, subsequent calls do nothing.
+*/
+func (t *TCPTransport) Close() error {
+	if !atomic.CompareAndSwapInt32(&t.closing, 0, 1) {
+		return nil
+	}
+	err := t.listener.Close()
+
+	// drain in-flight requests
+	deadline := time.Now().Add(t.clientTimeout)
+	for atomic.LoadInt32(&t.activeRequests) > 0 || atomic.LoadInt32(&t.activeControl) > 0 {
+		if time.Now().After(deadline) {
+			t.Logger.Println("[DENDRITE][INFO]: TCPTransport - gave up waiting for in-flight requests")
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(t.shutdown_c)
+	<-t.sched_done
+
+	t.connLock.Lock()
+	for conn := range t.srvConns {
+		conn.close()
+	}
+	for _, c := range t.conns {
+		c.conn.Close()
+	}
+	t.connLock.Unlock()
+	t.Logger.Println("[DENDRITE][INFO]: TCPTransport - shutdown complete")
+	return err
+}
+
+/*
+	InitTCPTransport creates TCP transport.
+
+	Every connection is served by its own reader, which decodes incoming frames and queues them
+	for processing in separate go routines (workers). Like ZMQTransport, it starts with 10 workers and
+	spawns more as needed. Multiple requests can be in flight on a single connection, as each frame
+	carries request id which is echoed back in the response. Frame layout is:
+		[4 bytes length][4 bytes request id][Encode() bytes]
+
+	Ring maintenance (control) messages are queued separately and served by fixed number of reserved
+	workers, so they never wait behind data messages registered by other packages.
+
+	Once there are more than maxQueuedRequests data requests in flight, new ones are refused straight
+	away with PbErr (overloaded) response. Control requests are refused the same way only if their own
+	queue is full, so connection's reader never blocks on a busy control lane.
+*/
+func InitTCPTransport(hostname string, timeout time.Duration, logger *log.Logger) (Transport, error) {
+	// use default logger if one is not provided
+	if logger == nil {
+		logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+	}
+	listener, err := net.Listen("tcp", hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &TCPTransport{
+		lock:              new(sync.Mutex),
+		clientTimeout:     timeout,
+		ClientTimeout:     timeout,
+		minHandlers:       10,
+		maxHandlers:       1024,
+		incrHandlers:      10,
+		activeRequests:    0,
+		maxQueuedRequests: defaultMaxQueuedRequests,
+		controlHandlers:   defaultControlHandlers,
+		workerIdleTimeout: 10 * time.Second,
+		table:             make(map[string]*localHandler),
+		control_c:         make(chan *workerComm),
+		request_c:         make(chan *tcpRequest, defaultMaxQueuedRequests),
+		ctl_request_c:     make(chan *tcpRequest, defaultMaxQueuedRequests),
+		listener:          listener,
+		connLock:          new(sync.Mutex),
+		conns:             make(map[string]*tcpClientConn),
+		dials:             make(map[string]*tcpDial),
+		srvConns:          make(map[*tcpServerConn]bool),
+		hooks:             make([]TransportHook, 0),
+		registry:          newMsgRegistry(),
+		backoff:           newPeerBackoff(),
+		clocks:            newPeerClocks(),
+		shutdown_c:        make(chan struct{}),
+		sched_done:        make(chan struct{}),
+		Logger:            logger,
+	}
+	// claim dendrite's own message types
+	err = transport.registry.claim(coreMsgTypeClaim(map[MsgType]MsgHandler{
+		PbPing:           transport.tcp_ping_handler,
+		PbErr:            transport.tcp_error_handler,
+		PbLeave:          transport.tcp_leave_handler,
+		PbListVnodes:     transport.tcp_listVnodes_handler,
+		PbFindSuccessors: transport.tcp_find_successors_handler,
+		PbGetPredecessor: transport.tcp_get_predecessor_handler,
+		PbNotify:         transport.tcp_notify_handler,
+		PbBroadcast:      transport.tcp_broadcast_handler,
+	}))
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	go transport.listen()
+	// control workers are reserved, scheduler does not manage them
+	for i := 0; i < transport.controlHandlers; i++ {
+		go transport.tcp_control_worker()
+	}
+	// Scheduler goroutine keeps track of running workers
+	// It spawns new ones if needed, and cancels ones that are idling
+	go func() {
+		sched_ticker := time.NewTicker(5 * time.Second)
+		workers := make(map[*workerComm]bool)
+		// fire up initial set of workers
+		for i := 0; i < transport.minHandlers; i++ {
+			go transport.tcp_worker()
+		}
+		for {
+			select {
+			case comm := <-transport.control_c:
+				// worker sent something...
+				msg := <-comm.worker_out
+				switch {
+				case msg == workerRegisterReq:
+					if len(workers) == transport.maxHandlers {
+						comm.worker_in <- workerRegisterDenied
+						logger.Println("[DENDRITE][INFO]: TCPTransport - max number of workers reached")
+						continue
+					}
+					if _, ok := workers[comm]; ok {
+						// worker already registered
+						continue
+					}
+					comm.worker_in <- workerRegisterAllowed
+					workers[comm] = true
+					logger.Println("[DENDRITE][INFO]: TCPTransport - registered new worker, total:", len(workers))
+				case msg == workerShutdownReq:
+					if len(workers) > transport.minHandlers {
+						comm.worker_in <- workerShutdownAllowed
+						for _ = range comm.worker_out {
+							// wait until worker closes the channel
+						}
+						delete(workers, comm)
+					} else {
+						comm.worker_in <- workerShutdownDenied
+					}
+				}
+			case <-sched_ticker.C:
+				// check if requests are piling up and start more workers if that's the case
+				if int(atomic.LoadInt32(&transport.activeRequests)) > 3*len(workers) {
+					for i := 0; i < transport.incrHandlers; i++ {
+						go transport.tcp_worker()
+					}
+				}
+			case <-transport.shutdown_c:
+				// transport is closing, stop all workers
+				sched_ticker.Stop()
+				for comm := range workers {
+					comm.worker_ctl <- workerCtlShutdown
+					for _ = range comm.worker_out {
+						// wait until worker closes the channel
+					}
+				}
+				close(transport.sched_done)
+				return
+			}
+		}
+	}()
+	return transport, nil
+}
+
+// listen accepts incoming connections and starts a reader for each one.
+func (transport *TCPTransport) listen() {
+	for {
+		conn, err := transport.listener.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&transport.closing) == 0 {
+				transport.Logger.Println("[DENDRITE][ERROR]: TCPTransport listener stopped accepting connections,", err)
+			}
+			return
+		}
+		srvConn := newTCPServerConn(conn)
+		transport.connLock.Lock()
+		transport.srvConns[srvConn] = true
+		transport.connLock.Unlock()
+		go transport.serveConn(srvConn)
+	}
+}
+
+// serveConn reads request frames from a connection, decodes them and queues them for workers.
+func (transport *TCPTransport) serveConn(conn *tcpServerConn) {
+	defer func() {
+		transport.connLock.Lock()
+		delete(transport.srvConns, conn)
+		transport.connLock.Unlock()
+		conn.close()
+	}()
+	reader := bufio.NewReader(conn.conn)
+	for {
+		id, rawmsg, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		// decode raw data
+		decoded, err := transport.Decode(rawmsg)
+		if err != nil {
+			errorMsg := NewErrorMsg("Failed to decode request - " + err.Error())
+			conn.writeFrame(id, transport.Encode(errorMsg.Type, errorMsg.Data))
+			continue
+		}
+		// if transportHandler is nil, this can not be a valid request
+		if decoded.TransportHandler == nil {
+			errorMsg := NewErrorMsg("Invalid request, unknown handler")
+			conn.writeFrame(id, transport.Encode(errorMsg.Type, errorMsg.Data))
+			continue
+		}
+		if atomic.LoadInt32(&transport.closing) == 1 {
+			errorMsg := NewErrorMsg("transport is shutting down")
+			conn.writeFrame(id, transport.Encode(errorMsg.Type, errorMsg.Data))
+			continue
+		}
+		request := &tcpRequest{id: id, msg: decoded, conn: conn}
+		if transport.registry.isControl(decoded.Type) {
+			atomic.AddInt32(&transport.activeControl, 1)
+			select {
+			case transport.ctl_request_c <- request:
+			default:
+				// control lane is full as well, refuse rather than block reads from this connection
+				atomic.AddInt32(&transport.activeControl, -1)
+				errorMsg := newOverloadedMsg()
+				conn.writeFrame(id, transport.Encode(errorMsg.Type, errorMsg.Data))
+			}
+			continue
+		}
+		if atomic.AddInt32(&transport.activeRequests, 1) > transport.maxQueuedRequests {
+			transport.shed(conn, id)
+			continue
+		}
+		select {
+		case transport.request_c <- request:
+		default:
+			transport.shed(conn, id)
+		}
+	}
+}
+
+// shed refuses the request with overloaded error.
+func (transport *TCPTransport) shed(conn *tcpServerConn, id uint32) {
+	atomic.AddInt32(&transport.activeRequests, -1)
+	errorMsg := newOverloadedMsg()
+	conn.writeFrame(id, transport.Encode(errorMsg.Type, errorMsg.Data))
+}
+
+func (transport *TCPTransport) tcp_worker() {
+	// setup communication channels with scheduler
+	worker_in := make(chan controlType, 1)
+	worker_out := make(chan controlType, 1)
+	worker_ctl := make(chan controlType, 1)
+	comm := &workerComm{
+		worker_in:  worker_in,
+		worker_out: worker_out,
+		worker_ctl: worker_ctl,
+	}
+	// notify scheduler that we're up
+	worker_out <- workerRegisterReq
+	select {
+	case transport.control_c <- comm:
+	case <-transport.shutdown_c:
+		return
+	}
+	v := <-worker_in
+	if v == workerRegisterDenied {
+		return
+	}
+
+	// process queued requests -- OR
+	// shutdown if scheduler wants me to -- OR
+	// request shutdown from scheduler if idling and exit if allowed
+	ticker := time.NewTicker(transport.workerIdleTimeout)
+	for {
+		select {
+		case request := <-transport.request_c:
+			transport.handleRequest(request)
+			atomic.AddInt32(&transport.activeRequests, -1)
+			// restart idle timer
+			ticker.Stop()
+			ticker = time.NewTicker(transport.workerIdleTimeout)
+
+		case controlMsg := <-comm.worker_ctl:
+			if controlMsg == workerCtlShutdown {
+				close(comm.worker_out)
+				transport.Logger.Println("[DENDRITE][INFO]: TCPTransport: worker shutdown")
+				return
+			}
+		case <-ticker.C:
+			// we're idling, lets request shutdown
+			comm.worker_out <- workerShutdownReq
+			select {
+			case transport.control_c <- comm:
+			case <-transport.shutdown_c:
+				// scheduler is going away, it will ask us to shutdown
+				continue
+			}
+			v := <-comm.worker_in
+			if v == workerShutdownAllowed {
+				transport.Logger.Println("[DENDRITE][INFO]: TCPTransport: worker shutdown due to idle state")
+				close(comm.worker_out)
+				return
+			}
+		}
+	}
+}
+
+// tcp_control_worker serves control requests. Control workers are started with the transport and live
+// as long as it does, so ring maintenance has reserved capacity regardless of the data load.
+func (transport *TCPTransport) tcp_control_worker() {
+	for {
+		select {
+		case request := <-transport.ctl_request_c:
+			transport.handleRequest(request)
+			atomic.AddInt32(&transport.activeControl, -1)
+		case <-transport.shutdown_c:
+			return
+		}
+	}
+}
+
+// handleRequest runs request's handler and writes the response back to the connection it came from.
+func (transport *TCPTransport) handleRequest(request *tcpRequest) {
+	response_c := make(chan *ChordMsg, 1)
+	request.msg.TransportHandler(request.msg, response_c)
+
+	var response *ChordMsg
+	select {
+	case response = <-response_c:
+	default:
+		// handler did not respond, but caller is waiting for something
+		response = NewErrorMsg("Request handler sent no response")
+	}
+	request.conn.writeFrame(request.id, transport.Encode(response.Type, response.Data))
+}
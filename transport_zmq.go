@@ -22,32 +22,18 @@ const (
 	PbGetPredecessor
 	PbProtoVnode
 	PbNotify
+	PbBroadcast
+	PbBroadcastResp
 )
 
 // newErrorMsg is a helper to create encoded *ChordMsg (PBProtoErr) with error in it.
 func (transport *ZMQTransport) newErrorMsg(msg string) *ChordMsg {
-	pbmsg := &PBProtoErr{
-		Error: proto.String(msg),
-	}
-	pbdata, _ := proto.Marshal(pbmsg)
-	return &ChordMsg{
-		Type: PbErr,
-		Data: pbdata,
-	}
-
+	return NewErrorMsg(msg)
 }
 
 // NewErrorMsg is a helper to create encoded *ChordMsg (PBProtoErr) with error in it.
 func (transport *ZMQTransport) NewErrorMsg(msg string) *ChordMsg {
-	pbmsg := &PBProtoErr{
-		Error: proto.String(msg),
-	}
-	pbdata, _ := proto.Marshal(pbmsg)
-	return &ChordMsg{
-		Type: PbErr,
-		Data: pbdata,
-	}
-
+	return NewErrorMsg(msg)
 }
 
 // Encode implement's Transport's Encode() in ZMQTransport.
@@ -60,8 +46,8 @@ func (transport *ZMQTransport) Encode(mt MsgType, data []byte) []byte {
 
 // Decode implements Transport's Decode() in ZMQTransport. For request messages
 // it also sets their respective handler to be called when such request comes in.
-// If message type is unknown to this transport, Decode() also checks for registered
-// TransportHooks and runs their Decode() implementation.
+// Decoders and handlers are looked up in the registry of claimed message types. If message type
+// was not claimed, Decode() also checks for registered TransportHooks and runs their Decode() implementation.
 func (transport *ZMQTransport) Decode(data []byte) (*ChordMsg, error) {
 	data_len := len(data)
 	if data_len == 0 {
@@ -75,103 +61,28 @@ func (transport *ZMQTransport) Decode(data []byte) (*ChordMsg, error) {
 	}
 
 	// parse the data and set the handler
-	switch cm.Type {
-	case PbPing:
-		var pingMsg PBProtoPing
-		err := proto.Unmarshal(cm.Data, &pingMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoPing message - %s", err)
-		}
-		cm.TransportMsg = pingMsg
-		cm.TransportHandler = transport.zmq_ping_handler
-	case PbErr:
-		var errorMsg PBProtoErr
-		err := proto.Unmarshal(cm.Data, &errorMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoErr message - %s", err)
-		}
-		cm.TransportMsg = errorMsg
-		cm.TransportHandler = transport.zmq_error_handler
-	case PbForward:
-		var forwardMsg PBProtoForward
-		err := proto.Unmarshal(cm.Data, &forwardMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoForward message - %s", err)
-		}
-		cm.TransportMsg = forwardMsg
-	case PbLeave:
-		var leaveMsg PBProtoLeave
-		err := proto.Unmarshal(cm.Data, &leaveMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoLeave message - %s", err)
-		}
-		cm.TransportMsg = leaveMsg
-		cm.TransportHandler = transport.zmq_leave_handler
-	case PbListVnodes:
-		var listVnodesMsg PBProtoListVnodes
-		err := proto.Unmarshal(cm.Data, &listVnodesMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoListVnodes message - %s", err)
-		}
-		cm.TransportMsg = listVnodesMsg
-		cm.TransportHandler = transport.zmq_listVnodes_handler
-	case PbListVnodesResp:
-		var listVnodesRespMsg PBProtoListVnodesResp
-		err := proto.Unmarshal(cm.Data, &listVnodesRespMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoListVnodesResp message - %s", err)
-		}
-		cm.TransportMsg = listVnodesRespMsg
-	case PbFindSuccessors:
-		var findSuccMsg PBProtoFindSuccessors
-		err := proto.Unmarshal(cm.Data, &findSuccMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoFindSuccessors message - %s", err)
-		}
-		cm.TransportMsg = findSuccMsg
-		cm.TransportHandler = transport.zmq_find_successors_handler
-	case PbGetPredecessor:
-		var getPredMsg PBProtoGetPredecessor
-		err := proto.Unmarshal(cm.Data, &getPredMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoGetPredecessor message - %s", err)
-		}
-		cm.TransportMsg = getPredMsg
-		cm.TransportHandler = transport.zmq_get_predecessor_handler
-	case PbNotify:
-		var notifyMsg PBProtoNotify
-		err := proto.Unmarshal(cm.Data, &notifyMsg)
+	if claimed, err := transport.registry.decode(cm); claimed {
 		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoNotify message - %s", err)
+			return nil, err
 		}
-		cm.TransportMsg = notifyMsg
-		cm.TransportHandler = transport.zmq_notify_handler
-	case PbProtoVnode:
-		var vnodeMsg PBProtoVnode
-		err := proto.Unmarshal(cm.Data, &vnodeMsg)
-		if err != nil {
-			return nil, fmt.Errorf("error decoding PBProtoVnode message - %s", err)
-		}
-		cm.TransportMsg = vnodeMsg
-	default:
-		// maybe a TransportHook should handle this?
-		for _, hook := range transport.hooks {
-			if hook_cm, err := hook.Decode(data); err != nil {
-				_, ok := err.(ErrHookUnknownType)
-				if ok {
-					// this hook knows nothing about this message type, try next one
-					continue
-				}
-				return nil, err
-			} else {
-				// hook is handling this!
-				return hook_cm, nil
+		return cm, nil
+	}
+
+	// maybe a TransportHook should handle this?
+	for _, hook := range transport.hooks {
+		if hook_cm, err := hook.Decode(data); err != nil {
+			_, ok := err.(ErrHookUnknownType)
+			if ok {
+				// this hook knows nothing about this message type, try next one
+				continue
 			}
+			return nil, err
+		} else {
+			// hook is handling this!
+			return hook_cm, nil
 		}
-		return nil, fmt.Errorf("error decoding message - unknown request type %x", cm.Type)
 	}
-
-	return cm, nil
+	return nil, fmt.Errorf("error decoding message - unknown request type %x", cm.Type)
 }
 
 // getVnodeHandler returns registered local vnode handler, if one is found for given vnode.
@@ -212,6 +123,7 @@ func (transport *ZMQTransport) ListVnodes(host string) ([]*Vnode, error) {
 		}
 		req_sock.SetRcvtimeo(2 * time.Second)
 		req_sock.SetSndtimeo(2 * time.Second)
+		req_sock.SetLinger(0)
 
 		defer req_sock.Close()
 		err = req_sock.Connect("tcp://" + host)
@@ -240,6 +152,10 @@ func (transport *ZMQTransport) ListVnodes(host string) ([]*Vnode, error) {
 			error_c <- fmt.Errorf("ZMQ::ListVnodes - error while decoding response - %s", err)
 			return
 		}
+		if isOverloadedMsg(decoded) {
+			error_c <- ErrPeerOverloaded
+			return
+		}
 
 		switch decoded.Type {
 		case PbErr:
@@ -285,6 +201,7 @@ func (transport *ZMQTransport) FindSuccessors(remote *Vnode, limit int, key []by
 		}
 		req_sock.SetRcvtimeo(2 * time.Second)
 		req_sock.SetSndtimeo(2 * time.Second)
+		req_sock.SetLinger(0)
 
 		defer req_sock.Close()
 		err = req_sock.Connect("tcp://" + remote.Host)
@@ -317,6 +234,10 @@ func (transport *ZMQTransport) FindSuccessors(remote *Vnode, limit int, key []by
 			error_c <- fmt.Errorf("ZMQ::FindSuccessors - error while decoding response - %s", err)
 			return
 		}
+		if isOverloadedMsg(decoded) {
+			error_c <- ErrPeerOverloaded
+			return
+		}
 
 		switch decoded.Type {
 		case PbErr:
@@ -367,6 +288,7 @@ func (transport *ZMQTransport) GetPredecessor(remote *Vnode) (*Vnode, error) {
 		}
 		req_sock.SetRcvtimeo(2 * time.Second)
 		req_sock.SetSndtimeo(2 * time.Second)
+		req_sock.SetLinger(0)
 
 		defer req_sock.Close()
 		err = req_sock.Connect("tcp://" + remote.Host)
@@ -397,6 +319,10 @@ func (transport *ZMQTransport) GetPredecessor(remote *Vnode) (*Vnode, error) {
 			error_c <- fmt.Errorf("ZMQ::GetPredecessor - error while decoding response - %s", err)
 			return
 		}
+		if isOverloadedMsg(decoded) {
+			error_c <- ErrPeerOverloaded
+			return
+		}
 
 		switch decoded.Type {
 		case PbErr:
@@ -437,6 +363,7 @@ func (transport *ZMQTransport) Notify(remote, self *Vnode) ([]*Vnode, error) {
 		}
 		req_sock.SetRcvtimeo(2 * time.Second)
 		req_sock.SetSndtimeo(2 * time.Second)
+		req_sock.SetLinger(0)
 
 		defer req_sock.Close()
 		err = req_sock.Connect("tcp://" + remote.Host)
@@ -469,6 +396,10 @@ func (transport *ZMQTransport) Notify(remote, self *Vnode) ([]*Vnode, error) {
 			error_c <- fmt.Errorf("ZMQ::Notify - error while decoding response - %s", err)
 			return
 		}
+		if isOverloadedMsg(decoded) {
+			error_c <- ErrPeerOverloaded
+			return
+		}
 
 		switch decoded.Type {
 		case PbErr:
@@ -500,6 +431,108 @@ func (transport *ZMQTransport) Notify(remote, self *Vnode) ([]*Vnode, error) {
 	}
 }
 
+// Leave - client request. Implements Transport's Leave() in ZMQTransport.
+func (transport *ZMQTransport) Leave(remote, self, pred *Vnode, succs []*Vnode) error {
+	// Build request protobuf
+	req := &PBProtoLeave{
+		Source: self.ToProtobuf(),
+		Dest:   remote.ToProtobuf(),
+	}
+	if pred != nil {
+		req.Predecessor = pred.ToProtobuf()
+	}
+	for _, succ := range succs {
+		if succ == nil {
+			break
+		}
+		req.Successors = append(req.Successors, succ.ToProtobuf())
+	}
+	reqData, _ := proto.Marshal(req)
+	decoded, err := transport.Request(remote.Host, PbLeave, reqData)
+	if err != nil {
+		return err
+	}
+
+	switch decoded.Type {
+	case PbErr:
+		pbMsg := decoded.TransportMsg.(PBProtoErr)
+		return fmt.Errorf("ZMQ::Leave - got error response - %s", pbMsg.GetError())
+	case PbListVnodesResp:
+		return nil
+	default:
+		// unexpected response
+		return fmt.Errorf("ZMQ::Leave - unexpected response")
+	}
+}
+
+// Request - client request. Implements Transport's Request() in ZMQTransport.
+func (transport *ZMQTransport) Request(host string, msgType MsgType, data []byte) (*ChordMsg, error) {
+	// don't pile up data requests on a peer that refused us recently. Control requests
+	// are served in separate lane and never wait for backoff
+	control := transport.registry.isControl(msgType)
+	if !control && transport.backoff.active(host) {
+		return nil, ErrPeerOverloaded
+	}
+	error_c := make(chan error, 1)
+	resp_c := make(chan *ChordMsg, 1)
+
+	go func() {
+		req_sock, err := transport.zmq_context.NewSocket(zmq.REQ)
+		if err != nil {
+			error_c <- fmt.Errorf("ZMQ::Request - newsocket error - %s", err)
+			return
+		}
+		req_sock.SetRcvtimeo(5 * time.Second)
+		req_sock.SetSndtimeo(5 * time.Second)
+		req_sock.SetLinger(0)
+
+		defer req_sock.Close()
+		err = req_sock.Connect("tcp://" + host)
+		if err != nil {
+			error_c <- fmt.Errorf("ZMQ::Request - connect error - %s", err)
+			return
+		}
+		encoded := transport.Encode(msgType, data)
+		_, err = req_sock.SendBytes(encoded, 0)
+		if err != nil {
+			error_c <- fmt.Errorf("ZMQ::Request - error while sending request - %s", err)
+			return
+		}
+
+		// read response and decode it
+		resp, err := req_sock.RecvBytes(0)
+		if err != nil {
+			error_c <- fmt.Errorf("ZMQ::Request - error while reading response - %s", err)
+			return
+		}
+		decoded, err := transport.Decode(resp)
+		if err != nil {
+			error_c <- fmt.Errorf("ZMQ::Request - error while decoding response - %s", err)
+			return
+		}
+		if isOverloadedMsg(decoded) {
+			if !control {
+				transport.backoff.overloaded(host)
+			}
+			error_c <- ErrPeerOverloaded
+			return
+		}
+		if !control {
+			transport.backoff.reset(host)
+		}
+		resp_c <- decoded
+	}()
+
+	select {
+	case <-time.After(transport.clientTimeout):
+		return nil, fmt.Errorf("ZMQ::Request - command timed out!")
+	case err := <-error_c:
+		return nil, err
+	case decoded := <-resp_c:
+		return decoded, nil
+	}
+}
+
 // Ping - client request. Implements Transport's Ping() in ZQMTransport.
 func (transport *ZMQTransport) Ping(remote_vn *Vnode) (bool, error) {
 	req_sock, err := transport.zmq_context.NewSocket(zmq.REQ)
@@ -514,10 +547,9 @@ func (transport *ZMQTransport) Ping(remote_vn *Vnode) (bool, error) {
 	}
 	req_sock.SetRcvtimeo(2 * time.Second)
 	req_sock.SetSndtimeo(2 * time.Second)
+	req_sock.SetLinger(0)
 
-	PbPingMsg := &PBProtoPing{
-		Version: proto.Int64(1),
-	}
+	PbPingMsg := newPingMsg()
 	PbPingData, _ := proto.Marshal(PbPingMsg)
 	encoded := transport.Encode(PbPing, PbPingData)
 	_, err = req_sock.SendBytes(encoded, 0)
@@ -532,10 +564,19 @@ func (transport *ZMQTransport) Ping(remote_vn *Vnode) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if isOverloadedMsg(decoded) {
+		return true, ErrPeerOverloaded
+	}
 	pongMsg := new(PBProtoPing)
 	err = proto.Unmarshal(decoded.Data, pongMsg)
 	if err != nil {
 		return false, err
 	}
+	transport.clocks.sample(remote_vn.Host, pongMsg.GetSent(), pongMsg.GetReceived(), time.Now().UnixNano())
 	return true, nil
 }
+
+// PeerClocks implements ClockReporter in ZMQTransport.
+func (transport *ZMQTransport) PeerClocks() []*PeerClock {
+	return transport.clocks.snapshot()
+}
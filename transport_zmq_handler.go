@@ -5,9 +5,7 @@ import (
 )
 
 func (transport *ZMQTransport) zmq_ping_handler(request *ChordMsg, w chan *ChordMsg) {
-	pbPongMsg := &PBProtoPing{
-		Version: proto.Int64(1),
-	}
+	pbPongMsg := newPongMsg(request)
 	pbPong, _ := proto.Marshal(pbPongMsg)
 	pong := &ChordMsg{
 		Type: PbPing,
@@ -166,8 +164,59 @@ func (transport *ZMQTransport) zmq_notify_handler(request *ChordMsg, w chan *Cho
 	}
 }
 
+func (transport *ZMQTransport) zmq_broadcast_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbMsg := request.TransportMsg.(PBProtoBroadcast)
+	dest := VnodeFromProtobuf(pbMsg.GetDest())
+
+	// make sure destination vnode exists locally
+	local_vn, err := transport.getVnodeHandler(dest)
+	if err != nil {
+		errorMsg := transport.newErrorMsg("ZMQ::BroadcastHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	acks := local_vn.Broadcast(pbMsg.GetLimit(), MsgType(pbMsg.GetMsgType()), pbMsg.GetPayload(), broadcastTimeoutOf(&pbMsg))
+	pbdata, err := proto.Marshal(&PBProtoBroadcastResp{Acks: proto.Int32(int32(acks))})
+	if err != nil {
+		errorMsg := transport.newErrorMsg("ZMQ::BroadcastHandler - failed to marshal response - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	w <- &ChordMsg{
+		Type: PbBroadcastResp,
+		Data: pbdata,
+	}
+}
+
 func (transport *ZMQTransport) zmq_leave_handler(request *ChordMsg, w chan *ChordMsg) {
+	pbMsg := request.TransportMsg.(PBProtoLeave)
+	dest := VnodeFromProtobuf(pbMsg.GetDest())
 
+	// make sure destination vnode exists locally
+	local_vn, err := transport.getVnodeHandler(dest)
+	if err != nil {
+		errorMsg := transport.newErrorMsg("ZMQ::LeaveHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	var pred *Vnode
+	if pbMsg.GetPredecessor() != nil {
+		pred = VnodeFromProtobuf(pbMsg.GetPredecessor())
+	}
+	succs := make([]*Vnode, len(pbMsg.GetSuccessors()))
+	for idx, pbVnode := range pbMsg.GetSuccessors() {
+		succs[idx] = VnodeFromProtobuf(pbVnode)
+	}
+	if err := local_vn.Leave(VnodeFromProtobuf(pbMsg.GetSource()), pred, succs); err != nil {
+		errorMsg := transport.newErrorMsg("ZMQ::LeaveHandler - " + err.Error())
+		w <- errorMsg
+		return
+	}
+	pbdata, _ := proto.Marshal(new(PBProtoListVnodesResp))
+	w <- &ChordMsg{
+		Type: PbListVnodesResp,
+		Data: pbdata,
+	}
 }
 func (transport *ZMQTransport) zmq_error_handler(request *ChordMsg, w chan *ChordMsg) {
 
@@ -1,10 +1,12 @@
 package dendrite
 
 import (
+	"fmt"
 	zmq "github.com/pebbe/zmq4"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,24 +23,41 @@ const (
 	workerCtlShutdown
 )
 
+// zmqTransportSeq numbers ZMQTransport instances, so each one binds its own internal endpoints.
+var zmqTransportSeq uint64
+
 // ZMQTransport implements Transport interface using ZeroMQ for communication.
 type ZMQTransport struct {
 	lock              *sync.Mutex
 	minHandlers       int
 	maxHandlers       int
 	incrHandlers      int
-	activeRequests    int
+	activeRequests    int32 // requests forwarded to workers, but not yet responded to
+	maxQueuedRequests int32
+	controlHandlers   int
 	ring              *Ring
 	table             map[string]*localHandler
 	clientTimeout     time.Duration
 	ClientTimeout     time.Duration
 	control_c         chan *workerComm
 	dealer_sock       *zmq.Socket
+	ctl_dealer_sock   *zmq.Socket
 	router_sock       *zmq.Socket
+	dealer_endpoint   string
+	ctl_endpoint      string
 	zmq_context       *zmq.Context
+	// Deprecated: ZMQContext is the transport's private context. It is kept for compatibility only,
+	// extensions should use Request() and ClaimMsgTypes() instead of creating their own sockets.
 	ZMQContext        *zmq.Context
 	workerIdleTimeout time.Duration
 	hooks             []TransportHook
+	registry          *msgRegistry
+	backoff           *peerBackoff
+	clocks            *peerClocks
+	closing           int32         // set to 1 by Close()
+	shutdown_c        chan struct{} // closed when workers should exit
+	proxy_done        chan struct{}
+	sched_done        chan struct{}
 	Logger            *log.Logger
 }
 
@@ -47,6 +66,28 @@ func (t *ZMQTransport) RegisterHook(h TransportHook) {
 	t.hooks = append(t.hooks, h)
 }
 
+// ClaimMsgTypes registers MsgTypeClaim within ZMQTransport.
+func (t *ZMQTransport) ClaimMsgTypes(c *MsgTypeClaim) error {
+	return t.registry.claim(c)
+}
+
+/*
+	Close shuts down ZMQTransport. New requests are refused, while in-flight ones are given up to
+	ClientTimeout to complete. Then workers and the scheduler are stopped, sockets are closed and
+	ZMQ context is terminated. Close can be called more than once, subsequent calls do nothing.
+*/
+func (t *ZMQTransport) Close() error {
+	if !atomic.CompareAndSwapInt32(&t.closing, 0, 1) {
+		return nil
+	}
+	// proxy drains in-flight requests and closes router and dealers
+	<-t.proxy_done
+	close(t.shutdown_c)
+	<-t.sched_done
+	t.Logger.Println("[DENDRITE][INFO]: TransportListener - shutdown complete")
+	return t.zmq_context.Term()
+}
+
 /*
 	InitZMQTransport creates ZeroMQ transport.
 
@@ -54,6 +95,14 @@ func (t *ZMQTransport) RegisterHook(h TransportHook) {
 	Multiplexer spawns go routines as needed, but 10 worker routines are created on startup.
 	Every request times out after provided timeout duration. ZMQ pattern is:
 		zmq.ROUTER(incoming) -> proxy -> zmq.DEALER -> [zmq.REP(worker), zmq.REP...]
+		                              -> zmq.DEALER(control) -> [zmq.REP(control worker), ...]
+
+	Ring maintenance (control) messages are routed to their own dealer, served by fixed number of
+	reserved workers, so they never wait behind data messages registered by other packages.
+
+	Proxy keeps track of in-flight data requests. Once there are more than maxQueuedRequests of them,
+	new data requests are refused straight away with PbErr (overloaded) response. Control requests
+	are never refused.
 */
 func InitZMQTransport(hostname string, timeout time.Duration, logger *log.Logger) (Transport, error) {
 	// use default logger if one is not provided
@@ -76,19 +125,30 @@ func InitZMQTransport(hostname string, timeout time.Duration, logger *log.Logger
 		return nil, err
 	}
 
+	// internal endpoints are unique to this instance, so several transports can live in one process
+	seq := atomic.AddUint64(&zmqTransportSeq, 1)
+	dealer_endpoint := fmt.Sprintf("inproc://dendrite-zmqdealer-%d", seq)
+	ctl_endpoint := fmt.Sprintf("inproc://dendrite-zmqdealer-ctl-%d", seq)
+
 	// setup dealer
 	dealer_sock, err := context.NewSocket(zmq.DEALER)
 	if err != nil {
 		return nil, err
 	}
-	err = dealer_sock.Bind("inproc://dendrite-zmqdealer")
+	err = dealer_sock.Bind(dealer_endpoint)
 	if err != nil {
 		return nil, err
 	}
-	poller := zmq.NewPoller()
-	poller.Add(router_sock, zmq.POLLIN)
-	poller.Add(dealer_sock, zmq.POLLIN)
 
+	// setup control dealer
+	ctl_dealer_sock, err := context.NewSocket(zmq.DEALER)
+	if err != nil {
+		return nil, err
+	}
+	err = ctl_dealer_sock.Bind(ctl_endpoint)
+	if err != nil {
+		return nil, err
+	}
 	transport := &ZMQTransport{
 		lock:              new(sync.Mutex),
 		clientTimeout:     timeout,
@@ -97,22 +157,51 @@ func InitZMQTransport(hostname string, timeout time.Duration, logger *log.Logger
 		maxHandlers:       1024,
 		incrHandlers:      10,
 		activeRequests:    0,
+		maxQueuedRequests: defaultMaxQueuedRequests,
+		controlHandlers:   defaultControlHandlers,
 		workerIdleTimeout: 10 * time.Second,
 		table:             make(map[string]*localHandler),
 		control_c:         make(chan *workerComm),
 		dealer_sock:       dealer_sock,
+		ctl_dealer_sock:   ctl_dealer_sock,
 		router_sock:       router_sock,
+		dealer_endpoint:   dealer_endpoint,
+		ctl_endpoint:      ctl_endpoint,
 		zmq_context:       context,
 		ZMQContext:        context,
 		hooks:             make([]TransportHook, 0),
+		registry:          newMsgRegistry(),
+		backoff:           newPeerBackoff(),
+		clocks:            newPeerClocks(),
+		shutdown_c:        make(chan struct{}),
+		proxy_done:        make(chan struct{}),
+		sched_done:        make(chan struct{}),
 		Logger:            logger,
 	}
+	// claim dendrite's own message types
+	err = transport.registry.claim(coreMsgTypeClaim(map[MsgType]MsgHandler{
+		PbPing:           transport.zmq_ping_handler,
+		PbErr:            transport.zmq_error_handler,
+		PbLeave:          transport.zmq_leave_handler,
+		PbListVnodes:     transport.zmq_listVnodes_handler,
+		PbFindSuccessors: transport.zmq_find_successors_handler,
+		PbGetPredecessor: transport.zmq_get_predecessor_handler,
+		PbNotify:         transport.zmq_notify_handler,
+		PbBroadcast:      transport.zmq_broadcast_handler,
+	}))
+	if err != nil {
+		return nil, err
+	}
 
-	go zmq.Proxy(router_sock, dealer_sock, nil)
+	go transport.proxy()
+	// control workers are reserved, scheduler does not manage them
+	for i := 0; i < transport.controlHandlers; i++ {
+		go transport.zmq_control_worker()
+	}
 	// Scheduler goroutine keeps track of running workers
 	// It spawns new ones if needed, and cancels ones that are idling
 	go func() {
-		sched_ticker := time.NewTicker(60 * time.Second)
+		sched_ticker := time.NewTicker(5 * time.Second)
 		workers := make(map[*workerComm]bool)
 		// fire up initial set of workers
 		for i := 0; i < transport.minHandlers; i++ {
@@ -151,17 +240,106 @@ func InitZMQTransport(hostname string, timeout time.Duration, logger *log.Logger
 				}
 			case <-sched_ticker.C:
 				// check if requests are piling up and start more workers if that's the case
-				if transport.activeRequests > 3*len(workers) {
+				if int(atomic.LoadInt32(&transport.activeRequests)) > 3*len(workers) {
 					for i := 0; i < transport.incrHandlers; i++ {
 						go transport.zmq_worker()
 					}
 				}
+			case <-transport.shutdown_c:
+				// transport is closing, stop all workers
+				sched_ticker.Stop()
+				for comm := range workers {
+					comm.worker_ctl <- workerCtlShutdown
+					for _ = range comm.worker_out {
+						// wait until worker closes the channel
+					}
+				}
+				close(transport.sched_done)
+				return
 			}
 		}
 	}()
 	return transport, nil
 }
 
+// proxy forwards requests from router to workers (through dealers) and responses back to router.
+// Control requests go to control dealer. Data requests beyond maxQueuedRequests are not forwarded,
+// but refused with overloaded error. Once transport is closing, all new requests are refused and
+// proxy exits (closing its sockets) as soon as in-flight requests are done, or ClientTimeout expires.
+func (transport *ZMQTransport) proxy() {
+	defer close(transport.proxy_done)
+	poller := zmq.NewPoller()
+	poller.Add(transport.router_sock, zmq.POLLIN)
+	poller.Add(transport.dealer_sock, zmq.POLLIN)
+	poller.Add(transport.ctl_dealer_sock, zmq.POLLIN)
+	ctlPending := 0
+	var drainDeadline time.Time
+	for {
+		if atomic.LoadInt32(&transport.closing) == 1 {
+			if drainDeadline.IsZero() {
+				drainDeadline = time.Now().Add(transport.clientTimeout)
+			}
+			if (atomic.LoadInt32(&transport.activeRequests) == 0 && ctlPending == 0) || time.Now().After(drainDeadline) {
+				break
+			}
+		}
+		// wake up periodically to notice Close()
+		sockets, err := poller.Poll(250 * time.Millisecond)
+		if err != nil {
+			transport.Logger.Println("[DENDRITE][ERROR]: TransportListener proxy poll error,", err)
+			continue
+		}
+		for _, socket := range sockets {
+			switch s := socket.Socket; s {
+			case transport.router_sock:
+				// request frames are: [client identity, empty delimiter, request]
+				frames, err := s.RecvMessageBytes(0)
+				if err != nil || len(frames) < 2 {
+					continue
+				}
+				if atomic.LoadInt32(&transport.closing) == 1 {
+					errorMsg := transport.newErrorMsg("transport is shutting down")
+					frames[len(frames)-1] = transport.Encode(errorMsg.Type, errorMsg.Data)
+					s.SendMessage(frames)
+					continue
+				}
+				if request := frames[len(frames)-1]; len(request) > 0 && transport.registry.isControl(MsgType(request[0])) {
+					ctlPending++
+					transport.ctl_dealer_sock.SendMessage(frames)
+					continue
+				}
+				if atomic.LoadInt32(&transport.activeRequests) >= transport.maxQueuedRequests {
+					// shed the load, respond with the same envelope
+					errorMsg := newOverloadedMsg()
+					frames[len(frames)-1] = transport.Encode(errorMsg.Type, errorMsg.Data)
+					s.SendMessage(frames)
+					continue
+				}
+				atomic.AddInt32(&transport.activeRequests, 1)
+				transport.dealer_sock.SendMessage(frames)
+			case transport.dealer_sock:
+				frames, err := s.RecvMessageBytes(0)
+				if err != nil {
+					continue
+				}
+				atomic.AddInt32(&transport.activeRequests, -1)
+				transport.router_sock.SendMessage(frames)
+			case transport.ctl_dealer_sock:
+				frames, err := s.RecvMessageBytes(0)
+				if err != nil {
+					continue
+				}
+				ctlPending--
+				transport.router_sock.SendMessage(frames)
+			}
+		}
+	}
+	for _, sock := range []*zmq.Socket{transport.router_sock, transport.dealer_sock, transport.ctl_dealer_sock} {
+		sock.SetLinger(0)
+		sock.Close()
+	}
+}
+
 type workerComm struct {
 	worker_in  chan controlType // worker's input channel for two way communication with scheduler
 	worker_out chan controlType // worker's output channel for two way communication with scheduler
@@ -175,9 +353,11 @@ func (transport *ZMQTransport) zmq_worker() {
 		transport.Logger.Println("[DENDRITE][ERROR]: TransportListener worker failed to create REP socket", err)
 		return
 	}
-	err = rep_sock.Connect("inproc://dendrite-zmqdealer")
+	rep_sock.SetLinger(0)
+	err = rep_sock.Connect(transport.dealer_endpoint)
 	if err != nil {
 		transport.Logger.Println("[DENDRITE][ERROR]: TransportListener worker failed to connect to dealer", err)
+		rep_sock.Close()
 		return
 	}
 
@@ -192,9 +372,15 @@ func (transport *ZMQTransport) zmq_worker() {
 	}
 	// notify scheduler that we're up
 	worker_out <- workerRegisterReq
-	transport.control_c <- comm
+	select {
+	case transport.control_c <- comm:
+	case <-transport.shutdown_c:
+		rep_sock.Close()
+		return
+	}
 	v := <-worker_in
 	if v == workerRegisterDenied {
+		rep_sock.Close()
 		return
 	}
 
@@ -206,10 +392,14 @@ func (transport *ZMQTransport) zmq_worker() {
 	cancel_c := make(chan bool, 1)
 	// read from socket and emit data, or stop if canceled
 	go func() {
+		defer rep_sock.Close()
 	MAINLOOP:
 		for {
 			// poll for 5 seconds, but then see if we should be canceled
-			sockets, _ := poller.Poll(5 * time.Second)
+			sockets, err := poller.Poll(5 * time.Second)
+			if err != nil && zmq.AsErrno(err) == zmq.ETERM {
+				break MAINLOOP
+			}
 			for _, socket := range sockets {
 				rawmsg, err := socket.Socket.RecvBytes(0)
 				if err != nil {
@@ -231,7 +421,11 @@ func (transport *ZMQTransport) zmq_worker() {
 					socket.Socket.SendBytes(encoded, 0)
 					continue
 				}
-				rpc_req_c <- decoded
+				select {
+				case rpc_req_c <- decoded:
+				case <-transport.shutdown_c:
+					break MAINLOOP
+				}
 				// wait for response
 				response := <-rpc_response_c
 				encoded := transport.Encode(response.Type, response.Data)
@@ -271,7 +465,12 @@ func (transport *ZMQTransport) zmq_worker() {
 		case <-ticker.C:
 			// we're idling, lets request shutdown
 			comm.worker_out <- workerShutdownReq
-			transport.control_c <- comm
+			select {
+			case transport.control_c <- comm:
+			case <-transport.shutdown_c:
+				// scheduler is going away, it will ask us to shutdown
+				continue
+			}
 			v := <-comm.worker_in
 			if v == workerShutdownAllowed {
 				transport.Logger.Println("[DENDRITE][INFO]: TransportListener: worker shutdown due to idle state")
@@ -283,3 +482,49 @@ func (transport *ZMQTransport) zmq_worker() {
 		}
 	}
 }
+
+// zmq_control_worker serves control requests. Control workers are started with the transport and live
+// as long as it does, so ring maintenance has reserved capacity regardless of the data load.
+func (transport *ZMQTransport) zmq_control_worker() {
+	rep_sock, err := transport.zmq_context.NewSocket(zmq.REP)
+	if err != nil {
+		transport.Logger.Println("[DENDRITE][ERROR]: TransportListener control worker failed to create REP socket", err)
+		return
+	}
+	rep_sock.SetLinger(0)
+	defer rep_sock.Close()
+	err = rep_sock.Connect(transport.ctl_endpoint)
+	if err != nil {
+		transport.Logger.Println("[DENDRITE][ERROR]: TransportListener control worker failed to connect to dealer", err)
+		return
+	}
+	for {
+		rawmsg, err := rep_sock.RecvBytes(0)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				// context terminated by Close()
+				return
+			}
+			transport.Logger.Println("[DENDRITE][ERROR]: TransportListener control worker error while reading from REP, ", err)
+			continue
+		}
+		var response *ChordMsg
+		decoded, err := transport.Decode(rawmsg)
+		switch {
+		case err != nil:
+			response = transport.newErrorMsg("Failed to decode request - " + err.Error())
+		case decoded.TransportHandler == nil:
+			response = transport.newErrorMsg("Invalid request, unknown handler")
+		default:
+			response_c := make(chan *ChordMsg, 1)
+			decoded.TransportHandler(decoded, response_c)
+			select {
+			case response = <-response_c:
+			default:
+				// handler did not respond, but caller is waiting for something
+				response = transport.newErrorMsg("Request handler sent no response")
+			}
+		}
+		rep_sock.SendBytes(transport.Encode(response.Type, response.Data), 0)
+	}
+}
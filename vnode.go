@@ -49,7 +49,7 @@ type localVnode struct {
 	predecessor       *Vnode
 	old_predecessor   *Vnode
 	stabilized        time.Time
-	timer             *time.Timer
+	timer             Timer
 	delegateMux       sync.Mutex
 }
 
@@ -69,15 +69,23 @@ func (vn *localVnode) init(idx int) {
 
 // schedule schedules vnode's stabilize().
 func (vn *localVnode) schedule() {
+	select {
+	case <-vn.ring.shutdown:
+		// ring is leaving
+		return
+	default:
+	}
 	// Setup our stabilize timer
-	vn.timer = time.AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
+	vn.timer = vn.ring.clock.AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
 }
 
 // stabilize is part of Chord Protocol. It is used to position a vnode inside of the ring and handle changes.
 func (vn *localVnode) stabilize() {
 	defer vn.schedule()
 
-	start := time.Now()
+	start := vn.ring.clock.Now()
+	old_successor := vn.successors[0]
+	was_connected := vn.hasRemoteSuccessor()
 	if err := vn.checkNewSuccessor(); err != nil {
 		vn.ring.Logln(LogDebug, "stabilize() - error checking successor:", err)
 	}
@@ -90,13 +98,92 @@ func (vn *localVnode) stabilize() {
 	//log.Printf("NotifySucc returned for %X\n", vn.Id)
 
 	if err := vn.fixFingerTable(); err != nil {
-		vn.ring.Logln(LogDebug, "stabilize() - error fixing finger table, last:", time.Since(start), vn.last_finger, err)
+		vn.ring.Logln(LogDebug, "stabilize() - error fixing finger table, last:", vn.ring.clock.Now().Sub(start), vn.last_finger, err)
 	}
 
 	if err := vn.checkPredecessor(); err != nil {
 		vn.ring.Logf(LogInfo, "stabilize() predecessor failed for %X - %s\n", vn.Id, err)
 	}
 	//log.Println("[stabilize] completed in", time.Since(start))
+
+	if !sameVnode(old_successor, vn.successors[0]) {
+		vn.ring.emit(&EventCtx{
+			EvType:        EvSuccessorChanged,
+			Target:        &vn.Vnode,
+			PrimaryItem:   vn.successors[0],
+			SecondaryItem: old_successor,
+		})
+	}
+	if was_connected && !vn.hasRemoteSuccessor() {
+		vn.isolate(old_successor)
+	}
+	successors := make([]*Vnode, len(vn.successors))
+	copy(successors, vn.successors)
+	vn.ring.emit(&EventCtx{
+		EvType:   EvVnodeStabilized,
+		Target:   &vn.Vnode,
+		ItemList: successors,
+	})
+}
+
+// hasRemoteSuccessor returns true if any of vnode's known successors lives on another host.
+func (vn *localVnode) hasRemoteSuccessor() bool {
+	for _, succ := range vn.successors {
+		if succ != nil && succ.Host != vn.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// isolate is called when all of vnode's successors on other hosts have failed, and only
+// local vnodes are left in its successor list.
+func (vn *localVnode) isolate(old_successor *Vnode) {
+	vn.ring.Logf(LogInfo, "stabilize() - vnode %X has no more successors on other hosts, it is isolated\n", vn.Id)
+	vn.ring.emit(&EventCtx{
+		EvType:        EvVnodeIsolated,
+		Target:        &vn.Vnode,
+		SecondaryItem: old_successor,
+	})
+}
+
+// leave stops vnode's stabilization and hands its predecessor and successors over to its neighbours.
+func (vn *localVnode) leave() error {
+	if vn.timer != nil {
+		vn.timer.Stop()
+	}
+	succs := make([]*Vnode, 0, len(vn.successors))
+	for _, succ := range vn.successors {
+		if succ == nil || sameVnode(succ, &vn.Vnode) {
+			break
+		}
+		succs = append(succs, succ)
+	}
+	pred := vn.predecessor
+	if sameVnode(pred, &vn.Vnode) {
+		pred = nil
+	}
+
+	var last_err error
+	if len(succs) > 0 {
+		if err := vn.ring.transport.Leave(succs[0], &vn.Vnode, pred, succs); err != nil {
+			last_err = err
+		}
+	}
+	if pred != nil && (len(succs) == 0 || !sameVnode(pred, succs[0])) {
+		if err := vn.ring.transport.Leave(pred, &vn.Vnode, pred, succs); err != nil {
+			last_err = err
+		}
+	}
+	return last_err
+}
+
+// sameVnode returns true if both vnodes are nil, or have the same Id.
+func sameVnode(a, b *Vnode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Compare(a.Id, b.Id) == 0
 }
 
 // closest_preceeding_finger finds closest preceeding Vnode for given id, by using finger table and local successor list.
@@ -156,6 +243,10 @@ func (vn *localVnode) checkNewSuccessor() error {
 		}
 		// Ask our successor for it's predecessor
 		maybe_suc, err := vn.ring.transport.GetPredecessor(vn.successors[0])
+		if err == ErrPeerOverloaded {
+			// successor is alive, just busy. Keep it and retry on next stabilization
+			break
+		}
 		if err != nil {
 			vn.ring.Logln(LogDebug, "stabilize::checkNewSuccessor() trying next known successor due to error:", err)
 			copy(vn.successors[0:], vn.successors[1:])
@@ -163,7 +254,10 @@ func (vn *localVnode) checkNewSuccessor() error {
 			continue
 		}
 
-		if maybe_suc != nil && between(vn.Id, vn.successors[0].Id, maybe_suc.Id, false) {
+		// when we're our own successor (everyone else left), (n, n) spans the whole ring and any other vnode is closer
+		self_succ := sameVnode(vn.successors[0], &vn.Vnode)
+		if maybe_suc != nil && !sameVnode(maybe_suc, &vn.Vnode) &&
+			(self_succ || between(vn.Id, vn.successors[0].Id, maybe_suc.Id, false)) {
 			alive, _ := vn.ring.transport.Ping(maybe_suc)
 			if alive {
 				copy(vn.successors[1:], vn.successors[0:len(vn.successors)-1])
@@ -262,6 +356,10 @@ func (vn *localVnode) checkPredecessor() error {
 	// Check predecessor
 	if vn.predecessor != nil {
 		ok, err := vn.ring.transport.Ping(vn.predecessor)
+		if ok && err == ErrPeerOverloaded {
+			// predecessor is shedding load, but it's alive
+			return nil
+		}
 		if err != nil || !ok {
 			vn.ring.Logln(LogInfo, "stabilize::checkPredecessor() - detected predecessor failure")
 			vn.old_predecessor = vn.predecessor
@@ -298,7 +396,15 @@ func (vn *localVnode) fixFingerTable() error {
 			//log.Printf("\t\t\t GOT OURSELVES BACK.. HOW????, skipping\n")
 			break
 		}
-		vn.finger[idx] = succs[0]
+		if old_finger := vn.finger[idx]; !sameVnode(old_finger, succs[0]) {
+			vn.finger[idx] = succs[0]
+			vn.ring.emit(&EventCtx{
+				EvType:        EvFingerChanged,
+				Target:        &vn.Vnode,
+				PrimaryItem:   succs[0],
+				SecondaryItem: old_finger,
+			})
+		}
 		vn.last_finger = idx
 		idx += 1
 		//log.Printf("\t\t\t set id: %X\n", succs[0].Id)
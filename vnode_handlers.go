@@ -2,6 +2,7 @@ package dendrite
 
 import (
 	"bytes"
+	"time"
 )
 
 /*
@@ -13,6 +14,8 @@ type VnodeHandler interface {
 	FindRemoteSuccessors(int) ([]*Vnode, error)
 	GetPredecessor() (*Vnode, error)
 	Notify(*Vnode) ([]*Vnode, error)
+	Leave(*Vnode, *Vnode, []*Vnode) error // args: leaving vnode, its predecessor, its successors
+	Broadcast([]byte, MsgType, []byte, time.Duration) int // args: limit, msgType, payload, timeout # returns: acks
 }
 
 // localHandler is a handler object connecting a VnodeHandler and Vnode.
@@ -73,7 +76,9 @@ func (vn *localVnode) GetPredecessor() (*Vnode, error) {
 // Notify is invoked when a Vnode gets notified.
 func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
 	// Check if we should update our predecessor
-	if vn.predecessor == nil || between(vn.predecessor.Id, vn.Id, maybe_pred.Id, false) {
+	// when we're our own predecessor, (n, n) spans the whole ring and any other vnode is closer
+	if vn.predecessor == nil || (sameVnode(vn.predecessor, &vn.Vnode) && !sameVnode(maybe_pred, &vn.Vnode)) ||
+		between(vn.predecessor.Id, vn.Id, maybe_pred.Id, false) {
 		var real_pred *Vnode
 
 		if vn.predecessor == nil {
@@ -111,12 +116,82 @@ func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
 		// maybe we're just joining and one of our local vnodes is closer to us than this predecessor
 		vn.ring.Logf(LogInfo, "vn.Notify() - setting new predecessor for %x: %x\n", vn.Id, maybe_pred.Id)
 		vn.predecessor = maybe_pred
+		vn.emitRangeChange(real_pred, maybe_pred)
 	}
 
 	// Return our successors list
 	return vn.successors, nil
 }
 
+// Leave is invoked when a neighbouring vnode leaves the ring. If it was our predecessor, its predecessor
+// becomes ours. If it was one of our successors, it is replaced by its own successors.
+func (vn *localVnode) Leave(leaving, pred *Vnode, succs []*Vnode) error {
+	if sameVnode(vn.predecessor, leaving) || (vn.predecessor == nil && sameVnode(vn.old_predecessor, leaving)) {
+		if sameVnode(pred, leaving) {
+			pred = nil
+		}
+		vn.ring.Logf(LogInfo, "vn.Leave() - predecessor %X of %X left\n", leaving.Id, vn.Id)
+		vn.old_predecessor = leaving
+		vn.predecessor = pred
+		vn.ring.emit(&EventCtx{
+			EvType:        EvPredecessorLeft,
+			Target:        &vn.Vnode,
+			PrimaryItem:   pred,
+			SecondaryItem: leaving,
+		})
+		if pred != nil {
+			vn.emitRangeChange(leaving, pred)
+		}
+	}
+
+	pos := -1
+	for idx, succ := range vn.successors {
+		if sameVnode(succ, leaving) {
+			pos = idx
+			break
+		}
+	}
+	if pos < 0 {
+		return nil
+	}
+	old_successor := vn.successors[0]
+	// leaving vnode's successors follow it in the ring, so they take its place in our list
+	new_succs := make([]*Vnode, len(vn.successors))
+	copy(new_succs, vn.successors[:pos])
+	next := pos
+	seen := make(map[string]bool)
+	for _, succ := range new_succs[:pos] {
+		seen[succ.String()] = true
+	}
+	candidates := append(append([]*Vnode{}, succs...), vn.successors[pos+1:]...)
+	for _, succ := range candidates {
+		if next == len(new_succs) {
+			break
+		}
+		if succ == nil || seen[succ.String()] || sameVnode(succ, leaving) || sameVnode(succ, &vn.Vnode) {
+			continue
+		}
+		seen[succ.String()] = true
+		new_succs[next] = succ
+		next++
+	}
+	if new_succs[0] == nil {
+		// no one else left
+		new_succs[0] = &vn.Vnode
+	}
+	vn.successors = new_succs
+	vn.updateRemoteSuccessors()
+	if !sameVnode(old_successor, vn.successors[0]) {
+		vn.ring.emit(&EventCtx{
+			EvType:        EvSuccessorChanged,
+			Target:        &vn.Vnode,
+			PrimaryItem:   vn.successors[0],
+			SecondaryItem: old_successor,
+		})
+	}
+	return nil
+}
+
 // FindRemoteSuccessors returns up to 'limit' successor vnodes,
 // that are unique and do not reside on same physical node as vnode.
 func (vn *localVnode) FindRemoteSuccessors(limit int) ([]*Vnode, error) {